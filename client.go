@@ -13,6 +13,8 @@ import (
 	"net/url"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -157,17 +159,43 @@ func GetBackoffDuration(attempt int) time.Duration {
 type APIClient interface {
 	GetKey(keyID string) (*Key, error)
 	CreateKey(keyID string, data []byte, acl ACL) (uint64, error)
+	CreateKeyWithMetadata(keyID string, data []byte, acl ACL, md KeyMetadata) (uint64, error)
+	GenerateKey(keyID string, g GeneratorSpec, acl ACL, md KeyMetadata) (uint64, error)
 	GetKeys(keys map[string]string) ([]string, error)
+	WatchKeys(keys map[string]string, timeout time.Duration) ([]string, error)
+	SearchKeys(opts KeySearchOptions) (*KeyIDPage, error)
+	ExplainAccess(keyID string, p *PrincipalSpec, access AccessType) (*AccessExplanation, error)
 	DeleteKey(keyID string) error
+	RestoreKey(keyID string) error
 	GetACL(keyID string) (*ACL, error)
 	PutAccess(keyID string, acl ...Access) error
+	GetMetadata(keyID string) (*KeyMetadata, error)
+	PutMetadata(keyID string, md KeyMetadata) error
+	GetPolicy(keyID string) (*KeyPolicy, error)
+	PutPolicy(keyID string, p KeyPolicy) error
+	GetApprovalRequests(keyID string) ([]ApprovalRequest, error)
+	ApproveRequest(keyID, requestID string) error
+	RejectRequest(keyID, requestID string) error
 	AddVersion(keyID string, data []byte) (uint64, error)
+	GenerateVersion(keyID string, g GeneratorSpec) (uint64, error)
 	UpdateVersion(keyID, versionID string, status VersionStatus) error
 	CacheGetKey(keyID string) (*Key, error)
 	NetworkGetKey(keyID string) (*Key, error)
 	GetKeyWithStatus(keyID string, status VersionStatus) (*Key, error)
 	CacheGetKeyWithStatus(keyID string, status VersionStatus) (*Key, error)
 	NetworkGetKeyWithStatus(keyID string, status VersionStatus) (*Key, error)
+	GetHistory(keyID string, opts HistoryOptions) (*AuditEventPage, error)
+	GetWebhooks(keyID string) ([]Webhook, error)
+	CreateWebhook(w Webhook) (*Webhook, error)
+	DeleteWebhook(webhookID string) error
+	GetWebhookDeadLetters(webhookID string) ([]WebhookDeadLetter, error)
+	GetNamespaces() ([]Namespace, error)
+	GetNamespace(prefix string) (*Namespace, error)
+	PutNamespaceAccess(prefix string, acl ...Access) error
+	DeleteNamespace(prefix string) error
+	GetSealStatus() (*SealStatus, error)
+	Unseal(share []byte) (*SealStatus, error)
+	Seal() (*SealStatus, error)
 }
 
 type HTTP interface {
@@ -279,6 +307,74 @@ func (c *HTTPClient) GetKeyWithStatus(keyID string, status VersionStatus) (*Key,
 	return key, err
 }
 
+// SearchKeys gets a page of the key IDs matching the search options.
+func (c *HTTPClient) SearchKeys(opts KeySearchOptions) (*KeyIDPage, error) {
+	d := url.Values{}
+	if opts.Cursor != "" {
+		d.Set("cursor", opts.Cursor)
+	}
+	if opts.Prefix != "" {
+		d.Set("prefix", opts.Prefix)
+	}
+	if opts.Access != None {
+		a, err := json.Marshal(opts.Access)
+		if err != nil {
+			return nil, err
+		}
+		d.Set("access", strings.Trim(string(a), `"`))
+	}
+	if opts.Team != "" {
+		d.Set("team", opts.Team)
+	}
+	if len(opts.Tags) > 0 {
+		d.Set("tags", strings.Join(opts.Tags, ","))
+	}
+	if opts.Limit != 0 {
+		d.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if err := setPrincipalSpec(d, opts.Principal); err != nil {
+		return nil, err
+	}
+	page := &KeyIDPage{}
+	err := c.getHTTPData("GET", "/v0/search/keys/?"+d.Encode(), nil, page)
+	return page, err
+}
+
+// ExplainAccess says whether the principal has the access type to a key and
+// which ACL entries grant it. If p is nil, it lists the entries that grant the
+// access to anyone.
+func (c *HTTPClient) ExplainAccess(keyID string, p *PrincipalSpec, access AccessType) (*AccessExplanation, error) {
+	d := url.Values{}
+	a, err := json.Marshal(access)
+	if err != nil {
+		return nil, err
+	}
+	d.Set("access", strings.Trim(string(a), `"`))
+	if err := setPrincipalSpec(d, p); err != nil {
+		return nil, err
+	}
+	explanation := &AccessExplanation{}
+	err = c.getHTTPData("GET", "/v0/keys/"+keyID+"/explain/?"+d.Encode(), nil, explanation)
+	return explanation, err
+}
+
+// setPrincipalSpec adds the query parameters describing a principal.
+func setPrincipalSpec(d url.Values, p *PrincipalSpec) error {
+	if p == nil {
+		return nil
+	}
+	t, err := json.Marshal(p.Type)
+	if err != nil {
+		return err
+	}
+	d.Set("principal_type", strings.Trim(string(t), `"`))
+	d.Set("principal", p.ID)
+	if len(p.Groups) > 0 {
+		d.Set("groups", strings.Join(p.Groups, ","))
+	}
+	return nil
+}
+
 // CreateKey creates a knox key with given keyID data and ACL.
 func (c *HTTPClient) CreateKey(keyID string, data []byte, acl ACL) (uint64, error) {
 	var i uint64
@@ -294,6 +390,52 @@ func (c *HTTPClient) CreateKey(keyID string, data []byte, acl ACL) (uint64, erro
 	return i, err
 }
 
+// CreateKeyWithMetadata creates a knox key with given keyID data, ACL, and
+// metadata. The server sets the creation information in the metadata.
+func (c *HTTPClient) CreateKeyWithMetadata(keyID string, data []byte, acl ACL, md KeyMetadata) (uint64, error) {
+	var i uint64
+	d := url.Values{}
+	d.Set("id", keyID)
+	d.Set("data", base64.StdEncoding.EncodeToString(data))
+	s, err := json.Marshal(acl)
+	if err != nil {
+		return i, err
+	}
+	d.Set("acl", string(s))
+	m, err := json.Marshal(md)
+	if err != nil {
+		return i, err
+	}
+	d.Set("metadata", string(m))
+	err = c.getHTTPData("POST", "/v0/keys/", d, &i)
+	return i, err
+}
+
+// GenerateKey creates a knox key whose data is generated by the server as
+// described by g. The data is not returned; read it with GetKey.
+func (c *HTTPClient) GenerateKey(keyID string, g GeneratorSpec, acl ACL, md KeyMetadata) (uint64, error) {
+	var i uint64
+	d := url.Values{}
+	d.Set("id", keyID)
+	gen, err := json.Marshal(g)
+	if err != nil {
+		return i, err
+	}
+	d.Set("generate", string(gen))
+	s, err := json.Marshal(acl)
+	if err != nil {
+		return i, err
+	}
+	d.Set("acl", string(s))
+	m, err := json.Marshal(md)
+	if err != nil {
+		return i, err
+	}
+	d.Set("metadata", string(m))
+	err = c.getHTTPData("POST", "/v0/keys/", d, &i)
+	return i, err
+}
+
 // GetKeys gets all Knox (if empty map) or gets all keys in map that do not match key version hash.
 func (c *HTTPClient) GetKeys(keys map[string]string) ([]string, error) {
 	var l []string
@@ -307,12 +449,95 @@ func (c *HTTPClient) GetKeys(keys map[string]string) ([]string, error) {
 	return l, err
 }
 
+// WatchKeys waits for any of the keys in the map to stop matching its version
+// hash and returns the IDs of the changed keys. It returns an empty list if
+// none change within timeout, which is rounded up to a whole second.
+func (c *HTTPClient) WatchKeys(keys map[string]string, timeout time.Duration) ([]string, error) {
+	var l []string
+
+	k, err := json.Marshal(keys)
+	if err != nil {
+		return nil, err
+	}
+	d := url.Values{}
+	d.Set("keys", string(k))
+	d.Set("timeout", strconv.Itoa(int((timeout+time.Second-1)/time.Second)))
+
+	err = c.getHTTPData("GET", "/v0/watch/?"+d.Encode(), nil, &l)
+	return l, err
+}
+
 // DeleteKey deletes a key from Knox.
 func (c HTTPClient) DeleteKey(keyID string) error {
 	err := c.getHTTPData("DELETE", "/v0/keys/"+keyID+"/", nil, nil)
 	return err
 }
 
+// GetMetadata gets the metadata of a knox key by keyID.
+func (c *HTTPClient) GetMetadata(keyID string) (*KeyMetadata, error) {
+	md := &KeyMetadata{}
+	err := c.getHTTPData("GET", "/v0/keys/"+keyID+"/metadata/", nil, md)
+	return md, err
+}
+
+// PutMetadata replaces the description, team, and tags of a specific key.
+func (c *HTTPClient) PutMetadata(keyID string, md KeyMetadata) error {
+	d := url.Values{}
+	s, err := json.Marshal(md)
+	if err != nil {
+		return err
+	}
+	d.Set("metadata", string(s))
+	err = c.getHTTPData("PUT", "/v0/keys/"+keyID+"/metadata/", d, nil)
+	return err
+}
+
+// GetPolicy gets the policy of a knox key by keyID.
+func (c *HTTPClient) GetPolicy(keyID string) (*KeyPolicy, error) {
+	p := &KeyPolicy{}
+	err := c.getHTTPData("GET", "/v0/keys/"+keyID+"/policy/", nil, p)
+	return p, err
+}
+
+// PutPolicy replaces the policy of a specific key. If the current policy
+// requires approval, this only creates an approval request and returns an
+// error naming it.
+func (c *HTTPClient) PutPolicy(keyID string, p KeyPolicy) error {
+	d := url.Values{}
+	s, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	d.Set("policy", string(s))
+	err = c.getHTTPData("PUT", "/v0/keys/"+keyID+"/policy/", d, nil)
+	return err
+}
+
+// GetApprovalRequests lists the pending approval requests of a specific key.
+func (c *HTTPClient) GetApprovalRequests(keyID string) ([]ApprovalRequest, error) {
+	requests := []ApprovalRequest{}
+	err := c.getHTTPData("GET", "/v0/keys/"+keyID+"/requests/", nil, &requests)
+	return requests, err
+}
+
+// ApproveRequest carries out a pending approval request made by another admin.
+func (c *HTTPClient) ApproveRequest(keyID, requestID string) error {
+	err := c.getHTTPData("POST", "/v0/keys/"+keyID+"/requests/"+requestID+"/approve/", nil, nil)
+	return err
+}
+
+// RejectRequest discards a pending approval request.
+func (c *HTTPClient) RejectRequest(keyID, requestID string) error {
+	err := c.getHTTPData("POST", "/v0/keys/"+keyID+"/requests/"+requestID+"/reject/", nil, nil)
+	return err
+}
+
+// RestoreKey restores a deleted key that has not yet been purged.
+func (c HTTPClient) RestoreKey(keyID string) error {
+	err := c.getHTTPData("POST", "/v0/keys/"+keyID+"/restore/", nil, nil)
+	return err
+}
+
 // GetACL gets a knox key by keyID.
 func (c *HTTPClient) GetACL(keyID string) (*ACL, error) {
 	acl := &ACL{}
@@ -341,6 +566,20 @@ func (c *HTTPClient) AddVersion(keyID string, data []byte) (uint64, error) {
 	return i, err
 }
 
+// GenerateVersion adds a key version whose data is generated by the server as
+// described by g. The data is not returned; read it with GetKey.
+func (c *HTTPClient) GenerateVersion(keyID string, g GeneratorSpec) (uint64, error) {
+	var i uint64
+	d := url.Values{}
+	gen, err := json.Marshal(g)
+	if err != nil {
+		return i, err
+	}
+	d.Set("generate", string(gen))
+	err = c.getHTTPData("POST", "/v0/keys/"+keyID+"/versions/", d, &i)
+	return i, err
+}
+
 // UpdateVersion either promotes or demotes a specific key version.
 func (c *HTTPClient) UpdateVersion(keyID, versionID string, status VersionStatus) error {
 	d := url.Values{}
@@ -354,6 +593,129 @@ func (c *HTTPClient) UpdateVersion(keyID, versionID string, status VersionStatus
 	return err
 }
 
+// GetHistory gets one page of the audit history of a key.
+func (c *HTTPClient) GetHistory(keyID string, opts HistoryOptions) (*AuditEventPage, error) {
+	d := url.Values{}
+	if opts.Cursor != "" {
+		d.Set("cursor", opts.Cursor)
+	}
+	if opts.Since != 0 {
+		d.Set("since", strconv.FormatInt(opts.Since, 10))
+	}
+	if opts.Until != 0 {
+		d.Set("until", strconv.FormatInt(opts.Until, 10))
+	}
+	if len(opts.Types) > 0 {
+		types := make([]string, len(opts.Types))
+		for i, t := range opts.Types {
+			types[i] = string(t)
+		}
+		d.Set("type", strings.Join(types, ","))
+	}
+	if opts.Limit != 0 {
+		d.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	page := &AuditEventPage{}
+	err := c.getHTTPData("GET", "/v0/keys/"+keyID+"/history/?"+d.Encode(), nil, page)
+	return page, err
+}
+
+// GetWebhooks lists the webhooks for a key, or every webhook if keyID is
+// empty. Secrets are not returned.
+func (c *HTTPClient) GetWebhooks(keyID string) ([]Webhook, error) {
+	d := url.Values{}
+	if keyID != "" {
+		d.Set("key", keyID)
+	}
+	hooks := []Webhook{}
+	err := c.getHTTPData("GET", "/v0/webhooks/?"+d.Encode(), nil, &hooks)
+	return hooks, err
+}
+
+// CreateWebhook creates a webhook with the URL, KeyID, Tags and Events of w.
+// The returned webhook has the secret its deliveries are signed with.
+func (c *HTTPClient) CreateWebhook(w Webhook) (*Webhook, error) {
+	d := url.Values{}
+	s, err := json.Marshal(w)
+	if err != nil {
+		return nil, err
+	}
+	d.Set("webhook", string(s))
+	hook := &Webhook{}
+	err = c.getHTTPData("POST", "/v0/webhooks/", d, hook)
+	return hook, err
+}
+
+// DeleteWebhook deletes a webhook and its dead letters.
+func (c *HTTPClient) DeleteWebhook(webhookID string) error {
+	err := c.getHTTPData("DELETE", "/v0/webhooks/"+webhookID+"/", nil, nil)
+	return err
+}
+
+// GetWebhookDeadLetters lists the events that could not be delivered to a
+// webhook.
+func (c *HTTPClient) GetWebhookDeadLetters(webhookID string) ([]WebhookDeadLetter, error) {
+	letters := []WebhookDeadLetter{}
+	err := c.getHTTPData("GET", "/v0/webhooks/"+webhookID+"/deadletters/", nil, &letters)
+	return letters, err
+}
+
+// GetNamespaces lists every namespace with its ACL.
+func (c *HTTPClient) GetNamespaces() ([]Namespace, error) {
+	namespaces := []Namespace{}
+	err := c.getHTTPData("GET", "/v0/namespaces/", nil, &namespaces)
+	return namespaces, err
+}
+
+// GetNamespace gets the namespace with the prefix.
+func (c *HTTPClient) GetNamespace(prefix string) (*Namespace, error) {
+	n := &Namespace{}
+	err := c.getHTTPData("GET", "/v0/namespaces/"+prefix+"/", nil, n)
+	return n, err
+}
+
+// PutNamespaceAccess adds ACL rules to a namespace, creating it if it does
+// not exist.
+func (c *HTTPClient) PutNamespaceAccess(prefix string, a ...Access) error {
+	d := url.Values{}
+	s, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	d.Set("acl", string(s))
+	err = c.getHTTPData("PUT", "/v0/namespaces/"+prefix+"/", d, nil)
+	return err
+}
+
+// DeleteNamespace removes a namespace. Keys in it no longer inherit its ACL.
+func (c *HTTPClient) DeleteNamespace(prefix string) error {
+	err := c.getHTTPData("DELETE", "/v0/namespaces/"+prefix+"/", nil, nil)
+	return err
+}
+
+// GetSealStatus reports whether the server is sealed.
+func (c *HTTPClient) GetSealStatus() (*SealStatus, error) {
+	status := &SealStatus{}
+	err := c.getHTTPData("GET", "/v0/health/", nil, status)
+	return status, err
+}
+
+// Unseal submits an operator's share of the master secret to a sealed server.
+func (c *HTTPClient) Unseal(share []byte) (*SealStatus, error) {
+	d := url.Values{}
+	d.Set("share", base64.StdEncoding.EncodeToString(share))
+	status := &SealStatus{}
+	err := c.getHTTPData("POST", "/v0/unseal/", d, status)
+	return status, err
+}
+
+// Seal discards the server's master key until it is unsealed again.
+func (c *HTTPClient) Seal() (*SealStatus, error) {
+	status := &SealStatus{}
+	err := c.getHTTPData("POST", "/v0/seal/", nil, status)
+	return status, err
+}
+
 func (c *HTTPClient) getClient() (HTTP, error) {
 	if c.Client == nil {
 		c.Client = &http.Client{}
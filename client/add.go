@@ -4,17 +4,24 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+
+	"github.com/pinterest/knox"
 )
 
+func init() {
+	cmdAdd.Run = runAdd // break init cycle
+}
+
 var cmdAdd = &Command{
-	Run:       runAdd,
-	UsageLine: "add <key_identifier>",
+	UsageLine: "add [-generate [-encoding enc] [-length n] [-charset chars]] <key_identifier>",
 	Short:     "adds a new key version to knox",
 	Long: `
 add adds a new key version to an existing key in knox. Key data should be sent to stdin.
 
 This key version will be set to active upon creation. The version id will be sent to stdout on creation.
 
+-generate has the server generate the version data instead of reading it from stdin. The generated data is not printed. -encoding, -length, and -charset work as in knox create.
+
 This command uses user access and requires write access in the key's ACL.
 
 For more about knox, see https://github.com/pinterest/knox.
@@ -22,13 +29,26 @@ For more about knox, see https://github.com/pinterest/knox.
 See also: knox create, knox promote
 	`,
 }
+var addGenerate = cmdAdd.Flag.Bool("generate", false, "")
+var addEncoding = cmdAdd.Flag.String("encoding", string(knox.Base64Encoding), "")
+var addLength = cmdAdd.Flag.Int("length", 32, "")
+var addCharset = cmdAdd.Flag.String("charset", "", "")
 
 func runAdd(cmd *Command, args []string) {
 	if len(args) != 1 {
 		fatalf("add takes only one argument. See 'knox help add'")
 	}
-	fmt.Println("Reading from stdin...")
 	keyID := args[0]
+	if *addGenerate {
+		g := generatorSpec(*addEncoding, *addLength, *addCharset)
+		versionID, err := cli.GenerateVersion(keyID, g)
+		if err != nil {
+			fatalf("Error generating version: %s", err.Error())
+		}
+		fmt.Printf("Added generated key version %d\n", versionID)
+		return
+	}
+	fmt.Println("Reading from stdin...")
 	data, err := ioutil.ReadAll(os.Stdin)
 	if err != nil {
 		fatalf("Problem reading key data: %s", err.Error())
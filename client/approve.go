@@ -0,0 +1,49 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+var cmdApprove = &Command{
+	Run:       runApprove,
+	UsageLine: "approve <key_identifier> [<request_id>]",
+	Short:     "approves a pending change to a key",
+	Long: `
+Approve carries out a change to a key that is waiting for approval. Keys whose policy requires approval turn deletions and ACL or policy changes into approval requests, which must be approved by an admin other than the one who made the request. Requests expire if they are not approved in time.
+
+Without a request ID, approve lists the pending requests for the key, one JSON request per line.
+
+This requires admin access to the key.
+
+For more about knox, see https://github.com/pinterest/knox.
+
+See also: knox reject, knox policy
+	`,
+}
+
+func runApprove(cmd *Command, args []string) {
+	if len(args) == 1 {
+		requests, err := cli.GetApprovalRequests(args[0])
+		if err != nil {
+			fatalf("Error getting approval requests: %s", err.Error())
+		}
+		for _, r := range requests {
+			rEnc, err := json.Marshal(r)
+			if err != nil {
+				fatalf("Could not marshal request: %s", err.Error())
+			}
+			fmt.Println(string(rEnc))
+		}
+		return
+	}
+	if len(args) != 2 {
+		fatalf("approve takes one or two arguments. See 'knox help approve'")
+	}
+
+	err := cli.ApproveRequest(args[0], args[1])
+	if err != nil {
+		fatalf("Error approving request: %s", err.Error())
+	}
+	fmt.Printf("Successfully approved request\n")
+}
@@ -0,0 +1,113 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pinterest/knox"
+)
+
+func init() {
+	cmdCanAccess.Run = runCanAccess // break init cycle
+}
+
+var cmdCanAccess = &Command{
+	UsageLine: "can-access [-access level] [-user name [-groups group,...] | -machine hostname | -service spiffe_id] [<key_identifier>]",
+	Short:     "explains who can access a key",
+	Long: `
+Can-access evaluates a key's ACL for a principal without authenticating as it, for example during an access review.
+
+With a key and a principal, it prints whether the principal has the access and the ACL entries that grant it. It exits with status 1 if access is not granted.
+With a key and no principal, it prints the ACL entries that grant the access to anyone.
+With a principal and no key, it lists the keys the principal has the access to.
+
+-access is read, write, or admin and defaults to read.
+
+-user: A user. -groups lists the groups the user should be treated as a member of.
+-machine: A machine hostname. Machine prefix entries are matched against it.
+-service: A SPIFFE ID such as 'spiffe://example.com/service'. Service prefix entries are matched against it.
+
+This requires valid user or machine authentication, but there are no authorization requirements.
+
+For more about knox, see https://github.com/pinterest/knox.
+
+See also: knox acl, knox access, knox keys
+	`,
+}
+var canAccessLevel = cmdCanAccess.Flag.String("access", "read", "")
+var canAccessUser = cmdCanAccess.Flag.String("user", "", "")
+var canAccessGroups = cmdCanAccess.Flag.String("groups", "", "")
+var canAccessMachine = cmdCanAccess.Flag.String("machine", "", "")
+var canAccessService = cmdCanAccess.Flag.String("service", "", "")
+
+func runCanAccess(cmd *Command, args []string) {
+	if len(args) > 1 {
+		fatalf("can-access takes at most one argument. See 'knox help can-access'")
+	}
+
+	var access knox.AccessType
+	switch strings.ToLower(*canAccessLevel) {
+	case "read":
+		access = knox.Read
+	case "write":
+		access = knox.Write
+	case "admin":
+		access = knox.Admin
+	default:
+		fatalf("-access must be read, write, or admin. See 'knox help can-access'")
+	}
+
+	var spec *knox.PrincipalSpec
+	switch {
+	case *canAccessUser != "":
+		spec = &knox.PrincipalSpec{Type: knox.User, ID: *canAccessUser, Groups: splitTags(*canAccessGroups)}
+	case *canAccessMachine != "":
+		spec = &knox.PrincipalSpec{Type: knox.Machine, ID: *canAccessMachine}
+	case *canAccessService != "":
+		spec = &knox.PrincipalSpec{Type: knox.Service, ID: *canAccessService}
+	}
+
+	if len(args) == 0 {
+		if spec == nil {
+			fatalf("can-access requires a key or a principal. See 'knox help can-access'")
+		}
+		opts := knox.KeySearchOptions{Access: access, Principal: spec}
+		for {
+			page, err := cli.SearchKeys(opts)
+			if err != nil {
+				fatalf("Error searching keys: %s", err.Error())
+			}
+			for _, k := range page.KeyIDs {
+				fmt.Println(k)
+			}
+			if page.Cursor == "" {
+				return
+			}
+			opts.Cursor = page.Cursor
+		}
+	}
+
+	explanation, err := cli.ExplainAccess(args[0], spec, access)
+	if err != nil {
+		fatalf("Error explaining access: %s", err.Error())
+	}
+	if spec != nil {
+		if explanation.Granted {
+			fmt.Printf("Granted: %s has %s access to %s through:\n", explanation.Principal, *canAccessLevel, explanation.KeyID)
+		} else {
+			fmt.Printf("Denied: %s does not have %s access to %s\n", explanation.Principal, *canAccessLevel, explanation.KeyID)
+		}
+	}
+	for _, a := range explanation.GrantedBy {
+		aEnc, err := json.Marshal(a)
+		if err != nil {
+			fatalf("Could not marshal entry: %s", err.Error())
+		}
+		fmt.Println(string(aEnc))
+	}
+	if spec != nil && !explanation.Granted {
+		os.Exit(1)
+	}
+}
@@ -142,16 +142,27 @@ var commands = []*Command{
 	cmdGetKeys,
 	cmdGet,
 	cmdGetVersions,
+	cmdHistory,
 	cmdGetACL,
+	cmdDescribe,
+	cmdCanAccess,
 	cmdPromote,
 	cmdCreate,
 	cmdAdd,
 	cmdDeactivate,
 	cmdReactivate,
 	cmdUpdateAccess,
+	cmdNamespace,
 	cmdDelete,
+	cmdUndelete,
+	cmdPolicy,
+	cmdApprove,
+	cmdReject,
 	cmdLogin,
 
+	// These commands are related to operating the knox server.
+	cmdOperator,
+
 	// These are additional help topics
 	cmdVersion,
 	helpAuth,
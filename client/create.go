@@ -8,38 +8,88 @@ import (
 	"github.com/pinterest/knox"
 )
 
+func init() {
+	cmdCreate.Run = runCreate // break init cycle
+}
+
 var cmdCreate = &Command{
-	Run:       runCreate,
-	UsageLine: "create <key_identifier>",
+	UsageLine: "create [-generate [-encoding enc] [-length n] [-charset chars]] [-description text] [-team name] [-tags tag,...] <key_identifier>",
 	Short:     "creates a new key",
 	Long: `
 Create will create a new key in knox with original data set as the primary data. Key data should be sent to stdin.
 
 The original key version id will be print to stdout.
 
+-generate has the server generate the key data with a secure random number generator instead of reading it from stdin, so the data never passes through your machine. The generated data is not printed; principals on the ACL can read it with knox get. -encoding is raw for random bytes, base64 or hex for encoded random bytes, alphanumeric for random letters and digits, or charset for random characters from -charset. -length is the number of random bytes, or characters for alphanumeric and charset. The default is 32 bytes of base64. Setting -charset implies -encoding charset.
+
 To create a new key, user credentials are required. The default access list will include the creator of this key and a limited set of site reliablity and security engineers.
 
+Keys in a namespace, such as payments:api_key in the payments: namespace, can only be created by admins of the namespace, who may also be machines or services. See 'knox help namespace'.
+
+-description, -team, and -tags set the metadata of the key, which describes what it is for and who owns it. They can be changed later with knox describe.
+
 For more about knox, see https://github.com/pinterest/knox.
 
-See also: knox add, knox get
+See also: knox add, knox get, knox describe
 	`,
 }
+var createDescription = cmdCreate.Flag.String("description", "", "")
+var createTeam = cmdCreate.Flag.String("team", "", "")
+var createTags = cmdCreate.Flag.String("tags", "", "")
+var createGenerate = cmdCreate.Flag.Bool("generate", false, "")
+var createEncoding = cmdCreate.Flag.String("encoding", string(knox.Base64Encoding), "")
+var createLength = cmdCreate.Flag.Int("length", 32, "")
+var createCharset = cmdCreate.Flag.String("charset", "", "")
 
 func runCreate(cmd *Command, args []string) {
 	if len(args) != 1 {
 		fatalf("create takes exactly one argument. See 'knox help create'")
 	}
-	fmt.Println("Reading from stdin...")
 	keyID := args[0]
+	// TODO(devinlundberg): allow ACL to be entered as input
+	acl := knox.ACL{}
+	if *createGenerate {
+		md := knox.KeyMetadata{
+			Description: *createDescription,
+			Team:        *createTeam,
+			Tags:        splitTags(*createTags),
+		}
+		g := generatorSpec(*createEncoding, *createLength, *createCharset)
+		versionID, err := cli.GenerateKey(keyID, g, acl, md)
+		if err != nil {
+			fatalf("Error generating key: %s", err.Error())
+		}
+		fmt.Printf("Created key with generated initial version %d\n", versionID)
+		return
+	}
+	fmt.Println("Reading from stdin...")
 	data, err := ioutil.ReadAll(os.Stdin)
 	if err != nil {
 		fatalf("Problem reading key data: %s", err.Error())
 	}
-	// TODO(devinlundberg): allow ACL to be entered as input
-	acl := knox.ACL{}
-	versionID, err := cli.CreateKey(keyID, data, acl)
+	var versionID uint64
+	if *createDescription != "" || *createTeam != "" || *createTags != "" {
+		md := knox.KeyMetadata{
+			Description: *createDescription,
+			Team:        *createTeam,
+			Tags:        splitTags(*createTags),
+		}
+		versionID, err = cli.CreateKeyWithMetadata(keyID, data, acl, md)
+	} else {
+		versionID, err = cli.CreateKey(keyID, data, acl)
+	}
 	if err != nil {
 		fatalf("Error adding version: %s", err.Error())
 	}
 	fmt.Printf("Created key with initial version %d\n", versionID)
 }
+
+// generatorSpec builds the GeneratorSpec for -generate. A charset implies the
+// charset encoding.
+func generatorSpec(encoding string, length int, charset string) knox.GeneratorSpec {
+	g := knox.GeneratorSpec{Encoding: knox.GeneratorEncoding(encoding), Length: length, Charset: charset}
+	if charset != "" {
+		g.Encoding = knox.CharsetEncoding
+	}
+	return g
+}
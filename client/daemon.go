@@ -48,6 +48,14 @@ var defaultDirPermission os.FileMode = 0777
 
 var daemonRefreshTime = 10 * time.Minute
 
+// daemonWatchTimeout is how long each request to watch the registered keys
+// waits for a change. After a failed watch the daemon waits
+// daemonWatchRetryTime before watching again, and it updates at most once per
+// daemonWatchMinInterval because of changes it is told about.
+var daemonWatchTimeout = time.Minute
+var daemonWatchRetryTime = 30 * time.Second
+var daemonWatchMinInterval = 5 * time.Second
+
 func runDaemon(cmd *Command, args []string) {
 
 	if os.Getenv("KNOX_MACHINE_AUTH") == "" {
@@ -91,6 +99,10 @@ func (d *daemon) loop(refresh time.Duration) {
 	}
 	watcher.Add(d.registerFilename())
 
+	// watch and retry outlive each wait, so that a watch still in progress
+	// when an update starts is reused rather than overlapped by another one.
+	var watch <-chan watchResult
+	var retry <-chan time.Time
 	for {
 		logf("Daemon updating all registered keys")
 		start := time.Now()
@@ -103,20 +115,99 @@ func (d *daemon) loop(refresh time.Duration) {
 		}
 		logf("Update of keys completed after %d ms", time.Since(start).Milliseconds())
 
-		select {
-		case event := <-watcher.Events:
-			// On any change to register file
-			logf("Got file watcher event: %s on %s", event.Op.String(), event.Name)
-		case <-t.C:
-			// add random jitter to prevent a stampede
-			<-time.After(time.Duration(rand.Intn(10)) * time.Millisecond)
-			daemonReportMetrics(map[string]uint64{
-				"err":     d.updateErrCount,
-				"get_err": d.getKeyErrCount,
-				"success": d.successCount,
-			})
+		// Between full updates, the server is asked to report changes to the
+		// registered keys as soon as they happen.
+		if watch == nil && retry == nil {
+			watch = d.watch()
+		}
+	wait:
+		for {
+			select {
+			case event := <-watcher.Events:
+				// On any change to register file
+				logf("Got file watcher event: %s on %s", event.Op.String(), event.Name)
+				break wait
+			case <-t.C:
+				// add random jitter to prevent a stampede
+				<-time.After(time.Duration(rand.Intn(10)) * time.Millisecond)
+				daemonReportMetrics(map[string]uint64{
+					"err":     d.updateErrCount,
+					"get_err": d.getKeyErrCount,
+					"success": d.successCount,
+				})
+				break wait
+			case r := <-watch:
+				watch = nil
+				if r.err != nil {
+					logf("Failed to watch keys: %s", r.err.Error())
+					retry = time.After(daemonWatchRetryTime)
+					continue
+				}
+				if len(r.keyIDs) == 0 {
+					watch = d.watch()
+					continue
+				}
+				logf("Server reported changed keys: %s", r.keyIDs)
+				// A key that cannot be updated is reported again straight
+				// away, so updates are spaced out.
+				time.Sleep(time.Until(start.Add(daemonWatchMinInterval)))
+				break wait
+			case <-retry:
+				retry = nil
+				watch = d.watch()
+			}
+		}
+	}
+}
+
+// watchResult is the outcome of a request to watch the registered keys.
+type watchResult struct {
+	keyIDs []string
+	err    error
+}
+
+// watch starts watching the registered keys that are on disk for changes,
+// and returns a channel that receives the result. It returns nil if there
+// are no keys to watch; keys that are registered later are picked up by the
+// update that follows the change to the register file.
+func (d *daemon) watch() <-chan watchResult {
+	keys, err := d.watchedKeys()
+	c := make(chan watchResult, 1)
+	if err != nil {
+		c <- watchResult{err: err}
+		return c
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	go func() {
+		ids, err := d.cli.WatchKeys(keys, daemonWatchTimeout)
+		c <- watchResult{ids, err}
+	}()
+	return c
+}
+
+// watchedKeys returns the version hashes of the registered keys on disk.
+func (d *daemon) watchedKeys() (map[string]string, error) {
+	err := d.registerKeyFile.Lock()
+	if err != nil {
+		return nil, err
+	}
+	keyIDs, err := d.registerKeyFile.Get()
+	d.registerKeyFile.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string]string{}
+	for _, keyID := range keyIDs {
+		key, err := d.cli.CacheGetKey(keyID)
+		if err != nil {
+			// The next update fetches keys that are not on disk yet.
+			continue
 		}
+		keys[keyID] = key.VersionHash
 	}
+	return keys, nil
 }
 
 func (d *daemon) initialize() error {
@@ -357,6 +357,58 @@ func TestUpdate(t *testing.T) {
 	}
 }
 
+func TestWatch(t *testing.T) {
+	params, dir, d := setUpTest(t)
+	defer TearDownTest(dir)
+	expected := knox.Key{
+		ID:          "testkey",
+		ACL:         knox.ACL([]knox.Access{}),
+		VersionList: knox.KeyVersionList{},
+		VersionHash: "VersionHash",
+	}
+	for _, id := range []string{expected.ID, "missing"} {
+		if err := addRegisteredKey(id, d.registerFilename()); err != nil {
+			t.Fatal("Failed to register key: " + err.Error())
+		}
+	}
+
+	// Nothing is watched until a key is on disk.
+	if c := d.watch(); c != nil {
+		t.Fatal("watch started without keys on disk")
+	}
+
+	params.setFunc(func(r *http.Request) {
+		setGoodResponse(params, expected)
+	})
+	if err := d.processKey(expected.ID); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	params.setFunc(func(r *http.Request) {
+		if r.URL.Path != "/v0/watch/" {
+			t.Errorf("Unexpected path: %s", r.URL.Path)
+		}
+		keys := r.URL.Query().Get("keys")
+		if keys != `{"testkey":"VersionHash"}` {
+			t.Errorf("%s does not equal %s", keys, `{"testkey":"VersionHash"}`)
+		}
+		if timeout := r.URL.Query().Get("timeout"); timeout != "60" {
+			t.Errorf("%s does not equal 60", timeout)
+		}
+		setGoodResponse(params, []string{expected.ID})
+	})
+	c := d.watch()
+	if c == nil {
+		t.Fatal("watch was not started")
+	}
+	r := <-c
+	if r.err != nil {
+		t.Fatalf("%s is not nil", r.err)
+	}
+	if len(r.keyIDs) != 1 || r.keyIDs[0] != expected.ID {
+		t.Fatalf("unexpected keys %v", r.keyIDs)
+	}
+}
+
 func addRegisteredKey(k, reg string) error {
 	f, err := os.OpenFile(reg, os.O_APPEND|os.O_WRONLY, 0666)
 	defer f.Close()
@@ -11,9 +11,13 @@ var cmdDelete = &Command{
 	Long: `
 This will delete your key and all data from the knox server. This operation is dangerous and requires admin permissions
 
+Deleted keys can be restored with knox undelete until the server purges them.
+
+If the key's policy requires approval, this only creates an approval request that another admin must approve with knox approve.
+
 For more about knox, see https://github.com/pinterest/knox.
 
-See also: knox create
+See also: knox create, knox undelete
     `,
 }
 
@@ -0,0 +1,84 @@
+package client
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+func init() {
+	cmdDescribe.Run = runDescribe // break init cycle
+}
+
+var cmdDescribe = &Command{
+	UsageLine: "describe [-description text] [-team name] [-tags tag,...] <key_identifier>",
+	Short:     "shows or updates the metadata of a key",
+	Long: `
+Describe prints the metadata of a key: its description, owning team, tags, and who created it and when.
+
+This doesn't require any access to the key, since metadata is not secret.
+
+-description, -team, and -tags update the metadata before it is printed. Fields that are not given are left unchanged. Tags are a comma separated list that replaces the existing tags; pass -tags "" to remove them. Updating metadata requires admin access to the key.
+
+For more about knox, see https://github.com/pinterest/knox.
+
+See also: knox create, knox acl
+	`,
+}
+var describeDescription = cmdDescribe.Flag.String("description", "", "")
+var describeTeam = cmdDescribe.Flag.String("team", "", "")
+var describeTags = cmdDescribe.Flag.String("tags", "", "")
+
+func runDescribe(cmd *Command, args []string) {
+	if len(args) != 1 {
+		fatalf("describe takes only one argument. See 'knox help describe'")
+	}
+	keyID := args[0]
+
+	md, err := cli.GetMetadata(keyID)
+	if err != nil {
+		fatalf("Error getting key metadata: %s", err.Error())
+	}
+
+	update := false
+	cmd.Flag.Visit(func(f *flag.Flag) {
+		update = true
+		switch f.Name {
+		case "description":
+			md.Description = *describeDescription
+		case "team":
+			md.Team = *describeTeam
+		case "tags":
+			md.Tags = splitTags(*describeTags)
+		}
+	})
+	if update {
+		err = cli.PutMetadata(keyID, *md)
+		if err != nil {
+			fatalf("Error updating key metadata: %s", err.Error())
+		}
+	}
+
+	fmt.Printf("Key:         %s\n", keyID)
+	fmt.Printf("Description: %s\n", md.Description)
+	fmt.Printf("Team:        %s\n", md.Team)
+	fmt.Printf("Tags:        %s\n", strings.Join(md.Tags, ", "))
+	fmt.Printf("Created by:  %s\n", md.CreatedBy)
+	created := ""
+	if md.CreationTime != 0 {
+		created = time.Unix(0, md.CreationTime).UTC().Format(time.RFC3339)
+	}
+	fmt.Printf("Created:     %s\n", created)
+}
+
+// splitTags parses a comma separated list of tags.
+func splitTags(s string) []string {
+	var tags []string
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
@@ -17,6 +17,8 @@ Acl get the ACL for a key.
 
 This doesn't require any access to the key and allows, e.g., to see who has admin access to ask for grants.
 
+Entries the key inherits from its namespaces are not included. See 'knox help namespace'.
+
 For more about knox, see https://github.com/pinterest/knox.
 
 See also: knox keys, knox get
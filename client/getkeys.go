@@ -2,26 +2,50 @@ package client
 
 import (
 	"fmt"
+	"strings"
+
+	"github.com/pinterest/knox"
 )
 
+func init() {
+	cmdGetKeys.Run = runGetKeys // break init cycle
+}
+
 var cmdGetKeys = &Command{
-	Run:       runGetKeys,
-	UsageLine: "keys [<version_id> ...]",
+	UsageLine: "keys [-prefix p] [-access level] [-team name] [-tags tag,...] [<version_id> ...]",
 	Short:     "gets keys and associated version hash",
 	Long: `
 Get Keys takes version ids returns matching key ids if they exist.
 
 If no version ids, are given it returns all version ids.
 
+The search flags list key ids in sorted order instead, and cannot be combined with version ids:
+
+-prefix only lists keys whose id starts with the prefix.
+-access only lists keys you have at least the given access to. It takes read, write, or admin.
+-team only lists keys owned by the given team.
+-tags only lists keys with all of the given comma separated tags.
+
 This requires valid user or machine authentication, but there are no authorization requirements.
 
 For more about knox, see https://github.com/pinterest/knox.
 
-See also: knox get, knox create, knox daemon
+See also: knox get, knox create, knox daemon, knox describe
 	`,
 }
+var getKeysPrefix = cmdGetKeys.Flag.String("prefix", "", "")
+var getKeysAccess = cmdGetKeys.Flag.String("access", "", "")
+var getKeysTeam = cmdGetKeys.Flag.String("team", "", "")
+var getKeysTags = cmdGetKeys.Flag.String("tags", "", "")
 
 func runGetKeys(cmd *Command, args []string) {
+	if *getKeysPrefix != "" || *getKeysAccess != "" || *getKeysTeam != "" || *getKeysTags != "" {
+		if len(args) != 0 {
+			fatalf("keys does not take version ids with search flags. See 'knox help keys'")
+		}
+		searchKeys()
+		return
+	}
 	m := map[string]string{}
 	for _, s := range args {
 		m[s] = "NONE"
@@ -34,3 +58,35 @@ func runGetKeys(cmd *Command, args []string) {
 		fmt.Println(k)
 	}
 }
+
+func searchKeys() {
+	opts := knox.KeySearchOptions{
+		Prefix: *getKeysPrefix,
+		Team:   *getKeysTeam,
+		Tags:   splitTags(*getKeysTags),
+	}
+	switch strings.ToLower(*getKeysAccess) {
+	case "":
+	case "read":
+		opts.Access = knox.Read
+	case "write":
+		opts.Access = knox.Write
+	case "admin":
+		opts.Access = knox.Admin
+	default:
+		fatalf("-access must be read, write, or admin. See 'knox help keys'")
+	}
+	for {
+		page, err := cli.SearchKeys(opts)
+		if err != nil {
+			fatalf("Error searching keys: %s", err.Error())
+		}
+		for _, k := range page.KeyIDs {
+			fmt.Println(k)
+		}
+		if page.Cursor == "" {
+			return
+		}
+		opts.Cursor = page.Cursor
+	}
+}
@@ -0,0 +1,95 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+func init() {
+	cmdHistory.Run = runHistory // break init cycle
+}
+
+var cmdHistory = &Command{
+	UsageLine: "history [-since time] [-until time] [-t type,...] <key_identifier>",
+	Short:     "gets the audit history for a key",
+	Long: `
+History prints the audit trail of a key, oldest first, one JSON event per line.
+
+-since only shows events at or after the given time.
+-until only shows events before the given time.
+Times are either RFC3339 timestamps such as 2020-01-02T15:04:05Z or durations before now such as 24h.
+
+-t restricts the output to a comma separated list of event types. Accepted values include create, add_version, promote, deactivate, reactivate, access, delete, and read. By default every event except reads is shown.
+
+This requires admin access to the key. The history of a deleted key is visible to the admins it had when it was deleted.
+
+For more about knox, see https://github.com/pinterest/knox.
+
+See also: knox versions, knox acl
+	`,
+}
+var historySince = cmdHistory.Flag.String("since", "", "")
+var historyUntil = cmdHistory.Flag.String("until", "", "")
+var historyTypes = cmdHistory.Flag.String("t", "", "")
+
+func runHistory(cmd *Command, args []string) {
+	if len(args) != 1 {
+		fatalf("history takes only one argument. See 'knox help history'")
+	}
+
+	opts := knox.HistoryOptions{}
+	var err error
+	if *historySince != "" {
+		opts.Since, err = parseHistoryTime(*historySince)
+		if err != nil {
+			fatalf("Invalid -since: %s", err.Error())
+		}
+	}
+	if *historyUntil != "" {
+		opts.Until, err = parseHistoryTime(*historyUntil)
+		if err != nil {
+			fatalf("Invalid -until: %s", err.Error())
+		}
+	}
+	if *historyTypes != "" {
+		for _, t := range strings.Split(*historyTypes, ",") {
+			opts.Types = append(opts.Types, knox.AuditEventType(strings.TrimSpace(t)))
+		}
+	}
+
+	keyID := args[0]
+	for {
+		page, err := cli.GetHistory(keyID, opts)
+		if err != nil {
+			fatalf("Error getting key history: %s", err.Error())
+		}
+		for _, e := range page.Events {
+			eEnc, err := json.Marshal(e)
+			if err != nil {
+				fatalf("Could not marshal event: %s", err.Error())
+			}
+			fmt.Println(string(eEnc))
+		}
+		if page.Cursor == "" {
+			return
+		}
+		opts.Cursor = page.Cursor
+	}
+}
+
+// parseHistoryTime parses an RFC3339 timestamp or a duration before now into
+// nanoseconds since the epoch.
+func parseHistoryTime(s string) (int64, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d).UnixNano(), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, fmt.Errorf("%q is neither a duration nor an RFC3339 time", s)
+	}
+	return t.UnixNano(), nil
+}
@@ -0,0 +1,109 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/pinterest/knox"
+)
+
+func init() {
+	cmdNamespace.Run = runNamespace // break init cycle
+}
+
+var cmdNamespace = &Command{
+	UsageLine:   "namespace list | get <prefix> | access [-expires duration] (-acl <file> <prefix> | {-n|-r|-w|-a} {-M|-U|-G|-P|-S|-N} <prefix> <principal>) | delete <prefix>",
+	Short:       "manages the acls of key namespaces",
+	CustomFlags: true,
+	Long: `
+Namespace manages ACLs attached to key ID prefixes. A namespace prefix ends with a colon, such as payments: or payments:stripe:. Every key whose ID starts with the prefix inherits the namespace's ACL in addition to its own, as do the keys of nested namespaces.
+
+Principals with admin access to a namespace can create keys in it, even if they are machines or services. Users can create keys in any namespace, as they can outside of namespaces; the keys still inherit the namespace's ACL.
+
+list prints every namespace followed by the entries of its ACL.
+
+get prints the entries of the ACL of one namespace.
+
+access adds or changes a rule in the ACL of a namespace, creating the namespace if it does not exist. It takes the same flags as knox access. This requires admin access to the namespace or a namespace it is nested in. Only principals with admin access through the server's default access list can create top level namespaces. Access cannot be granted in a namespace that contains keys whose policy requires approval; grant it on those keys instead.
+
+delete removes a namespace. Keys in it keep their own ACLs. This requires the same access as access.
+
+For more about knox, see https://github.com/pinterest/knox.
+
+See also: knox access, knox acl, knox create
+	`,
+}
+
+var namespaceAccessFlags = newAccessFlags(&cmdNamespace.Flag)
+
+func runNamespace(cmd *Command, args []string) {
+	if len(args) == 0 {
+		fatalf("namespace requires a subcommand. See 'knox help namespace'")
+	}
+	sub := args[0]
+	cmd.Flag.Parse(args[1:])
+	args = cmd.Flag.Args()
+
+	switch sub {
+	case "list":
+		if len(args) != 0 {
+			fatalf("namespace list takes no arguments. See 'knox help namespace'")
+		}
+		namespaces, err := cli.GetNamespaces()
+		if err != nil {
+			fatalf("Error getting namespaces: %s", err.Error())
+		}
+		for _, n := range namespaces {
+			fmt.Println(n.Prefix)
+			printNamespaceACL(n.ACL, "  ")
+		}
+	case "get":
+		if len(args) != 1 {
+			fatalf("namespace get takes exactly one argument. See 'knox help namespace'")
+		}
+		n, err := cli.GetNamespace(args[0])
+		if err != nil {
+			fatalf("Error getting namespace: %s", err.Error())
+		}
+		printNamespaceACL(n.ACL, "")
+	case "access":
+		if *namespaceAccessFlags.acl != "" {
+			if len(args) != 1 {
+				fatalf("namespace access takes one argument when used with -acl. See 'knox help namespace'")
+			}
+		} else if len(args) != 2 {
+			fatalf("namespace access takes exactly two arguments. See 'knox help namespace'")
+		}
+		principal := ""
+		if len(args) == 2 {
+			principal = args[1]
+		}
+		err := cli.PutNamespaceAccess(args[0], namespaceAccessFlags.rules("namespace access", principal)...)
+		if err != nil {
+			fatalf("Failed to update namespace access: %s", err.Error())
+		}
+		fmt.Println("Successfully updated namespace access")
+	case "delete":
+		if len(args) != 1 {
+			fatalf("namespace delete takes exactly one argument. See 'knox help namespace'")
+		}
+		err := cli.DeleteNamespace(args[0])
+		if err != nil {
+			fatalf("Error deleting namespace: %s", err.Error())
+		}
+		fmt.Println("Successfully deleted namespace")
+	default:
+		fatalf("Unknown namespace subcommand %q. See 'knox help namespace'", sub)
+	}
+}
+
+// printNamespaceACL prints each entry of the ACL as JSON, like knox acl.
+func printNamespaceACL(acl knox.ACL, indent string) {
+	for _, a := range acl {
+		aEnc, err := json.Marshal(a)
+		if err != nil {
+			fatalf("Could not marshal entry: %v", a)
+		}
+		fmt.Println(indent + string(aEnc))
+	}
+}
@@ -0,0 +1,100 @@
+package client
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/shamir"
+)
+
+func init() {
+	cmdOperator.Run = runOperator // break init cycle
+}
+
+var cmdOperator = &Command{
+	UsageLine:   "operator split [-shares n] [-threshold k] | unseal | seal | status",
+	Short:       "manages the seal of a knox server",
+	CustomFlags: true,
+	Long: `
+Operator manages a server that keeps its master secret split between several operators. Such a server starts sealed and refuses key operations until enough operators submit their shares of the secret.
+
+split reads a secret from stdin and prints -shares base64 encoded shares, one per line, any -threshold of which recreate it. This runs locally and does not talk to the server. Give each share to a different operator.
+
+unseal reads one base64 encoded share from stdin and submits it to the server. The server unseals once -threshold shares have been submitted. This requires admin access through the server's default access list or being one of its unseal operators. A share with the same index as one already submitted is rejected.
+
+seal discards the server's master secret. The server refuses key operations until it is unsealed again. This requires admin access through the server's default access list.
+
+status prints whether the server is sealed and how many shares it has.
+
+For more about knox, see https://github.com/pinterest/knox.
+	`,
+}
+var operatorShares = cmdOperator.Flag.Int("shares", 5, "")
+var operatorThreshold = cmdOperator.Flag.Int("threshold", 3, "")
+
+func runOperator(cmd *Command, args []string) {
+	if len(args) == 0 {
+		fatalf("operator requires a subcommand. See 'knox help operator'")
+	}
+	cmd.Flag.Parse(args[1:])
+	if cmd.Flag.NArg() != 0 {
+		fatalf("operator %s takes no arguments. See 'knox help operator'", args[0])
+	}
+
+	switch args[0] {
+	case "split":
+		secret, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			fatalf("Problem reading secret: %s", err.Error())
+		}
+		shares, err := shamir.Split(secret, *operatorShares, *operatorThreshold)
+		if err != nil {
+			fatalf("Error splitting secret: %s", err.Error())
+		}
+		for _, share := range shares {
+			fmt.Println(base64.StdEncoding.EncodeToString(share))
+		}
+		return
+	case "unseal":
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			fatalf("Problem reading share: %s", err.Error())
+		}
+		share, err := base64.StdEncoding.DecodeString(strings.TrimSpace(line))
+		if err != nil {
+			fatalf("Share is not base64 encoded: %s", err.Error())
+		}
+		status, err := cli.Unseal(share)
+		if err != nil {
+			fatalf("Error unsealing: %s", err.Error())
+		}
+		printSealStatus(status)
+	case "seal":
+		status, err := cli.Seal()
+		if err != nil {
+			fatalf("Error sealing: %s", err.Error())
+		}
+		printSealStatus(status)
+	case "status":
+		status, err := cli.GetSealStatus()
+		if err != nil {
+			fatalf("Error getting seal status: %s", err.Error())
+		}
+		printSealStatus(status)
+	default:
+		fatalf("Unknown operator subcommand %q. See 'knox help operator'", args[0])
+	}
+}
+
+func printSealStatus(s *knox.SealStatus) {
+	if !s.Sealed {
+		fmt.Println("Server is unsealed")
+		return
+	}
+	fmt.Printf("Server is sealed, %d of %d shares submitted\n", s.Progress, s.Threshold)
+}
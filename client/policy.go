@@ -0,0 +1,102 @@
+package client
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+func init() {
+	cmdPolicy.Run = runPolicy // break init cycle
+}
+
+var cmdPolicy = &Command{
+	UsageLine: "policy [-require_approval=true|false] [-rotation_period duration] [-promote_delay duration] [-grace_period duration] [-generator encoding] [-length n] [-charset chars] <key_identifier>",
+	Short:     "shows or updates the policy of a key",
+	Long: `
+Policy prints the policy of a key, which controls how the key may be changed.
+
+-require_approval updates the policy before it is printed. When it is on, deleting the key and changing its ACL or policy only create approval requests, which a second admin must approve with knox approve. Turning it on takes effect immediately, but turning it off needs approval as well.
+
+-rotation_period has the server rotate the key on a schedule. Every period it adds a new Active version with generated data, promotes it to Primary after -promote_delay (default 1h), and deactivates the previous versions after -grace_period (default 24h) more. The period must be longer than the promote delay. -rotation_period 0 stops rotation.
+
+-generator sets how rotated versions are generated: raw for random bytes, base64 or hex for encoded random bytes, alphanumeric for random letters and digits, or charset for random characters from -charset. -length is the number of random bytes, or characters for alphanumeric and charset. The default is 32 bytes of base64. Setting -charset implies -generator charset.
+
+Flags that are not given leave the existing policy unchanged.
+
+This requires admin access to update the policy. Anyone can view it.
+
+For more about knox, see https://github.com/pinterest/knox.
+
+See also: knox approve, knox reject, knox versions
+	`,
+}
+var policyRequireApproval = cmdPolicy.Flag.Bool("require_approval", false, "")
+var policyRotationPeriod = cmdPolicy.Flag.Duration("rotation_period", 0, "")
+var policyPromoteDelay = cmdPolicy.Flag.Duration("promote_delay", time.Hour, "")
+var policyGracePeriod = cmdPolicy.Flag.Duration("grace_period", 24*time.Hour, "")
+var policyGenerator = cmdPolicy.Flag.String("generator", string(knox.Base64Encoding), "")
+var policyLength = cmdPolicy.Flag.Int("length", 32, "")
+var policyCharset = cmdPolicy.Flag.String("charset", "", "")
+
+func runPolicy(cmd *Command, args []string) {
+	if len(args) != 1 {
+		fatalf("policy takes only one argument. See 'knox help policy'")
+	}
+	keyID := args[0]
+
+	p, err := cli.GetPolicy(keyID)
+	if err != nil {
+		fatalf("Error getting key policy: %s", err.Error())
+	}
+
+	update := false
+	cmd.Flag.Visit(func(f *flag.Flag) {
+		update = true
+		if f.Name == "require_approval" {
+			p.RequireApproval = *policyRequireApproval
+			return
+		}
+		if p.Rotation == nil {
+			p.Rotation = &knox.RotationPolicy{
+				Generator:    generatorSpec(*policyGenerator, *policyLength, *policyCharset),
+				PromoteDelay: *policyPromoteDelay,
+				GracePeriod:  *policyGracePeriod,
+			}
+		}
+		switch f.Name {
+		case "rotation_period":
+			p.Rotation.Period = *policyRotationPeriod
+		case "promote_delay":
+			p.Rotation.PromoteDelay = *policyPromoteDelay
+		case "grace_period":
+			p.Rotation.GracePeriod = *policyGracePeriod
+		case "generator", "charset":
+			p.Rotation.Generator = generatorSpec(*policyGenerator, p.Rotation.Generator.Length, *policyCharset)
+		case "length":
+			p.Rotation.Generator.Length = *policyLength
+		}
+	})
+	if p.Rotation != nil && p.Rotation.Period == 0 {
+		p.Rotation = nil
+	}
+	if update {
+		err = cli.PutPolicy(keyID, *p)
+		if err != nil {
+			fatalf("Error updating key policy: %s", err.Error())
+		}
+	}
+
+	fmt.Printf("Key:              %s\n", keyID)
+	fmt.Printf("Require approval: %t\n", p.RequireApproval)
+	if p.Rotation == nil {
+		fmt.Printf("Rotation:         none\n")
+		return
+	}
+	fmt.Printf("Rotation period:  %s\n", p.Rotation.Period)
+	fmt.Printf("Promote delay:    %s\n", p.Rotation.PromoteDelay)
+	fmt.Printf("Grace period:     %s\n", p.Rotation.GracePeriod)
+	fmt.Printf("Generator:        %d %s\n", p.Rotation.Generator.Length, p.Rotation.Generator.Encoding)
+}
@@ -0,0 +1,32 @@
+package client
+
+import (
+	"fmt"
+)
+
+var cmdReject = &Command{
+	Run:       runReject,
+	UsageLine: "reject <key_identifier> <request_id>",
+	Short:     "rejects a pending change to a key",
+	Long: `
+Reject discards a change to a key that is waiting for approval, so it is never carried out. Use knox approve with only a key to list the pending requests.
+
+This requires admin access to the key. The admin who made a request can also reject it to withdraw it.
+
+For more about knox, see https://github.com/pinterest/knox.
+
+See also: knox approve, knox policy
+	`,
+}
+
+func runReject(cmd *Command, args []string) {
+	if len(args) != 2 {
+		fatalf("reject takes exactly two arguments. See 'knox help reject'")
+	}
+
+	err := cli.RejectRequest(args[0], args[1])
+	if err != nil {
+		fatalf("Error rejecting request: %s", err.Error())
+	}
+	fmt.Printf("Successfully rejected request\n")
+}
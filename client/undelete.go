@@ -0,0 +1,30 @@
+package client
+
+import (
+	"fmt"
+)
+
+var cmdUndelete = &Command{
+	Run:       runUndelete,
+	UsageLine: "undelete <key_identifier>",
+	Short:     "restores a deleted key",
+	Long: `
+This will restore a key that was deleted with knox delete, along with all of its versions and its ACL. Keys can only be restored until the server purges them. This requires admin permissions on the key as it was when deleted.
+
+For more about knox, see https://github.com/pinterest/knox.
+
+See also: knox delete
+    `,
+}
+
+func runUndelete(cmd *Command, args []string) {
+	if len(args) != 1 {
+		fatalf("undelete takes exactly one argument. See 'knox help undelete'")
+	}
+
+	err := cli.RestoreKey(args[0])
+	if err != nil {
+		fatalf("Error restoring key: %s", err.Error())
+	}
+	fmt.Printf("Successfully restored key\n")
+}
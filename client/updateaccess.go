@@ -2,8 +2,11 @@ package client
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
+	"strings"
+	"time"
 
 	"github.com/pinterest/knox"
 )
@@ -13,7 +16,7 @@ func init() {
 }
 
 var cmdUpdateAccess = &Command{
-	UsageLine: "access (-acl <file> <key_identifier> | {-n|-r|-w|-a} {-M|-U|-G|-P} <key_identifier> <principal>)",
+	UsageLine: "access [-expires duration] (-acl <file> <key_identifier> | {-n|-r|-w|-a} {-M|-U|-G|-P} <key_identifier> <principal>)",
 	Short:     "access modifies the acl of a key",
 	Long: `
 Access will add or change the acl on a key by adding a specific access control rule.
@@ -32,7 +35,9 @@ Access will add or change the acl on a key by adding a specific access control r
 -S: A specific service. The principal should be set to the exact SPIFFE ID. For example, 'spiffe://example.com/service'.
 -N: A service prefix (namespace). The principal should be set to a SPIFFE ID ending with a slash, such as 'spiffe://example.com/namespace/'. This will match all services under that prefix, so for example 'spiffe://example.com/namespace/service' would be allowed.
 
-This command requires admin access to the key.
+-expires: Makes the grant temporary. It takes a duration such as 24h or 30m, after which the access no longer applies and is removed from the acl. With -acl, it applies to every rule in the file that does not set its own expiry.
+
+This command requires admin access to the key. If the key's policy requires approval, the change only takes effect once another admin approves it with knox approve.
 
 For more about knox, see https://github.com/pinterest/knox.
 
@@ -40,27 +45,59 @@ See also: knox create, knox get
 	`,
 }
 
-var updateAccessACL = cmdUpdateAccess.Flag.String("acl", "", "")
+var updateAccessFlags = newAccessFlags(&cmdUpdateAccess.Flag)
 
-var updateAccessNone = cmdUpdateAccess.Flag.Bool("n", false, "")
-var updateAccessRead = cmdUpdateAccess.Flag.Bool("r", false, "")
-var updateAccessWrite = cmdUpdateAccess.Flag.Bool("w", false, "")
-var updateAccessAdmin = cmdUpdateAccess.Flag.Bool("a", false, "")
+// accessFlags are the flags that describe access rules, shared by the
+// commands that change ACLs.
+type accessFlags struct {
+	acl     *string
+	expires *time.Duration
 
-var updateAccessMachine = cmdUpdateAccess.Flag.Bool("M", false, "")
-var updateAccessUser = cmdUpdateAccess.Flag.Bool("U", false, "")
-var updateAccessGroup = cmdUpdateAccess.Flag.Bool("G", false, "")
-var updateAccessPrefix = cmdUpdateAccess.Flag.Bool("P", false, "")
-var updateAccessService = cmdUpdateAccess.Flag.Bool("S", false, "")
-var updateAccessServicePrefix = cmdUpdateAccess.Flag.Bool("N", false, "")
+	none  *bool
+	read  *bool
+	write *bool
+	admin *bool
 
-func runUpdateAccess(cmd *Command, args []string) {
-	if *updateAccessACL != "" {
-		if len(args) != 1 {
-			fatalf("access takes one argument when used with --acl. See 'knox help access'")
-		}
-		keyID := args[0]
-		b, err := ioutil.ReadFile(*updateAccessACL)
+	machine       *bool
+	user          *bool
+	group         *bool
+	prefix        *bool
+	service       *bool
+	servicePrefix *bool
+}
+
+func newAccessFlags(f *flag.FlagSet) *accessFlags {
+	return &accessFlags{
+		acl:     f.String("acl", "", ""),
+		expires: f.Duration("expires", 0, ""),
+
+		none:  f.Bool("n", false, ""),
+		read:  f.Bool("r", false, ""),
+		write: f.Bool("w", false, ""),
+		admin: f.Bool("a", false, ""),
+
+		machine:       f.Bool("M", false, ""),
+		user:          f.Bool("U", false, ""),
+		group:         f.Bool("G", false, ""),
+		prefix:        f.Bool("P", false, ""),
+		service:       f.Bool("S", false, ""),
+		servicePrefix: f.Bool("N", false, ""),
+	}
+}
+
+// rules returns the access rules in the -acl file, or the rule for principal
+// given by the other flags. name is the command used in error messages.
+func (f *accessFlags) rules(name, principal string) []knox.Access {
+	help := "knox help " + strings.Fields(name)[0]
+	if *f.expires < 0 {
+		fatalf("-expires must be a positive duration. See '%s'", help)
+	}
+	var expires int64
+	if *f.expires > 0 {
+		expires = time.Now().Add(*f.expires).UnixNano()
+	}
+	if *f.acl != "" {
+		b, err := ioutil.ReadFile(*f.acl)
 		if err != nil {
 			fatalf("Could not read acl file %s", err.Error())
 		}
@@ -69,49 +106,60 @@ func runUpdateAccess(cmd *Command, args []string) {
 		if err != nil {
 			fatalf("Could not decode access list properly %s", err.Error())
 		}
-		err = cli.PutAccess(keyID, acl...)
-		if err != nil {
-			fatalf("Failed to update access: %s", err.Error())
+		for i := range acl {
+			if acl[i].Expires == 0 {
+				acl[i].Expires = expires
+			}
 		}
-		fmt.Println("Successfully updated Access")
-		return
-	}
-	if len(args) != 2 {
-		fatalf("access takes exactly two arguments. See 'knox help access'")
+		return acl
 	}
-	keyID := args[0]
-	principal := args[1]
 	var access knox.Access
 	access.ID = principal
+	access.Expires = expires
 	switch {
-	case *updateAccessNone:
+	case *f.none:
 		access.AccessType = knox.None
-	case *updateAccessRead:
+	case *f.read:
 		access.AccessType = knox.Read
-	case *updateAccessWrite:
+	case *f.write:
 		access.AccessType = knox.Write
-	case *updateAccessAdmin:
+	case *f.admin:
 		access.AccessType = knox.Admin
 	default:
-		fatalf("access requires {-n,-r,-w,-a}. See 'knox help access'")
+		fatalf("%s requires {-n,-r,-w,-a}. See '%s'", name, help)
 	}
 	switch {
-	case *updateAccessMachine:
+	case *f.machine:
 		access.Type = knox.Machine
-	case *updateAccessUser:
+	case *f.user:
 		access.Type = knox.User
-	case *updateAccessGroup:
+	case *f.group:
 		access.Type = knox.UserGroup
-	case *updateAccessPrefix:
+	case *f.prefix:
 		access.Type = knox.MachinePrefix
-	case *updateAccessService:
+	case *f.service:
 		access.Type = knox.Service
-	case *updateAccessServicePrefix:
+	case *f.servicePrefix:
 		access.Type = knox.ServicePrefix
 	default:
-		fatalf("access requires {-M|-U|-G|-P|-S|-N}. See 'knox help access'")
+		fatalf("%s requires {-M|-U|-G|-P|-S|-N}. See '%s'", name, help)
+	}
+	return []knox.Access{access}
+}
+
+func runUpdateAccess(cmd *Command, args []string) {
+	if *updateAccessFlags.acl != "" {
+		if len(args) != 1 {
+			fatalf("access takes one argument when used with --acl. See 'knox help access'")
+		}
+	} else if len(args) != 2 {
+		fatalf("access takes exactly two arguments. See 'knox help access'")
+	}
+	principal := ""
+	if len(args) == 2 {
+		principal = args[1]
 	}
-	err := cli.PutAccess(keyID, access)
+	err := cli.PutAccess(args[0], updateAccessFlags.rules("access", principal)...)
 	if err != nil {
 		fatalf("Failed to update access: %s", err.Error())
 	}
@@ -7,6 +7,7 @@ import (
 	"reflect"
 	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestMockClient(t *testing.T) {
@@ -165,6 +166,39 @@ func TestGetKeys(t *testing.T) {
 	}
 }
 
+func TestWatchKeys(t *testing.T) {
+	expected := []string{"a"}
+	resp, err := buildGoodResponse(expected)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	srv := buildServer(200, resp, func(r *http.Request) {
+		if r.Method != "GET" {
+			t.Fatalf("%s is not GET", r.Method)
+		}
+		if r.URL.Path != "/v0/watch/" {
+			t.Fatalf("%s is not %s", r.URL.Path, "/v0/watch/")
+		}
+		if keys := r.URL.Query().Get("keys"); keys != `{"a":"x"}` {
+			t.Fatalf("%s is not %s", keys, `{"a":"x"}`)
+		}
+		if timeout := r.URL.Query().Get("timeout"); timeout != "2" {
+			t.Fatalf("%s is not %s", timeout, "2")
+		}
+	})
+	defer srv.Close()
+
+	cli := MockClient(srv.Listener.Addr().String())
+
+	k, err := cli.WatchKeys(map[string]string{"a": "x"}, 1500*time.Millisecond)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(k) != 1 || k[0] != "a" {
+		t.Fatalf("%v is not %v", k, expected)
+	}
+}
+
 func TestCreateKey(t *testing.T) {
 	expected := uint64(123)
 	resp, err := buildGoodResponse(expected)
@@ -453,3 +487,447 @@ func TestGetKeyWithStatus(t *testing.T) {
 		t.Fatalf("path '%v' is not empty", k.Path)
 	}
 }
+
+func TestGetHistory(t *testing.T) {
+	expected := AuditEventPage{
+		Events: []AuditEvent{{Sequence: 7, Type: CreateKeyEvent, KeyID: "testkey"}},
+		Cursor: "7",
+	}
+	resp, err := buildGoodResponse(expected)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	srv := buildServer(200, resp, func(r *http.Request) {
+		if r.Method != "GET" {
+			t.Fatalf("%s is not GET", r.Method)
+		}
+		if r.URL.Path != "/v0/keys/testkey/history/" {
+			t.Fatalf("%s is not %s", r.URL.Path, "/v0/keys/testkey/history/")
+		}
+		q := r.URL.Query()
+		if q.Get("cursor") != "3" || q.Get("since") != "100" || q.Get("type") != "create,delete" || q.Get("limit") != "5" {
+			t.Fatalf("unexpected query %s", r.URL.RawQuery)
+		}
+		if _, ok := q["until"]; ok {
+			t.Fatalf("unexpected query %s", r.URL.RawQuery)
+		}
+	})
+	defer srv.Close()
+
+	cli := MockClient(srv.Listener.Addr().String())
+
+	page, err := cli.GetHistory("testkey", HistoryOptions{
+		Cursor: "3",
+		Since:  100,
+		Types:  []AuditEventType{CreateKeyEvent, DeleteKeyEvent},
+		Limit:  5,
+	})
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if page.Cursor != "7" || len(page.Events) != 1 || page.Events[0].Sequence != 7 {
+		t.Fatalf("unexpected page %+v", page)
+	}
+}
+
+func TestRestoreKey(t *testing.T) {
+	resp, err := buildGoodResponse("")
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	srv := buildServer(200, resp, func(r *http.Request) {
+		if r.Method != "POST" {
+			t.Fatalf("%s is not POST", r.Method)
+		}
+		if r.URL.Path != "/v0/keys/testkey/restore/" {
+			t.Fatalf("%s is not %s", r.URL.Path, "/v0/keys/testkey/restore/")
+		}
+	})
+	defer srv.Close()
+
+	cli := MockClient(srv.Listener.Addr().String())
+
+	err = cli.RestoreKey("testkey")
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	expected := KeyMetadata{Description: "test key", Team: "security", Tags: []string{"prod"}, CreatedBy: "testuser", CreationTime: 1}
+	resp, err := buildGoodResponse(expected)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	srv := buildServer(200, resp, func(r *http.Request) {
+		if r.URL.Path != "/v0/keys/testkey/metadata/" && r.URL.Path != "/v0/keys/" {
+			t.Fatalf("%s is not %s", r.URL.Path, "/v0/keys/testkey/metadata/")
+		}
+		switch r.Method {
+		case "GET":
+		case "PUT", "POST":
+			r.ParseForm()
+			if r.PostForm["metadata"][0] != `{"description":"test key","tags":["prod"]}` {
+				t.Fatalf("%s is not expected", r.PostForm["metadata"][0])
+			}
+		default:
+			t.Fatalf("unexpected method %s", r.Method)
+		}
+	})
+	defer srv.Close()
+
+	cli := MockClient(srv.Listener.Addr().String())
+
+	md, err := cli.GetMetadata("testkey")
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if md.Description != expected.Description || md.CreatedBy != expected.CreatedBy || !md.HasTag("prod") {
+		t.Fatalf("%+v is not %+v", md, expected)
+	}
+	err = cli.PutMetadata("testkey", KeyMetadata{Description: "test key", Tags: []string{"prod"}})
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+}
+
+func TestSearchKeys(t *testing.T) {
+	expected := KeyIDPage{KeyIDs: []string{"a", "b"}, Cursor: "b"}
+	resp, err := buildGoodResponse(expected)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	srv := buildServer(200, resp, func(r *http.Request) {
+		if r.Method != "GET" {
+			t.Fatalf("%s is not GET", r.Method)
+		}
+		if r.URL.Path != "/v0/search/keys/" {
+			t.Fatalf("%s is not %s", r.URL.Path, "/v0/search/keys/")
+		}
+		q := r.URL.Query()
+		if q.Get("prefix") != "app:" || q.Get("access") != "Write" || q.Get("tags") != "prod,db" || q.Get("cursor") != "x" {
+			t.Fatalf("unexpected query %s", r.URL.RawQuery)
+		}
+		if _, ok := q["team"]; ok {
+			t.Fatalf("unexpected query %s", r.URL.RawQuery)
+		}
+	})
+	defer srv.Close()
+
+	cli := MockClient(srv.Listener.Addr().String())
+
+	page, err := cli.SearchKeys(KeySearchOptions{
+		Cursor: "x",
+		Prefix: "app:",
+		Access: Write,
+		Tags:   []string{"prod", "db"},
+	})
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(page.KeyIDs) != 2 || page.Cursor != "b" {
+		t.Fatalf("unexpected page %+v", page)
+	}
+}
+
+func TestExplainAccess(t *testing.T) {
+	expected := AccessExplanation{
+		KeyID:      "testkey",
+		Principal:  "web0123",
+		AccessType: Read,
+		Granted:    true,
+		GrantedBy:  ACL{{Type: MachinePrefix, ID: "web", AccessType: Read}},
+	}
+	resp, err := buildGoodResponse(expected)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	srv := buildServer(200, resp, func(r *http.Request) {
+		if r.Method != "GET" {
+			t.Fatalf("%s is not GET", r.Method)
+		}
+		if r.URL.Path != "/v0/keys/testkey/explain/" {
+			t.Fatalf("%s is not %s", r.URL.Path, "/v0/keys/testkey/explain/")
+		}
+		q := r.URL.Query()
+		if q.Get("access") != "Read" || q.Get("principal_type") != "User" || q.Get("principal") != "alice" || q.Get("groups") != "a,b" {
+			t.Fatalf("unexpected query %s", r.URL.RawQuery)
+		}
+	})
+	defer srv.Close()
+
+	cli := MockClient(srv.Listener.Addr().String())
+
+	e, err := cli.ExplainAccess("testkey", &PrincipalSpec{Type: User, ID: "alice", Groups: []string{"a", "b"}}, Read)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if !e.Granted || len(e.GrantedBy) != 1 || e.GrantedBy[0].ID != "web" {
+		t.Fatalf("unexpected explanation %+v", e)
+	}
+}
+
+func TestApprovalRequests(t *testing.T) {
+	expected := []ApprovalRequest{{ID: "123", KeyID: "testkey", Operation: DeleteKeyOperation, RequestedBy: "testuser"}}
+	resp, err := buildGoodResponse(expected)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	srv := buildServer(200, resp, func(r *http.Request) {
+		switch r.URL.Path {
+		case "/v0/keys/testkey/requests/":
+			if r.Method != "GET" {
+				t.Fatalf("%s is not GET", r.Method)
+			}
+		case "/v0/keys/testkey/requests/123/approve/", "/v0/keys/testkey/requests/123/reject/":
+			if r.Method != "POST" {
+				t.Fatalf("%s is not POST", r.Method)
+			}
+		case "/v0/keys/testkey/policy/":
+			if r.Method == "PUT" {
+				r.ParseForm()
+				if r.PostForm["policy"][0] != `{"require_approval":true}` {
+					t.Fatalf("%s is not expected", r.PostForm["policy"][0])
+				}
+			}
+		default:
+			t.Fatalf("unexpected path %s", r.URL.Path)
+		}
+	})
+	defer srv.Close()
+
+	cli := MockClient(srv.Listener.Addr().String())
+
+	requests, err := cli.GetApprovalRequests("testkey")
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(requests) != 1 || requests[0].ID != "123" || requests[0].Operation != DeleteKeyOperation {
+		t.Fatalf("%+v is not %+v", requests, expected)
+	}
+	if err := cli.ApproveRequest("testkey", "123"); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if err := cli.RejectRequest("testkey", "123"); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if err := cli.PutPolicy("testkey", KeyPolicy{RequireApproval: true}); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	expected := uint64(123)
+	resp, err := buildGoodResponse(expected)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	srv := buildServer(200, resp, func(r *http.Request) {
+		if r.Method != "POST" {
+			t.Fatalf("%s is not POST", r.Method)
+		}
+		if r.URL.Path != "/v0/keys/" && r.URL.Path != "/v0/keys/testkey/versions/" {
+			t.Fatalf("unexpected path %s", r.URL.Path)
+		}
+		r.ParseForm()
+		if _, ok := r.PostForm["data"]; ok {
+			t.Fatal("data should not be sent")
+		}
+		if r.PostForm["generate"][0] != `{"encoding":"hex","length":16}` {
+			t.Fatalf("%s is not expected", r.PostForm["generate"][0])
+		}
+	})
+	defer srv.Close()
+
+	cli := MockClient(srv.Listener.Addr().String())
+
+	g := GeneratorSpec{Encoding: HexEncoding, Length: 16}
+	v, err := cli.GenerateKey("testkey", g, ACL{}, KeyMetadata{})
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if v != expected {
+		t.Fatalf("%d is not %d", v, expected)
+	}
+	v, err = cli.GenerateVersion("testkey", g)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if v != expected {
+		t.Fatalf("%d is not %d", v, expected)
+	}
+}
+
+func TestSeal(t *testing.T) {
+	expected := SealStatus{Sealed: true, Threshold: 3, Progress: 1}
+	resp, err := buildGoodResponse(expected)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	srv := buildServer(200, resp, func(r *http.Request) {
+		switch r.URL.Path {
+		case "/v0/health/":
+			if r.Method != "GET" {
+				t.Fatalf("%s is not GET", r.Method)
+			}
+		case "/v0/unseal/":
+			r.ParseForm()
+			if r.PostForm["share"][0] != "c2hhcmU=" {
+				t.Fatalf("%s is not expected", r.PostForm["share"][0])
+			}
+		case "/v0/seal/":
+			if r.Method != "POST" {
+				t.Fatalf("%s is not POST", r.Method)
+			}
+		default:
+			t.Fatalf("unexpected path %s", r.URL.Path)
+		}
+	})
+	defer srv.Close()
+
+	cli := MockClient(srv.Listener.Addr().String())
+
+	status, err := cli.GetSealStatus()
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if *status != expected {
+		t.Fatalf("%+v is not %+v", status, expected)
+	}
+	if _, err := cli.Unseal([]byte("share")); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if _, err := cli.Seal(); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	expected := []Webhook{{ID: "w1", URL: "https://example.com/hook", KeyID: "testkey"}}
+	resp, err := buildGoodResponse(expected)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	srv := buildServer(200, resp, func(r *http.Request) {
+		switch r.URL.Path {
+		case "/v0/webhooks/":
+			if r.Method != "GET" {
+				t.Fatalf("%s is not GET", r.Method)
+			}
+			if key := r.URL.Query().Get("key"); key != "testkey" {
+				t.Fatalf("%s is not %s", key, "testkey")
+			}
+		case "/v0/webhooks/w1/":
+			if r.Method != "DELETE" {
+				t.Fatalf("%s is not DELETE", r.Method)
+			}
+		case "/v0/webhooks/w1/deadletters/":
+			if r.Method != "GET" {
+				t.Fatalf("%s is not GET", r.Method)
+			}
+		default:
+			t.Fatalf("unexpected path %s", r.URL.Path)
+		}
+	})
+	defer srv.Close()
+
+	cli := MockClient(srv.Listener.Addr().String())
+
+	hooks, err := cli.GetWebhooks("testkey")
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(hooks) != 1 || hooks[0].ID != "w1" {
+		t.Fatalf("%+v is not %+v", hooks, expected)
+	}
+	if err := cli.DeleteWebhook("w1"); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if _, err := cli.GetWebhookDeadLetters("w1"); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+}
+
+func TestCreateWebhook(t *testing.T) {
+	expected := Webhook{ID: "w1", URL: "https://example.com/hook", KeyID: "testkey", Secret: "s"}
+	resp, err := buildGoodResponse(expected)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	srv := buildServer(200, resp, func(r *http.Request) {
+		if r.Method != "POST" {
+			t.Fatalf("%s is not POST", r.Method)
+		}
+		if r.URL.Path != "/v0/webhooks/" {
+			t.Fatalf("%s is not %s", r.URL.Path, "/v0/webhooks/")
+		}
+		r.ParseForm()
+		var w Webhook
+		if err := json.Unmarshal([]byte(r.PostForm["webhook"][0]), &w); err != nil {
+			t.Fatalf("%s is not nil", err)
+		}
+		if w.URL != expected.URL || w.KeyID != expected.KeyID {
+			t.Fatalf("%+v is not %+v", w, expected)
+		}
+	})
+	defer srv.Close()
+
+	cli := MockClient(srv.Listener.Addr().String())
+
+	hook, err := cli.CreateWebhook(Webhook{URL: "https://example.com/hook", KeyID: "testkey"})
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if hook.ID != "w1" || hook.Secret != "s" {
+		t.Fatalf("%+v is not %+v", hook, expected)
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	expected := []Namespace{{Prefix: "payments:", ACL: ACL{{Type: UserGroup, ID: "payments", AccessType: Admin}}}}
+	resp, err := buildGoodResponse(expected)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	srv := buildServer(200, resp, func(r *http.Request) {
+		switch r.URL.Path {
+		case "/v0/namespaces/":
+			if r.Method != "GET" {
+				t.Fatalf("%s is not GET", r.Method)
+			}
+		case "/v0/namespaces/payments:/":
+			if r.Method != "PUT" && r.Method != "DELETE" {
+				t.Fatalf("%s is not PUT or DELETE", r.Method)
+			}
+			if r.Method == "PUT" {
+				r.ParseForm()
+				var acl ACL
+				if err := json.Unmarshal([]byte(r.PostForm["acl"][0]), &acl); err != nil {
+					t.Fatalf("%s is not nil", err)
+				}
+				if len(acl) != 1 || acl[0] != expected[0].ACL[0] {
+					t.Fatalf("%+v is not %+v", acl, expected[0].ACL)
+				}
+			}
+		default:
+			t.Fatalf("unexpected path %s", r.URL.Path)
+		}
+	})
+	defer srv.Close()
+
+	cli := MockClient(srv.Listener.Addr().String())
+
+	namespaces, err := cli.GetNamespaces()
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(namespaces) != 1 || namespaces[0].Prefix != "payments:" {
+		t.Fatalf("%+v is not %+v", namespaces, expected)
+	}
+	if err := cli.PutNamespaceAccess("payments:", expected[0].ACL...); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if err := cli.DeleteNamespace("payments:"); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+}
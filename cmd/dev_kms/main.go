@@ -0,0 +1,42 @@
+// dev_kms serves the remote key wrapping protocol used by the -kms_url flag
+// of dev_server. It stands in for a real key management service in
+// development and must not be used to protect real secrets.
+package main
+
+import (
+	"crypto/rand"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/pinterest/knox/server/keydb"
+)
+
+var (
+	flagAddr    = flag.String("http", "localhost:9100", "HTTP address to listen on")
+	flagKeyID   = flag.String("key_id", "knox", "ID of the master key to serve")
+	flagKeyfile = flag.String("master_keyfile", "", "Keyfile with the master key, protected by the passphrase in $KNOX_KEYFILE_PASSPHRASE (a random key is used if empty)")
+)
+
+func main() {
+	flag.Parse()
+
+	var w keydb.KeyWrapper
+	if *flagKeyfile != "" {
+		var err error
+		w, err = keydb.NewKeyfileWrapper(*flagKeyfile, []byte(os.Getenv("KNOX_KEYFILE_PASSPHRASE")))
+		if err != nil {
+			log.Fatal("Failed to open keyfile: ", err)
+		}
+	} else {
+		masterKey := make([]byte, 32)
+		if _, err := rand.Read(masterKey); err != nil {
+			log.Fatal("Failed to generate master key: ", err)
+		}
+		w = keydb.NewAESKeyWrapper(masterKey)
+	}
+
+	h := keydb.NewKMSHandler(map[string]keydb.KeyWrapper{*flagKeyID: w})
+	log.Fatal(http.ListenAndServe(*flagAddr, h))
+}
@@ -10,15 +10,20 @@ import (
 	"encoding/pem"
 	"expvar"
 	"flag"
+	"fmt"
 	"math/big"
 	"math/rand"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/pinterest/knox"
 	"github.com/pinterest/knox/log"
 	"github.com/pinterest/knox/server"
+	"github.com/pinterest/knox/server/audit"
 	"github.com/pinterest/knox/server/auth"
 	"github.com/pinterest/knox/server/keydb"
 )
@@ -41,9 +46,25 @@ var gitSha = expvar.NewString("version")
 var service = expvar.NewString("service")
 
 var (
-	flagAddr = flag.String("http", ":9000", "HTTP port to listen on")
+	flagAddr         = flag.String("http", ":9000", "HTTP port to listen on")
+	flagAuditLog     = flag.String("audit_log", "", "File to append the audit log to (kept in memory if empty)")
+	flagDBFile       = flag.String("db_file", "", "File to store keys in (kept in memory if empty)")
+	flagCacheRefresh = flag.Duration("cache_refresh", 0, "Serve reads from an in memory cache of the keys, refreshed at this interval (disabled if 0)")
+	flagRetention    = flag.Duration("deleted_key_retention", 7*24*time.Hour, "How long deleted keys can be restored before they are purged")
+	flagApproval     = flag.Duration("approval_ttl", 24*time.Hour, "How long approval requests wait for a second admin before they expire")
+	flagKeyfile      = flag.String("master_keyfile", "", "Keyfile with the master key, protected by the passphrase in $"+keyfilePassphraseEnv+" (created if missing)")
+	flagKeyVersion   = flag.Int("master_key_version", 0, "Version of the master key in -master_keyfile, from 0 to 255")
+	flagRetiredKeys  = flag.String("retired_keyfiles", "", "Comma separated version=file pairs of retired master keyfiles, with the same passphrase as -master_keyfile, whose keys are moved to it in the background")
+	flagKMSURL       = flag.String("kms_url", "", "URL of a key management service to wrap data keys with instead of a local master key")
+	flagKMSKeyID     = flag.String("kms_key_id", "knox", "ID of the master key in the key management service")
+	flagUnseal       = flag.Int("unseal_threshold", 0, "Start sealed until this many operators submit shares of the -master_keyfile passphrase (disabled if 0)")
+	flagWebhookNets  = flag.String("webhook_allowed_networks", "", "Comma separated CIDRs of internal networks that webhooks may be delivered to")
 )
 
+// keyfilePassphraseEnv is the environment variable holding the passphrase of
+// the master keyfile.
+const keyfilePassphraseEnv = "KNOX_KEYFILE_PASSPHRASE"
+
 const (
 	authTimeout = 10 * time.Second // Calls to auth timeout after 10 seconds
 	serviceName = "knox_dev"
@@ -54,15 +75,60 @@ func main() {
 	flag.Parse()
 	accLogger, errLogger := setupLogging("dev", serviceName)
 
-	dbEncryptionKey := []byte("testtesttesttest")
-	cryptor := keydb.NewAESGCMCryptor(0, dbEncryptionKey)
+	cryptor, err := newCryptor()
+	if err != nil {
+		errLogger.Fatal("Failed to set up the master key: ", err)
+	}
 
 	tlsCert, tlsKey, err := buildCert()
 	if err != nil {
 		errLogger.Fatal("Failed to make TLS key or cert: ", err)
 	}
 
-	db := keydb.NewTempDB()
+	var db keydb.DB = keydb.NewTempDB()
+	if *flagDBFile != "" {
+		db, err = keydb.NewFileDB(*flagDBFile)
+		if err != nil {
+			errLogger.Fatal("Failed to open key database: ", err)
+		}
+	}
+	leaser, _ := db.(keydb.Leaser)
+	if *flagCacheRefresh > 0 {
+		cache := keydb.NewCachedDB(db)
+		go cache.Run(*flagCacheRefresh, nil)
+		db = cache
+	}
+
+	var auditSink audit.Sink = audit.NewMemorySink()
+	if *flagAuditLog != "" {
+		auditSink, err = audit.NewFileSink(*flagAuditLog)
+		if err != nil {
+			errLogger.Fatal("Failed to open audit log: ", err)
+		}
+	}
+	auditLogger, err := audit.NewLogger(auditSink)
+	if err != nil {
+		errLogger.Fatal("Failed to set up audit logger: ", err)
+	}
+	server.SetAuditLogger(auditLogger)
+	server.SetApprovalTTL(*flagApproval)
+
+	var webhookNets []*net.IPNet
+	if *flagWebhookNets != "" {
+		for _, cidr := range strings.Split(*flagWebhookNets, ",") {
+			_, n, err := net.ParseCIDR(cidr)
+			if err != nil {
+				errLogger.Fatal("Failed to parse -webhook_allowed_networks: ", err)
+			}
+			webhookNets = append(webhookNets, n)
+		}
+	}
+	webhooks, err := server.NewWebhooks(db, cryptor, server.NewWebhookClient(authTimeout, webhookNets))
+	if err != nil {
+		errLogger.Fatal("Failed to set up webhooks: ", err)
+	}
+	go webhooks.Run(nil)
+	server.SetWebhooks(webhooks)
 
 	server.AddDefaultAccess(&knox.Access{
 		Type:       knox.UserGroup,
@@ -87,11 +153,108 @@ func main() {
 
 	r := server.GetRouter(cryptor, db, decorators)
 
+	m := server.NewKeyManager(cryptor, db)
+	purger := server.NewPurger(m, *flagRetention)
+	go purger.Run(time.Hour, nil)
+	rotator := server.NewRotator(m, leaser)
+	go rotator.Run(time.Minute, nil)
+	reencryptor := server.NewReencryptor(db, cryptor, leaser)
+	expvar.Publish("reencryption", expvar.Func(func() interface{} { return reencryptor.Progress() }))
+	go reencryptor.Run(time.Hour, nil)
+
 	http.Handle("/", r)
 
 	errLogger.Fatal(serveTLS(tlsCert, tlsKey, *flagAddr))
 }
 
+// newCryptor builds the cryptor for the master key selected by flags. Without
+// flags it uses a fixed test key.
+func newCryptor() (keydb.Cryptor, error) {
+	switch {
+	case *flagUnseal > 0:
+		if *flagKeyfile == "" {
+			return nil, fmt.Errorf("-unseal_threshold requires -master_keyfile")
+		}
+		sealer := server.NewSealer(*flagUnseal, keyfileCryptor)
+		server.SetSealer(sealer)
+		return sealer, nil
+	case *flagKMSURL != "":
+		// Remote master keys cannot be used to derive a MAC key, so keys are
+		// not signed.
+		client := &http.Client{Timeout: authTimeout}
+		return keydb.NewKMSCryptor(0, keydb.NewHTTPKeyWrapper(client, *flagKMSURL, *flagKMSKeyID)), nil
+	case *flagKeyfile != "":
+		return keyfileCryptor([]byte(os.Getenv(keyfilePassphraseEnv)))
+	}
+	dbEncryptionKey := []byte("testtesttesttest")
+	return withMAC(keydb.NewEnvelopeCryptor(0, dbEncryptionKey), keydb.NewAESKeyWrapper(dbEncryptionKey))
+}
+
+// macPurpose is the purpose MAC keys are derived from master keys for.
+const macPurpose = "knox key record mac"
+
+// withMAC signs keys with a MAC key derived from the master key of w. Keys
+// signed with MAC keys derived from the retired master keys are still
+// accepted until they are signed again.
+func withMAC(c keydb.Cryptor, w keydb.KeyWrapper, retired ...keydb.KeyWrapper) (keydb.Cryptor, error) {
+	macKey, err := keydb.DeriveKey(w, macPurpose)
+	if err != nil {
+		return nil, err
+	}
+	var previous [][]byte
+	for _, r := range retired {
+		k, err := keydb.DeriveKey(r, macPurpose)
+		if err != nil {
+			return nil, err
+		}
+		previous = append(previous, k)
+	}
+	return keydb.NewMACKeyring(c, macKey, previous, false), nil
+}
+
+// keyfileCryptor opens the master keyfile with passphrase, creating it first
+// if it does not exist, along with any retired keyfiles.
+func keyfileCryptor(passphrase []byte) (keydb.Cryptor, error) {
+	if *flagKeyVersion < 0 || *flagKeyVersion > 255 {
+		return nil, fmt.Errorf("-master_key_version must be from 0 to 255")
+	}
+	if _, err := os.Stat(*flagKeyfile); os.IsNotExist(err) {
+		if err := keydb.CreateKeyfile(*flagKeyfile, passphrase); err != nil {
+			return nil, err
+		}
+	}
+	w, err := keydb.NewKeyfileWrapper(*flagKeyfile, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	version := byte(*flagKeyVersion)
+	wrappers := map[byte]keydb.KeyWrapper{version: w}
+	var retired []keydb.KeyWrapper
+	if *flagRetiredKeys != "" {
+		for _, pair := range strings.Split(*flagRetiredKeys, ",") {
+			parts := strings.SplitN(pair, "=", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("-retired_keyfiles entry %q is not version=file", pair)
+			}
+			v, err := strconv.Atoi(parts[0])
+			if err != nil || v < 0 || v > 255 || byte(v) == version {
+				return nil, fmt.Errorf("-retired_keyfiles entry %q has a bad or current version", pair)
+			}
+			rw, err := keydb.NewKeyfileWrapper(parts[1], passphrase)
+			if err != nil {
+				return nil, err
+			}
+			wrappers[byte(v)] = rw
+			retired = append(retired, rw)
+		}
+	}
+	c, err := keydb.NewEnvelopeKeyring(version, wrappers)
+	if err != nil {
+		return nil, err
+	}
+	return withMAC(c, w, retired...)
+}
+
 func setupLogging(gitSha, service string) (*log.Logger, *log.Logger) {
 	accLogger := log.New(os.Stderr, "", 0)
 	accLogger.SetVersion(gitSha)
@@ -22,6 +22,13 @@ func moveKeyData(sDB keydb.DB, sCrypt keydb.Cryptor, dDB keydb.DB, dCrypt keydb.
 		if err != nil {
 			return err
 		}
+		// State that is not part of knox.Key carries over as is. Encrypt
+		// signed the key without it, so it is signed again.
+		newDBK.DeletedAt = dbk.DeletedAt
+		newDBK.ApprovalRequests = dbk.ApprovalRequests
+		if err := keydb.Sign(dCrypt, newDBK); err != nil {
+			return err
+		}
 		newDBKeys = append(newDBKeys, newDBK)
 	}
 
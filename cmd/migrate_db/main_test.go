@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/keydb"
+)
+
+func TestMoveKeyDataDeletedKey(t *testing.T) {
+	sCrypt := keydb.NewMACCryptor(keydb.NewAESGCMCryptor(0, make([]byte, 16)), []byte("source"), false)
+	dCrypt := keydb.NewMACCryptor(keydb.NewAESGCMCryptor(1, make([]byte, 16)), []byte("dest"), false)
+	source := generateTestDBWithKeys(sCrypt)
+	dbk, err := source.Get("test_key")
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	deleted := dbk.Copy()
+	deleted.DeletedAt = 1234
+	deleted.ApprovalRequests = []knox.ApprovalRequest{{ID: "r1", KeyID: "test_key", RequestedBy: "testuser"}}
+	if err := keydb.Sign(sCrypt, deleted); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if err := source.Update(deleted); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+
+	dest := keydb.NewTempDB()
+	if err := moveKeyData(source, sCrypt, dest, dCrypt); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	moved, err := dest.Get("test_key")
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if moved.DeletedAt != 1234 || len(moved.ApprovalRequests) != 1 {
+		t.Fatalf("unexpected key %+v", moved)
+	}
+	k, err := dCrypt.Decrypt(moved)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if k.ID != "test_key" || len(k.VersionList) != 3 {
+		t.Fatalf("unexpected key %+v", k)
+	}
+}
@@ -2,6 +2,7 @@
 package knox
 
 import (
+	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
@@ -11,12 +12,14 @@ import (
 	"regexp"
 	"sort"
 	"strings"
+	"time"
 )
 
 var (
 	ErrACLDuplicateEntries = fmt.Errorf("Duplicate entries in ACL")
 	ErrACLContainsNone     = fmt.Errorf("ACL contains None access")
 	ErrACLEmptyPrincipal   = fmt.Errorf("Principals of type user, user group, machine, or machine prefix may not be empty.")
+	ErrACLInvalidExpiry    = fmt.Errorf("ACL expiry times may not be negative")
 
 	ErrACLInvalidService               = fmt.Errorf("Service is invalid, must conform to 'spiffe://<domain>/<path>' format.")
 	ErrACLInvalidServicePrefixURL      = fmt.Errorf("Service prefix is invalid URL, must conform to 'spiffe://<domain>/<path>/' format.")
@@ -37,6 +40,23 @@ var (
 	ErrKeyVersionNotFound = fmt.Errorf("Key version not found")
 	ErrKeyIDNotFound      = fmt.Errorf("KeyID not found")
 	ErrKeyExists          = fmt.Errorf("Key Exists")
+	ErrKeyNotDeleted      = fmt.Errorf("Key is not deleted")
+
+	ErrApprovalRequestNotFound = fmt.Errorf("Approval request not found")
+	ErrWebhookNotFound         = fmt.Errorf("Webhook not found")
+	ErrNamespaceNotFound       = fmt.Errorf("Namespace not found")
+
+	ErrInvalidNamespace = fmt.Errorf("Namespace prefixes can only contain alphanumeric characters, colons, and underscores, and must end with a colon.")
+
+	ErrInvalidWebhookURL   = fmt.Errorf("Webhook URL must be an absolute http or https URL")
+	ErrInvalidWebhookEvent = fmt.Errorf("Webhooks can only subscribe to create, add_version, promote, deactivate, access and delete events")
+
+	ErrInvalidGenerator      = fmt.Errorf("Generator must have a known encoding and a length between 1 and 4096")
+	ErrInvalidCharset        = fmt.Errorf("Generator charset must have at least two unique printable ASCII characters and is only used with the charset encoding")
+	ErrInvalidRotationPolicy = fmt.Errorf("Rotation period must be positive and longer than the promote delay, and delays may not be negative")
+
+	ErrMetadataTooLarge = fmt.Errorf("Key metadata is too large")
+	ErrInvalidTag       = fmt.Errorf("Tags must be non-empty, unique, and at most 128 characters")
 )
 
 const (
@@ -302,6 +322,14 @@ type Access struct {
 	Type       PrincipalType `json:"type"`
 	ID         string        `json:"id"`
 	AccessType AccessType    `json:"access"`
+	// Expires is when the grant stops applying in nanoseconds since the epoch.
+	// Zero means the grant does not expire.
+	Expires int64 `json:"expires,omitempty"`
+}
+
+// Expired reports whether the grant has expired at time t.
+func (a Access) Expired(t time.Time) bool {
+	return a.Expires != 0 && a.Expires <= t.UnixNano()
 }
 
 // Validate ensures the ACL is of valid form. Not specifying the same group
@@ -311,6 +339,9 @@ func (acl ACL) Validate() error {
 		if a.AccessType == None {
 			return ErrACLContainsNone
 		}
+		if a.Expires < 0 {
+			return ErrACLInvalidExpiry
+		}
 		for j, b := range acl {
 			if i != j && a.ID == b.ID && a.Type == b.Type {
 				return ErrACLDuplicateEntries
@@ -321,8 +352,12 @@ func (acl ACL) Validate() error {
 }
 
 // Add appends an access to the ACL. It does so by overwriting any existing access
-// that principal or group may have had.
+// that principal or group may have had, including its expiry. Adding an access
+// that has already expired removes the principal or group like None does.
 func (acl ACL) Add(a Access) ACL {
+	if a.Expired(time.Now()) {
+		a.AccessType = None
+	}
 	for i, b := range acl {
 		if b.Type == a.Type && a.ID == b.ID {
 			if a.AccessType == None {
@@ -340,6 +375,17 @@ func (acl ACL) Add(a Access) ACL {
 	return append(acl, a)
 }
 
+// Prune returns the ACL without the accesses that have expired at time t.
+func (acl ACL) Prune(t time.Time) ACL {
+	pruned := ACL{}
+	for _, a := range acl {
+		if !a.Expired(t) {
+			pruned = append(pruned, a)
+		}
+	}
+	return pruned
+}
+
 // KeyVersion is a specific version of a Key. All attributes should be immutable
 // except status.
 type KeyVersion struct {
@@ -381,6 +427,84 @@ type Key struct {
 	VersionList KeyVersionList `json:"versions"`
 	VersionHash string         `json:"hash"`
 	Path        string         `json:"path,omitempty"`
+	Metadata    *KeyMetadata   `json:"metadata,omitempty"`
+	Policy      *KeyPolicy     `json:"policy,omitempty"`
+	// InheritedACL holds the ACLs of the namespaces the key is in. It is
+	// filled in by the server when the key is read and is never stored.
+	InheritedACL ACL `json:"inherited_acl,omitempty"`
+}
+
+// EffectiveACL returns the entries that govern access to the key: those in
+// its own ACL and those inherited from its namespaces.
+func (k *Key) EffectiveACL() ACL {
+	if len(k.InheritedACL) == 0 {
+		return k.ACL
+	}
+	acl := make(ACL, 0, len(k.ACL)+len(k.InheritedACL))
+	acl = append(acl, k.ACL...)
+	return append(acl, k.InheritedACL...)
+}
+
+// Limits on the size of key metadata.
+const (
+	maxDescriptionLength = 4096
+	maxTeamLength        = 256
+	maxTags              = 64
+	maxTagLength         = 128
+)
+
+// KeyMetadata describes what a key is for and who owns it. It is not secret.
+type KeyMetadata struct {
+	Description string   `json:"description,omitempty"`
+	Team        string   `json:"team,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	// CreatedBy and CreationTime are set by the server when the key is created.
+	CreatedBy    string `json:"created_by,omitempty"`
+	CreationTime int64  `json:"ts,omitempty"`
+}
+
+// Copy provides a deep copy of the metadata so that tags can be edited in a copy.
+func (m *KeyMetadata) Copy() *KeyMetadata {
+	if m == nil {
+		return nil
+	}
+	c := *m
+	if m.Tags != nil {
+		c.Tags = make([]string, len(m.Tags))
+		copy(c.Tags, m.Tags)
+	}
+	return &c
+}
+
+// HasTag reports whether the metadata includes the tag.
+func (m *KeyMetadata) HasTag(tag string) bool {
+	if m == nil {
+		return false
+	}
+	for _, t := range m.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate ensures the metadata is within size limits and tags are well formed.
+func (m *KeyMetadata) Validate() error {
+	if len(m.Description) > maxDescriptionLength || len(m.Team) > maxTeamLength || len(m.Tags) > maxTags {
+		return ErrMetadataTooLarge
+	}
+	for i, t := range m.Tags {
+		if t == "" || len(t) > maxTagLength {
+			return ErrInvalidTag
+		}
+		for _, u := range m.Tags[:i] {
+			if t == u {
+				return ErrInvalidTag
+			}
+		}
+	}
+	return nil
 }
 
 // Validate calls makes sure all attributes of key are in good state.
@@ -402,9 +526,199 @@ func (k Key) Validate() error {
 	if k.VersionHash != k.VersionList.Hash() {
 		return ErrInvalidVersionHash
 	}
+	if k.Metadata != nil {
+		return k.Metadata.Validate()
+	}
+	return nil
+}
+
+// Namespace is an ACL attached to a key ID prefix such as "payments:". Every
+// key whose ID starts with the prefix inherits the ACL, in addition to its
+// own, and so do the keys of nested namespaces.
+type Namespace struct {
+	Prefix string `json:"prefix"`
+	ACL    ACL    `json:"acl"`
+	// MAC protects the integrity of the stored ACL, for servers whose cryptor
+	// signs keys. It is never returned to clients.
+	MAC []byte `json:"mac,omitempty"`
+}
+
+// Validate makes sure the prefix is a key ID prefix ending in a colon and the
+// ACL is valid.
+func (n Namespace) Validate() error {
+	re := regexp.MustCompile("^[a-zA-Z0-9_:]*[a-zA-Z0-9_]:$")
+	if !re.MatchString(n.Prefix) {
+		return ErrInvalidNamespace
+	}
+	return n.ACL.Validate()
+}
+
+// Contains reports whether the key ID, or the prefix of a nested namespace,
+// is in the namespace.
+func (n Namespace) Contains(id string) bool {
+	return len(id) > len(n.Prefix) && strings.HasPrefix(id, n.Prefix)
+}
+
+// KeyPolicy controls how a key may be changed.
+type KeyPolicy struct {
+	// RequireApproval turns deleting the key and changing its ACL or policy
+	// into requests that a second Admin must approve.
+	RequireApproval bool `json:"require_approval,omitempty"`
+	// Rotation has the server rotate the key on a schedule if it is set.
+	Rotation *RotationPolicy `json:"rotation,omitempty"`
+}
+
+// Copy provides a deep copy of the policy.
+func (p *KeyPolicy) Copy() *KeyPolicy {
+	if p == nil {
+		return nil
+	}
+	c := *p
+	if p.Rotation != nil {
+		r := *p.Rotation
+		c.Rotation = &r
+	}
+	return &c
+}
+
+// Validate ensures the rotation policy, if any, is well formed.
+func (p *KeyPolicy) Validate() error {
+	if p.Rotation != nil {
+		return p.Rotation.Validate()
+	}
+	return nil
+}
+
+// RotationPolicy describes how the server rotates a key. Every Period it adds
+// a generated Active version, promotes it to Primary after PromoteDelay, and
+// deactivates the previous versions once GracePeriod has passed after that.
+type RotationPolicy struct {
+	Generator GeneratorSpec `json:"generator"`
+	// Period is the time between new versions.
+	Period time.Duration `json:"period"`
+	// PromoteDelay gives clients time to fetch a new version before it
+	// becomes Primary.
+	PromoteDelay time.Duration `json:"promote_delay"`
+	// GracePeriod keeps the previous versions Active while clients switch to
+	// the new Primary.
+	GracePeriod time.Duration `json:"grace_period"`
+}
+
+// Validate ensures the periods are consistent and the generator is valid.
+func (p *RotationPolicy) Validate() error {
+	if p.Period <= 0 || p.PromoteDelay < 0 || p.GracePeriod < 0 || p.PromoteDelay >= p.Period {
+		return ErrInvalidRotationPolicy
+	}
+	return p.Generator.Validate()
+}
+
+// GeneratorEncoding is how generated secret material is encoded.
+type GeneratorEncoding string
+
+const (
+	// RawEncoding generates Length random bytes.
+	RawEncoding GeneratorEncoding = "raw"
+	// Base64Encoding generates Length random bytes in standard base64.
+	Base64Encoding GeneratorEncoding = "base64"
+	// HexEncoding generates Length random bytes in hex.
+	HexEncoding GeneratorEncoding = "hex"
+	// AlphanumericEncoding generates Length random letters and digits.
+	AlphanumericEncoding GeneratorEncoding = "alphanumeric"
+	// CharsetEncoding generates Length random characters from Charset.
+	CharsetEncoding GeneratorEncoding = "charset"
+)
+
+// maxGeneratorLength is the largest Length of a GeneratorSpec.
+const maxGeneratorLength = 4096
+
+// GeneratorSpec describes secret material for the server to generate.
+type GeneratorSpec struct {
+	Encoding GeneratorEncoding `json:"encoding"`
+	Length   int               `json:"length"`
+	// Charset is the characters to choose from with CharsetEncoding.
+	Charset string `json:"charset,omitempty"`
+}
+
+// Validate ensures the encoding is known, the length is in range, and the
+// charset is usable.
+func (g GeneratorSpec) Validate() error {
+	switch g.Encoding {
+	case RawEncoding, Base64Encoding, HexEncoding, AlphanumericEncoding, CharsetEncoding:
+	default:
+		return ErrInvalidGenerator
+	}
+	if g.Length <= 0 || g.Length > maxGeneratorLength {
+		return ErrInvalidGenerator
+	}
+	if (g.Encoding == CharsetEncoding) != (g.Charset != "") {
+		return ErrInvalidCharset
+	}
+	if g.Encoding == CharsetEncoding {
+		if len(g.Charset) < 2 {
+			return ErrInvalidCharset
+		}
+		for i := 0; i < len(g.Charset); i++ {
+			c := g.Charset[i]
+			if c <= ' ' || c > '~' || strings.IndexByte(g.Charset[i+1:], c) >= 0 {
+				return ErrInvalidCharset
+			}
+		}
+	}
 	return nil
 }
 
+// ApprovalOperation is a change to a key that can wait for approval.
+type ApprovalOperation string
+
+const (
+	// DeleteKeyOperation deletes the key.
+	DeleteKeyOperation ApprovalOperation = "delete"
+	// UpdateAccessOperation applies ACL changes to the key.
+	UpdateAccessOperation ApprovalOperation = "access"
+	// UpdatePolicyOperation replaces the policy of the key.
+	UpdatePolicyOperation ApprovalOperation = "policy"
+)
+
+// ApprovalRequest is a pending change to a key with a KeyPolicy that requires
+// approval. It is carried out once an Admin other than the requester approves it.
+type ApprovalRequest struct {
+	ID        string            `json:"id"`
+	KeyID     string            `json:"key_id"`
+	Operation ApprovalOperation `json:"operation"`
+	// ACL holds the access changes of an UpdateAccessOperation.
+	ACL ACL `json:"acl,omitempty"`
+	// Policy is the new policy of an UpdatePolicyOperation.
+	Policy       *KeyPolicy `json:"policy,omitempty"`
+	RequestedBy  string     `json:"requested_by"`
+	CreationTime int64      `json:"ts"`
+	// Expires is when the request lapses in nanoseconds since the epoch.
+	Expires int64 `json:"expires"`
+}
+
+// Copy provides a deep copy of the request.
+func (r ApprovalRequest) Copy() ApprovalRequest {
+	if r.ACL != nil {
+		r.ACL = append(ACL{}, r.ACL...)
+	}
+	r.Policy = r.Policy.Copy()
+	return r
+}
+
+// Expired reports whether the request has lapsed at time t.
+func (r ApprovalRequest) Expired(t time.Time) bool {
+	return t.UnixNano() >= r.Expires
+}
+
+// SealStatus describes whether a server is sealed. A sealed server does not
+// have its master key and refuses key operations until Threshold operators
+// have submitted their shares of it.
+type SealStatus struct {
+	Sealed    bool `json:"sealed"`
+	Threshold int  `json:"threshold"`
+	// Progress is the number of shares submitted so far.
+	Progress int `json:"progress"`
+}
+
 // GetActive returns the active keys in a KeyVersionList.
 func (kvl KeyVersionList) GetActive() KeyVersionList {
 	var ks KeyVersionList
@@ -571,6 +885,282 @@ func NewPrincipalMux(defaultPrincipal Principal, allPrincipals map[string]Princi
 	}
 }
 
+// AuditEventType is the kind of operation recorded by an AuditEvent.
+type AuditEventType string
+
+const (
+	// CreateKeyEvent records the creation of a key.
+	CreateKeyEvent AuditEventType = "create"
+	// ReadKeyEvent records a successful read of key data.
+	ReadKeyEvent AuditEventType = "read"
+	// UpdateMetadataEvent records a change to a key's metadata.
+	UpdateMetadataEvent AuditEventType = "metadata"
+	// DeleteKeyEvent records the deletion of a key.
+	DeleteKeyEvent AuditEventType = "delete"
+	// RestoreKeyEvent records a deleted key being restored.
+	RestoreKeyEvent AuditEventType = "restore"
+	// PurgeKeyEvent records a deleted key being permanently removed.
+	PurgeKeyEvent AuditEventType = "purge"
+	// UpdateAccessEvent records a change to a key's ACL.
+	UpdateAccessEvent AuditEventType = "access"
+	// AddVersionEvent records a new key version being added.
+	AddVersionEvent AuditEventType = "add_version"
+	// PromoteVersionEvent records a key version being promoted to Primary.
+	PromoteVersionEvent AuditEventType = "promote"
+	// DeactivateVersionEvent records a key version being made Inactive.
+	DeactivateVersionEvent AuditEventType = "deactivate"
+	// ReactivateVersionEvent records an Inactive key version being made Active.
+	ReactivateVersionEvent AuditEventType = "reactivate"
+	// UpdatePolicyEvent records a change to a key's policy.
+	UpdatePolicyEvent AuditEventType = "policy"
+	// RequestApprovalEvent records a change that is waiting for approval.
+	// Approved changes are recorded as their own event type with the
+	// approver as principal and the RequestID set.
+	RequestApprovalEvent AuditEventType = "request"
+	// RejectRequestEvent records an approval request being rejected.
+	RejectRequestEvent AuditEventType = "reject"
+	// IntegrityFailureEvent records a key whose stored ACL, version hash,
+	// version statuses, deletion time, policy, metadata, or approval requests
+	// were changed outside of knox, or a namespace whose stored ACL was. For
+	// namespaces, KeyID is the prefix.
+	IntegrityFailureEvent AuditEventType = "integrity_failure"
+	// UpdateNamespaceEvent records a change to a namespace's ACL, and
+	// DeleteNamespaceEvent its removal. Their KeyID is the namespace prefix.
+	UpdateNamespaceEvent AuditEventType = "namespace_access"
+	DeleteNamespaceEvent AuditEventType = "namespace_delete"
+)
+
+// AuditEvent is a single entry in the audit trail of a key. Events are hash
+// chained: Hash covers every other field of the event, including PrevHash,
+// which is the Hash of the event with the previous Sequence number.
+// RequestID is set on events that belong to an approval request.
+type AuditEvent struct {
+	Sequence   uint64         `json:"seq"`
+	Timestamp  int64          `json:"ts"`
+	Type       AuditEventType `json:"type"`
+	Principal  string         `json:"principal"`
+	Principals []string       `json:"principals,omitempty"`
+	AuthType   string         `json:"auth_type"`
+	KeyID      string         `json:"key_id"`
+	VersionIDs []uint64       `json:"version_ids,omitempty"`
+	OldACL     ACL            `json:"old_acl,omitempty"`
+	NewACL     ACL            `json:"new_acl,omitempty"`
+	OldStatus  *VersionStatus `json:"old_status,omitempty"`
+	NewStatus  *VersionStatus `json:"new_status,omitempty"`
+	RequestID  string         `json:"request_id,omitempty"`
+	PrevHash   string         `json:"prev_hash"`
+	Hash       string         `json:"hash"`
+}
+
+// ComputeHash returns the hash of the event for chaining. The Hash field
+// itself is not included.
+func (e AuditEvent) ComputeHash() (string, error) {
+	e.Hash = ""
+	b, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(b)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// AuditEventPage is one page of a key's audit history.
+type AuditEventPage struct {
+	Events []AuditEvent `json:"events"`
+	// Cursor fetches the next page when passed back to the server. It is
+	// empty on the last page.
+	Cursor string `json:"cursor"`
+}
+
+// WebhookEvents are the event types delivered to webhooks.
+var WebhookEvents = []AuditEventType{
+	CreateKeyEvent,
+	AddVersionEvent,
+	PromoteVersionEvent,
+	DeactivateVersionEvent,
+	UpdateAccessEvent,
+	DeleteKeyEvent,
+}
+
+// Webhook is a subscription to key lifecycle events. The server POSTs a JSON
+// encoded WebhookEvent to URL for each event that matches, signed with
+// Secret in the WebhookSignatureHeader.
+type Webhook struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// KeyID limits the webhook to one key. Webhooks without one receive
+	// events for every key.
+	KeyID string `json:"key_id,omitempty"`
+	// Tags limits the webhook to keys that have all of the tags.
+	Tags []string `json:"tags,omitempty"`
+	// Events limits the webhook to the given event types. By default every
+	// type in WebhookEvents is delivered.
+	Events       []AuditEventType `json:"events,omitempty"`
+	CreatedBy    string           `json:"created_by"`
+	CreationTime int64            `json:"ts"`
+	// Secret is generated by the server and only returned when the webhook
+	// is created.
+	Secret string `json:"secret,omitempty"`
+}
+
+// Validate checks that the URL and event types of the webhook are valid.
+func (w *Webhook) Validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ErrInvalidWebhookURL
+	}
+	for _, t := range w.Events {
+		known := false
+		for _, u := range WebhookEvents {
+			known = known || t == u
+		}
+		if !known {
+			return ErrInvalidWebhookEvent
+		}
+	}
+	return nil
+}
+
+// Matches reports whether the webhook wants an event of type t for a key
+// with the given ID and tags.
+func (w *Webhook) Matches(t AuditEventType, keyID string, tags []string) bool {
+	if w.KeyID != "" && w.KeyID != keyID {
+		return false
+	}
+	events := w.Events
+	if len(events) == 0 {
+		events = WebhookEvents
+	}
+	wanted := false
+	for _, u := range events {
+		wanted = wanted || t == u
+	}
+	if !wanted {
+		return false
+	}
+	for _, tag := range w.Tags {
+		found := false
+		for _, u := range tags {
+			found = found || tag == u
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// WebhookEvent is the payload delivered to a webhook. It describes the
+// change from the audit event without any key data.
+type WebhookEvent struct {
+	// ID identifies the delivery, so receivers can ignore retries of a
+	// delivery they have already handled.
+	ID         string         `json:"id"`
+	WebhookID  string         `json:"webhook_id"`
+	Timestamp  int64          `json:"ts"`
+	Type       AuditEventType `json:"type"`
+	KeyID      string         `json:"key_id"`
+	Principal  string         `json:"principal"`
+	VersionIDs []uint64       `json:"version_ids,omitempty"`
+	OldACL     ACL            `json:"old_acl,omitempty"`
+	NewACL     ACL            `json:"new_acl,omitempty"`
+	OldStatus  *VersionStatus `json:"old_status,omitempty"`
+	NewStatus  *VersionStatus `json:"new_status,omitempty"`
+	RequestID  string         `json:"request_id,omitempty"`
+}
+
+// WebhookDeadLetter records an event that could not be delivered to a
+// webhook after every retry.
+type WebhookDeadLetter struct {
+	Event    WebhookEvent `json:"event"`
+	Attempts int          `json:"attempts"`
+	// LastError is the error or HTTP status of the last attempt.
+	LastError string `json:"last_error"`
+	FailedAt  int64  `json:"failed_at"`
+}
+
+// Headers set on webhook deliveries. The signature is the hex encoded
+// HMAC-SHA256 of the request body keyed with the webhook's secret.
+const (
+	WebhookSignatureHeader = "X-Knox-Signature"
+	WebhookEventHeader     = "X-Knox-Event"
+	WebhookDeliveryHeader  = "X-Knox-Delivery"
+)
+
+// WebhookSignature returns the signature of a webhook payload. Receivers
+// should compare it to the WebhookSignatureHeader with hmac.Equal.
+func WebhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// HistoryOptions filters the audit history of a key.
+type HistoryOptions struct {
+	// Cursor is the Cursor of the previous AuditEventPage.
+	Cursor string
+	// Since and Until bound event timestamps (in nanoseconds) as [Since, Until).
+	// Zero leaves that side unbounded.
+	Since int64
+	Until int64
+	// Types restricts the events to the given types. By default every event
+	// except reads is returned.
+	Types []AuditEventType
+	// Limit is the maximum page size. Zero uses the server default.
+	Limit int
+}
+
+// KeyIDPage is one page of key IDs from a key search.
+type KeyIDPage struct {
+	KeyIDs []string `json:"keys"`
+	// Cursor fetches the next page when passed back to the server. It is
+	// empty on the last page.
+	Cursor string `json:"cursor"`
+}
+
+// PrincipalSpec describes a principal whose access is evaluated without
+// authenticating as it, e.g. for access reviews.
+type PrincipalSpec struct {
+	// Type is User, Machine, or Service.
+	Type PrincipalType `json:"type"`
+	// ID is the username, hostname, or SPIFFE ID.
+	ID string `json:"id"`
+	// Groups are the groups a User is a member of.
+	Groups []string `json:"groups,omitempty"`
+}
+
+// AccessExplanation says whether a key grants access and which ACL entries
+// grant it.
+type AccessExplanation struct {
+	KeyID string `json:"id"`
+	// Principal is the ID of the principal evaluated, or empty if every
+	// principal was considered.
+	Principal  string     `json:"principal,omitempty"`
+	AccessType AccessType `json:"access"`
+	Granted    bool       `json:"granted"`
+	GrantedBy  ACL        `json:"granted_by"`
+}
+
+// KeySearchOptions filters a key search. Keys are returned in ID order.
+type KeySearchOptions struct {
+	// Cursor is the Cursor of the previous KeyIDPage.
+	Cursor string
+	// Prefix only matches key IDs that start with it.
+	Prefix string
+	// Access only matches keys the caller has at least this access to. None
+	// matches every key.
+	Access AccessType
+	// Principal evaluates Access for the given principal instead of the
+	// caller. Access defaults to Read if it is set.
+	Principal *PrincipalSpec
+	// Team only matches keys owned by the team if it is not empty.
+	Team string
+	// Tags only matches keys that have all of the tags.
+	Tags []string
+	// Limit is the maximum page size. Zero uses the server default.
+	Limit int
+}
+
 // These are the error codes for use in server responses.
 const (
 	OKCode = iota
@@ -587,6 +1177,11 @@ const (
 	BadRequestDataCode
 	BadKeyFormatCode
 	BadPrincipalIdentifier
+	ApprovalPendingCode
+	ApprovalRequestDoesNotExistCode
+	SealedCode
+	WebhookDoesNotExistCode
+	NamespaceDoesNotExistCode
 )
 
 // Response is the format for responses from the api server.
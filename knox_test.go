@@ -3,7 +3,9 @@ package knox_test
 import (
 	"bytes"
 	"encoding/json"
+	"strings"
 	"testing"
+	"time"
 
 	. "github.com/pinterest/knox"
 )
@@ -269,6 +271,157 @@ func TestACLAdd(t *testing.T) {
 	}
 
 }
+func TestACLExpiry(t *testing.T) {
+	now := time.Now()
+	a1 := Access{ID: "testmachine", AccessType: Admin, Type: Machine}
+	a2 := Access{ID: "testmachine", AccessType: Read, Type: Machine, Expires: now.Add(time.Hour).UnixNano()}
+	a3 := Access{ID: "testmachine", AccessType: Read, Type: Machine, Expires: now.Add(-time.Hour).UnixNano()}
+	a4 := Access{ID: "testmachine2", AccessType: Read, Type: Machine, Expires: now.Add(-time.Hour).UnixNano()}
+
+	if a1.Expired(now) || a2.Expired(now) || !a3.Expired(now) {
+		t.Error("Unexpected expiry")
+	}
+
+	acl := ACL([]Access{a1})
+	acl1 := acl.Add(a2)
+	if len(acl1) != 1 || acl1[0].Expires != a2.Expires {
+		t.Error("Unexpected ACL for adding temporary access")
+	}
+	acl2 := acl1.Add(a3)
+	if len(acl2) != 0 {
+		t.Error("Unexpected ACL for adding expired access")
+	}
+	acl3 := acl.Add(a4)
+	if len(acl3) != 1 {
+		t.Error("Unexpected ACL for adding expired access")
+	}
+
+	pruned := ACL([]Access{a1, a4}).Prune(now)
+	if len(pruned) != 1 || pruned[0].ID != a1.ID {
+		t.Error("Unexpected ACL after pruning")
+	}
+
+	invalid := ACL([]Access{{ID: "testmachine", AccessType: Read, Type: Machine, Expires: -1}})
+	if invalid.Validate() != ErrACLInvalidExpiry {
+		t.Error("Negative expiry should not validate")
+	}
+
+	// Access without an expiry keeps the same JSON.
+	b, err := json.Marshal(a1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `{"type":"Machine","id":"testmachine","access":"Admin"}` {
+		t.Errorf("Unexpected JSON %s", b)
+	}
+	var a Access
+	if err := json.Unmarshal(b, &a); err != nil || a.Expires != 0 {
+		t.Errorf("Unexpected access %+v: %v", a, err)
+	}
+}
+
+func TestKeyMetadataValidate(t *testing.T) {
+	valid := KeyMetadata{Description: "a key", Team: "security", Tags: []string{"prod", "db"}}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	long := KeyMetadata{Description: strings.Repeat("a", 4097)}
+	if long.Validate() != ErrMetadataTooLarge {
+		t.Error("Long description should not validate")
+	}
+	for _, tags := range [][]string{{""}, {"a", "a"}, {strings.Repeat("a", 129)}} {
+		md := KeyMetadata{Tags: tags}
+		if md.Validate() != ErrInvalidTag {
+			t.Errorf("Tags %v should not validate", tags)
+		}
+	}
+
+	k := Key{ID: "test", VersionList: KeyVersionList{{ID: 1, Status: Primary}}, Metadata: &long}
+	k.VersionHash = k.VersionList.Hash()
+	if k.Validate() != ErrMetadataTooLarge {
+		t.Error("Key with invalid metadata should not validate")
+	}
+
+	c := valid.Copy()
+	c.Tags[0] = "dev"
+	if valid.Tags[0] != "prod" || !c.HasTag("dev") || c.HasTag("prod") {
+		t.Error("Copy shares tags with the original")
+	}
+}
+
+func TestKeyPolicyValidate(t *testing.T) {
+	gen := GeneratorSpec{Encoding: Base64Encoding, Length: 32}
+	valid := KeyPolicy{Rotation: &RotationPolicy{Generator: gen, Period: time.Hour, PromoteDelay: time.Minute}}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	for _, r := range []RotationPolicy{
+		{Generator: gen},
+		{Generator: gen, Period: time.Hour, PromoteDelay: time.Hour},
+		{Generator: gen, Period: time.Hour, GracePeriod: -time.Minute},
+	} {
+		p := KeyPolicy{Rotation: &r}
+		if p.Validate() != ErrInvalidRotationPolicy {
+			t.Errorf("Rotation %+v should not validate", r)
+		}
+	}
+	p := KeyPolicy{Rotation: &RotationPolicy{Generator: GeneratorSpec{Encoding: "base32", Length: 32}, Period: time.Hour}}
+	if p.Validate() != ErrInvalidGenerator {
+		t.Error("Unknown encoding should not validate")
+	}
+
+	c := valid.Copy()
+	c.Rotation.Period = 2 * time.Hour
+	if valid.Rotation.Period != time.Hour {
+		t.Error("Copy shares the rotation policy with the original")
+	}
+}
+
+func TestWebhookValidate(t *testing.T) {
+	valid := Webhook{URL: "https://example.com/hook", Events: []AuditEventType{PromoteVersionEvent}}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	for _, u := range []string{"", "example.com/hook", "ftp://example.com/hook", "https:///hook"} {
+		w := Webhook{URL: u}
+		if w.Validate() != ErrInvalidWebhookURL {
+			t.Errorf("URL %q should not validate", u)
+		}
+	}
+	w := Webhook{URL: "https://example.com/hook", Events: []AuditEventType{ReadKeyEvent}}
+	if w.Validate() != ErrInvalidWebhookEvent {
+		t.Error("Read events should not validate")
+	}
+}
+
+func TestWebhookMatches(t *testing.T) {
+	w := Webhook{}
+	if !w.Matches(CreateKeyEvent, "k1", nil) || w.Matches(ReadKeyEvent, "k1", nil) {
+		t.Error("Webhooks without filters should match every webhook event")
+	}
+	w = Webhook{KeyID: "k1", Tags: []string{"prod", "pci"}, Events: []AuditEventType{UpdateAccessEvent}}
+	if !w.Matches(UpdateAccessEvent, "k1", []string{"pci", "prod", "db"}) {
+		t.Error("Webhook should match")
+	}
+	if w.Matches(UpdateAccessEvent, "k2", []string{"pci", "prod"}) {
+		t.Error("Webhook should not match other keys")
+	}
+	if w.Matches(UpdateAccessEvent, "k1", []string{"prod"}) {
+		t.Error("Webhook should not match keys without every tag")
+	}
+	if w.Matches(PromoteVersionEvent, "k1", []string{"pci", "prod"}) {
+		t.Error("Webhook should not match other events")
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	// echo -n body | openssl dgst -sha256 -hmac secret
+	expected := "dc46983557fea127b43af721467eb9b3fde2338fe3e14f51952aa8478c13d355"
+	if sig := WebhookSignature("secret", []byte("body")); sig != expected {
+		t.Fatalf("%s does not equal %s", sig, expected)
+	}
+}
+
 func TestAccessTypeCanAccess(t *testing.T) {
 	if Read.CanAccess(Admin) || Read.CanAccess(Write) || !Read.CanAccess(Read) || !Read.CanAccess(None) {
 		t.Error("Read has incorrect access")
@@ -466,3 +619,53 @@ func TestPrincipalValidation(t *testing.T) {
 	validatePrincipal(Service, "spiffe://example.com/service", true)
 	validatePrincipal(ServicePrefix, "spiffe://example.com/prefix/", true)
 }
+
+func TestNamespaceValidate(t *testing.T) {
+	for _, prefix := range []string{"payments:", "payments:stripe:", "a_b:1:"} {
+		n := Namespace{Prefix: prefix, ACL: ACL{{Type: UserGroup, ID: "payments", AccessType: Admin}}}
+		if err := n.Validate(); err != nil {
+			t.Errorf("Prefix %q: %s is not nil", prefix, err)
+		}
+	}
+	for _, prefix := range []string{"", ":", "payments", "pay-ments:", "payments::", "payments:stripe"} {
+		n := Namespace{Prefix: prefix}
+		if n.Validate() != ErrInvalidNamespace {
+			t.Errorf("Prefix %q should not validate", prefix)
+		}
+	}
+	n := Namespace{Prefix: "payments:", ACL: ACL{{Type: User, ID: "alice", AccessType: None}}}
+	if n.Validate() != ErrACLContainsNone {
+		t.Error("ACL with None should not validate")
+	}
+}
+
+func TestNamespaceContains(t *testing.T) {
+	n := Namespace{Prefix: "payments:"}
+	for _, id := range []string{"payments:api_key", "payments:stripe:", "payments:stripe:api_key"} {
+		if !n.Contains(id) {
+			t.Errorf("%s should be in %s", id, n.Prefix)
+		}
+	}
+	for _, id := range []string{"payments:", "payments", "payments_api_key", "ops:payments:api_key"} {
+		if n.Contains(id) {
+			t.Errorf("%s should not be in %s", id, n.Prefix)
+		}
+	}
+}
+
+func TestKeyEffectiveACL(t *testing.T) {
+	own := Access{Type: User, ID: "alice", AccessType: Admin}
+	inherited := Access{Type: Machine, ID: "payments001", AccessType: Read}
+	k := Key{ACL: ACL{own}}
+	if len(k.EffectiveACL()) != 1 {
+		t.Fatalf("%v does not equal %v", k.EffectiveACL(), k.ACL)
+	}
+	k.InheritedACL = ACL{inherited}
+	acl := k.EffectiveACL()
+	if len(acl) != 2 || acl[0] != own || acl[1] != inherited {
+		t.Fatalf("%v does not equal [%v %v]", acl, own, inherited)
+	}
+	if len(k.ACL) != 1 {
+		t.Fatalf("%v was changed", k.ACL)
+	}
+}
@@ -5,12 +5,15 @@ import (
 	"math/rand"
 	"net/http"
 	"os"
+	"sort"
 	"time"
 
 	"github.com/gorilla/mux"
 
 	"github.com/pinterest/knox"
 	"github.com/pinterest/knox/log"
+	"github.com/pinterest/knox/server/audit"
+	"github.com/pinterest/knox/server/auth"
 	"github.com/pinterest/knox/server/keydb"
 )
 
@@ -33,19 +36,24 @@ type httpErrResp struct {
 
 // HTTPErrMap is a mapping from err subcodes to the http err response that will be returned.
 var HTTPErrMap = map[int]*httpErrResp{
-	knox.NoKeyIDCode:                   {http.StatusBadRequest, "Missing Key ID"},
-	knox.InternalServerErrorCode:       {http.StatusInternalServerError, "Internal Server Error"},
-	knox.KeyIdentifierExistsCode:       {http.StatusBadRequest, "Key identifer exists"},
-	knox.KeyVersionDoesNotExistCode:    {http.StatusNotFound, "Key version does not exist"},
-	knox.KeyIdentifierDoesNotExistCode: {http.StatusNotFound, "Key identifer does not exist"},
-	knox.UnauthenticatedCode:           {http.StatusUnauthorized, "User or machine is not authenticated"},
-	knox.UnauthorizedCode:              {http.StatusForbidden, "User or machine not authorized"},
-	knox.NotYetImplementedCode:         {http.StatusNotImplemented, "Not yet implemented"},
-	knox.NotFoundCode:                  {http.StatusNotFound, "Route not found"},
-	knox.NoKeyDataCode:                 {http.StatusBadRequest, "Missing Key Data"},
-	knox.BadRequestDataCode:            {http.StatusBadRequest, "Bad request format"},
-	knox.BadKeyFormatCode:              {http.StatusBadRequest, "Key ID contains unsupported characters"},
-	knox.BadPrincipalIdentifier:        {http.StatusBadRequest, "Invalid principal identifier"},
+	knox.NoKeyIDCode:                     {http.StatusBadRequest, "Missing Key ID"},
+	knox.InternalServerErrorCode:         {http.StatusInternalServerError, "Internal Server Error"},
+	knox.KeyIdentifierExistsCode:         {http.StatusBadRequest, "Key identifer exists"},
+	knox.KeyVersionDoesNotExistCode:      {http.StatusNotFound, "Key version does not exist"},
+	knox.KeyIdentifierDoesNotExistCode:   {http.StatusNotFound, "Key identifer does not exist"},
+	knox.UnauthenticatedCode:             {http.StatusUnauthorized, "User or machine is not authenticated"},
+	knox.UnauthorizedCode:                {http.StatusForbidden, "User or machine not authorized"},
+	knox.NotYetImplementedCode:           {http.StatusNotImplemented, "Not yet implemented"},
+	knox.NotFoundCode:                    {http.StatusNotFound, "Route not found"},
+	knox.NoKeyDataCode:                   {http.StatusBadRequest, "Missing Key Data"},
+	knox.BadRequestDataCode:              {http.StatusBadRequest, "Bad request format"},
+	knox.BadKeyFormatCode:                {http.StatusBadRequest, "Key ID contains unsupported characters"},
+	knox.BadPrincipalIdentifier:          {http.StatusBadRequest, "Invalid principal identifier"},
+	knox.ApprovalPendingCode:             {http.StatusAccepted, "Request is pending approval"},
+	knox.ApprovalRequestDoesNotExistCode: {http.StatusNotFound, "Approval request does not exist"},
+	knox.SealedCode:                      {http.StatusServiceUnavailable, "Server is sealed"},
+	knox.WebhookDoesNotExistCode:         {http.StatusNotFound, "Webhook does not exist"},
+	knox.NamespaceDoesNotExistCode:       {http.StatusNotFound, "Namespace does not exist"},
 }
 
 func combine(f, g func(http.HandlerFunc) http.HandlerFunc) func(http.HandlerFunc) http.HandlerFunc {
@@ -143,6 +151,8 @@ type route struct {
 	path       string
 	method     string
 	parameters []parameter
+	// allowSealed routes can be used while the server is sealed.
+	allowSealed bool
 }
 
 func writeErr(apiErr *httpError) http.HandlerFunc {
@@ -188,6 +198,10 @@ func writeData(w http.ResponseWriter, data interface{}) {
 
 // ServeHTTP runs API middleware and calls the underlying handler function.
 func (r route) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !r.allowSealed && sealer != nil && sealer.Status().Sealed {
+		writeErr(errF(knox.SealedCode, "Server is sealed until enough operators submit their unseal shares"))(w, req)
+		return
+	}
 	db := getDB(req)
 	principal := GetPrincipal(req)
 	ps := GetParams(req)
@@ -219,6 +233,95 @@ func AddPrincipalValidator(validator knox.PrincipalValidator) {
 	extraPrincipalValidators = append(extraPrincipalValidators, validator)
 }
 
+// How long approval requests wait for a second Admin before they expire.
+var approvalTTL = 24 * time.Hour
+
+// SetApprovalTTL sets how long approval requests wait for a second Admin
+// before they expire.
+func SetApprovalTTL(d time.Duration) {
+	approvalTTL = d
+}
+
+// The sealer that holds the master key, if the server supports sealing.
+var sealer *Sealer
+
+// SetSealer makes key routes unavailable while s is sealed and enables the
+// unseal and seal routes. s must also be the cryptor given to GetRouter.
+func SetSealer(s *Sealer) {
+	sealer = s
+}
+
+// Principals other than the Admins in the default access list that can submit
+// unseal shares.
+var unsealOperators []knox.Access
+
+// AddUnsealOperator lets principals matching a submit unseal shares. Admins in
+// the default access list can always submit them.
+func AddUnsealOperator(a *knox.Access) {
+	unsealOperators = append(unsealOperators, *a)
+}
+
+// The audit log that key reads and mutations are recorded to. Auditing is
+// disabled unless this is set by the main function.
+var auditLogger *audit.Logger
+
+// SetAuditLogger records every key read and mutation to the given audit logger.
+func SetAuditLogger(l *audit.Logger) {
+	auditLogger = l
+}
+
+// The webhooks that key lifecycle events are sent to. Webhooks are disabled
+// unless this is set by the main function.
+var webhooks *Webhooks
+
+// SetWebhooks sends key lifecycle events to w and enables the webhook routes.
+// w must be run by the main function for events to be delivered.
+func SetWebhooks(w *Webhooks) {
+	webhooks = w
+}
+
+// recordEvent fills in the principal information for an audit event, records
+// it and sends it to webhooks. Failures are logged rather than failing the
+// request.
+func recordEvent(principal knox.Principal, e knox.AuditEvent) {
+	if auditLogger == nil && webhooks == nil {
+		return
+	}
+	e.Principal = principal.GetID()
+	e.AuthType = principal.Type()
+	if mux, ok := principal.(knox.PrincipalMux); ok {
+		e.Principals = mux.GetIDs()
+		sort.Strings(e.Principals)
+	}
+	writeEvent(e)
+}
+
+// recordSystemEvent records an audit event for an operation the server made
+// on its own, such as purging deleted keys. The component doing the work is
+// recorded as the principal.
+func recordSystemEvent(component string, e knox.AuditEvent) {
+	if auditLogger == nil && webhooks == nil {
+		return
+	}
+	e.Principal = component
+	e.AuthType = systemAuthType
+	writeEvent(e)
+}
+
+// systemAuthType is the AuthType of audit events recorded by recordSystemEvent.
+const systemAuthType = "system"
+
+func writeEvent(e knox.AuditEvent) {
+	if auditLogger != nil {
+		if err := auditLogger.Record(e); err != nil {
+			log.Printf("Failed to record %s audit event for %s: %s", e.Type, e.KeyID, err.Error())
+		}
+	}
+	if webhooks != nil {
+		webhooks.Notify(e)
+	}
+}
+
 // newKeyVersion creates a new KeyVersion with correctly set defaults.
 func newKeyVersion(d []byte, s knox.VersionStatus) knox.KeyVersion {
 	version := knox.KeyVersion{}
@@ -230,18 +333,46 @@ func newKeyVersion(d []byte, s knox.VersionStatus) knox.KeyVersion {
 	return version
 }
 
-// NewKey creates a new Key with correctly set defaults.
+// newApprovalRequest creates an ApprovalRequest by the principal that expires
+// after the approval TTL. Its ID is random so that it cannot be guessed by
+// anyone who has not been told about the request.
+func newApprovalRequest(keyID string, op knox.ApprovalOperation, u knox.Principal) (knox.ApprovalRequest, error) {
+	id, err := randomHex(16)
+	if err != nil {
+		return knox.ApprovalRequest{}, err
+	}
+	now := time.Now()
+	return knox.ApprovalRequest{
+		ID:           id,
+		KeyID:        keyID,
+		Operation:    op,
+		RequestedBy:  u.GetID(),
+		CreationTime: now.UnixNano(),
+		Expires:      now.Add(approvalTTL).UnixNano(),
+	}, nil
+}
+
+// NewKey creates a new Key with correctly set defaults. Users are given Admin
+// access to the keys they create; other principals can only create keys in
+// namespaces they administer, so they get their access from the namespace.
 func newKey(id string, acl knox.ACL, d []byte, u knox.Principal) knox.Key {
 	key := knox.Key{}
 	key.ID = id
 
-	creatorAccess := knox.Access{ID: u.GetID(), AccessType: knox.Admin, Type: knox.User}
-	key.ACL = acl.Add(creatorAccess)
+	key.ACL = acl
+	if auth.IsUser(u) {
+		creatorAccess := knox.Access{ID: u.GetID(), AccessType: knox.Admin, Type: knox.User}
+		key.ACL = acl.Add(creatorAccess)
+	}
 	for _, a := range defaultAccess {
 		key.ACL = key.ACL.Add(a)
 	}
 
 	key.VersionList = []knox.KeyVersion{newKeyVersion(d, knox.Primary)}
 	key.VersionHash = key.VersionList.Hash()
+	key.Metadata = &knox.KeyMetadata{
+		CreatedBy:    u.GetID(),
+		CreationTime: key.VersionList[0].CreationTime,
+	}
 	return key
 }
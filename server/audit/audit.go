@@ -0,0 +1,229 @@
+// Package audit records a tamper-evident trail of operations on knox keys.
+package audit
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+var (
+	ErrChainBroken  = fmt.Errorf("Audit event does not chain to the previous event")
+	ErrHashMismatch = fmt.Errorf("Audit event hash does not match its contents")
+	ErrOutOfOrder   = fmt.Errorf("Audit events are not in sequence order")
+	ErrNoReader     = fmt.Errorf("Audit sink does not support queries")
+)
+
+// Sink is where audit events are persisted.
+//
+// Sinks are written to by a single Logger which assigns sequence numbers and
+// hashes, so a Sink should only deal with storage.
+type Sink interface {
+	// Write persists the event. It must fail if an event with the same
+	// sequence number has already been written.
+	Write(e *knox.AuditEvent) error
+	// Last returns the event with the highest sequence number, or nil if
+	// there are no events.
+	Last() (*knox.AuditEvent, error)
+}
+
+// Query selects the audit events of a single key.
+type Query struct {
+	KeyID string
+	// After only selects events with a greater sequence number.
+	After uint64
+	// Since and Until bound the event timestamps as [Since, Until). A zero
+	// value leaves that side unbounded.
+	Since int64
+	Until int64
+	// Types only selects events of the given types if it is not empty.
+	Types []knox.AuditEventType
+	// Limit is the maximum number of events to return if greater than zero.
+	Limit int
+}
+
+// Matches reports whether the event is selected by the query, ignoring Limit.
+func (q Query) Matches(e *knox.AuditEvent) bool {
+	if e.KeyID != q.KeyID || e.Sequence <= q.After {
+		return false
+	}
+	if e.Timestamp < q.Since || (q.Until != 0 && e.Timestamp >= q.Until) {
+		return false
+	}
+	if len(q.Types) == 0 {
+		return true
+	}
+	for _, t := range q.Types {
+		if e.Type == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Reader is implemented by sinks that can be queried for past events.
+type Reader interface {
+	// Query returns the selected events in sequence order.
+	Query(q Query) ([]knox.AuditEvent, error)
+}
+
+// filterEvents applies the query to events that are in sequence order.
+func filterEvents(events []knox.AuditEvent, q Query) []knox.AuditEvent {
+	out := []knox.AuditEvent{}
+	for i := range events {
+		if q.Limit > 0 && len(out) == q.Limit {
+			break
+		}
+		if q.Matches(&events[i]) {
+			out = append(out, events[i])
+		}
+	}
+	return out
+}
+
+// Logger assigns sequence numbers to audit events, chains them together by
+// hash, and writes them to a Sink.
+type Logger struct {
+	sync.Mutex
+	sink Sink
+	last *knox.AuditEvent
+	now  func() time.Time
+}
+
+// NewLogger creates a Logger that continues the chain already in the sink.
+func NewLogger(sink Sink) (*Logger, error) {
+	last, err := sink.Last()
+	if err != nil {
+		return nil, err
+	}
+	return &Logger{sink: sink, last: last, now: time.Now}, nil
+}
+
+// Record fills in the sequence, timestamp, and hash fields of the event and
+// writes it to the sink.
+func (l *Logger) Record(e knox.AuditEvent) error {
+	l.Lock()
+	defer l.Unlock()
+	err := l.write(&e)
+	if err == nil {
+		return nil
+	}
+	// Another writer (e.g. a second server sharing the sink) may have extended
+	// the chain. Pick up its last event and try once more.
+	last, lastErr := l.sink.Last()
+	if lastErr != nil || last == nil || (l.last != nil && last.Sequence == l.last.Sequence) {
+		return err
+	}
+	l.last = last
+	return l.write(&e)
+}
+
+func (l *Logger) write(e *knox.AuditEvent) error {
+	e.Sequence = 1
+	e.PrevHash = ""
+	if l.last != nil {
+		e.Sequence = l.last.Sequence + 1
+		e.PrevHash = l.last.Hash
+	}
+	e.Timestamp = l.now().UnixNano()
+	hash, err := e.ComputeHash()
+	if err != nil {
+		return err
+	}
+	e.Hash = hash
+	if err := l.sink.Write(e); err != nil {
+		return err
+	}
+	l.last = e
+	return nil
+}
+
+// Query returns the events selected by q if the sink supports queries.
+func (l *Logger) Query(q Query) ([]knox.AuditEvent, error) {
+	r, ok := l.sink.(Reader)
+	if !ok {
+		return nil, ErrNoReader
+	}
+	return r.Query(q)
+}
+
+// Verify checks that the events are a contiguous, unmodified run of the
+// audit chain. The first event is trusted as the start of the run unless it
+// is the first event ever written, in which case it must not chain to anything.
+func Verify(events []knox.AuditEvent) error {
+	for i, e := range events {
+		hash, err := e.ComputeHash()
+		if err != nil {
+			return err
+		}
+		if hash != e.Hash {
+			return fmt.Errorf("event %d: %w", e.Sequence, ErrHashMismatch)
+		}
+		if i == 0 {
+			if e.Sequence == 1 && e.PrevHash != "" {
+				return fmt.Errorf("event %d: %w", e.Sequence, ErrChainBroken)
+			}
+			continue
+		}
+		prev := events[i-1]
+		if e.Sequence != prev.Sequence+1 {
+			return fmt.Errorf("event %d: %w", e.Sequence, ErrOutOfOrder)
+		}
+		if e.PrevHash != prev.Hash {
+			return fmt.Errorf("event %d: %w", e.Sequence, ErrChainBroken)
+		}
+	}
+	return nil
+}
+
+// NewMemorySink creates a MemorySink with no events.
+func NewMemorySink() *MemorySink {
+	return &MemorySink{}
+}
+
+// MemorySink keeps audit events in memory. It is written for testing and
+// simple dev work.
+type MemorySink struct {
+	sync.RWMutex
+	events []knox.AuditEvent
+}
+
+// Write appends the event.
+func (s *MemorySink) Write(e *knox.AuditEvent) error {
+	s.Lock()
+	defer s.Unlock()
+	if n := len(s.events); n > 0 && s.events[n-1].Sequence >= e.Sequence {
+		return ErrOutOfOrder
+	}
+	s.events = append(s.events, *e)
+	return nil
+}
+
+// Last returns the most recently written event.
+func (s *MemorySink) Last() (*knox.AuditEvent, error) {
+	s.RLock()
+	defer s.RUnlock()
+	if len(s.events) == 0 {
+		return nil, nil
+	}
+	e := s.events[len(s.events)-1]
+	return &e, nil
+}
+
+// Events returns a copy of all events in sequence order.
+func (s *MemorySink) Events() []knox.AuditEvent {
+	s.RLock()
+	defer s.RUnlock()
+	events := make([]knox.AuditEvent, len(s.events))
+	copy(events, s.events)
+	return events
+}
+
+// Query returns the selected events.
+func (s *MemorySink) Query(q Query) ([]knox.AuditEvent, error) {
+	s.RLock()
+	defer s.RUnlock()
+	return filterEvents(s.events, q), nil
+}
@@ -0,0 +1,210 @@
+package audit
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/pinterest/knox"
+)
+
+func recordEvents(t *testing.T, l *Logger, keyID string, n int) {
+	for i := 0; i < n; i++ {
+		err := l.Record(knox.AuditEvent{Type: knox.ReadKeyEvent, KeyID: keyID, Principal: "testuser"})
+		if err != nil {
+			t.Fatalf("%s is not nil", err)
+		}
+	}
+}
+
+func TestLoggerChain(t *testing.T) {
+	s := NewMemorySink()
+	l, err := NewLogger(s)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	recordEvents(t, l, "k1", 3)
+
+	events := s.Events()
+	if len(events) != 3 {
+		t.Fatalf("%d does not equal 3", len(events))
+	}
+	for i, e := range events {
+		if e.Sequence != uint64(i+1) {
+			t.Fatalf("%d does not equal %d", e.Sequence, i+1)
+		}
+		if e.Timestamp == 0 || e.Hash == "" {
+			t.Fatal("timestamp and hash should be set")
+		}
+	}
+	if events[0].PrevHash != "" {
+		t.Fatalf("first event should not chain, got %q", events[0].PrevHash)
+	}
+	if err := Verify(events); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if err := Verify(events[1:]); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	s := NewMemorySink()
+	l, err := NewLogger(s)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	recordEvents(t, l, "k1", 4)
+
+	modified := s.Events()
+	modified[1].Principal = "someoneelse"
+	if err := Verify(modified); !errors.Is(err, ErrHashMismatch) {
+		t.Fatalf("%s does not equal %s", err, ErrHashMismatch)
+	}
+
+	removed := s.Events()
+	removed = append(removed[:1], removed[2:]...)
+	if err := Verify(removed); !errors.Is(err, ErrOutOfOrder) {
+		t.Fatalf("%s does not equal %s", err, ErrOutOfOrder)
+	}
+
+	// Rewriting the sequence numbers and hashes still breaks the chain.
+	rechained := s.Events()
+	rechained = append(rechained[:1], rechained[2:]...)
+	for i := 1; i < len(rechained); i++ {
+		rechained[i].Sequence = uint64(i + 1)
+		rechained[i].Hash, _ = rechained[i].ComputeHash()
+	}
+	if err := Verify(rechained); !errors.Is(err, ErrChainBroken) {
+		t.Fatalf("%s does not equal %s", err, ErrChainBroken)
+	}
+}
+
+func TestLoggerRecoversFromSharedSink(t *testing.T) {
+	s := NewMemorySink()
+	l1, err := NewLogger(s)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	l2, err := NewLogger(s)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	recordEvents(t, l1, "k1", 2)
+	recordEvents(t, l2, "k2", 1)
+	recordEvents(t, l1, "k1", 1)
+
+	events := s.Events()
+	if len(events) != 4 {
+		t.Fatalf("%d does not equal 4", len(events))
+	}
+	if err := Verify(events); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "audit.log")
+
+	s, err := NewFileSink(fn)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	l, err := NewLogger(s)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	recordEvents(t, l, "k1", 2)
+	s.Close()
+
+	// Reopening the file continues the existing chain.
+	s, err = NewFileSink(fn)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	defer s.Close()
+	l, err = NewLogger(s)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	recordEvents(t, l, "k2", 1)
+
+	events, err := s.Events()
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("%d does not equal 3", len(events))
+	}
+	if events[2].KeyID != "k2" || events[2].Sequence != 3 {
+		t.Fatalf("unexpected last event %+v", events[2])
+	}
+	if err := Verify(events); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	s := NewMemorySink()
+	l, err := NewLogger(s)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	recordEvents(t, l, "k1", 2)
+	recordEvents(t, l, "k2", 1)
+	err = l.Record(knox.AuditEvent{Type: knox.DeleteKeyEvent, KeyID: "k1", Principal: "testuser"})
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+
+	events, err := l.Query(Query{KeyID: "k1"})
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("%d does not equal 3", len(events))
+	}
+
+	events, err = l.Query(Query{KeyID: "k1", After: 1, Limit: 1})
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(events) != 1 || events[0].Sequence != 2 {
+		t.Fatalf("unexpected events %+v", events)
+	}
+
+	events, err = l.Query(Query{KeyID: "k1", Types: []knox.AuditEventType{knox.DeleteKeyEvent}})
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(events) != 1 || events[0].Sequence != 4 {
+		t.Fatalf("unexpected events %+v", events)
+	}
+
+	events, err = l.Query(Query{KeyID: "k1", Until: events[0].Timestamp})
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	for _, e := range events {
+		if e.Type == knox.DeleteKeyEvent {
+			t.Fatalf("unexpected event %+v", e)
+		}
+	}
+
+	_, err = (&Logger{sink: noReaderSink{}}).Query(Query{KeyID: "k1"})
+	if err != ErrNoReader {
+		t.Fatalf("%s does not equal %s", err, ErrNoReader)
+	}
+}
+
+type noReaderSink struct{}
+
+func (noReaderSink) Write(e *knox.AuditEvent) error  { return nil }
+func (noReaderSink) Last() (*knox.AuditEvent, error) { return nil, nil }
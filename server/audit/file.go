@@ -0,0 +1,110 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/pinterest/knox"
+)
+
+// FileSink writes audit events to a file as newline delimited JSON.
+type FileSink struct {
+	sync.Mutex
+	path string
+	f    *os.File
+	last *knox.AuditEvent
+}
+
+// NewFileSink opens (or creates) the audit log at path for appending.
+func NewFileSink(path string) (*FileSink, error) {
+	s := &FileSink{path: path}
+	events, err := s.Events()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(events) > 0 {
+		s.last = &events[len(events)-1]
+	}
+	s.f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Write appends the event to the file and syncs it to disk.
+func (s *FileSink) Write(e *knox.AuditEvent) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.last != nil && s.last.Sequence >= e.Sequence {
+		return ErrOutOfOrder
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if _, err := s.f.Write(b); err != nil {
+		return err
+	}
+	if err := s.f.Sync(); err != nil {
+		return err
+	}
+	last := *e
+	s.last = &last
+	return nil
+}
+
+// Last returns the most recently written event.
+func (s *FileSink) Last() (*knox.AuditEvent, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.last == nil {
+		return nil, nil
+	}
+	e := *s.last
+	return &e, nil
+}
+
+// Events reads every event in the file in the order they were written.
+func (s *FileSink) Events() ([]knox.AuditEvent, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var events []knox.AuditEvent
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var e knox.AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", s.path, line, err.Error())
+		}
+		events = append(events, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// Query reads the file and returns the selected events.
+func (s *FileSink) Query(q Query) ([]knox.AuditEvent, error) {
+	events, err := s.Events()
+	if err != nil {
+		return nil, err
+	}
+	return filterEvents(events, q), nil
+}
+
+// Close closes the underlying file.
+func (s *FileSink) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.f.Close()
+}
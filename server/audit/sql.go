@@ -0,0 +1,147 @@
+package audit
+
+import (
+	"database/sql"
+	"encoding/json"
+	"math"
+
+	"github.com/pinterest/knox"
+)
+
+// SQLSink stores audit events in a table next to the keydb tables.
+type SQLSink struct {
+	writeStmt *sql.Stmt
+	lastStmt  *sql.Stmt
+	queryStmt *sql.Stmt
+}
+
+// sqlQueryBatch is the number of rows read at a time when querying events.
+const sqlQueryBatch = 500
+
+var sqlCreateAuditEvents = `CREATE TABLE IF NOT EXISTS audit_events (
+	seq BIGINT PRIMARY KEY,
+	ts BIGINT NOT NULL,
+	type VARCHAR(64) NOT NULL,
+	key_id VARCHAR(512) NOT NULL,
+	event TEXT NOT NULL
+);`
+
+// NewPostgreSQLSink will create a SQLSink with the necessary statements for using postgres.
+func NewPostgreSQLSink(sqlDB *sql.DB) (*SQLSink, error) {
+	s := &SQLSink{}
+	var err error
+	_, err = sqlDB.Exec(sqlCreateAuditEvents)
+	if err != nil {
+		return nil, err
+	}
+	s.writeStmt, err = sqlDB.Prepare("INSERT INTO audit_events (seq, ts, type, key_id, event) VALUES ($1,$2,$3,$4,$5)")
+	if err != nil {
+		return nil, err
+	}
+	s.lastStmt, err = sqlDB.Prepare("SELECT event FROM audit_events ORDER BY seq DESC LIMIT 1")
+	if err != nil {
+		return nil, err
+	}
+	s.queryStmt, err = sqlDB.Prepare("SELECT seq, event FROM audit_events WHERE key_id=$1 AND seq>$2 AND ts>=$3 AND ts<$4 ORDER BY seq LIMIT $5")
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewSQLSink creates a table and prepared statements suitable for mysql and sqlite databases.
+func NewSQLSink(sqlDB *sql.DB) (*SQLSink, error) {
+	s := &SQLSink{}
+	var err error
+	_, err = sqlDB.Exec(sqlCreateAuditEvents)
+	if err != nil {
+		return nil, err
+	}
+	s.writeStmt, err = sqlDB.Prepare("INSERT INTO audit_events (seq, ts, type, key_id, event) VALUES (?,?,?,?,?)")
+	if err != nil {
+		return nil, err
+	}
+	s.lastStmt, err = sqlDB.Prepare("SELECT event FROM audit_events ORDER BY seq DESC LIMIT 1")
+	if err != nil {
+		return nil, err
+	}
+	s.queryStmt, err = sqlDB.Prepare("SELECT seq, event FROM audit_events WHERE key_id=? AND seq>? AND ts>=? AND ts<? ORDER BY seq LIMIT ?")
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Write inserts the event. The sequence number is the primary key, so two
+// writers racing to extend the chain cannot both succeed.
+func (s *SQLSink) Write(e *knox.AuditEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = s.writeStmt.Exec(e.Sequence, e.Timestamp, string(e.Type), e.KeyID, b)
+	return err
+}
+
+// Last returns the event with the highest sequence number.
+func (s *SQLSink) Last() (*knox.AuditEvent, error) {
+	var b []byte
+	err := s.lastStmt.QueryRow().Scan(&b)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var e knox.AuditEvent
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// Query returns the selected events. Key, sequence, and time filters are
+// applied by the database; type filters are applied as rows are read.
+func (s *SQLSink) Query(q Query) ([]knox.AuditEvent, error) {
+	until := q.Until
+	if until == 0 {
+		until = math.MaxInt64
+	}
+	events := []knox.AuditEvent{}
+	after := q.After
+	for {
+		rows, err := s.queryStmt.Query(q.KeyID, after, q.Since, until, sqlQueryBatch)
+		if err != nil {
+			return nil, err
+		}
+		n := 0
+		for rows.Next() {
+			n++
+			var b []byte
+			if err := rows.Scan(&after, &b); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			var e knox.AuditEvent
+			if err := json.Unmarshal(b, &e); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if q.Matches(&e) {
+				events = append(events, e)
+				if q.Limit > 0 && len(events) == q.Limit {
+					rows.Close()
+					return events, nil
+				}
+			}
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+		if n < sqlQueryBatch {
+			return events, nil
+		}
+	}
+}
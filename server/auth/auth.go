@@ -315,6 +315,23 @@ func NewService(domain string, path string) knox.Principal {
 	return service{domain, path}
 }
 
+// NewServiceFromID creates a service principal from its SPIFFE ID.
+func NewServiceFromID(spiffeID string) (knox.Principal, error) {
+	return spiffeToPrincipal([]string{spiffeID})
+}
+
+// GrantingEntries returns the entries of the ACL that each give the principal
+// at least the given access on their own.
+func GrantingEntries(p knox.Principal, acl knox.ACL, t knox.AccessType) knox.ACL {
+	granting := knox.ACL{}
+	for _, a := range acl {
+		if p.CanAccess(knox.ACL{a}, t) {
+			granting = append(granting, a)
+		}
+	}
+	return granting
+}
+
 // User represents an LDAP user and the AuthProvider to allow group information
 type user struct {
 	ID     string
@@ -336,8 +353,13 @@ func (u user) Type() string {
 
 // CanAccess determines if a User can access an object represented by the ACL
 // with a certain AccessType. It compares LDAP username and LDAP group.
+// Expired entries are ignored.
 func (u user) CanAccess(acl knox.ACL, t knox.AccessType) bool {
+	now := time.Now()
 	for _, a := range acl {
+		if a.Expired(now) {
+			continue
+		}
 		switch a.Type {
 		case knox.User:
 			if a.ID == u.ID && a.AccessType.CanAccess(t) {
@@ -366,8 +388,13 @@ func (m machine) Type() string {
 
 // CanAccess determines if a Machine can access an object represented by the ACL
 // with a certain AccessType. It compares Machine hostname and hostname prefix.
+// Expired entries are ignored.
 func (m machine) CanAccess(acl knox.ACL, t knox.AccessType) bool {
+	now := time.Now()
 	for _, a := range acl {
+		if a.Expired(now) {
+			continue
+		}
 		switch a.Type {
 		case knox.Machine:
 			if a.ID == string(m) && a.AccessType.CanAccess(t) {
@@ -401,8 +428,13 @@ func (s service) Type() string {
 
 // CanAccess determines if a Service can access an object represented by the ACL
 // with a certain AccessType. It compares Service id and id prefix.
+// Expired entries are ignored.
 func (s service) CanAccess(acl knox.ACL, t knox.AccessType) bool {
+	now := time.Now()
 	for _, a := range acl {
+		if a.Expired(now) {
+			continue
+		}
 		switch a.Type {
 		case knox.Service:
 			if a.ID == string(s.GetID()) && a.AccessType.CanAccess(t) {
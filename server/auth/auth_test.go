@@ -96,6 +96,34 @@ func TestServiceCanAccess(t *testing.T) {
 	}
 }
 
+func TestCanAccessIgnoresExpired(t *testing.T) {
+	expired := time.Now().Add(-time.Minute).UnixNano()
+	active := time.Now().Add(time.Hour).UnixNano()
+	principals := []struct {
+		p      knox.Principal
+		access knox.Access
+	}{
+		{NewUser("test", []string{"group"}), knox.Access{ID: "test", Type: knox.User}},
+		{NewUser("test", []string{"group"}), knox.Access{ID: "group", Type: knox.UserGroup}},
+		{NewMachine("test001"), knox.Access{ID: "test001", Type: knox.Machine}},
+		{NewMachine("test001"), knox.Access{ID: "test", Type: knox.MachinePrefix}},
+		{NewService("example.com", "serviceA"), knox.Access{ID: "spiffe://example.com/serviceA", Type: knox.Service}},
+		{NewService("example.com", "serviceA"), knox.Access{ID: "spiffe://example.com/", Type: knox.ServicePrefix}},
+	}
+	for _, tc := range principals {
+		a := tc.access
+		a.AccessType = knox.Read
+		a.Expires = active
+		if !tc.p.CanAccess(knox.ACL{a}, knox.Read) {
+			t.Errorf("%s can't access with unexpired %s", tc.p.GetID(), a.ID)
+		}
+		a.Expires = expired
+		if tc.p.CanAccess(knox.ACL{a}, knox.Read) {
+			t.Errorf("%s can access with expired %s", tc.p.GetID(), a.ID)
+		}
+	}
+}
+
 func TestPrincipalMuxType(t *testing.T) {
 	u := NewUser("test", []string{"returntrue"})
 	s := NewService("example.com", "serviceA")
@@ -403,3 +431,35 @@ func TestSpiffeFallbackSuccess(t *testing.T) {
 	}
 	testSpiffeAuthFlow(t, "0tANYTHING", &a)
 }
+
+func TestGrantingEntries(t *testing.T) {
+	acl := knox.ACL{
+		{ID: "web", AccessType: knox.Read, Type: knox.MachinePrefix},
+		{ID: "web0123", AccessType: knox.Admin, Type: knox.Machine},
+		{ID: "db", AccessType: knox.Admin, Type: knox.MachinePrefix},
+		{ID: "web01", AccessType: knox.Admin, Type: knox.MachinePrefix, Expires: time.Now().Add(-time.Minute).UnixNano()},
+	}
+	m := NewMachine("web0123")
+	granting := GrantingEntries(m, acl, knox.Read)
+	if len(granting) != 2 || granting[0] != acl[0] || granting[1] != acl[1] {
+		t.Errorf("unexpected entries %v", granting)
+	}
+	granting = GrantingEntries(m, acl, knox.Admin)
+	if len(granting) != 1 || granting[0] != acl[1] {
+		t.Errorf("unexpected entries %v", granting)
+	}
+	if len(GrantingEntries(NewMachine("other"), acl, knox.Read)) != 0 {
+		t.Error("unexpected entries for other machine")
+	}
+
+	s, err := NewServiceFromID("spiffe://example.com/serviceA")
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if s.GetID() != "spiffe://example.com/serviceA" {
+		t.Errorf("%s is not spiffe://example.com/serviceA", s.GetID())
+	}
+	if _, err := NewServiceFromID("example.com/serviceA"); err == nil {
+		t.Error("Expected err")
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"math/big"
+
+	"github.com/pinterest/knox"
+)
+
+const alphanumeric = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+
+// generateSecret returns secret material from crypto/rand as described by the
+// spec.
+func generateSecret(g knox.GeneratorSpec) ([]byte, error) {
+	if err := g.Validate(); err != nil {
+		return nil, err
+	}
+	switch g.Encoding {
+	case knox.AlphanumericEncoding:
+		return randomString(alphanumeric, g.Length)
+	case knox.CharsetEncoding:
+		return randomString(g.Charset, g.Length)
+	}
+	b := make([]byte, g.Length)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	switch g.Encoding {
+	case knox.Base64Encoding:
+		return []byte(base64.StdEncoding.EncodeToString(b)), nil
+	case knox.HexEncoding:
+		return []byte(hex.EncodeToString(b)), nil
+	default:
+		return b, nil
+	}
+}
+
+// randomString returns n characters chosen uniformly from charset.
+func randomString(charset string, n int) ([]byte, error) {
+	max := big.NewInt(int64(len(charset)))
+	out := make([]byte, n)
+	for i := range out {
+		j, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = charset[j.Int64()]
+	}
+	return out, nil
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/pinterest/knox"
+)
+
+func TestGenerateSecret(t *testing.T) {
+	b, err := generateSecret(knox.GeneratorSpec{Encoding: knox.RawEncoding, Length: 32})
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(b) != 32 {
+		t.Fatalf("%d does not equal 32", len(b))
+	}
+
+	b, err = generateSecret(knox.GeneratorSpec{Encoding: knox.Base64Encoding, Length: 32})
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(string(b))
+	if err != nil || len(decoded) != 32 {
+		t.Fatalf("unexpected base64 secret %q", b)
+	}
+
+	b, err = generateSecret(knox.GeneratorSpec{Encoding: knox.HexEncoding, Length: 16})
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	decoded, err = hex.DecodeString(string(b))
+	if err != nil || len(decoded) != 16 {
+		t.Fatalf("unexpected hex secret %q", b)
+	}
+
+	b, err = generateSecret(knox.GeneratorSpec{Encoding: knox.AlphanumericEncoding, Length: 20})
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(b) != 20 {
+		t.Fatalf("%d does not equal 20", len(b))
+	}
+	for _, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			t.Fatalf("unexpected character %q in %q", c, b)
+		}
+	}
+
+	b, err = generateSecret(knox.GeneratorSpec{Encoding: knox.CharsetEncoding, Length: 64, Charset: "01"})
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(b) != 64 || strings.Trim(string(b), "01") != "" {
+		t.Fatalf("unexpected charset secret %q", b)
+	}
+	for _, g := range []knox.GeneratorSpec{
+		{Encoding: knox.CharsetEncoding, Length: 16},
+		{Encoding: knox.CharsetEncoding, Length: 16, Charset: "a"},
+		{Encoding: knox.CharsetEncoding, Length: 16, Charset: "aba"},
+		{Encoding: knox.CharsetEncoding, Length: 16, Charset: "a b"},
+		{Encoding: knox.HexEncoding, Length: 16, Charset: "ab"},
+	} {
+		if _, err := generateSecret(g); err != knox.ErrInvalidCharset {
+			t.Fatalf("%v does not equal %s for %+v", err, knox.ErrInvalidCharset, g)
+		}
+	}
+
+	for _, g := range []knox.GeneratorSpec{
+		{Encoding: "base32", Length: 16},
+		{Encoding: knox.HexEncoding, Length: 0},
+		{Encoding: knox.HexEncoding, Length: 5000},
+	} {
+		if _, err := generateSecret(g); err != knox.ErrInvalidGenerator {
+			t.Fatalf("%v does not equal %s for %+v", err, knox.ErrInvalidGenerator, g)
+		}
+	}
+}
@@ -2,8 +2,12 @@ package server
 
 import (
 	"fmt"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/log"
 	"github.com/pinterest/knox/server/keydb"
 )
 
@@ -11,22 +15,44 @@ import (
 type KeyManager interface {
 	GetAllKeyIDs() ([]string, error)
 	GetUpdatedKeyIDs(map[string]string) ([]string, error)
+	WatchKeyIDs(versions map[string]string, timeout time.Duration) ([]string, error)
 	GetKey(id string, status knox.VersionStatus) (*knox.Key, error)
+	SearchKeyIDs(q KeyQuery) ([]string, error)
 	AddNewKey(*knox.Key) error
 	DeleteKey(id string) error
+	GetDeletedKey(id string) (*knox.Key, error)
+	RestoreKey(id string) error
+	PurgeDeletedKeys(deletedBefore time.Time) ([]string, error)
 	UpdateAccess(string, ...knox.Access) error
+	UpdateMetadata(id string, md knox.KeyMetadata) error
+	SetPolicy(id string, p knox.KeyPolicy) error
+	AddApprovalRequest(r *knox.ApprovalRequest) error
+	GetApprovalRequests(id string) ([]knox.ApprovalRequest, error)
+	ApproveRequest(keyID, requestID string) (*knox.ApprovalRequest, error)
+	RejectRequest(keyID, requestID string) (*knox.ApprovalRequest, error)
 	AddVersion(string, *knox.KeyVersion) error
 	UpdateVersion(keyID string, versionID uint64, s knox.VersionStatus) error
+	GetNamespaces() ([]knox.Namespace, error)
+	GetNamespace(prefix string) (*knox.Namespace, error)
+	ParentNamespaces(id string) ([]knox.Namespace, error)
+	UpdateNamespaceAccess(prefix string, acl ...knox.Access) error
+	DeleteNamespace(prefix string) error
 }
 
 // NewKeyManager builds a struct for interfacing with the keydb.
 func NewKeyManager(c keydb.Cryptor, db keydb.DB) KeyManager {
-	return &keyManager{c, db}
+	m := &keyManager{cryptor: c, db: db}
+	if feed, ok := db.(keydb.ChangeFeed); ok {
+		m.watcher = newChangeWatcher(feed)
+	}
+	return m
 }
 
 type keyManager struct {
 	cryptor keydb.Cryptor
 	db      keydb.DB
+	// watcher is nil if the db has no change feed.
+	watcher *changeWatcher
 }
 
 func (m *keyManager) GetAllKeyIDs() ([]string, error) {
@@ -36,34 +62,252 @@ func (m *keyManager) GetAllKeyIDs() ([]string, error) {
 	}
 	output := []string{}
 	for _, k := range keys {
-		output = append(output, k.ID)
+		if k.DeletedAt == 0 {
+			output = append(output, k.ID)
+		}
 	}
 	return output, nil
 }
 
 func (m *keyManager) GetUpdatedKeyIDs(versions map[string]string) ([]string, error) {
+	if idx, ok := m.db.(keydb.HashIndex); ok {
+		return idx.UpdatedKeyIDs(versions)
+	}
 	keys, err := m.db.GetAll()
 	if err != nil {
 		return nil, err
 	}
 	output := []string{}
 	for _, k := range keys {
-		if v, ok := versions[k.ID]; ok && k.VersionHash != v {
+		if v, ok := versions[k.ID]; ok && k.DeletedAt == 0 && k.VersionHash != v {
 			output = append(output, k.ID)
 		}
 	}
 	return output, nil
 }
 
-func (m *keyManager) GetKey(id string, status knox.VersionStatus) (*knox.Key, error) {
+// WatchKeyIDs returns the IDs in versions of keys whose version hash differs,
+// like GetUpdatedKeyIDs, waiting for one of them to change if none have. It
+// returns an empty list if none change before the timeout. Without a change
+// feed the keys are only checked again at the timeout.
+func (m *keyManager) WatchKeyIDs(versions map[string]string, timeout time.Duration) ([]string, error) {
+	var notify <-chan struct{}
+	if m.watcher != nil {
+		sub, err := m.watcher.subscribe(versions)
+		if err != nil && err != keydb.ErrNoChangeFeed {
+			return nil, err
+		}
+		if err == nil {
+			defer m.watcher.unsubscribe(sub)
+			notify = sub.c
+		}
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		ids, err := m.changedKeyIDs(versions)
+		if err != nil || len(ids) > 0 {
+			return ids, err
+		}
+		select {
+		case <-notify:
+		case <-deadline.C:
+			if notify == nil {
+				return m.changedKeyIDs(versions)
+			}
+			return ids, nil
+		}
+	}
+}
+
+// changedKeyIDs reads each key in versions and returns, in order, the IDs of
+// the keys that are not deleted and whose version hash differs.
+func (m *keyManager) changedKeyIDs(versions map[string]string) ([]string, error) {
+	ids := make([]string, 0, len(versions))
+	for id := range versions {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	output := []string{}
+	for _, id := range ids {
+		k, err := m.db.Get(id)
+		if err == knox.ErrKeyIDNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if k.DeletedAt == 0 && k.VersionHash != versions[id] {
+			output = append(output, id)
+		}
+	}
+	return output, nil
+}
+
+// update writes the key to the db, pruning expired entries from its ACL and
+// expired approval requests.
+func (m *keyManager) update(k *keydb.DBKey) error {
+	return m.updateIn(m.db, k)
+}
+
+// updateIn is update on db, which may be a transaction.
+func (m *keyManager) updateIn(db keydb.DB, k *keydb.DBKey) error {
+	now := time.Now()
+	k.ACL = k.ACL.Prune(now)
+	var requests []knox.ApprovalRequest
+	for _, r := range k.ApprovalRequests {
+		if !r.Expired(now) {
+			requests = append(requests, r)
+		}
+	}
+	k.ApprovalRequests = requests
+	if err := keydb.Sign(m.cryptor, k); err != nil {
+		return err
+	}
+	return db.Update(k)
+}
+
+// transact runs f in a transaction if the db supports them, and directly on
+// the db otherwise.
+func (m *keyManager) transact(f func(db keydb.DB) error) error {
+	if t, ok := m.db.(keydb.Transactor); ok {
+		return t.Transact(f)
+	}
+	return f(m.db)
+}
+
+// keyManagerComponent is recorded as the principal of audit events raised by
+// the key manager itself.
+const keyManagerComponent = "key_manager"
+
+// verify checks the integrity of a key read from the db and raises an alert
+// if it was changed outside of knox.
+func (m *keyManager) verify(k *keydb.DBKey) error {
+	err := keydb.Verify(m.cryptor, k)
+	if err == keydb.ErrMACMismatch {
+		log.Printf("ALERT: key %s failed its integrity check; its ACL, versions, deletion, or policy were changed outside of knox", k.ID)
+		recordSystemEvent(keyManagerComponent, knox.AuditEvent{
+			Type:  knox.IntegrityFailureEvent,
+			KeyID: k.ID,
+		})
+	}
+	return err
+}
+
+// KeyQuery selects keys for SearchKeyIDs.
+type KeyQuery struct {
+	// Prefix only selects key IDs that start with it.
+	Prefix string
+	// After only selects key IDs that sort after it.
+	After string
+	// Principal and Access only select keys the principal has at least
+	// Access to. They are ignored if Access is None.
+	Principal knox.Principal
+	Access    knox.AccessType
+	// Team only selects keys owned by the team if it is not empty.
+	Team string
+	// Tags only selects keys that have all of the tags.
+	Tags []string
+	// Rotating only selects keys with a rotation policy.
+	Rotating bool
+	// RequireApproval only selects keys whose policy requires approval.
+	RequireApproval bool
+	// Limit is the maximum number of IDs to return if greater than zero.
+	Limit int
+}
+
+// matches reports whether the key, which inherits the given ACL from its
+// namespaces, is selected by the query, ignoring Limit.
+func (q KeyQuery) matches(k *keydb.DBKey, inherited knox.ACL) bool {
+	if k.DeletedAt != 0 || !strings.HasPrefix(k.ID, q.Prefix) || k.ID <= q.After {
+		return false
+	}
+	if q.Team != "" && (k.Metadata == nil || k.Metadata.Team != q.Team) {
+		return false
+	}
+	for _, t := range q.Tags {
+		if !k.Metadata.HasTag(t) {
+			return false
+		}
+	}
+	if q.Rotating && (k.Policy == nil || k.Policy.Rotation == nil) {
+		return false
+	}
+	if q.RequireApproval && (k.Policy == nil || !k.Policy.RequireApproval) {
+		return false
+	}
+	if q.Access != knox.None && !q.Principal.CanAccess(k.ACL, q.Access) && !q.Principal.CanAccess(inherited, q.Access) {
+		return false
+	}
+	return true
+}
+
+// SearchKeyIDs returns the IDs of the keys selected by q in sorted order.
+func (m *keyManager) SearchKeyIDs(q KeyQuery) ([]string, error) {
+	dbKeys, err := m.db.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	namespaces, err := m.namespaces()
+	if err != nil {
+		return nil, err
+	}
+	// Sort a copy since the slice may be shared with the db.
+	keys := make([]keydb.DBKey, len(dbKeys))
+	copy(keys, dbKeys)
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	output := []string{}
+	for i := range keys {
+		if q.Limit > 0 && len(output) == q.Limit {
+			break
+		}
+		// The MAC is checked after matching so that only the keys that
+		// would be returned pay for it. Keys that fail it are left out.
+		if q.matches(&keys[i], inheritedACL(namespaces, keys[i].ID)) && m.verify(&keys[i]) == nil {
+			output = append(output, keys[i].ID)
+		}
+	}
+	return output, nil
+}
+
+// get returns the key from the db, treating deleted keys as missing.
+func (m *keyManager) get(id string) (*keydb.DBKey, error) {
+	encK, err := m.getAny(id)
+	if err != nil {
+		return nil, err
+	}
+	if encK.DeletedAt != 0 {
+		return nil, knox.ErrKeyIDNotFound
+	}
+	return encK, nil
+}
+
+// getAny returns the key from the db, including deleted keys, after checking
+// its integrity.
+func (m *keyManager) getAny(id string) (*keydb.DBKey, error) {
 	encK, err := m.db.Get(id)
 	if err != nil {
 		return nil, err
 	}
+	if err := m.verify(encK); err != nil {
+		return nil, err
+	}
+	return encK, nil
+}
+
+func (m *keyManager) GetKey(id string, status knox.VersionStatus) (*knox.Key, error) {
+	encK, err := m.get(id)
+	if err != nil {
+		return nil, err
+	}
 	k, err := m.cryptor.Decrypt(encK)
 	if err != nil {
 		return nil, fmt.Errorf("Error decrypting key: %s", err.Error())
 	}
+	k.InheritedACL, err = m.inheritedACL(id)
+	if err != nil {
+		return nil, err
+	}
 	switch status {
 	case knox.Inactive:
 		return k, nil
@@ -86,15 +330,120 @@ func (m *keyManager) AddNewKey(k *knox.Key) error {
 	if err != nil {
 		return err
 	}
+	dbk.ACL = dbk.ACL.Prune(time.Now())
+	if err := keydb.Sign(m.cryptor, dbk); err != nil {
+		return err
+	}
 	return m.db.Add(dbk)
 }
 
+// DeleteKey marks the key as deleted. It can be restored until it is purged,
+// and its ID cannot be reused in the meantime.
 func (m *keyManager) DeleteKey(id string) error {
-	return m.db.Remove(id)
+	encK, err := m.get(id)
+	if err != nil {
+		return err
+	}
+	newEncK := encK.Copy()
+	newEncK.DeletedAt = time.Now().UnixNano()
+	return m.update(newEncK)
+}
+
+// GetDeletedKey returns a key that has been deleted but not yet purged.
+func (m *keyManager) GetDeletedKey(id string) (*knox.Key, error) {
+	encK, err := m.getAny(id)
+	if err != nil {
+		return nil, err
+	}
+	if encK.DeletedAt == 0 {
+		return nil, knox.ErrKeyNotDeleted
+	}
+	k, err := m.cryptor.Decrypt(encK)
+	if err != nil {
+		return nil, err
+	}
+	k.InheritedACL, err = m.inheritedACL(id)
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// RestoreKey undeletes a key. The check and the write are made in one
+// transaction, so a key is never restored while it is being purged.
+func (m *keyManager) RestoreKey(id string) error {
+	return m.transact(func(db keydb.DB) error {
+		encK, err := db.Get(id)
+		if err != nil {
+			return err
+		}
+		if err := m.verify(encK); err != nil {
+			return err
+		}
+		if encK.DeletedAt == 0 {
+			return knox.ErrKeyNotDeleted
+		}
+		newEncK := encK.Copy()
+		newEncK.DeletedAt = 0
+		return m.updateIn(db, newEncK)
+	})
+}
+
+// errNotPurgeable stops a purge of a key that is no longer eligible.
+var errNotPurgeable = fmt.Errorf("Key is not eligible to be purged")
+
+// PurgeDeletedKeys permanently removes keys deleted before the given time and
+// returns their IDs. Keys that fail their integrity check are never purged.
+func (m *keyManager) PurgeDeletedKeys(deletedBefore time.Time) ([]string, error) {
+	keys, err := m.db.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	purged := []string{}
+	for _, k := range keys {
+		if k.DeletedAt == 0 || k.DeletedAt >= deletedBefore.UnixNano() {
+			continue
+		}
+		err := m.purgeKey(k.ID, deletedBefore)
+		switch {
+		case err == nil:
+			purged = append(purged, k.ID)
+		case err == errNotPurgeable || err == knox.ErrKeyIDNotFound || err == keydb.ErrDBVersion:
+			// The key was restored, changed, or purged since GetAll.
+		default:
+			return purged, err
+		}
+	}
+	return purged, nil
+}
+
+// purgeKey removes a key if it is still deleted before the given time. The
+// key is checked and removed in one transaction, and is updated at the
+// version that was checked before it is removed, so a restore that commits
+// after the check fails the purge instead of being lost.
+func (m *keyManager) purgeKey(id string, deletedBefore time.Time) error {
+	return m.transact(func(db keydb.DB) error {
+		current, err := db.Get(id)
+		if err != nil {
+			return err
+		}
+		if current.DeletedAt == 0 || current.DeletedAt >= deletedBefore.UnixNano() {
+			return errNotPurgeable
+		}
+		// Never purge a key whose deletion time may have been backdated.
+		if err := m.verify(current); err != nil {
+			log.Printf("Not purging key %s: %s", id, err.Error())
+			return errNotPurgeable
+		}
+		if err := db.Update(current); err != nil {
+			return err
+		}
+		return db.Remove(id)
+	})
 }
 
 func (m *keyManager) UpdateAccess(id string, acl ...knox.Access) error {
-	encK, err := m.db.Get(id)
+	encK, err := m.get(id)
 	if err != nil {
 		return err
 	}
@@ -106,11 +455,141 @@ func (m *keyManager) UpdateAccess(id string, acl ...knox.Access) error {
 	if err != nil {
 		return err
 	}
-	return m.db.Update(newEncK)
+	return m.update(newEncK)
+}
+
+// UpdateMetadata replaces the description, team, and tags of the key. The
+// creation information is kept from the existing metadata.
+func (m *keyManager) UpdateMetadata(id string, md knox.KeyMetadata) error {
+	encK, err := m.get(id)
+	if err != nil {
+		return err
+	}
+	if encK.Metadata != nil {
+		md.CreatedBy = encK.Metadata.CreatedBy
+		md.CreationTime = encK.Metadata.CreationTime
+	} else {
+		md.CreatedBy = ""
+		md.CreationTime = 0
+	}
+	if err := md.Validate(); err != nil {
+		return err
+	}
+	newEncK := encK.Copy()
+	newEncK.Metadata = md.Copy()
+	return m.update(newEncK)
+}
+
+// SetPolicy replaces the policy of the key.
+func (m *keyManager) SetPolicy(id string, p knox.KeyPolicy) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	encK, err := m.get(id)
+	if err != nil {
+		return err
+	}
+	newEncK := encK.Copy()
+	newEncK.Policy = &p
+	return m.update(newEncK)
+}
+
+// AddApprovalRequest stores a request for a change to the key in r.KeyID.
+func (m *keyManager) AddApprovalRequest(r *knox.ApprovalRequest) error {
+	encK, err := m.get(r.KeyID)
+	if err != nil {
+		return err
+	}
+	newEncK := encK.Copy()
+	newEncK.ApprovalRequests = append(newEncK.ApprovalRequests, r.Copy())
+	return m.update(newEncK)
+}
+
+// GetApprovalRequests returns the requests for changes to the key that have
+// not expired.
+func (m *keyManager) GetApprovalRequests(id string) ([]knox.ApprovalRequest, error) {
+	encK, err := m.get(id)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	requests := []knox.ApprovalRequest{}
+	for _, r := range encK.ApprovalRequests {
+		if !r.Expired(now) {
+			requests = append(requests, r.Copy())
+		}
+	}
+	return requests, nil
+}
+
+// takeRequest returns a copy of the key without the request, along with the
+// request. Expired requests are not found.
+func takeRequest(encK *keydb.DBKey, requestID string) (*keydb.DBKey, *knox.ApprovalRequest, error) {
+	newEncK := encK.Copy()
+	for i, r := range newEncK.ApprovalRequests {
+		if r.ID != requestID {
+			continue
+		}
+		if r.Expired(time.Now()) {
+			break
+		}
+		newEncK.ApprovalRequests = append(newEncK.ApprovalRequests[:i], newEncK.ApprovalRequests[i+1:]...)
+		return newEncK, &r, nil
+	}
+	return nil, nil, knox.ErrApprovalRequestNotFound
+}
+
+// ApproveRequest removes the request and carries out its change in the same
+// update, so a request can only be carried out once.
+func (m *keyManager) ApproveRequest(keyID, requestID string) (*knox.ApprovalRequest, error) {
+	encK, err := m.get(keyID)
+	if err != nil {
+		return nil, err
+	}
+	newEncK, r, err := takeRequest(encK, requestID)
+	if err != nil {
+		return nil, err
+	}
+	switch r.Operation {
+	case knox.DeleteKeyOperation:
+		newEncK.DeletedAt = time.Now().UnixNano()
+	case knox.UpdateAccessOperation:
+		for _, a := range r.ACL {
+			newEncK.ACL = newEncK.ACL.Add(a)
+		}
+		err = newEncK.ACL.Validate()
+		if err != nil {
+			return nil, err
+		}
+	case knox.UpdatePolicyOperation:
+		newEncK.Policy = r.Policy.Copy()
+	default:
+		return nil, fmt.Errorf("Unknown approval operation %s", r.Operation)
+	}
+	if err := m.update(newEncK); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// RejectRequest removes the request without carrying it out.
+func (m *keyManager) RejectRequest(keyID, requestID string) (*knox.ApprovalRequest, error) {
+	encK, err := m.get(keyID)
+	if err != nil {
+		return nil, err
+	}
+	newEncK, r, err := takeRequest(encK, requestID)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.update(newEncK); err != nil {
+		return nil, err
+	}
+	return r, nil
 }
 
 func (m *keyManager) AddVersion(id string, v *knox.KeyVersion) error {
-	encK, err := m.db.Get(id)
+	encK, err := m.get(id)
 	if err != nil {
 		return err
 	}
@@ -126,20 +605,20 @@ func (m *keyManager) AddVersion(id string, v *knox.KeyVersion) error {
 	if err != nil {
 		return err
 	}
-	encV, err := m.cryptor.EncryptVersion(k, v)
+	newEncK := encK.Copy()
+	encV, err := keydb.EncryptVersion(m.cryptor, newEncK, k, v)
 	if err != nil {
 		return err
 	}
 
-	newEncK := encK.Copy()
 	newEncK.VersionList = append(newEncK.VersionList, *encV)
 	newEncK.VersionHash = k.VersionList.Hash()
 
-	return m.db.Update(newEncK)
+	return m.update(newEncK)
 }
 
 func (m *keyManager) UpdateVersion(keyID string, versionID uint64, s knox.VersionStatus) error {
-	encK, err := m.db.Get(keyID)
+	encK, err := m.get(keyID)
 	if err != nil {
 		return err
 	}
@@ -166,5 +645,134 @@ func (m *keyManager) UpdateVersion(keyID string, versionID uint64, s knox.Versio
 		}
 	}
 	newEncK.VersionHash = k.VersionHash
-	return m.db.Update(newEncK)
+	return m.update(newEncK)
+}
+
+// namespaces returns every namespace, or none if the db does not store them.
+func (m *keyManager) namespaces() ([]knox.Namespace, error) {
+	namespaces, err := m.GetNamespaces()
+	if err == keydb.ErrNoNamespaces {
+		return nil, nil
+	}
+	return namespaces, err
+}
+
+// verifiedNamespaces drops the namespaces that fail their integrity check,
+// so that their ACLs are never inherited, and raises an alert for each.
+// Namespaces only grant access, so dropping one never grants more. The MACs
+// of the rest are cleared, so they are not returned to clients.
+func (m *keyManager) verifiedNamespaces(namespaces []knox.Namespace) []knox.Namespace {
+	verified := make([]knox.Namespace, 0, len(namespaces))
+	for _, n := range namespaces {
+		if err := keydb.VerifyNamespace(m.cryptor, &n); err != nil {
+			log.Printf("ALERT: namespace %s failed its integrity check; its ACL was changed outside of knox: %s", n.Prefix, err.Error())
+			recordSystemEvent(keyManagerComponent, knox.AuditEvent{
+				Type:  knox.IntegrityFailureEvent,
+				KeyID: n.Prefix,
+			})
+			continue
+		}
+		n.MAC = nil
+		verified = append(verified, n)
+	}
+	return verified
+}
+
+// inheritedACL returns the entries of the ACLs of the namespaces that
+// contain id.
+func inheritedACL(namespaces []knox.Namespace, id string) knox.ACL {
+	var acl knox.ACL
+	for _, n := range namespaces {
+		if n.Contains(id) {
+			acl = append(acl, n.ACL...)
+		}
+	}
+	return acl
+}
+
+func (m *keyManager) inheritedACL(id string) (knox.ACL, error) {
+	namespaces, err := m.namespaces()
+	if err != nil {
+		return nil, err
+	}
+	return inheritedACL(namespaces, id), nil
+}
+
+// GetNamespaces returns every namespace that passes its integrity check,
+// ordered by prefix. It fails with keydb.ErrNoNamespaces if the db does not
+// store namespaces.
+func (m *keyManager) GetNamespaces() ([]knox.Namespace, error) {
+	store, ok := m.db.(keydb.NamespaceStore)
+	if !ok {
+		return nil, keydb.ErrNoNamespaces
+	}
+	namespaces, err := store.GetNamespaces()
+	if err != nil {
+		return nil, err
+	}
+	return m.verifiedNamespaces(namespaces), nil
+}
+
+// GetNamespace returns the namespace with the prefix.
+func (m *keyManager) GetNamespace(prefix string) (*knox.Namespace, error) {
+	namespaces, err := m.GetNamespaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range namespaces {
+		if n.Prefix == prefix {
+			return &n, nil
+		}
+	}
+	return nil, knox.ErrNamespaceNotFound
+}
+
+// ParentNamespaces returns the namespaces that contain a key ID or namespace
+// prefix, outermost first.
+func (m *keyManager) ParentNamespaces(id string) ([]knox.Namespace, error) {
+	namespaces, err := m.namespaces()
+	if err != nil {
+		return nil, err
+	}
+	parents := []knox.Namespace{}
+	for _, n := range namespaces {
+		if n.Contains(id) {
+			parents = append(parents, n)
+		}
+	}
+	return parents, nil
+}
+
+// UpdateNamespaceAccess applies the changes to the ACL of the namespace with
+// the prefix, creating it if it does not exist. A namespace that failed its
+// integrity check is replaced.
+func (m *keyManager) UpdateNamespaceAccess(prefix string, acl ...knox.Access) error {
+	n, err := m.GetNamespace(prefix)
+	if err == knox.ErrNamespaceNotFound {
+		n, err = &knox.Namespace{Prefix: prefix, ACL: knox.ACL{}}, nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, a := range acl {
+		n.ACL = n.ACL.Add(a)
+	}
+	n.ACL = n.ACL.Prune(time.Now())
+	if err := n.Validate(); err != nil {
+		return err
+	}
+	if err := keydb.SignNamespace(m.cryptor, n); err != nil {
+		return err
+	}
+	return m.db.(keydb.NamespaceStore).PutNamespace(n)
+}
+
+// DeleteNamespace removes the namespace with the prefix. Keys in it no
+// longer inherit its ACL.
+func (m *keyManager) DeleteNamespace(prefix string) error {
+	store, ok := m.db.(keydb.NamespaceStore)
+	if !ok {
+		return keydb.ErrNoNamespaces
+	}
+	return store.RemoveNamespace(prefix)
 }
@@ -4,8 +4,10 @@ import (
 	"reflect"
 	"sort"
 	"testing"
+	"time"
 
 	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/audit"
 	"github.com/pinterest/knox/server/auth"
 	"github.com/pinterest/knox/server/keydb"
 )
@@ -102,6 +104,98 @@ func TestGetAllKeyIDs(t *testing.T) {
 	}
 }
 
+func TestGetUpdatedKeyIDsIndexed(t *testing.T) {
+	cryptor := keydb.NewAESGCMCryptor(10, []byte("testtesttesttest"))
+	m := NewKeyManager(cryptor, keydb.NewCachedDB(keydb.NewTempDB()))
+	u := auth.NewUser("test", []string{})
+	key1 := newKey("id1", knox.ACL{}, []byte("data"), u)
+	key2 := newKey("id2", knox.ACL{}, []byte("data"), u)
+	for _, k := range []*knox.Key{&key1, &key2} {
+		if err := m.AddNewKey(k); err != nil {
+			t.Fatalf("%s is not nil", err)
+		}
+	}
+	keys, err := m.GetUpdatedKeyIDs(map[string]string{key1.ID: key1.VersionHash, key2.ID: "NOT_THE_HASH", "id3": "NOT_THE_HASH"})
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(keys) != 1 || keys[0] != key2.ID {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+	if err := m.DeleteKey(key2.ID); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	keys, err = m.GetUpdatedKeyIDs(map[string]string{key2.ID: "NOT_THE_HASH"})
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(keys) != 0 {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+}
+
+// noFeedDB hides the change feed of the DB it wraps.
+type noFeedDB struct {
+	keydb.DB
+}
+
+func TestWatchKeyIDs(t *testing.T) {
+	defer func(d time.Duration) { watchPollInterval = d }(watchPollInterval)
+	watchPollInterval = 10 * time.Millisecond
+	cryptor := keydb.NewAESGCMCryptor(10, []byte("testtesttesttest"))
+	u := auth.NewUser("test", []string{})
+	for _, db := range []keydb.DB{keydb.NewTempDB(), keydb.NewCachedDB(keydb.NewTempDB()), noFeedDB{keydb.NewTempDB()}} {
+		m := NewKeyManager(cryptor, db)
+		key1 := newKey("id1", knox.ACL{}, []byte("data"), u)
+		key2 := newKey("id2", knox.ACL{}, []byte("data"), u)
+		for _, k := range []*knox.Key{&key1, &key2} {
+			if err := m.AddNewKey(k); err != nil {
+				t.Fatalf("%s is not nil", err)
+			}
+		}
+		versions := map[string]string{key1.ID: key1.VersionHash, key2.ID: key2.VersionHash, "id3": "NOT_THE_HASH"}
+
+		// Keys that have already changed are returned straight away.
+		keys, err := m.WatchKeyIDs(map[string]string{key1.ID: "NOT_THE_HASH"}, time.Hour)
+		if err != nil {
+			t.Fatalf("%s is not nil", err)
+		}
+		if len(keys) != 1 || keys[0] != key1.ID {
+			t.Fatalf("unexpected keys %v", keys)
+		}
+		keys, err = m.WatchKeyIDs(versions, 20*time.Millisecond)
+		if err != nil {
+			t.Fatalf("%s is not nil", err)
+		}
+		if len(keys) != 0 {
+			t.Fatalf("unexpected keys %v", keys)
+		}
+
+		timeout := 5 * time.Second
+		if _, ok := db.(noFeedDB); ok {
+			// Without a change feed, changes are only seen at the timeout.
+			timeout = 100 * time.Millisecond
+		}
+		result := make(chan []string)
+		go func() {
+			keys, err := m.WatchKeyIDs(versions, timeout)
+			if err != nil {
+				t.Errorf("%s is not nil", err)
+			}
+			result <- keys
+		}()
+		time.Sleep(20 * time.Millisecond)
+		kv := newKeyVersion([]byte("data2"), knox.Active)
+		if err := m.AddVersion(key2.ID, &kv); err != nil {
+			t.Fatalf("%s is not nil", err)
+		}
+		keys = <-result
+		if len(keys) != 1 || keys[0] != key2.ID {
+			t.Fatalf("unexpected keys %v", keys)
+		}
+	}
+}
+
 func TestGetUpdatedKeyIDs(t *testing.T) {
 	m, u, acl := GetMocks()
 	keys, err := m.GetUpdatedKeyIDs(map[string]string{})
@@ -499,3 +593,539 @@ func TestGetInactiveKeyVersions(t *testing.T) {
 		t.Fatalf("Wanted two key versions, got: %d", len(key.VersionList))
 	}
 }
+
+func TestDeleteRestoreKey(t *testing.T) {
+	m, u, acl := GetMocks()
+	key1 := newKey("id1", acl, []byte("data"), u)
+	if err := m.AddNewKey(&key1); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	key2 := newKey("id2", acl, []byte("data"), u)
+	if err := m.AddNewKey(&key2); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+
+	if err := m.RestoreKey("id1"); err != knox.ErrKeyNotDeleted {
+		t.Fatalf("%s does not equal %s", err, knox.ErrKeyNotDeleted)
+	}
+	if err := m.DeleteKey("id1"); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if err := m.DeleteKey("id1"); err != knox.ErrKeyIDNotFound {
+		t.Fatalf("%s does not equal %s", err, knox.ErrKeyIDNotFound)
+	}
+
+	// Deleted keys are hidden from reads and writes.
+	keys, err := m.GetAllKeyIDs()
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(keys) != 1 || keys[0] != "id2" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+	keys, err = m.GetUpdatedKeyIDs(map[string]string{"id1": "NOTAHASH"})
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(keys) != 0 {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+	if _, err := m.GetKey("id1", knox.Primary); err != knox.ErrKeyIDNotFound {
+		t.Fatalf("%s does not equal %s", err, knox.ErrKeyIDNotFound)
+	}
+	if err := m.UpdateAccess("id1", knox.Access{Type: knox.User, ID: "a", AccessType: knox.Read}); err != knox.ErrKeyIDNotFound {
+		t.Fatalf("%s does not equal %s", err, knox.ErrKeyIDNotFound)
+	}
+	if err := m.AddNewKey(&key1); err != knox.ErrKeyExists {
+		t.Fatalf("%s does not equal %s", err, knox.ErrKeyExists)
+	}
+	deleted, err := m.GetDeletedKey("id1")
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if string(deleted.VersionList[0].Data) != "data" {
+		t.Fatalf("unexpected key %+v", deleted)
+	}
+
+	if err := m.RestoreKey("id1"); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	k, err := m.GetKey("id1", knox.Primary)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if string(k.VersionList[0].Data) != "data" {
+		t.Fatalf("unexpected key %+v", k)
+	}
+	if _, err := m.GetDeletedKey("id1"); err != knox.ErrKeyNotDeleted {
+		t.Fatalf("%s does not equal %s", err, knox.ErrKeyNotDeleted)
+	}
+}
+
+func TestPurgeDeletedKeys(t *testing.T) {
+	m, u, acl := GetMocks()
+	for _, id := range []string{"id1", "id2", "id3"} {
+		key := newKey(id, acl, []byte("data"), u)
+		if err := m.AddNewKey(&key); err != nil {
+			t.Fatalf("%s is not nil", err)
+		}
+	}
+	if err := m.DeleteKey("id1"); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	time.Sleep(time.Millisecond)
+	cutoff := time.Now()
+	time.Sleep(time.Millisecond)
+	if err := m.DeleteKey("id2"); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+
+	purged, err := m.PurgeDeletedKeys(cutoff)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if !reflect.DeepEqual(purged, []string{"id1"}) {
+		t.Fatalf("unexpected purged keys %v", purged)
+	}
+	if _, err := m.GetDeletedKey("id1"); err != knox.ErrKeyIDNotFound {
+		t.Fatalf("%s does not equal %s", err, knox.ErrKeyIDNotFound)
+	}
+	if err := m.RestoreKey("id2"); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+
+	purged, err = m.PurgeDeletedKeys(time.Now())
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(purged) != 0 {
+		t.Fatalf("unexpected purged keys %v", purged)
+	}
+	keys, err := m.GetAllKeyIDs()
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	sort.Strings(keys)
+	if !reflect.DeepEqual(keys, []string{"id2", "id3"}) {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+}
+
+// restoringDB restores a key right after it is read, as a concurrent restore
+// would. It is not a keydb.Transactor, so nothing stops the restore.
+type restoringDB struct {
+	keydb.DB
+	m  KeyManager
+	id string
+}
+
+func (db *restoringDB) Get(id string) (*keydb.DBKey, error) {
+	k, err := db.DB.Get(id)
+	if err == nil && id == db.id {
+		db.id = ""
+		if err := db.m.RestoreKey(id); err != nil {
+			return nil, err
+		}
+	}
+	return k, err
+}
+
+func TestPurgeRestoredKey(t *testing.T) {
+	db := &restoringDB{DB: keydb.NewTempDB()}
+	m := NewKeyManager(keydb.NewAESGCMCryptor(10, []byte("testtesttesttest")), db)
+	db.m = m
+	u := auth.NewUser("test", []string{})
+	key := newKey("id1", knox.ACL{}, []byte("data"), u)
+	if err := m.AddNewKey(&key); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if err := m.DeleteKey("id1"); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+
+	// The key is restored after the purge read it, so it is kept.
+	db.id = "id1"
+	purged, err := m.PurgeDeletedKeys(time.Now())
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(purged) != 0 {
+		t.Fatalf("restored key was purged: %v", purged)
+	}
+	if _, err := m.GetKey("id1", knox.Primary); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+}
+
+func TestUpdateAccessPrunesExpired(t *testing.T) {
+	m, u, acl := GetMocks()
+	key := newKey("id1", acl, []byte("data"), u)
+	if err := m.AddNewKey(&key); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	soon := knox.Access{Type: knox.Machine, ID: "m1", AccessType: knox.Read, Expires: time.Now().Add(10 * time.Millisecond).UnixNano()}
+	later := knox.Access{Type: knox.Machine, ID: "m2", AccessType: knox.Read, Expires: time.Now().Add(time.Hour).UnixNano()}
+	if err := m.UpdateAccess("id1", soon, later); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	k, err := m.GetKey("id1", knox.Primary)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(k.ACL) != len(key.ACL)+2 {
+		t.Fatalf("unexpected acl %v", k.ACL)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if err := m.AddVersion("id1", &knox.KeyVersion{ID: 5, Data: []byte("data2"), Status: knox.Active}); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	k, err = m.GetKey("id1", knox.Primary)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(k.ACL) != len(key.ACL)+1 || k.ACL[len(k.ACL)-1] != later {
+		t.Fatalf("unexpected acl %v", k.ACL)
+	}
+}
+
+func TestApproveRequest(t *testing.T) {
+	m, u, acl := GetMocks()
+	key1 := newKey("id1", acl, []byte("data"), u)
+	if err := m.AddNewKey(&key1); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+
+	r, err := newApprovalRequest("id1", knox.DeleteKeyOperation, u)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if err := m.AddApprovalRequest(&r); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	expired, err := newApprovalRequest("id1", knox.DeleteKeyOperation, u)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(r.ID) != 32 || r.ID == expired.ID {
+		t.Fatalf("request IDs %s and %s are not 16 distinct random bytes", r.ID, expired.ID)
+	}
+	expired.Expires = time.Now().UnixNano()
+	if err := m.AddApprovalRequest(&expired); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	requests, err := m.GetApprovalRequests("id1")
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(requests) != 1 || requests[0].ID != r.ID {
+		t.Fatalf("unexpected requests %+v", requests)
+	}
+	if _, err := m.ApproveRequest("id1", expired.ID); err != knox.ErrApprovalRequestNotFound {
+		t.Fatalf("%s does not equal %s", err, knox.ErrApprovalRequestNotFound)
+	}
+
+	approved, err := m.ApproveRequest("id1", r.ID)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if approved.Operation != knox.DeleteKeyOperation {
+		t.Fatalf("unexpected request %+v", approved)
+	}
+	if _, err := m.GetKey("id1", knox.Primary); err != knox.ErrKeyIDNotFound {
+		t.Fatalf("%s does not equal %s", err, knox.ErrKeyIDNotFound)
+	}
+	if err := m.RestoreKey("id1"); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if _, err := m.RejectRequest("id1", r.ID); err != knox.ErrApprovalRequestNotFound {
+		t.Fatalf("%s does not equal %s", err, knox.ErrApprovalRequestNotFound)
+	}
+}
+
+func TestIntegrityFailure(t *testing.T) {
+	db := keydb.NewTempDB()
+	cryptor := keydb.NewMACCryptor(keydb.NewAESGCMCryptor(10, []byte("testtesttesttest")), []byte("mackey"), false)
+	m := NewKeyManager(cryptor, db)
+	u := auth.NewUser("test", []string{})
+	sink := audit.NewMemorySink()
+	l, err := audit.NewLogger(sink)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	SetAuditLogger(l)
+	defer SetAuditLogger(nil)
+
+	key := newKey("id1", knox.ACL{}, []byte("data"), u)
+	if err := m.AddNewKey(&key); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	// Changes made through the key manager are signed.
+	if err := m.UpdateAccess("id1", knox.Access{Type: knox.User, ID: "friend", AccessType: knox.Read}); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if err := m.AddVersion("id1", &knox.KeyVersion{ID: 2, Data: []byte("data2"), Status: knox.Active, CreationTime: 1}); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if _, err := m.GetKey("id1", knox.Primary); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+
+	// Changes made directly in the db are not.
+	encK, err := db.Get("id1")
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	tampered := encK.Copy()
+	tampered.ACL = tampered.ACL.Add(knox.Access{Type: knox.User, ID: "attacker", AccessType: knox.Read})
+	if err := db.Update(tampered); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if _, err := m.GetKey("id1", knox.Primary); err != keydb.ErrMACMismatch {
+		t.Fatalf("%v does not equal %s", err, keydb.ErrMACMismatch)
+	}
+	if err := m.UpdateAccess("id1", knox.Access{Type: knox.User, ID: "attacker", AccessType: knox.None}); err != keydb.ErrMACMismatch {
+		t.Fatalf("%v does not equal %s", err, keydb.ErrMACMismatch)
+	}
+
+	events := sink.Events()
+	last := events[len(events)-1]
+	if last.Type != knox.IntegrityFailureEvent || last.KeyID != "id1" || last.Principal != keyManagerComponent {
+		t.Fatalf("unexpected event %+v", last)
+	}
+}
+
+func TestIntegrityFailurePurgeSearch(t *testing.T) {
+	db := keydb.NewTempDB()
+	cryptor := keydb.NewMACCryptor(keydb.NewAESGCMCryptor(10, []byte("testtesttesttest")), []byte("mackey"), false)
+	m := NewKeyManager(cryptor, db)
+	u := auth.NewUser("test", []string{})
+	attacker := auth.NewUser("attacker", []string{})
+	for _, id := range []string{"id1", "id2"} {
+		key := newKey(id, knox.ACL{}, []byte("data"), u)
+		if err := m.AddNewKey(&key); err != nil {
+			t.Fatalf("%s is not nil", err)
+		}
+	}
+	if err := m.DeleteKey("id1"); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+
+	// A backdated deletion does not get the key purged.
+	encK, err := db.Get("id1")
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	tampered := encK.Copy()
+	tampered.DeletedAt = 1
+	if err := db.Update(tampered); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	purged, err := m.PurgeDeletedKeys(time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(purged) != 0 {
+		t.Fatalf("tampered key was purged: %v", purged)
+	}
+	if _, err := db.Get("id1"); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+
+	// Keys whose ACL was changed in the db are not found by search.
+	encK, err = db.Get("id2")
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	tampered = encK.Copy()
+	tampered.ACL = tampered.ACL.Add(knox.Access{Type: knox.User, ID: "attacker", AccessType: knox.Read})
+	if err := db.Update(tampered); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	ids, err := m.SearchKeyIDs(KeyQuery{Principal: attacker, Access: knox.Read})
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(ids) != 0 {
+		t.Fatalf("tampered key was found: %v", ids)
+	}
+}
+
+func TestNamespaceIntegrityFailure(t *testing.T) {
+	db := &keydb.TempDB{}
+	cryptor := keydb.NewMACCryptor(keydb.NewAESGCMCryptor(10, []byte("testtesttesttest")), []byte("mackey"), false)
+	m := NewKeyManager(cryptor, db)
+	u := auth.NewUser("test", []string{})
+	sink := audit.NewMemorySink()
+	l, err := audit.NewLogger(sink)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	SetAuditLogger(l)
+	defer SetAuditLogger(nil)
+
+	key := newKey("payments:k1", knox.ACL{}, []byte("data"), u)
+	if err := m.AddNewKey(&key); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	friend := knox.Access{Type: knox.User, ID: "friend", AccessType: knox.Read}
+	if err := m.UpdateNamespaceAccess("payments:", friend); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	// Namespaces changed through the key manager are signed, and their MACs
+	// are not returned.
+	n, err := m.GetNamespace("payments:")
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(n.ACL) != 1 || n.MAC != nil {
+		t.Fatalf("unexpected namespace %+v", n)
+	}
+	k, err := m.GetKey("payments:k1", knox.Primary)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(k.InheritedACL) != 1 || k.InheritedACL[0] != friend {
+		t.Fatalf("%+v does not equal [%+v]", k.InheritedACL, friend)
+	}
+
+	// Namespaces changed directly in the db are not inherited or listed.
+	namespaces, err := db.GetNamespaces()
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	tampered := namespaces[0]
+	tampered.ACL = tampered.ACL.Add(knox.Access{Type: knox.User, ID: "attacker", AccessType: knox.Admin})
+	if err := db.PutNamespace(&tampered); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if err := db.PutNamespace(&knox.Namespace{Prefix: "other:", ACL: tampered.ACL}); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	k, err = m.GetKey("payments:k1", knox.Primary)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(k.InheritedACL) != 0 {
+		t.Fatalf("tampered namespace was inherited: %+v", k.InheritedACL)
+	}
+	namespaces, err = m.GetNamespaces()
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(namespaces) != 0 {
+		t.Fatalf("tampered namespaces were listed: %+v", namespaces)
+	}
+	events := sink.Events()
+	for i, prefix := range []string{"other:", "payments:"} {
+		e := events[len(events)-2+i]
+		if e.Type != knox.IntegrityFailureEvent || e.KeyID != prefix || e.Principal != keyManagerComponent {
+			t.Fatalf("unexpected event %+v", e)
+		}
+	}
+
+	// Updating a tampered namespace replaces it.
+	if err := m.UpdateNamespaceAccess("payments:", friend); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	n, err = m.GetNamespace("payments:")
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(n.ACL) != 1 || n.ACL[0] != friend {
+		t.Fatalf("%+v does not equal [%+v]", n.ACL, friend)
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	m, u, acl := GetMocks()
+	for _, id := range []string{"payments:k1", "other"} {
+		key := newKey(id, acl, []byte("data"), u)
+		if err := m.AddNewKey(&key); err != nil {
+			t.Fatalf("%s is not nil", err)
+		}
+	}
+	outer := knox.Access{Type: knox.Machine, ID: "payments001", AccessType: knox.Read}
+	inner := knox.Access{Type: knox.UserGroup, ID: "stripe", AccessType: knox.Admin}
+	if err := m.UpdateNamespaceAccess("payments", outer); err != knox.ErrInvalidNamespace {
+		t.Fatalf("%v does not equal %s", err, knox.ErrInvalidNamespace)
+	}
+	if err := m.UpdateNamespaceAccess("payments:", outer); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if err := m.UpdateNamespaceAccess("payments:stripe:", inner); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+
+	// Keys inherit the ACLs of the namespaces that contain them.
+	key, err := m.GetKey("payments:k1", knox.Primary)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if !reflect.DeepEqual(key.InheritedACL, knox.ACL{outer}) {
+		t.Fatalf("%v does not equal %v", key.InheritedACL, knox.ACL{outer})
+	}
+	key, err = m.GetKey("other", knox.Primary)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(key.InheritedACL) != 0 {
+		t.Fatalf("%v is not empty", key.InheritedACL)
+	}
+	parents, err := m.ParentNamespaces("payments:stripe:k2")
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(parents) != 2 || parents[0].Prefix != "payments:" || parents[1].Prefix != "payments:stripe:" {
+		t.Fatalf("%+v are not the payments: and payments:stripe: namespaces", parents)
+	}
+	ids, err := m.SearchKeyIDs(KeyQuery{Principal: auth.NewMachine("payments001"), Access: knox.Read})
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if !reflect.DeepEqual(ids, []string{"payments:k1"}) {
+		t.Fatalf("%v does not equal [payments:k1]", ids)
+	}
+
+	// Removing an entry keeps the namespace.
+	if err := m.UpdateNamespaceAccess("payments:", knox.Access{Type: knox.Machine, ID: "payments001"}); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	n, err := m.GetNamespace("payments:")
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(n.ACL) != 0 {
+		t.Fatalf("%v is not empty", n.ACL)
+	}
+
+	if err := m.DeleteNamespace("payments:stripe:"); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if _, err := m.GetNamespace("payments:stripe:"); err != knox.ErrNamespaceNotFound {
+		t.Fatalf("%v does not equal %s", err, knox.ErrNamespaceNotFound)
+	}
+	if err := m.DeleteNamespace("payments:stripe:"); err != knox.ErrNamespaceNotFound {
+		t.Fatalf("%v does not equal %s", err, knox.ErrNamespaceNotFound)
+	}
+}
+
+func TestNamespacesUnsupported(t *testing.T) {
+	db := &noFeedDB{keydb.NewTempDB()}
+	m := NewKeyManager(keydb.NewAESGCMCryptor(10, []byte("testtesttesttest")), db)
+	u := auth.NewUser("test", []string{})
+	key := newKey("payments:k1", knox.ACL{}, []byte("data"), u)
+	if err := m.AddNewKey(&key); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	// Keys are read as if there were no namespaces.
+	if _, err := m.GetKey("payments:k1", knox.Primary); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if _, err := m.GetNamespaces(); err != keydb.ErrNoNamespaces {
+		t.Fatalf("%v does not equal %s", err, keydb.ErrNoNamespaces)
+	}
+	if err := m.UpdateNamespaceAccess("payments:", knox.Access{Type: knox.Machine, ID: "payments001", AccessType: knox.Read}); err != keydb.ErrNoNamespaces {
+		t.Fatalf("%v does not equal %s", err, keydb.ErrNoNamespaces)
+	}
+}
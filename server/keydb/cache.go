@@ -0,0 +1,536 @@
+package keydb
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/log"
+)
+
+// HashIndex is implemented by DBs that can compare version hashes without
+// reading every key.
+type HashIndex interface {
+	// UpdatedKeyIDs returns the IDs in versions of keys that are not deleted
+	// and whose version hash differs from the one given.
+	UpdatedKeyIDs(versions map[string]string) ([]string, error)
+}
+
+// CachedDB is a DB that serves reads from an in memory copy of another DB.
+// Writes go straight to the underlying DB and drop the key from the cache,
+// so the next read of it goes to the DB as well.
+//
+// Writes made by other servers sharing the DB are seen on the next Refresh,
+// so the refresh interval bounds how long a server can act on a stale ACL.
+// When the DB is a ChangeFeed a refresh only reads the keys that changed, so
+// it can run every few seconds. An Update based on a stale key fails with
+// ErrDBVersion, as it would for any concurrent change, and drops the key so a
+// retry reads the current one.
+type CachedDB struct {
+	db DB
+
+	sync.RWMutex
+	keys   map[string]*DBKey
+	loaded bool
+	// gen counts changes to the cache, and touched holds the generation at
+	// which each key was last written or read through. A refresh does not
+	// replace keys touched since it started, since it may have read them
+	// before the change.
+	gen     uint64
+	touched map[string]uint64
+	// seq is the change feed sequence number the cache is up to date with,
+	// if fed is set.
+	seq int64
+	fed bool
+	// namespaces is nil until it is read through. nsGen counts namespace
+	// writes, so a read that raced with a write is not cached.
+	namespaces []knox.Namespace
+	nsGen      uint64
+}
+
+// NewCachedDB creates a CachedDB in front of db. Keys are loaded on first use.
+func NewCachedDB(db DB) *CachedDB {
+	return &CachedDB{db: db, keys: map[string]*DBKey{}, touched: map[string]uint64{}}
+}
+
+// touch records a change to the key and drops it from the cache. It must be
+// called with the lock held.
+func (c *CachedDB) touch(id string) {
+	c.gen++
+	c.touched[id] = c.gen
+	delete(c.keys, id)
+}
+
+// cacheChangeBatch is the number of changes a refresh reads at a time.
+const cacheChangeBatch = 1000
+
+// Refresh brings the cache up to date with the underlying DB. If the DB has a
+// change feed, only the keys changed since the last refresh are read;
+// otherwise every key is reloaded, and keys whose DBVersion has not changed
+// keep their cached copy. Namespaces are always reloaded.
+func (c *CachedDB) Refresh() error {
+	if s, ok := c.db.(NamespaceStore); ok {
+		if _, err := c.loadNamespaces(s); err != nil {
+			return err
+		}
+	}
+	c.RLock()
+	start, loaded, seq, fed := c.gen, c.loaded, c.seq, c.fed
+	c.RUnlock()
+
+	feed, ok := c.db.(ChangeFeed)
+	if ok && loaded && fed {
+		err := c.refreshChanges(feed, start, seq)
+		if err != ErrChangesTruncated {
+			return err
+		}
+	}
+	fed = false
+	if ok {
+		var err error
+		seq, err = feed.LastSeq()
+		if err != nil && err != ErrNoChangeFeed {
+			return err
+		}
+		fed = err == nil
+	}
+
+	keys, err := c.db.GetAll()
+	if err != nil {
+		return err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	fresh := make(map[string]*DBKey, len(keys))
+	for i := range keys {
+		k := &keys[i]
+		if c.touched[k.ID] > start {
+			continue
+		}
+		if old, ok := c.keys[k.ID]; ok && old.DBVersion == k.DBVersion {
+			fresh[k.ID] = old
+			continue
+		}
+		fresh[k.ID] = k.Copy()
+	}
+	for id, gen := range c.touched {
+		if gen <= start {
+			delete(c.touched, id)
+		} else if k, ok := c.keys[id]; ok {
+			fresh[id] = k
+		}
+	}
+	c.keys = fresh
+	c.loaded = true
+	c.seq, c.fed = seq, fed
+	return nil
+}
+
+// refreshChanges reads the keys changed after seq, along with the keys
+// written through the cache before the refresh started, which the change
+// feed may have listed before seq.
+func (c *CachedDB) refreshChanges(feed ChangeFeed, start uint64, seq int64) error {
+	ids := map[string]bool{}
+	for {
+		changes, err := feed.Changes(seq, cacheChangeBatch)
+		if err != nil {
+			return err
+		}
+		for _, ch := range changes {
+			ids[ch.KeyID] = true
+			seq = ch.Seq
+		}
+		if len(changes) < cacheChangeBatch {
+			break
+		}
+	}
+	c.RLock()
+	for id, gen := range c.touched {
+		if gen <= start {
+			ids[id] = true
+		}
+	}
+	c.RUnlock()
+
+	// A nil key is one that has been removed.
+	fetched := make(map[string]*DBKey, len(ids))
+	for id := range ids {
+		k, err := c.db.Get(id)
+		if err != nil && err != knox.ErrKeyIDNotFound {
+			return err
+		}
+		fetched[id] = k
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	for id, k := range fetched {
+		if c.touched[id] > start {
+			continue
+		}
+		if k == nil {
+			delete(c.keys, id)
+		} else {
+			c.keys[id] = k
+		}
+	}
+	for id, gen := range c.touched {
+		if gen <= start {
+			delete(c.touched, id)
+		}
+	}
+	c.seq = seq
+	return nil
+}
+
+// load refreshes the cache if it has never been loaded.
+func (c *CachedDB) load() error {
+	c.RLock()
+	loaded := c.loaded
+	c.RUnlock()
+	if loaded {
+		return nil
+	}
+	return c.Refresh()
+}
+
+// Run refreshes the cache every interval until stop is closed.
+func (c *CachedDB) Run(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := c.Refresh(); err != nil {
+				log.Printf("Failed to refresh key cache: %s", err.Error())
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Get returns the cached key, or reads it from the underlying DB if it is not
+// cached.
+func (c *CachedDB) Get(id string) (*DBKey, error) {
+	c.RLock()
+	k, ok := c.keys[id]
+	start := c.gen
+	c.RUnlock()
+	if ok {
+		return k.Copy(), nil
+	}
+	k, err := c.db.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	c.Lock()
+	// A key written while it was read may be out of date, so it is left for
+	// the next read.
+	if c.touched[id] <= start {
+		c.touch(id)
+		c.keys[id] = k.Copy()
+	}
+	c.Unlock()
+	return k, nil
+}
+
+// GetAll returns every cached key, loading the cache on first use. Keys
+// written since the last refresh are read from the underlying DB.
+func (c *CachedDB) GetAll() ([]DBKey, error) {
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	c.RLock()
+	keys := make([]DBKey, 0, len(c.keys))
+	for _, k := range c.keys {
+		keys = append(keys, *k.Copy())
+	}
+	missing := c.uncached()
+	c.RUnlock()
+	for _, id := range missing {
+		k, err := c.Get(id)
+		if err == knox.ErrKeyIDNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *k)
+	}
+	return keys, nil
+}
+
+// uncached returns the IDs of touched keys that are not in the cache. It must
+// be called with the read lock held.
+func (c *CachedDB) uncached() []string {
+	var ids []string
+	for id := range c.touched {
+		if _, ok := c.keys[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// UpdatedKeyIDs returns the IDs in versions of keys that are not deleted and
+// whose version hash differs, looking up only the given keys.
+func (c *CachedDB) UpdatedKeyIDs(versions map[string]string) ([]string, error) {
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	output := []string{}
+	for id, hash := range versions {
+		c.RLock()
+		k, ok := c.keys[id]
+		_, touched := c.touched[id]
+		c.RUnlock()
+		if !ok {
+			if !touched {
+				continue
+			}
+			var err error
+			k, err = c.Get(id)
+			if err == knox.ErrKeyIDNotFound {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		if k.DeletedAt == 0 && k.VersionHash != hash {
+			output = append(output, id)
+		}
+	}
+	return output, nil
+}
+
+// Update writes the key to the underlying DB and drops it from the cache.
+func (c *CachedDB) Update(key *DBKey) error {
+	err := c.db.Update(key)
+	if err == nil || err == ErrDBVersion || err == knox.ErrKeyIDNotFound {
+		c.Lock()
+		c.touch(key.ID)
+		c.Unlock()
+	}
+	return err
+}
+
+// Add adds the keys to the underlying DB and drops them from the cache.
+func (c *CachedDB) Add(keys ...*DBKey) error {
+	err := c.db.Add(keys...)
+	c.Lock()
+	for _, k := range keys {
+		c.touch(k.ID)
+	}
+	c.Unlock()
+	return err
+}
+
+// Remove removes the key from the underlying DB and the cache.
+func (c *CachedDB) Remove(id string) error {
+	err := c.db.Remove(id)
+	c.Lock()
+	c.touch(id)
+	c.Unlock()
+	return err
+}
+
+// Transact runs f in a transaction on the underlying DB, which must be a
+// Transactor. The keys it writes are dropped from the cache.
+func (c *CachedDB) Transact(f func(tx DB) error) error {
+	t, ok := c.db.(Transactor)
+	if !ok {
+		return ErrNoTransactions
+	}
+	tx := &cachedTx{}
+	err := t.Transact(func(db DB) error {
+		tx.DB = db
+		return f(tx)
+	})
+	c.Lock()
+	for _, id := range tx.written {
+		c.touch(id)
+	}
+	c.Unlock()
+	return err
+}
+
+// cachedTx records the keys written in a transaction on a CachedDB.
+type cachedTx struct {
+	DB
+	written []string
+}
+
+func (t *cachedTx) Update(key *DBKey) error {
+	t.written = append(t.written, key.ID)
+	return t.DB.Update(key)
+}
+
+func (t *cachedTx) Add(keys ...*DBKey) error {
+	for _, k := range keys {
+		t.written = append(t.written, k.ID)
+	}
+	return t.DB.Add(keys...)
+}
+
+func (t *cachedTx) Remove(id string) error {
+	t.written = append(t.written, id)
+	return t.DB.Remove(id)
+}
+
+// Changes returns the changes from the underlying DB, which must be a
+// ChangeFeed.
+func (c *CachedDB) Changes(after int64, limit int) ([]Change, error) {
+	feed, ok := c.db.(ChangeFeed)
+	if !ok {
+		return nil, ErrNoChangeFeed
+	}
+	return feed.Changes(after, limit)
+}
+
+// LastSeq returns the latest sequence number of the underlying DB, which must
+// be a ChangeFeed.
+func (c *CachedDB) LastSeq() (int64, error) {
+	feed, ok := c.db.(ChangeFeed)
+	if !ok {
+		return 0, ErrNoChangeFeed
+	}
+	return feed.LastSeq()
+}
+
+// webhooks returns the underlying DB if it is a WebhookStore. Webhooks are
+// not cached.
+func (c *CachedDB) webhooks() (WebhookStore, error) {
+	s, ok := c.db.(WebhookStore)
+	if !ok {
+		return nil, ErrNoWebhooks
+	}
+	return s, nil
+}
+
+// AddWebhook adds a webhook to the underlying DB.
+func (c *CachedDB) AddWebhook(w *knox.Webhook) error {
+	s, err := c.webhooks()
+	if err != nil {
+		return err
+	}
+	return s.AddWebhook(w)
+}
+
+// GetWebhooks returns every webhook in the underlying DB.
+func (c *CachedDB) GetWebhooks() ([]knox.Webhook, error) {
+	s, err := c.webhooks()
+	if err != nil {
+		return nil, err
+	}
+	return s.GetWebhooks()
+}
+
+// RemoveWebhook removes a webhook from the underlying DB.
+func (c *CachedDB) RemoveWebhook(id string) error {
+	s, err := c.webhooks()
+	if err != nil {
+		return err
+	}
+	return s.RemoveWebhook(id)
+}
+
+// AddDeadLetter adds a dead letter to the underlying DB.
+func (c *CachedDB) AddDeadLetter(d *knox.WebhookDeadLetter) error {
+	s, err := c.webhooks()
+	if err != nil {
+		return err
+	}
+	return s.AddDeadLetter(d)
+}
+
+// GetDeadLetters returns the dead letters of a webhook in the underlying DB.
+func (c *CachedDB) GetDeadLetters(webhookID string) ([]knox.WebhookDeadLetter, error) {
+	s, err := c.webhooks()
+	if err != nil {
+		return nil, err
+	}
+	return s.GetDeadLetters(webhookID)
+}
+
+// namespaceStore returns the underlying DB if it is a NamespaceStore.
+func (c *CachedDB) namespaceStore() (NamespaceStore, error) {
+	s, ok := c.db.(NamespaceStore)
+	if !ok {
+		return nil, ErrNoNamespaces
+	}
+	return s, nil
+}
+
+// loadNamespaces reads the namespaces from the underlying DB and caches them
+// unless they were written in the meantime.
+func (c *CachedDB) loadNamespaces(s NamespaceStore) ([]knox.Namespace, error) {
+	c.RLock()
+	gen := c.nsGen
+	c.RUnlock()
+	namespaces, err := s.GetNamespaces()
+	if err != nil {
+		return nil, err
+	}
+	c.Lock()
+	if c.nsGen == gen {
+		c.namespaces = namespaces
+	}
+	c.Unlock()
+	return copyNamespaces(namespaces), nil
+}
+
+// GetNamespaces returns every namespace, reading them through the cache
+// since they are needed for every key read.
+func (c *CachedDB) GetNamespaces() ([]knox.Namespace, error) {
+	s, err := c.namespaceStore()
+	if err != nil {
+		return nil, err
+	}
+	c.RLock()
+	namespaces := c.namespaces
+	c.RUnlock()
+	if namespaces != nil {
+		return copyNamespaces(namespaces), nil
+	}
+	return c.loadNamespaces(s)
+}
+
+// PutNamespace writes the namespace to the underlying DB and drops the
+// cached namespaces.
+func (c *CachedDB) PutNamespace(n *knox.Namespace) error {
+	s, err := c.namespaceStore()
+	if err != nil {
+		return err
+	}
+	defer c.invalidateNamespaces()
+	return s.PutNamespace(n)
+}
+
+// RemoveNamespace removes the namespace from the underlying DB and drops the
+// cached namespaces.
+func (c *CachedDB) RemoveNamespace(prefix string) error {
+	s, err := c.namespaceStore()
+	if err != nil {
+		return err
+	}
+	defer c.invalidateNamespaces()
+	return s.RemoveNamespace(prefix)
+}
+
+func (c *CachedDB) invalidateNamespaces() {
+	c.Lock()
+	defer c.Unlock()
+	c.nsGen++
+	c.namespaces = nil
+}
+
+func copyNamespaces(namespaces []knox.Namespace) []knox.Namespace {
+	c := make([]knox.Namespace, len(namespaces))
+	for i, n := range namespaces {
+		c[i] = copyNamespace(&n)
+	}
+	return c
+}
@@ -0,0 +1,265 @@
+package keydb
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/pinterest/knox"
+)
+
+// countingDB counts the reads that reach the underlying DB.
+type countingDB struct {
+	DB
+	gets, getAlls int
+}
+
+func (db *countingDB) Get(id string) (*DBKey, error) {
+	db.gets++
+	return db.DB.Get(id)
+}
+
+func (db *countingDB) GetAll() ([]DBKey, error) {
+	db.getAlls++
+	return db.DB.GetAll()
+}
+
+func TestCachedDBServesReads(t *testing.T) {
+	inner := &countingDB{DB: NewTempDB()}
+	c := NewCachedDB(inner)
+	k := newDBKey("k1", []byte("a"), 0)
+	if err := c.Add(&k); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := c.Get("k1"); err != nil {
+			t.Fatalf("%s is not nil", err)
+		}
+	}
+	if inner.gets != 1 {
+		t.Fatalf("%d does not equal 1", inner.gets)
+	}
+	for i := 0; i < 3; i++ {
+		keys, err := c.GetAll()
+		if err != nil {
+			t.Fatalf("%s is not nil", err)
+		}
+		if len(keys) != 1 {
+			t.Fatalf("%d does not equal 1", len(keys))
+		}
+	}
+	if inner.getAlls != 1 {
+		t.Fatalf("%d does not equal 1", inner.getAlls)
+	}
+}
+
+func TestCachedDBInvalidation(t *testing.T) {
+	inner := NewTempDB()
+	c := NewCachedDB(inner)
+	k := newDBKey("k1", []byte("a"), 0)
+	if err := c.Add(&k); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if err := c.Refresh(); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+
+	// A write by another server is seen after a refresh.
+	other, _ := inner.Get("k1")
+	other.VersionHash = "other"
+	if err := inner.Update(other); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	cached, _ := c.Get("k1")
+	if cached.VersionHash == "other" {
+		t.Fatal("cache read through to the DB")
+	}
+	// Updating the stale key fails and drops it from the cache.
+	cached.VersionHash = "local"
+	if err := c.Update(cached); err != ErrDBVersion {
+		t.Fatalf("%v does not equal %s", err, ErrDBVersion)
+	}
+	cached, _ = c.Get("k1")
+	if cached.VersionHash != "other" {
+		t.Fatalf("%s does not equal other", cached.VersionHash)
+	}
+
+	// Local writes are seen immediately.
+	cached.VersionHash = "local"
+	if err := c.Update(cached); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	cached, _ = c.Get("k1")
+	if cached.VersionHash != "local" {
+		t.Fatalf("%s does not equal local", cached.VersionHash)
+	}
+
+	k2 := newDBKey("k2", []byte("b"), 0)
+	if err := inner.Add(&k2); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if err := c.Remove("k1"); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	keys, _ := c.GetAll()
+	if len(keys) != 0 {
+		t.Fatalf("unexpected keys %+v", keys)
+	}
+	if err := c.Refresh(); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	keys, _ = c.GetAll()
+	if len(keys) != 1 || keys[0].ID != "k2" {
+		t.Fatalf("unexpected keys %+v", keys)
+	}
+}
+
+func TestCachedDBUpdatedKeyIDs(t *testing.T) {
+	inner := &countingDB{DB: NewTempDB()}
+	c := NewCachedDB(inner)
+	var keys []*DBKey
+	for _, id := range []string{"k1", "k2", "k3"} {
+		k := newDBKey(id, []byte("a"), 0)
+		k.VersionHash = id + "-hash"
+		keys = append(keys, &k)
+	}
+	keys[2].DeletedAt = 1
+	if err := c.Add(keys...); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	ids, err := c.UpdatedKeyIDs(map[string]string{"k1": "k1-hash", "k2": "old", "k3": "old", "missing": "old"})
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(ids) != 1 || ids[0] != "k2" {
+		t.Fatalf("unexpected ids %v", ids)
+	}
+
+	k, _ := c.Get("k1")
+	k.VersionHash = "new"
+	if err := c.Update(k); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	ids, err = c.UpdatedKeyIDs(map[string]string{"k1": "k1-hash", "k2": "old"})
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	sort.Strings(ids)
+	if len(ids) != 2 || ids[0] != "k1" || ids[1] != "k2" {
+		t.Fatalf("unexpected ids %v", ids)
+	}
+	if inner.getAlls != 1 {
+		t.Fatalf("%d does not equal 1", inner.getAlls)
+	}
+	if _, err := c.Get("missing"); err != knox.ErrKeyIDNotFound {
+		t.Fatalf("%v does not equal %s", err, knox.ErrKeyIDNotFound)
+	}
+}
+
+// feedDB is a countingDB that also exposes the change feed of the DB.
+type feedDB struct {
+	*countingDB
+	ChangeFeed
+}
+
+func TestCachedDBRefreshChanges(t *testing.T) {
+	inner := NewTempDB()
+	counting := &countingDB{DB: inner}
+	c := NewCachedDB(&feedDB{counting, inner.(ChangeFeed)})
+	k1 := newDBKey("k1", []byte("a"), 0)
+	k2 := newDBKey("k2", []byte("b"), 0)
+	if err := c.Add(&k1, &k2); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if err := c.Refresh(); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+
+	// Only the keys changed by other servers are read again.
+	k, _ := inner.Get("k1")
+	k.VersionHash = "other"
+	if err := inner.Update(k); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if err := inner.Remove("k2"); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	k3 := newDBKey("k3", []byte("c"), 0)
+	if err := inner.Add(&k3); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	counting.gets = 0
+	if err := c.Refresh(); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if counting.getAlls != 1 || counting.gets != 3 {
+		t.Fatalf("refresh read %d keys and all keys %d times", counting.gets, counting.getAlls)
+	}
+	keys, _ := c.GetAll()
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	if len(keys) != 2 || keys[0].ID != "k1" || keys[0].VersionHash != "other" || keys[1].ID != "k3" {
+		t.Fatalf("unexpected keys %+v", keys)
+	}
+
+	// Once the changes it needs are discarded, every key is read again.
+	for i := 0; i < 2*changeRingSize; i++ {
+		k, _ := inner.Get("k1")
+		if err := inner.Update(k); err != nil {
+			t.Fatalf("%s is not nil", err)
+		}
+	}
+	if err := c.Refresh(); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if counting.getAlls != 2 {
+		t.Fatalf("%d does not equal 2", counting.getAlls)
+	}
+}
+
+func TestCachedDBNamespaces(t *testing.T) {
+	inner := NewTempDB()
+	c := NewCachedDB(inner)
+	if err := c.PutNamespace(&knox.Namespace{Prefix: "a:"}); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	namespaces, err := c.GetNamespaces()
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(namespaces) != 1 {
+		t.Fatalf("%d does not equal 1", len(namespaces))
+	}
+
+	// Changes made by another server are seen after a refresh.
+	if err := inner.(NamespaceStore).PutNamespace(&knox.Namespace{Prefix: "b:"}); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	namespaces, err = c.GetNamespaces()
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(namespaces) != 1 {
+		t.Fatalf("%d does not equal 1", len(namespaces))
+	}
+	if err := c.Refresh(); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	namespaces, err = c.GetNamespaces()
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(namespaces) != 2 {
+		t.Fatalf("%d does not equal 2", len(namespaces))
+	}
+
+	// Writes through the cache are seen immediately.
+	if err := c.RemoveNamespace("a:"); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	namespaces, err = c.GetNamespaces()
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(namespaces) != 1 || namespaces[0].Prefix != "b:" {
+		t.Fatalf("%+v does not equal [b:]", namespaces)
+	}
+}
@@ -0,0 +1,83 @@
+package keydb
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ErrChangesTruncated is returned when changes after the given sequence
+// number are no longer kept, so the caller has to read every key again.
+var ErrChangesTruncated = fmt.Errorf("changes since the given sequence number are not available")
+
+// ErrNoChangeFeed is returned when changes are read from a DB that does not
+// keep them.
+var ErrNoChangeFeed = fmt.Errorf("DB does not have a change feed")
+
+// Change records that a key was added, updated or removed.
+type Change struct {
+	// Seq orders the changes to a DB. Each change has a larger sequence
+	// number than the changes before it.
+	Seq   int64  `json:"seq"`
+	KeyID string `json:"id"`
+}
+
+// ChangeFeed is implemented by DBs that log every Add, Update and Remove, so
+// readers can find the keys that changed without reading all of them.
+type ChangeFeed interface {
+	// Changes returns up to limit changes with a sequence number greater than
+	// after, oldest first. It returns ErrChangesTruncated if some of those
+	// changes are no longer kept.
+	Changes(after int64, limit int) ([]Change, error)
+	// LastSeq returns the sequence number of the latest change. Reading it
+	// before GetAll gives the point to read changes from afterwards.
+	LastSeq() (int64, error)
+}
+
+// changeRingSize is the number of changes kept by DBs that keep their change
+// feed in memory.
+const changeRingSize = 4096
+
+// changeRing keeps the latest changes to a DB in memory. The zero value is an
+// empty feed starting at sequence number zero.
+type changeRing struct {
+	changes []Change
+	// floor is the sequence number of the last change that is no longer
+	// kept, and last the sequence number of the latest change.
+	floor, last int64
+}
+
+func newChangeRing(seq int64) changeRing {
+	return changeRing{floor: seq, last: seq}
+}
+
+// add records a change. seq must be larger than that of every earlier change.
+func (r *changeRing) add(seq int64, id string) {
+	r.changes = append(r.changes, Change{Seq: seq, KeyID: id})
+	r.last = seq
+	// Old changes are dropped in bulk so adding a change is cheap.
+	if len(r.changes) >= 2*changeRingSize {
+		drop := len(r.changes) - changeRingSize
+		r.floor = r.changes[drop-1].Seq
+		r.changes = append([]Change(nil), r.changes[drop:]...)
+	}
+}
+
+// since returns up to limit changes after the given sequence number. A
+// sequence number later than the last change was not given out by this feed,
+// for example if the DB was restarted, so it is treated as truncated.
+func (r *changeRing) since(after int64, limit int) ([]Change, error) {
+	if after < r.floor || after > r.last {
+		return nil, ErrChangesTruncated
+	}
+	i := sort.Search(len(r.changes), func(i int) bool { return r.changes[i].Seq > after })
+	n := len(r.changes) - i
+	if n > limit {
+		n = limit
+	}
+	if n < 0 {
+		n = 0
+	}
+	changes := make([]Change, n)
+	copy(changes, r.changes[i:i+n])
+	return changes, nil
+}
@@ -0,0 +1,33 @@
+package keydb
+
+import "testing"
+
+func TestChangeRing(t *testing.T) {
+	var r changeRing
+	for i := int64(1); i <= 2*changeRingSize; i++ {
+		r.add(i, "k")
+	}
+	if len(r.changes) != changeRingSize {
+		t.Fatalf("%d does not equal %d", len(r.changes), changeRingSize)
+	}
+	if _, err := r.since(0, 10); err != ErrChangesTruncated {
+		t.Fatalf("%v does not equal %s", err, ErrChangesTruncated)
+	}
+	changes, err := r.since(r.floor, 10)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(changes) != 10 || changes[0].Seq != r.floor+1 {
+		t.Fatalf("unexpected changes %+v", changes)
+	}
+	changes, err = r.since(r.last, 10)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(changes) != 0 {
+		t.Fatalf("unexpected changes %+v", changes)
+	}
+	if _, err := r.since(r.last+1, 10); err != ErrChangesTruncated {
+		t.Fatalf("%v does not equal %s", err, ErrChangesTruncated)
+	}
+}
@@ -0,0 +1,65 @@
+package keydb_test
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+
+	"github.com/pinterest/knox/server/keydb"
+	"github.com/pinterest/knox/server/keydb/keydbtest"
+)
+
+func TestTempDBConformance(t *testing.T) {
+	keydbtest.Run(t, func(t *testing.T) keydb.DB {
+		return keydb.NewTempDB()
+	})
+}
+
+func TestFileDBConformance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filedb")
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	defer os.RemoveAll(dir)
+	n := 0
+	keydbtest.Run(t, func(t *testing.T) keydb.DB {
+		n++
+		db, err := keydb.NewFileDB(path.Join(dir, strconv.Itoa(n)))
+		if err != nil {
+			t.Fatalf("%s is not nil", err)
+		}
+		t.Cleanup(func() { db.Close() })
+		return db
+	})
+}
+
+func TestCachedDBConformance(t *testing.T) {
+	keydbtest.Run(t, func(t *testing.T) keydb.DB {
+		return keydb.NewCachedDB(keydb.NewTempDB())
+	})
+}
+
+// TestSQLDBConformance runs against sqlite, so it is skipped unless the tests
+// are built with the sqlite tag.
+func TestSQLDBConformance(t *testing.T) {
+	if !keydb.HasSQLiteDriver() {
+		t.Skip("sqlite3 driver is not registered; run with -tags sqlite")
+	}
+	keydbtest.Run(t, func(t *testing.T) keydb.DB {
+		d, err := sql.Open("sqlite3", ":memory:")
+		if err != nil {
+			t.Fatalf("%s is not nil", err)
+		}
+		// Every connection to :memory: opens a separate database.
+		d.SetMaxOpenConns(1)
+		t.Cleanup(func() { d.Close() })
+		db, err := keydb.NewSQLDB(d)
+		if err != nil {
+			t.Fatalf("%s is not nil", err)
+		}
+		return db
+	})
+}
@@ -45,7 +45,7 @@ func (c *aesGCMCryptor) EncryptVersion(k *knox.Key, v *knox.KeyVersion) (*EncKey
 		return nil, err
 	}
 
-	ciphertext := gcm.Seal(nil, nonce, v.Data, c.generateAD(k.ID, v.ID, v.CreationTime))
+	ciphertext := gcm.Seal(nil, nonce, v.Data, generateAD(k.ID, v.ID, v.CreationTime))
 
 	return &EncKeyVersion{
 		ID:             v.ID,
@@ -57,7 +57,7 @@ func (c *aesGCMCryptor) EncryptVersion(k *knox.Key, v *knox.KeyVersion) (*EncKey
 }
 
 // generateAD generates the data to be signed with key version versionid|creationtime|keyid
-func (c *aesGCMCryptor) generateAD(kid string, vid uint64, creation int64) []byte {
+func generateAD(kid string, vid uint64, creation int64) []byte {
 	idBytes := make([]byte, binary.MaxVarintLen64)
 	binary.PutUvarint(idBytes, vid)
 	creationBytes := make([]byte, binary.MaxVarintLen64)
@@ -83,7 +83,7 @@ func (c *aesGCMCryptor) decryptVersion(k *DBKey, v *EncKeyVersion) (*knox.KeyVer
 		return nil, err
 	}
 
-	plaintext, err := gcm.Open(nil, md.Nonce(), v.EncData, c.generateAD(k.ID, v.ID, v.CreationTime))
+	plaintext, err := gcm.Open(nil, md.Nonce(), v.EncData, generateAD(k.ID, v.ID, v.CreationTime))
 	if err != nil {
 		return nil, err
 	}
@@ -111,6 +111,8 @@ func (c *aesGCMCryptor) Encrypt(k *knox.Key) (*DBKey, error) {
 		ACL:         k.ACL,
 		VersionList: dbVersions,
 		VersionHash: k.VersionHash,
+		Metadata:    k.Metadata.Copy(),
+		Policy:      k.Policy.Copy(),
 	}
 	return &newKey, nil
 }
@@ -130,6 +132,8 @@ func (c *aesGCMCryptor) Decrypt(k *DBKey) (*knox.Key, error) {
 		ACL:         k.ACL,
 		VersionList: versions,
 		VersionHash: k.VersionHash,
+		Metadata:    k.Metadata.Copy(),
+		Policy:      k.Policy.Copy(),
 	}
 	return &newKey, nil
 }
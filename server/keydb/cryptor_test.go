@@ -15,6 +15,8 @@ func makeTestKey() *knox.Key {
 		ACL:         knox.ACL([]knox.Access{{Type: knox.User, ID: "testUser", AccessType: knox.Read}}),
 		VersionList: knox.KeyVersionList([]knox.KeyVersion{makeTestVersion()}),
 		VersionHash: "testHash",
+		Metadata:    &knox.KeyMetadata{Description: "test key", Tags: []string{"test"}, CreatedBy: "testUser", CreationTime: 1},
+		Policy:      &knox.KeyPolicy{RequireApproval: true},
 	}
 }
 
@@ -0,0 +1,367 @@
+package keydb
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+
+	"github.com/pinterest/knox"
+)
+
+var (
+	ErrInvalidDataKey = fmt.Errorf("Data key is missing or malformed")
+	ErrNotRewrappable = fmt.Errorf("Key has versions that are not encrypted under its data key")
+)
+
+// Crypto schemes of key versions. aesGCMCryptor predates schemes, so its
+// metadata does not record one; it is recognized by its length instead.
+const (
+	aesGCMScheme   byte = 0
+	envelopeScheme byte = 1
+)
+
+// aesMetadataLen is the length of the metadata written by aesGCMCryptor: a
+// version byte followed by a GCM nonce.
+const aesMetadataLen = 1 + 12
+
+// dataKeySize is the size of per-key data encryption keys (AES-256).
+const dataKeySize = 32
+
+// versionScheme returns the crypto scheme of a key version.
+func versionScheme(v *EncKeyVersion) (byte, error) {
+	switch {
+	case len(v.CryptoMetadata) == aesMetadataLen:
+		return aesGCMScheme, nil
+	case len(v.CryptoMetadata) > 0:
+		return v.CryptoMetadata[0], nil
+	}
+	return 0, ErrCryptorVersion
+}
+
+// DBVersionEncryptor is implemented by Cryptors that need the stored key to
+// encrypt a new version, e.g. to use the key's data key. EncryptDBVersion may
+// set fields of k, such as DataKey, which must then be written with the version.
+type DBVersionEncryptor interface {
+	EncryptDBVersion(k *DBKey, v *knox.KeyVersion) (*EncKeyVersion, error)
+}
+
+// EncryptVersion encrypts a new version of the stored key k, whose decrypted
+// form is key. It uses EncryptDBVersion if the cryptor implements it.
+func EncryptVersion(c Cryptor, k *DBKey, key *knox.Key, v *knox.KeyVersion) (*EncKeyVersion, error) {
+	if e, ok := c.(DBVersionEncryptor); ok {
+		return e.EncryptDBVersion(k, v)
+	}
+	return c.EncryptVersion(key, v)
+}
+
+// Rewrapper is implemented by Cryptors that can bring a stale key up to date
+// by rewrapping its data key under the current master key, without
+// decrypting and reencrypting its versions.
+type Rewrapper interface {
+	// Rewrap sets k.DataKey to its data key wrapped by the current master
+	// key. It fails with ErrNotRewrappable if k has versions that are not
+	// encrypted under its data key, which must be reencrypted instead.
+	Rewrap(k *DBKey) error
+}
+
+// Rewrap rewraps the data key of k if c is a Rewrapper, and fails with
+// ErrNotRewrappable otherwise.
+func Rewrap(c Cryptor, k *DBKey) error {
+	if r, ok := c.(Rewrapper); ok {
+		return r.Rewrap(k)
+	}
+	return ErrNotRewrappable
+}
+
+// NewEnvelopeCryptor creates a Cryptor that encrypts the versions of each key
+// under a random data key for that key. The data key is stored in
+// DBKey.DataKey, wrapped with AES GCM by the master key, so rotating the
+// master key only needs the data keys to be rewrapped; see
+// NewEnvelopeKeyring. Versions encrypted by an AES GCM cryptor with the same
+// version and master key still decrypt.
+func NewEnvelopeCryptor(version byte, masterKey []byte) Cryptor {
+	c, _ := NewEnvelopeKeyring(version, map[byte]KeyWrapper{version: &aesKeyWrapper{masterKey}})
+	return c
+}
+
+// NewEnvelopeKeyring creates an envelope encryption Cryptor that wraps new
+// data keys with the master key of the current version, and unwraps them
+// with whichever version in wrappers is recorded in the wrapped data key.
+// Keys with data keys wrapped by a previous version are stale, and a
+// Reencryptor rewraps their data keys. Versions encrypted directly under a
+// master key by an AES GCM cryptor still decrypt if the master key of their
+// version is local, e.g. from NewAESKeyWrapper or NewKeyfileWrapper.
+func NewEnvelopeKeyring(current byte, wrappers map[byte]KeyWrapper) (Cryptor, error) {
+	if _, ok := wrappers[current]; !ok {
+		return nil, ErrNoCurrentKey
+	}
+	c := &envelopeCryptor{
+		version:  current,
+		wrappers: map[byte]KeyWrapper{},
+		legacy:   map[byte]*aesGCMCryptor{},
+	}
+	for version, w := range wrappers {
+		c.wrappers[version] = w
+		if aw, ok := w.(*aesKeyWrapper); ok {
+			c.legacy[version] = &aesGCMCryptor{aw.keyData, version}
+		}
+	}
+	return c, nil
+}
+
+type envelopeCryptor struct {
+	version byte
+	// wrappers holds the master key of every version that data keys can be
+	// wrapped by, including the current one.
+	wrappers map[byte]KeyWrapper
+	// legacy decrypts versions written before data keys were used, by the
+	// version of their master key. It only has the master keys that are
+	// available to knox.
+	legacy map[byte]*aesGCMCryptor
+}
+
+// envelopeMetadata is the scheme, the version of the master key that wrapped
+// the data key, and the nonce.
+type envelopeMetadata []byte
+
+func (c envelopeMetadata) Version() byte {
+	return c[1]
+}
+
+func (c envelopeMetadata) Nonce() []byte {
+	return c[2:]
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(b)
+}
+
+// wrap wraps a data key with the master key and prefixes the master key
+// version. The key ID is authenticated so a data key cannot be moved to
+// another key.
+func (c *envelopeCryptor) wrap(keyID string, dataKey []byte) ([]byte, error) {
+	wrapped, err := c.wrappers[c.version].Wrap(dataKey, []byte(keyID))
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{c.version}, wrapped...), nil
+}
+
+// unwrap unwraps a data key with the master key of the version it was
+// wrapped by.
+func (c *envelopeCryptor) unwrap(keyID string, wrapped []byte) ([]byte, error) {
+	if len(wrapped) < 1 {
+		return nil, ErrInvalidDataKey
+	}
+	w, ok := c.wrappers[wrapped[0]]
+	if !ok {
+		return nil, ErrCryptorVersion
+	}
+	return w.Unwrap(wrapped[1:], []byte(keyID))
+}
+
+// newDataKey generates a data key for the key and returns it along with its
+// wrapped form.
+func (c *envelopeCryptor) newDataKey(keyID string) ([]byte, []byte, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, nil, err
+	}
+	wrapped, err := c.wrap(keyID, dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dataKey, wrapped, nil
+}
+
+func (c *envelopeCryptor) encryptVersion(dataKey []byte, keyID string, v *knox.KeyVersion) (*EncKeyVersion, error) {
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	md := append([]byte{envelopeScheme, c.version}, nonce...)
+
+	return &EncKeyVersion{
+		ID:             v.ID,
+		EncData:        gcm.Seal(nil, nonce, v.Data, generateAD(keyID, v.ID, v.CreationTime)),
+		Status:         v.Status,
+		CreationTime:   v.CreationTime,
+		CryptoMetadata: md,
+	}, nil
+}
+
+func (c *envelopeCryptor) decryptVersion(dataKey []byte, k *DBKey, v *EncKeyVersion) (*knox.KeyVersion, error) {
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	md := envelopeMetadata(v.CryptoMetadata)
+	if len(md) != 2+gcm.NonceSize() {
+		return nil, ErrInvalidDataKey
+	}
+	plaintext, err := gcm.Open(nil, md.Nonce(), v.EncData, generateAD(k.ID, v.ID, v.CreationTime))
+	if err != nil {
+		return nil, err
+	}
+	return &knox.KeyVersion{
+		ID:           v.ID,
+		Data:         plaintext,
+		Status:       v.Status,
+		CreationTime: v.CreationTime,
+	}, nil
+}
+
+// EncryptVersion encrypts directly under the master key, as an AES GCM
+// cryptor would, since a knox.Key does not carry its data key. Use
+// EncryptDBVersion to encrypt under the data key. Cryptors without the master
+// key, such as those from NewKMSCryptor, can only use EncryptDBVersion.
+func (c *envelopeCryptor) EncryptVersion(k *knox.Key, v *knox.KeyVersion) (*EncKeyVersion, error) {
+	legacy, ok := c.legacy[c.version]
+	if !ok {
+		return nil, ErrInvalidDataKey
+	}
+	return legacy.EncryptVersion(k, v)
+}
+
+// EncryptDBVersion encrypts a version under the key's data key, generating a
+// data key first for keys that were stored without one.
+func (c *envelopeCryptor) EncryptDBVersion(k *DBKey, v *knox.KeyVersion) (*EncKeyVersion, error) {
+	var dataKey []byte
+	var err error
+	if k.DataKey == nil {
+		var wrapped []byte
+		dataKey, wrapped, err = c.newDataKey(k.ID)
+		if err != nil {
+			return nil, err
+		}
+		k.DataKey = wrapped
+	} else {
+		dataKey, err = c.unwrap(k.ID, k.DataKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c.encryptVersion(dataKey, k.ID, v)
+}
+
+func (c *envelopeCryptor) Encrypt(k *knox.Key) (*DBKey, error) {
+	dataKey, wrapped, err := c.newDataKey(k.ID)
+	if err != nil {
+		return nil, err
+	}
+	dbVersions := make([]EncKeyVersion, len(k.VersionList))
+	for i, v := range k.VersionList {
+		dbv, err := c.encryptVersion(dataKey, k.ID, &v)
+		if err != nil {
+			return nil, err
+		}
+		dbVersions[i] = *dbv
+	}
+
+	newKey := DBKey{
+		ID:          k.ID,
+		ACL:         k.ACL,
+		VersionList: dbVersions,
+		VersionHash: k.VersionHash,
+		Metadata:    k.Metadata.Copy(),
+		Policy:      k.Policy.Copy(),
+		DataKey:     wrapped,
+	}
+	return &newKey, nil
+}
+
+func (c *envelopeCryptor) Decrypt(k *DBKey) (*knox.Key, error) {
+	var dataKey []byte
+	versions := make([]knox.KeyVersion, len(k.VersionList))
+	for i, v := range k.VersionList {
+		scheme, err := versionScheme(&v)
+		if err != nil {
+			return nil, err
+		}
+		var dbv *knox.KeyVersion
+		switch scheme {
+		case aesGCMScheme:
+			legacy, ok := c.legacy[aesCryptoMetadata(v.CryptoMetadata).Version()]
+			if !ok {
+				return nil, ErrCryptorVersion
+			}
+			dbv, err = legacy.decryptVersion(k, &v)
+		case envelopeScheme:
+			if dataKey == nil {
+				if k.DataKey == nil {
+					return nil, ErrInvalidDataKey
+				}
+				dataKey, err = c.unwrap(k.ID, k.DataKey)
+				if err != nil {
+					return nil, err
+				}
+			}
+			dbv, err = c.decryptVersion(dataKey, k, &v)
+		default:
+			err = ErrCryptorVersion
+		}
+		if err != nil {
+			return nil, err
+		}
+		versions[i] = *dbv
+	}
+
+	newKey := knox.Key{
+		ID:          k.ID,
+		ACL:         k.ACL,
+		VersionList: versions,
+		VersionHash: k.VersionHash,
+		Metadata:    k.Metadata.Copy(),
+		Policy:      k.Policy.Copy(),
+	}
+	return &newKey, nil
+}
+
+// Rewrap rewraps the data key of k with the current master key. Keys whose
+// data key is already wrapped by it are left unchanged.
+func (c *envelopeCryptor) Rewrap(k *DBKey) error {
+	if len(k.DataKey) == 0 {
+		return ErrNotRewrappable
+	}
+	for _, v := range k.VersionList {
+		if s, err := versionScheme(&v); err != nil || s != envelopeScheme {
+			return ErrNotRewrappable
+		}
+	}
+	if k.DataKey[0] == c.version {
+		return nil
+	}
+	dataKey, err := c.unwrap(k.ID, k.DataKey)
+	if err != nil {
+		return err
+	}
+	wrapped, err := c.wrap(k.ID, dataKey)
+	if err != nil {
+		return err
+	}
+	k.DataKey = wrapped
+	return nil
+}
+
+// Stale reports whether k has versions that are not encrypted under a data
+// key wrapped by the current master key.
+func (c *envelopeCryptor) Stale(k *DBKey) bool {
+	if len(k.DataKey) == 0 || k.DataKey[0] != c.version {
+		return true
+	}
+	for _, v := range k.VersionList {
+		if s, err := versionScheme(&v); err != nil || s != envelopeScheme {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,232 @@
+package keydb
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/pinterest/knox"
+)
+
+func TestEnvelopeEncryptDecryptKey(t *testing.T) {
+	k := makeTestKey()
+	crypt := NewEnvelopeCryptor(10, testSecret)
+	encK, err := crypt.Encrypt(k)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(encK.DataKey) == 0 {
+		t.Fatal("data key is not set")
+	}
+	if s, _ := versionScheme(&encK.VersionList[0]); s != envelopeScheme {
+		t.Fatalf("%d does not equal %d", s, envelopeScheme)
+	}
+	decK, err := crypt.Decrypt(encK)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if !reflect.DeepEqual(decK, k) {
+		t.Fatal("decrypted key does not equal key")
+	}
+
+	// Each key gets its own data key.
+	encK2, err := crypt.Encrypt(k)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if bytes.Equal(encK.DataKey, encK2.DataKey) {
+		t.Fatal("data keys should differ between keys")
+	}
+
+	// Data keys are bound to their key ID.
+	encK.ID = "otherID"
+	if _, err := crypt.Decrypt(encK); err == nil {
+		t.Fatal("error is nil for a data key of another key")
+	}
+}
+
+func TestEnvelopeEncryptVersion(t *testing.T) {
+	k := makeTestKey()
+	crypt := NewEnvelopeCryptor(10, testSecret)
+	encK, err := crypt.Encrypt(k)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	dataKey := encK.DataKey
+
+	v := knox.KeyVersion{ID: 2, Data: []byte("data2"), Status: knox.Active, CreationTime: 2}
+	encV, err := EncryptVersion(crypt, encK, k, &v)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if !bytes.Equal(encK.DataKey, dataKey) {
+		t.Fatal("data key should not change when adding a version")
+	}
+	encK.VersionList = append(encK.VersionList, *encV)
+	k.VersionList = append(k.VersionList, v)
+
+	decK, err := crypt.Decrypt(encK)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if !reflect.DeepEqual(decK, k) {
+		t.Fatal("decrypted key does not equal key")
+	}
+}
+
+func TestEnvelopeDecryptsAESGCM(t *testing.T) {
+	k := makeTestKey()
+	encK, err := NewAESGCMCryptor(10, testSecret).Encrypt(k)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	crypt := NewEnvelopeCryptor(10, testSecret)
+	decK, err := crypt.Decrypt(encK)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if !reflect.DeepEqual(decK, k) {
+		t.Fatal("decrypted key does not equal key")
+	}
+
+	// New versions of existing keys get a data key.
+	v := knox.KeyVersion{ID: 2, Data: []byte("data2"), Status: knox.Active, CreationTime: 2}
+	encV, err := EncryptVersion(crypt, encK, k, &v)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(encK.DataKey) == 0 {
+		t.Fatal("data key is not set")
+	}
+	encK.VersionList = append(encK.VersionList, *encV)
+	k.VersionList = append(k.VersionList, v)
+	decK, err = crypt.Decrypt(encK)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if !reflect.DeepEqual(decK, k) {
+		t.Fatal("decrypted key does not equal key")
+	}
+}
+
+func TestEnvelopeBadData(t *testing.T) {
+	k := makeTestKey()
+	crypt := NewEnvelopeCryptor(10, testSecret)
+	encK, err := crypt.Encrypt(k)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+
+	_, err = NewEnvelopeCryptor(1, testSecret).Decrypt(encK)
+	if err != ErrCryptorVersion {
+		t.Fatalf("%v does not equal %s", err, ErrCryptorVersion)
+	}
+
+	noDataKey := encK.Copy()
+	noDataKey.DataKey = nil
+	if _, err := crypt.Decrypt(noDataKey); err != ErrInvalidDataKey {
+		t.Fatalf("%v does not equal %s", err, ErrInvalidDataKey)
+	}
+
+	badCiphertext := encK.Copy()
+	badCiphertext.VersionList[0].EncData = []byte("invalidciphertext")
+	if _, err := crypt.Decrypt(badCiphertext); err == nil {
+		t.Fatal("error is nil for bad ciphertext")
+	}
+
+	for _, md := range [][]byte{nil, {envelopeScheme}, {9, 9}} {
+		_, err = crypt.Decrypt(&DBKey{DataKey: encK.DataKey, VersionList: []EncKeyVersion{{CryptoMetadata: md}}})
+		if err == nil {
+			t.Fatalf("error is nil for metadata %v", md)
+		}
+	}
+}
+
+func TestEnvelopeStale(t *testing.T) {
+	k := makeTestKey()
+	crypt := NewEnvelopeCryptor(10, testSecret).(StaleChecker)
+	encK, err := crypt.(Cryptor).Encrypt(k)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if crypt.Stale(encK) {
+		t.Fatal("key encrypted under a current data key should not be stale")
+	}
+	if !NewEnvelopeCryptor(11, testSecret).(StaleChecker).Stale(encK) {
+		t.Fatal("key with a data key wrapped by another master key should be stale")
+	}
+	oldK, err := NewAESGCMCryptor(10, testSecret).Encrypt(k)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if !crypt.Stale(oldK) {
+		t.Fatal("key encrypted without a data key should be stale")
+	}
+}
+
+func TestEnvelopeKeyringRewrap(t *testing.T) {
+	newSecret := []byte("newnewnewnewnew!")
+	if _, err := NewEnvelopeKeyring(11, map[byte]KeyWrapper{10: NewAESKeyWrapper(testSecret)}); err != ErrNoCurrentKey {
+		t.Fatalf("%v does not equal %s", err, ErrNoCurrentKey)
+	}
+
+	k := makeTestKey()
+	encK, err := NewEnvelopeCryptor(10, testSecret).Encrypt(k)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	crypt, err := NewEnvelopeKeyring(11, map[byte]KeyWrapper{
+		10: NewAESKeyWrapper(testSecret),
+		11: NewAESKeyWrapper(newSecret),
+	})
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	decK, err := crypt.Decrypt(encK)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if !reflect.DeepEqual(decK, k) {
+		t.Fatal("decrypted key does not equal key")
+	}
+	if !crypt.(StaleChecker).Stale(encK) {
+		t.Fatal("key with a data key wrapped by a previous master key should be stale")
+	}
+
+	// Rewrapping only changes the data key.
+	rewrapped := encK.Copy()
+	if err := Rewrap(crypt, rewrapped); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if rewrapped.DataKey[0] != 11 {
+		t.Fatalf("%d does not equal 11", rewrapped.DataKey[0])
+	}
+	if !reflect.DeepEqual(rewrapped.VersionList, encK.VersionList) {
+		t.Fatal("versions should not change when rewrapping")
+	}
+	if crypt.(StaleChecker).Stale(rewrapped) {
+		t.Fatal("rewrapped key should not be stale")
+	}
+	decK, err = NewEnvelopeCryptor(11, newSecret).Decrypt(rewrapped)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if !reflect.DeepEqual(decK, k) {
+		t.Fatal("decrypted key does not equal key")
+	}
+
+	// Versions encrypted without a data key cannot be rewrapped.
+	oldK, err := NewAESGCMCryptor(10, testSecret).Encrypt(k)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if _, err := crypt.Decrypt(oldK); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if err := Rewrap(crypt, oldK); err != ErrNotRewrappable {
+		t.Fatalf("%v does not equal %s", err, ErrNotRewrappable)
+	}
+	if err := Rewrap(NewAESGCMCryptor(10, testSecret), encK); err != ErrNotRewrappable {
+		t.Fatalf("%v does not equal %s", err, ErrNotRewrappable)
+	}
+}
@@ -0,0 +1,516 @@
+package keydb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+// fileCompactMin is the number of superseded records a FileDB log can hold
+// before it is compacted.
+const fileCompactMin = 1000
+
+// FileDB is a DB stored in a single file, for small deployments that do not
+// run a database server. Every write is appended to the file as a line of
+// JSON and synced before it is applied. Once most of the log is superseded,
+// it is compacted by writing the live keys to a new file and renaming it over
+// the old one. The file must only be opened by one server at a time.
+type FileDB struct {
+	sync.RWMutex
+	path    string
+	f       *os.File
+	keys    map[string]*DBKey
+	size    int64
+	records int
+	version int64
+	leases  map[string]lease
+	// changes holds the changes since the file was opened. Sequence numbers
+	// are the DBVersions written with them.
+	changes    changeRing
+	webhooks   webhookSet
+	namespaces namespaceSet
+}
+
+// fileRecord is a line of the FileDB log. A record with a key replaces the
+// key; a record without one removes the key with the given ID. Records of
+// other types hold webhooks, dead letters and namespaces in the same way.
+type fileRecord struct {
+	Type      string `json:"type,omitempty"`
+	ID        string `json:"id"`
+	Key       *DBKey `json:"key,omitempty"`
+	DBVersion int64  `json:"db_version,omitempty"`
+	// Webhook is set on webhook records and DeadLetter on dead letter
+	// records. Dead letters are only ever added.
+	Webhook    *knox.Webhook           `json:"webhook,omitempty"`
+	DeadLetter *knox.WebhookDeadLetter `json:"dead_letter,omitempty"`
+	// Namespace is set on namespace records, whose ID is the prefix.
+	Namespace *knox.Namespace `json:"namespace,omitempty"`
+	// Batch is set on the first record of a write of several records to the
+	// number of records in the write. They are only applied if all of them
+	// were written.
+	Batch int `json:"batch,omitempty"`
+}
+
+// Types of fileRecord. Key records have no type, so logs written before
+// webhooks were added are read unchanged.
+const (
+	fileWebhookRecord    = "webhook"
+	fileDeadLetterRecord = "dead_letter"
+	fileNamespaceRecord  = "namespace"
+)
+
+// NewFileDB opens (or creates) the FileDB at path.
+func NewFileDB(path string) (*FileDB, error) {
+	db := &FileDB{path: path, keys: map[string]*DBKey{}}
+	var err error
+	db.size, err = db.load()
+	if err != nil {
+		return nil, err
+	}
+	db.f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	// A record cut short by a crash was never acknowledged, so it is dropped.
+	if err := db.truncate(); err != nil {
+		db.f.Close()
+		return nil, err
+	}
+	db.changes = newChangeRing(db.version)
+	return db, nil
+}
+
+// truncate discards anything in the file after the last complete record.
+func (db *FileDB) truncate() error {
+	if err := db.f.Truncate(db.size); err != nil {
+		return err
+	}
+	_, err := db.f.Seek(db.size, io.SeekStart)
+	return err
+}
+
+// load replays the log and returns the length of its complete records.
+func (db *FileDB) load() (int64, error) {
+	f, err := os.Open(db.path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	// size is the length of the applied records and pending holds the
+	// records of a batch that has not been read in full.
+	var size, pendingSize int64
+	var pending []*fileRecord
+	batch := 0
+	r := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		b, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return size, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		var rec fileRecord
+		if err := json.Unmarshal(b, &rec); err != nil {
+			return 0, fmt.Errorf("%s:%d: %s", db.path, line, err.Error())
+		}
+		if len(pending) == 0 {
+			batch = rec.Batch
+		}
+		pending = append(pending, &rec)
+		pendingSize += int64(len(b))
+		if len(pending) < batch {
+			continue
+		}
+		for _, rec := range pending {
+			db.apply(rec)
+		}
+		size += pendingSize
+		pending, pendingSize = nil, 0
+	}
+}
+
+func (db *FileDB) apply(rec *fileRecord) {
+	db.records++
+	switch rec.Type {
+	case fileWebhookRecord:
+		if rec.Webhook == nil {
+			db.webhooks.remove(rec.ID)
+		} else {
+			db.webhooks.put(rec.Webhook)
+		}
+		return
+	case fileDeadLetterRecord:
+		db.webhooks.addDeadLetter(rec.DeadLetter)
+		return
+	case fileNamespaceRecord:
+		if rec.Namespace == nil {
+			db.namespaces.remove(rec.ID)
+		} else {
+			db.namespaces.put(rec.Namespace)
+		}
+		return
+	}
+	if rec.DBVersion > db.version {
+		db.version = rec.DBVersion
+	}
+	if rec.Key == nil {
+		delete(db.keys, rec.ID)
+		return
+	}
+	k := rec.Key.Copy()
+	k.DBVersion = rec.DBVersion
+	db.keys[rec.ID] = k
+}
+
+// nextVersion returns a DBVersion later than every version in the file.
+func (db *FileDB) nextVersion() int64 {
+	v := time.Now().UnixNano()
+	if v <= db.version {
+		v = db.version + 1
+	}
+	return v
+}
+
+// write appends the records to the log, syncs it, and then applies them.
+func (db *FileDB) write(recs ...*fileRecord) error {
+	if len(recs) == 0 {
+		return nil
+	}
+	if len(recs) > 1 {
+		recs[0].Batch = len(recs)
+	}
+	var buf bytes.Buffer
+	for _, rec := range recs {
+		b, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+	_, err := db.f.Write(buf.Bytes())
+	if err == nil {
+		err = db.f.Sync()
+	}
+	if err != nil {
+		// Later records must not be appended to a partial one.
+		db.truncate()
+		return err
+	}
+	db.size += int64(buf.Len())
+	for _, rec := range recs {
+		db.apply(rec)
+		if rec.Type == "" {
+			db.changes.add(rec.DBVersion, rec.ID)
+		}
+	}
+	if live := db.live(); db.records-live > fileCompactMin && db.records > 2*live {
+		// The records are already durable, so a failed compaction is
+		// retried on the next write instead of failing this one.
+		db.compact()
+	}
+	return nil
+}
+
+// live is the number of records a compacted log has.
+func (db *FileDB) live() int {
+	return len(db.keys) + db.webhooks.size() + len(db.namespaces)
+}
+
+// compact rewrites the log with one record per live key, webhook, dead
+// letter and namespace. The new log is synced before it replaces the old one, so a crash
+// leaves one or the other.
+func (db *FileDB) compact() error {
+	tmp := db.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	var recs []*fileRecord
+	for _, id := range db.sortedIDs() {
+		k := db.keys[id]
+		recs = append(recs, &fileRecord{ID: id, Key: k, DBVersion: k.DBVersion})
+	}
+	for _, hook := range db.webhooks.list() {
+		hook := hook
+		recs = append(recs, &fileRecord{Type: fileWebhookRecord, ID: hook.ID, Webhook: &hook})
+		for _, d := range db.webhooks.deadLettersOf(hook.ID) {
+			d := d
+			recs = append(recs, &fileRecord{Type: fileDeadLetterRecord, ID: hook.ID, DeadLetter: &d})
+		}
+	}
+	for _, n := range db.namespaces.list() {
+		n := n
+		recs = append(recs, &fileRecord{Type: fileNamespaceRecord, ID: n.Prefix, Namespace: &n})
+	}
+	w := bufio.NewWriter(f)
+	for _, rec := range recs {
+		b, err := json.Marshal(rec)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(b)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := os.Rename(tmp, db.path); err != nil {
+		f.Close()
+		return err
+	}
+	db.f.Close()
+	db.f = f
+	db.size = size
+	db.records = len(recs)
+	return syncDir(filepath.Dir(db.path))
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (db *FileDB) sortedIDs() []string {
+	ids := make([]string, 0, len(db.keys))
+	for id := range db.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Get gets the stored db key from the FileDB.
+func (db *FileDB) Get(id string) (*DBKey, error) {
+	db.RLock()
+	defer db.RUnlock()
+	k, ok := db.keys[id]
+	if !ok {
+		return nil, knox.ErrKeyIDNotFound
+	}
+	return k.Copy(), nil
+}
+
+// GetAll gets all keys from the FileDB, ordered by ID.
+func (db *FileDB) GetAll() ([]DBKey, error) {
+	db.RLock()
+	defer db.RUnlock()
+	keys := make([]DBKey, 0, len(db.keys))
+	for _, id := range db.sortedIDs() {
+		keys = append(keys, *db.keys[id].Copy())
+	}
+	return keys, nil
+}
+
+// Update makes an update to DBKey indexed by its ID.
+// It will fail if the key has been changed since the specified version.
+func (db *FileDB) Update(key *DBKey) error {
+	db.Lock()
+	defer db.Unlock()
+	old, ok := db.keys[key.ID]
+	if !ok {
+		return knox.ErrKeyIDNotFound
+	}
+	if old.DBVersion != key.DBVersion {
+		return ErrDBVersion
+	}
+	return db.write(&fileRecord{ID: key.ID, Key: key, DBVersion: db.nextVersion()})
+}
+
+// Add adds the key(s) to the DB (it will fail if the key id exists).
+func (db *FileDB) Add(keys ...*DBKey) error {
+	db.Lock()
+	defer db.Unlock()
+	seen := map[string]bool{}
+	for _, key := range keys {
+		if _, ok := db.keys[key.ID]; ok || seen[key.ID] {
+			return knox.ErrKeyExists
+		}
+		seen[key.ID] = true
+	}
+	recs := make([]*fileRecord, len(keys))
+	for i, key := range keys {
+		// Each key gets its own version since it is also the sequence
+		// number of its change.
+		db.version = db.nextVersion()
+		recs[i] = &fileRecord{ID: key.ID, Key: key, DBVersion: db.version}
+	}
+	return db.write(recs...)
+}
+
+// Remove permanently removes the key specified by the ID.
+func (db *FileDB) Remove(id string) error {
+	db.Lock()
+	defer db.Unlock()
+	if _, ok := db.keys[id]; !ok {
+		return knox.ErrKeyIDNotFound
+	}
+	return db.write(&fileRecord{ID: id, DBVersion: db.nextVersion()})
+}
+
+// Transact runs f on a copy of the changed keys and writes them to the log
+// as one batch if f succeeds. The DB is locked until f returns.
+func (db *FileDB) Transact(f func(tx DB) error) error {
+	db.Lock()
+	defer db.Unlock()
+	s := newStagedDB(db.keys, func() int64 {
+		db.version = db.nextVersion()
+		return db.version
+	})
+	if err := f(s); err != nil {
+		return err
+	}
+	recs := make([]*fileRecord, len(s.order))
+	for i, id := range s.order {
+		rec := &fileRecord{ID: id, Key: s.changes[id]}
+		if rec.Key != nil {
+			rec.DBVersion = rec.Key.DBVersion
+		} else {
+			rec.DBVersion = s.version()
+		}
+		recs[i] = rec
+	}
+	// A key changed more than once may be ahead of keys changed after it.
+	sort.Slice(recs, func(i, j int) bool { return recs[i].DBVersion < recs[j].DBVersion })
+	return db.write(recs...)
+}
+
+// Changes returns up to limit changes after the given sequence number. Only
+// the latest changes since the file was opened are kept.
+func (db *FileDB) Changes(after int64, limit int) ([]Change, error) {
+	db.RLock()
+	defer db.RUnlock()
+	return db.changes.since(after, limit)
+}
+
+// LastSeq returns the sequence number of the latest change.
+func (db *FileDB) LastSeq() (int64, error) {
+	db.RLock()
+	defer db.RUnlock()
+	return db.changes.last, nil
+}
+
+// AddWebhook adds a webhook. It fails with ErrWebhookExists if the ID is
+// taken.
+func (db *FileDB) AddWebhook(w *knox.Webhook) error {
+	db.Lock()
+	defer db.Unlock()
+	if db.webhooks.has(w.ID) {
+		return ErrWebhookExists
+	}
+	return db.write(&fileRecord{Type: fileWebhookRecord, ID: w.ID, Webhook: w})
+}
+
+// GetWebhooks returns every webhook, oldest first.
+func (db *FileDB) GetWebhooks() ([]knox.Webhook, error) {
+	db.RLock()
+	defer db.RUnlock()
+	return db.webhooks.list(), nil
+}
+
+// RemoveWebhook removes the webhook and its dead letters.
+func (db *FileDB) RemoveWebhook(id string) error {
+	db.Lock()
+	defer db.Unlock()
+	if !db.webhooks.has(id) {
+		return knox.ErrWebhookNotFound
+	}
+	return db.write(&fileRecord{Type: fileWebhookRecord, ID: id})
+}
+
+// AddDeadLetter records an event that could not be delivered to a webhook.
+func (db *FileDB) AddDeadLetter(d *knox.WebhookDeadLetter) error {
+	db.Lock()
+	defer db.Unlock()
+	if !db.webhooks.has(d.Event.WebhookID) {
+		return knox.ErrWebhookNotFound
+	}
+	return db.write(&fileRecord{Type: fileDeadLetterRecord, ID: d.Event.WebhookID, DeadLetter: d})
+}
+
+// GetDeadLetters returns the dead letters of a webhook, oldest first.
+func (db *FileDB) GetDeadLetters(webhookID string) ([]knox.WebhookDeadLetter, error) {
+	db.RLock()
+	defer db.RUnlock()
+	if !db.webhooks.has(webhookID) {
+		return nil, knox.ErrWebhookNotFound
+	}
+	return db.webhooks.deadLettersOf(webhookID), nil
+}
+
+// GetNamespaces returns every namespace ordered by prefix.
+func (db *FileDB) GetNamespaces() ([]knox.Namespace, error) {
+	db.RLock()
+	defer db.RUnlock()
+	return db.namespaces.list(), nil
+}
+
+// PutNamespace adds the namespace or replaces the one with its prefix.
+func (db *FileDB) PutNamespace(n *knox.Namespace) error {
+	db.Lock()
+	defer db.Unlock()
+	return db.write(&fileRecord{Type: fileNamespaceRecord, ID: n.Prefix, Namespace: n})
+}
+
+// RemoveNamespace removes the namespace with the prefix.
+func (db *FileDB) RemoveNamespace(prefix string) error {
+	db.Lock()
+	defer db.Unlock()
+	if !db.namespaces.has(prefix) {
+		return knox.ErrNamespaceNotFound
+	}
+	return db.write(&fileRecord{Type: fileNamespaceRecord, ID: prefix})
+}
+
+// AcquireLease grants or renews the named lease to holder for ttl. Leases are
+// not written to the file since only one server uses it.
+func (db *FileDB) AcquireLease(name, holder string, ttl time.Duration) (bool, error) {
+	db.Lock()
+	defer db.Unlock()
+	now := time.Now()
+	if l, ok := db.leases[name]; ok && l.holder != holder && now.Before(l.expires) {
+		return false, nil
+	}
+	if db.leases == nil {
+		db.leases = map[string]lease{}
+	}
+	db.leases[name] = lease{holder, now.Add(ttl)}
+	return true, nil
+}
+
+// Close closes the underlying file.
+func (db *FileDB) Close() error {
+	db.Lock()
+	defer db.Unlock()
+	return db.f.Close()
+}
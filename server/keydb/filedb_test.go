@@ -0,0 +1,319 @@
+package keydb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+func newTestFileDB(t *testing.T) (*FileDB, string, func()) {
+	dir, err := ioutil.TempDir("", "filedb")
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	fn := path.Join(dir, "keys.db")
+	db, err := NewFileDB(fn)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("%s is not nil", err)
+	}
+	return db, fn, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestFileDB(t *testing.T) {
+	db, _, cleanup := newTestFileDB(t)
+	defer cleanup()
+	timeout := 100 * time.Millisecond
+	TesterAddGet(t, db, timeout)
+	TesterAddUpdate(t, db, timeout)
+	TesterAddRemove(t, db, timeout)
+}
+
+func TestFileDBReopen(t *testing.T) {
+	db, fn, cleanup := newTestFileDB(t)
+	defer cleanup()
+	k1 := newDBKey("k1", []byte("a"), 0)
+	k2 := newDBKey("k2", []byte("b"), 0)
+	if err := db.Add(&k1, &k2); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	k, err := db.Get("k1")
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	k.VersionList = append(k.VersionList, newEncKeyVersion([]byte("c"), knox.Active))
+	if err := db.Update(k); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if err := db.Remove("k2"); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	k, _ = db.Get("k1")
+	db.Close()
+
+	// A record cut short by a crash is dropped.
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	f.Write([]byte(`{"id":"k3","key":{"id":`))
+	f.Close()
+
+	db, err = NewFileDB(fn)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	defer db.Close()
+	keys, err := db.GetAll()
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(keys) != 1 || keys[0].ID != "k1" {
+		t.Fatalf("unexpected keys %+v", keys)
+	}
+	if keys[0].DBVersion != k.DBVersion || len(keys[0].VersionList) != 2 {
+		t.Fatalf("unexpected key %+v", keys[0])
+	}
+	// Writes after the dropped record are read back.
+	k3 := newDBKey("k3", []byte("d"), 0)
+	if err := db.Add(&k3); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	db.Close()
+	db, err = NewFileDB(fn)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	defer db.Close()
+	if _, err := db.Get("k3"); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+}
+
+func TestFileDBCompaction(t *testing.T) {
+	db, fn, cleanup := newTestFileDB(t)
+	defer cleanup()
+	k := newDBKey("k1", []byte("a"), 0)
+	if err := db.Add(&k); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	for i := 0; i < fileCompactMin+10; i++ {
+		k, err := db.Get("k1")
+		if err != nil {
+			t.Fatalf("%s is not nil", err)
+		}
+		k.VersionHash = string(rune('a' + i%26))
+		if err := db.Update(k); err != nil {
+			t.Fatalf("%s is not nil", err)
+		}
+	}
+	if db.records > fileCompactMin {
+		t.Fatalf("log was not compacted, %d records", db.records)
+	}
+	last, _ := db.Get("k1")
+	db.Close()
+
+	db, err := NewFileDB(fn)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	defer db.Close()
+	got, err := db.Get("k1")
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if got.VersionHash != last.VersionHash || got.DBVersion != last.DBVersion {
+		t.Fatalf("%+v does not equal %+v", got, last)
+	}
+	// Updates with the version from before reopening still apply.
+	if err := db.Update(got); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+}
+
+func TestFileDBTornBatch(t *testing.T) {
+	db, fn, cleanup := newTestFileDB(t)
+	defer cleanup()
+	k1 := newDBKey("k1", []byte("a"), 0)
+	if err := db.Add(&k1); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	k2 := newDBKey("k2", []byte("b"), 0)
+	k3 := newDBKey("k3", []byte("c"), 0)
+	if err := db.Add(&k2, &k3); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	db.Close()
+
+	// Cut the file after the first record of the batch.
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	lines := bytes.SplitAfter(b, []byte("\n"))
+	if err := ioutil.WriteFile(fn, bytes.Join(lines[:2], nil), 0600); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+
+	db, err = NewFileDB(fn)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	defer db.Close()
+	keys, err := db.GetAll()
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(keys) != 1 || keys[0].ID != "k1" {
+		t.Fatalf("unexpected keys %+v", keys)
+	}
+	if err := db.Add(&k2); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+}
+
+func TestFileDBChangesReopen(t *testing.T) {
+	db, fn, cleanup := newTestFileDB(t)
+	defer cleanup()
+	k := newDBKey("k1", []byte("a"), 0)
+	if err := db.Add(&k); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	seq, _ := db.LastSeq()
+	db.Close()
+
+	// Changes from before the file was opened are not kept, but later
+	// changes are read from the sequence number it was opened at.
+	db, err := NewFileDB(fn)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	defer db.Close()
+	if _, err := db.Changes(seq-1, 10); err != ErrChangesTruncated {
+		t.Fatalf("%v does not equal %s", err, ErrChangesTruncated)
+	}
+	if err := db.Remove("k1"); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	changes, err := db.Changes(seq, 10)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(changes) != 1 || changes[0].KeyID != "k1" || changes[0].Seq <= seq {
+		t.Fatalf("unexpected changes %+v", changes)
+	}
+}
+
+func TestFileDBWebhooksCompaction(t *testing.T) {
+	db, fn, cleanup := newTestFileDB(t)
+	defer cleanup()
+	hook := &knox.Webhook{ID: "w1", URL: "https://example.com/hook", Secret: "s"}
+	if err := db.AddWebhook(hook); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	removed := &knox.Webhook{ID: "w2", URL: "https://example.com/hook"}
+	if err := db.AddWebhook(removed); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if err := db.RemoveWebhook("w2"); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	d := &knox.WebhookDeadLetter{Event: knox.WebhookEvent{ID: "d1", WebhookID: "w1"}, Attempts: 3}
+	if err := db.AddDeadLetter(d); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	// Webhooks and dead letters survive compaction.
+	k := newDBKey("k1", []byte("a"), 0)
+	if err := db.Add(&k); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	for i := 0; i < fileCompactMin+10; i++ {
+		k, err := db.Get("k1")
+		if err != nil {
+			t.Fatalf("%s is not nil", err)
+		}
+		if err := db.Update(k); err != nil {
+			t.Fatalf("%s is not nil", err)
+		}
+	}
+	if db.records > fileCompactMin {
+		t.Fatalf("log was not compacted, %d records", db.records)
+	}
+	db.Close()
+
+	db, err := NewFileDB(fn)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	defer db.Close()
+	hooks, err := db.GetWebhooks()
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(hooks) != 1 || hooks[0].ID != "w1" || hooks[0].Secret != "s" {
+		t.Fatalf("%+v does not equal [%+v]", hooks, hook)
+	}
+	letters, err := db.GetDeadLetters("w1")
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(letters) != 1 || letters[0].Event.ID != "d1" {
+		t.Fatalf("%+v does not equal [%+v]", letters, d)
+	}
+}
+
+func TestFileDBNamespacesCompaction(t *testing.T) {
+	db, fn, cleanup := newTestFileDB(t)
+	defer cleanup()
+	n := &knox.Namespace{Prefix: "payments:", ACL: knox.ACL{{Type: knox.UserGroup, ID: "payments", AccessType: knox.Admin}}}
+	for _, prefix := range []string{"payments:", "removed:"} {
+		if err := db.PutNamespace(&knox.Namespace{Prefix: prefix}); err != nil {
+			t.Fatalf("%s is not nil", err)
+		}
+	}
+	if err := db.PutNamespace(n); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if err := db.RemoveNamespace("removed:"); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	// Namespaces survive compaction.
+	k := newDBKey("k1", []byte("a"), 0)
+	if err := db.Add(&k); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	for i := 0; i < fileCompactMin+10; i++ {
+		k, err := db.Get("k1")
+		if err != nil {
+			t.Fatalf("%s is not nil", err)
+		}
+		if err := db.Update(k); err != nil {
+			t.Fatalf("%s is not nil", err)
+		}
+	}
+	if db.records > fileCompactMin {
+		t.Fatalf("log was not compacted, %d records", db.records)
+	}
+	db.Close()
+
+	db, err := NewFileDB(fn)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	defer db.Close()
+	namespaces, err := db.GetNamespaces()
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(namespaces) != 1 || namespaces[0].Prefix != "payments:" || len(namespaces[0].ACL) != 1 || namespaces[0].ACL[0] != n.ACL[0] {
+		t.Fatalf("%+v does not equal [%+v]", namespaces, *n)
+	}
+}
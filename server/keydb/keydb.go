@@ -1,8 +1,6 @@
 package keydb
 
 import (
-	"database/sql"
-	"encoding/json"
 	"fmt"
 	"sync"
 	"time"
@@ -14,10 +12,23 @@ var ErrDBVersion = fmt.Errorf("DB version does not match")
 
 // DBKey is a struct for the json serialization of keys in the database.
 type DBKey struct {
-	ID          string          `json:"id"`
-	ACL         knox.ACL        `json:"acl"`
-	VersionList []EncKeyVersion `json:"versions"`
-	VersionHash string          `json:"hash"`
+	ID          string            `json:"id"`
+	ACL         knox.ACL          `json:"acl"`
+	VersionList []EncKeyVersion   `json:"versions"`
+	VersionHash string            `json:"hash"`
+	Metadata    *knox.KeyMetadata `json:"metadata,omitempty"`
+	// DeletedAt is when the key was deleted in nanoseconds since the epoch, or
+	// zero if it has not been. Deleted keys are kept until they are purged.
+	DeletedAt int64           `json:"deleted,omitempty"`
+	Policy    *knox.KeyPolicy `json:"policy,omitempty"`
+	// ApprovalRequests are the changes to the key waiting for approval.
+	ApprovalRequests []knox.ApprovalRequest `json:"approval_requests,omitempty"`
+	// DataKey is the key's data encryption key wrapped by the master key, for
+	// cryptors that use envelope encryption.
+	DataKey []byte `json:"data_key,omitempty"`
+	// MAC protects the integrity of the plaintext fields, for cryptors that
+	// implement Signer.
+	MAC []byte `json:"mac,omitempty"`
 	// The version should be set by the db provider and is not part of the data.
 	DBVersion int64 `json:"-"`
 }
@@ -28,12 +39,31 @@ func (k *DBKey) Copy() *DBKey {
 	copy(versionList, k.VersionList)
 	acl := make([]knox.Access, len(k.ACL))
 	copy(acl, k.ACL)
+	var requests []knox.ApprovalRequest
+	for _, r := range k.ApprovalRequests {
+		requests = append(requests, r.Copy())
+	}
+	var dataKey, mac []byte
+	if k.DataKey != nil {
+		dataKey = make([]byte, len(k.DataKey))
+		copy(dataKey, k.DataKey)
+	}
+	if k.MAC != nil {
+		mac = make([]byte, len(k.MAC))
+		copy(mac, k.MAC)
+	}
 	return &DBKey{
-		ID:          k.ID,
-		ACL:         acl,
-		VersionList: versionList,
-		VersionHash: k.VersionHash,
-		DBVersion:   k.DBVersion,
+		ID:               k.ID,
+		ACL:              acl,
+		VersionList:      versionList,
+		VersionHash:      k.VersionHash,
+		Metadata:         k.Metadata.Copy(),
+		DeletedAt:        k.DeletedAt,
+		Policy:           k.Policy.Copy(),
+		ApprovalRequests: requests,
+		DataKey:          dataKey,
+		MAC:              mac,
+		DBVersion:        k.DBVersion,
 	}
 }
 
@@ -65,6 +95,19 @@ type DB interface {
 	Remove(id string) error
 }
 
+// Leaser is implemented by DBs that can grant leases. Servers sharing a DB
+// use them to elect one server to run a background job.
+type Leaser interface {
+	// AcquireLease grants or renews the named lease to holder for ttl. It
+	// returns false if another holder has a lease that has not expired.
+	AcquireLease(name, holder string, ttl time.Duration) (bool, error)
+}
+
+type lease struct {
+	holder  string
+	expires time.Time
+}
+
 // NewTempDB creates a new TempDB with no data.
 func NewTempDB() DB {
 	return &TempDB{}
@@ -74,8 +117,12 @@ func NewTempDB() DB {
 // out fresh everytime. It is written for testing and simple dev work.
 type TempDB struct {
 	sync.RWMutex
-	keys []DBKey
-	err  error
+	keys       []DBKey
+	leases     map[string]lease
+	changes    changeRing
+	webhooks   webhookSet
+	namespaces namespaceSet
+	err        error
 }
 
 // SetError is used to set the error the TempDB for testing purposes.
@@ -94,7 +141,7 @@ func (db *TempDB) Get(id string) (*DBKey, error) {
 	}
 	for _, k := range db.keys {
 		if k.ID == id {
-			return &k, nil
+			return k.Copy(), nil
 		}
 	}
 	return nil, knox.ErrKeyIDNotFound
@@ -107,7 +154,11 @@ func (db *TempDB) GetAll() ([]DBKey, error) {
 	if db.err != nil {
 		return nil, db.err
 	}
-	return db.keys, nil
+	keys := make([]DBKey, len(db.keys))
+	for i, k := range db.keys {
+		keys[i] = *k.Copy()
+	}
+	return keys, nil
 }
 
 // Update looks for an existing key and updates the key in the database.
@@ -125,6 +176,7 @@ func (db *TempDB) Update(key *DBKey) error {
 			k := key.Copy()
 			k.DBVersion = time.Now().UnixNano()
 			db.keys[i] = *k
+			db.logChange(k.ID)
 			return nil
 		}
 	}
@@ -138,7 +190,12 @@ func (db *TempDB) Add(keys ...*DBKey) error {
 	if db.err != nil {
 		return db.err
 	}
+	seen := map[string]bool{}
 	for _, key := range keys {
+		if seen[key.ID] {
+			return knox.ErrKeyExists
+		}
+		seen[key.ID] = true
 		for _, oldK := range db.keys {
 			if oldK.ID == key.ID {
 				return knox.ErrKeyExists
@@ -150,6 +207,7 @@ func (db *TempDB) Add(keys ...*DBKey) error {
 		k.DBVersion = time.Now().UnixNano()
 
 		db.keys = append(db.keys, *k)
+		db.logChange(k.ID)
 	}
 	return nil
 
@@ -165,213 +223,191 @@ func (db *TempDB) Remove(id string) error {
 	for i, k := range db.keys {
 		if k.ID == id {
 			db.keys = append(db.keys[:i], db.keys[i+1:]...)
+			db.logChange(id)
 			return nil
 		}
 	}
 	return knox.ErrKeyIDNotFound
 }
 
-// SQLDB provides a generic way to use SQL providers as Knox DBs.
-type SQLDB struct {
-	getStmt    *sql.Stmt
-	getAllStmt *sql.Stmt
-	UpdateStmt *sql.Stmt
-	AddStmt    *sql.Stmt
-	RemoveStmt *sql.Stmt
-	db         sql.DB
-}
-
-var sqlCreateKeys = `CREATE TABLE IF NOT EXISTS secrets (
-	id VARCHAR(512) PRIMARY KEY,
-	acl TEXT NOT NULL,
-	version_hash TEXT NOT NULL,
-	versions TEXT NOT NULL,
-	last_updated BIGINT NOT NULL
-);`
-
-// NewPostgreSQLDB will create a SQLDB with the necessary statements for using postgres.
-func NewPostgreSQLDB(sqlDB *sql.DB) (DB, error) {
-	db := &SQLDB{}
-	var err error
-	_, err = sqlDB.Exec(sqlCreateKeys)
-	if err != nil {
-		return nil, err
-	}
-	db.getStmt, err = sqlDB.Prepare("SELECT id, acl, version_hash, versions, last_updated FROM secrets WHERE id=$1")
-	if err != nil {
-		return nil, err
-	}
-	db.getAllStmt, err = sqlDB.Prepare("SELECT id, acl, version_hash, versions, last_updated FROM secrets")
-	if err != nil {
-		return nil, err
-	}
-	db.UpdateStmt, err = sqlDB.Prepare("UPDATE secrets SET versions=$1, version_hash=$2,last_updated=$3,acl=$4 WHERE id=$5 AND last_updated=$6")
-	if err != nil {
-		return nil, err
-	}
-	db.AddStmt, err = sqlDB.Prepare("INSERT INTO secrets (id, acl, versions, version_hash, last_updated) VALUES ($1,$2,$3,$4,$5)")
-	if err != nil {
-		return nil, err
-	}
-	db.RemoveStmt, err = sqlDB.Prepare("DELETE FROM secrets WHERE id=$1")
-	if err != nil {
-		return nil, err
-	}
-	return db, nil
+// AcquireLease grants or renews the named lease to holder for ttl.
+func (db *TempDB) AcquireLease(name, holder string, ttl time.Duration) (bool, error) {
+	db.Lock()
+	defer db.Unlock()
+	if db.err != nil {
+		return false, db.err
+	}
+	now := time.Now()
+	if l, ok := db.leases[name]; ok && l.holder != holder && now.Before(l.expires) {
+		return false, nil
+	}
+	if db.leases == nil {
+		db.leases = map[string]lease{}
+	}
+	db.leases[name] = lease{holder, now.Add(ttl)}
+	return true, nil
 }
 
-// NewSQLDB creates a table and prepared statements suitable for mysql and sqlite databases.
-func NewSQLDB(sqlDB *sql.DB) (DB, error) {
-	db := &SQLDB{}
-	var err error
-	_, err = sqlDB.Exec(sqlCreateKeys)
-	if err != nil {
-		return nil, err
+// Transact runs f on a copy of the changed keys and applies them if f
+// succeeds. The DB is locked until f returns.
+func (db *TempDB) Transact(f func(tx DB) error) error {
+	db.Lock()
+	defer db.Unlock()
+	if db.err != nil {
+		return db.err
 	}
-	db.getStmt, err = sqlDB.Prepare("SELECT id, acl, version_hash, versions, last_updated FROM secrets WHERE id=?")
-	if err != nil {
-		return nil, err
+	base := make(map[string]*DBKey, len(db.keys))
+	for i := range db.keys {
+		base[db.keys[i].ID] = &db.keys[i]
 	}
-	db.getAllStmt, err = sqlDB.Prepare("SELECT id, acl, version_hash, versions, last_updated FROM secrets")
-	if err != nil {
-		return nil, err
+	s := newStagedDB(base, func() int64 { return time.Now().UnixNano() })
+	if err := f(s); err != nil {
+		return err
 	}
-	db.UpdateStmt, err = sqlDB.Prepare("UPDATE secrets SET versions=?, version_hash=?,last_updated=?,acl=? WHERE id=? AND last_updated=?")
-	if err != nil {
-		return nil, err
+	keys := make([]DBKey, 0, len(db.keys))
+	for _, k := range db.keys {
+		if changed, ok := s.changes[k.ID]; !ok {
+			keys = append(keys, k)
+		} else if changed != nil {
+			keys = append(keys, *changed)
+		}
 	}
-	db.AddStmt, err = sqlDB.Prepare("INSERT INTO secrets (id, acl, versions, version_hash, last_updated) VALUES (?,?,?,?,?)")
-	if err != nil {
-		return nil, err
+	for _, id := range s.order {
+		if _, ok := base[id]; !ok && s.changes[id] != nil {
+			keys = append(keys, *s.changes[id])
+		}
 	}
-	db.RemoveStmt, err = sqlDB.Prepare("DELETE FROM secrets WHERE id=?")
-	if err != nil {
-		return nil, err
+	db.keys = keys
+	for _, id := range s.order {
+		db.logChange(id)
 	}
-	return db, nil
+	return nil
 }
 
-// Get will return the key given its key ID.
-func (db *SQLDB) Get(id string) (*DBKey, error) {
-	var key DBKey
-	var acl, versions []byte
-	err := db.getStmt.QueryRow(id).Scan(&key.ID, &acl, &key.VersionHash, &versions, &key.DBVersion)
-	if err != nil {
-		return nil, knox.ErrKeyIDNotFound
-	}
-	err = json.Unmarshal(acl, &key.ACL)
-	if err != nil {
-		return nil, err
+// logChange adds a change to the key to the change feed. It must be called
+// with the lock held.
+func (db *TempDB) logChange(id string) {
+	db.changes.add(db.changes.last+1, id)
+}
+
+// Changes returns up to limit changes after the given sequence number. Only
+// the latest changes are kept.
+func (db *TempDB) Changes(after int64, limit int) ([]Change, error) {
+	db.RLock()
+	defer db.RUnlock()
+	if db.err != nil {
+		return nil, db.err
 	}
-	err = json.Unmarshal(versions, &key.VersionList)
-	if err != nil {
-		return nil, err
+	return db.changes.since(after, limit)
+}
+
+// LastSeq returns the sequence number of the latest change.
+func (db *TempDB) LastSeq() (int64, error) {
+	db.RLock()
+	defer db.RUnlock()
+	if db.err != nil {
+		return 0, db.err
 	}
-	return &key, nil
+	return db.changes.last, nil
 }
 
-// GetAll returns all of the keys in the database.
-func (db *SQLDB) GetAll() ([]DBKey, error) {
-	var keys []DBKey
-	rows, err := db.getAllStmt.Query()
-	if err != nil {
-		return nil, err
-	}
-	for rows.Next() {
-		var key DBKey
-		var acl, versions []byte
-		err := rows.Scan(&key.ID, &acl, &key.VersionHash, &versions, &key.DBVersion)
-		if err != nil {
-			return nil, err
-		}
-		err = json.Unmarshal(acl, &key.ACL)
-		if err != nil {
-			return nil, err
-		}
-		err = json.Unmarshal(versions, &key.VersionList)
-		if err != nil {
-			return nil, err
-		}
-		keys = append(keys, key)
+// AddWebhook adds a webhook. It fails with ErrWebhookExists if the ID is
+// taken.
+func (db *TempDB) AddWebhook(w *knox.Webhook) error {
+	db.Lock()
+	defer db.Unlock()
+	if db.err != nil {
+		return db.err
 	}
-	err = rows.Err()
-	if err != nil {
-		return nil, err
+	if db.webhooks.has(w.ID) {
+		return ErrWebhookExists
 	}
-	return keys, nil
+	db.webhooks.put(w)
+	return nil
 }
 
-// Update makes an update to DBKey indexed by its ID.
-// It will fail if the key has been changed since the specified version.
-func (db *SQLDB) Update(key *DBKey) error {
-	versions, err := json.Marshal(key.VersionList)
-	if err != nil {
-		return err
+// GetWebhooks returns every webhook, oldest first.
+func (db *TempDB) GetWebhooks() ([]knox.Webhook, error) {
+	db.RLock()
+	defer db.RUnlock()
+	if db.err != nil {
+		return nil, db.err
 	}
-	acl, err := json.Marshal(key.ACL)
-	if err != nil {
-		return err
+	return db.webhooks.list(), nil
+}
+
+// RemoveWebhook removes the webhook and its dead letters.
+func (db *TempDB) RemoveWebhook(id string) error {
+	db.Lock()
+	defer db.Unlock()
+	if db.err != nil {
+		return db.err
 	}
-	updateTime := time.Now().UnixNano()
-	r, err := db.UpdateStmt.Exec(versions, key.VersionHash, updateTime, acl, key.ID, key.DBVersion)
-	if err != nil {
-		return err
+	if !db.webhooks.has(id) {
+		return knox.ErrWebhookNotFound
 	}
-	affected, err := r.RowsAffected()
-	if err != nil {
-		// This likely shouldn't return an error if rows affected is not implemented.
-		return err
+	db.webhooks.remove(id)
+	return nil
+}
+
+// AddDeadLetter records an event that could not be delivered to a webhook.
+func (db *TempDB) AddDeadLetter(d *knox.WebhookDeadLetter) error {
+	db.Lock()
+	defer db.Unlock()
+	if db.err != nil {
+		return db.err
 	}
-	if affected == 0 {
-		rs, err := db.getStmt.Query(key.ID)
-		defer rs.Close()
-		if err != nil {
-			return err
-		}
-		if !rs.Next() {
-			return knox.ErrKeyIDNotFound
-		}
-		return ErrDBVersion
+	if !db.webhooks.has(d.Event.WebhookID) {
+		return knox.ErrWebhookNotFound
 	}
+	db.webhooks.addDeadLetter(d)
 	return nil
 }
 
-// Add adds the key version (it will fail if the key id exists).
-func (db *SQLDB) Add(keys ...*DBKey) error {
-	// For loop is the dumbest way to this; should refactor into one query/transaction.
-	for _, key := range keys {
-		versions, err := json.Marshal(key.VersionList)
-		if err != nil {
-			return err
-		}
-		acl, err := json.Marshal(key.ACL)
-		if err != nil {
-			return err
-		}
-		updateTime := time.Now().UnixNano()
-		_, err = db.AddStmt.Exec(key.ID, acl, versions, key.VersionHash, updateTime)
-		if err != nil {
-			// Not sure how to properly differentiate here...
-			return knox.ErrKeyExists
-		}
-		// Not checking rows affected because I assume the db will return an error on primary key collision.
+// GetDeadLetters returns the dead letters of a webhook, oldest first.
+func (db *TempDB) GetDeadLetters(webhookID string) ([]knox.WebhookDeadLetter, error) {
+	db.RLock()
+	defer db.RUnlock()
+	if db.err != nil {
+		return nil, db.err
 	}
-	return nil
+	if !db.webhooks.has(webhookID) {
+		return nil, knox.ErrWebhookNotFound
+	}
+	return db.webhooks.deadLettersOf(webhookID), nil
 }
 
-// Remove permanently removes the key specified by the ID.
-func (db *SQLDB) Remove(id string) error {
-	r, err := db.RemoveStmt.Exec(id)
-	if err != nil {
-		return err
+// GetNamespaces returns every namespace ordered by prefix.
+func (db *TempDB) GetNamespaces() ([]knox.Namespace, error) {
+	db.RLock()
+	defer db.RUnlock()
+	if db.err != nil {
+		return nil, db.err
 	}
-	affected, err := r.RowsAffected()
-	if err != nil {
-		// This likely shouldn't return an error if rows affected is not implemented.
-		return err
+	return db.namespaces.list(), nil
+}
+
+// PutNamespace adds the namespace or replaces the one with its prefix.
+func (db *TempDB) PutNamespace(n *knox.Namespace) error {
+	db.Lock()
+	defer db.Unlock()
+	if db.err != nil {
+		return db.err
+	}
+	db.namespaces.put(n)
+	return nil
+}
+
+// RemoveNamespace removes the namespace with the prefix.
+func (db *TempDB) RemoveNamespace(prefix string) error {
+	db.Lock()
+	defer db.Unlock()
+	if db.err != nil {
+		return db.err
 	}
-	if affected == 0 {
-		return knox.ErrKeyIDNotFound
+	if !db.namespaces.has(prefix) {
+		return knox.ErrNamespaceNotFound
 	}
+	db.namespaces.remove(prefix)
 	return nil
 }
@@ -52,6 +52,11 @@ func TestDBCopy(t *testing.T) {
 		VersionList: []EncKeyVersion{v},
 		VersionHash: "hash1",
 		DBVersion:   1,
+		ApprovalRequests: []knox.ApprovalRequest{
+			{ID: "r1", ACL: []knox.Access{a}, Policy: &knox.KeyPolicy{RequireApproval: true}},
+		},
+		DataKey: []byte("datakey"),
+		MAC:     []byte("mac"),
 	}
 	b := r.Copy()
 	b.ID = "id2"
@@ -62,6 +67,10 @@ func TestDBCopy(t *testing.T) {
 	if r.DBVersion == b.DBVersion {
 		t.Error("DBVersion are equal after copy")
 	}
+	b.DeletedAt = 3
+	if r.DeletedAt == b.DeletedAt {
+		t.Error("DeletedAt are equal after copy")
+	}
 	b.VersionHash = "hash2"
 	if r.VersionHash == b.VersionHash {
 		t.Error("VersionHash are equal after copy")
@@ -74,6 +83,19 @@ func TestDBCopy(t *testing.T) {
 	if r.VersionList[0].ID == b.VersionList[0].ID {
 		t.Error("VersionList[0].ID are equal after copy")
 	}
+	b.ApprovalRequests[0].ACL[0].ID = "pi"
+	b.ApprovalRequests[0].Policy.RequireApproval = false
+	if r.ApprovalRequests[0].ACL[0].ID == "pi" || !r.ApprovalRequests[0].Policy.RequireApproval {
+		t.Error("ApprovalRequests are shared after copy")
+	}
+	b.DataKey[0] = 'x'
+	if string(r.DataKey) != "datakey" {
+		t.Error("DataKey is shared after copy")
+	}
+	b.MAC[0] = 'x'
+	if string(r.MAC) != "mac" {
+		t.Error("MAC is shared after copy")
+	}
 
 }
 
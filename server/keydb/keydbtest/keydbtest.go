@@ -0,0 +1,833 @@
+// Package keydbtest checks that an implementation of keydb.DB behaves the way
+// the Knox server relies on. A backend proves it is correct by calling Run
+// from its own tests:
+//
+//	func TestConformance(t *testing.T) {
+//		keydbtest.Run(t, func(t *testing.T) keydb.DB {
+//			return NewMyDB()
+//		})
+//	}
+package keydbtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/keydb"
+)
+
+// NewDB returns an empty DB for one test. It may use t to register cleanup
+// or to fail the test if the DB cannot be created.
+type NewDB func(t *testing.T) keydb.DB
+
+// concurrentWriters is the number of goroutines that race to update a key.
+const concurrentWriters = 8
+
+var tests = []struct {
+	name string
+	run  func(t *testing.T, db keydb.DB)
+}{
+	{"AddGet", testAddGet},
+	{"AddDuplicate", testAddDuplicate},
+	{"AddAtomic", testAddAtomic},
+	{"RoundTrip", testRoundTrip},
+	{"Update", testUpdate},
+	{"UpdateMissing", testUpdateMissing},
+	{"ConcurrentUpdates", testConcurrentUpdates},
+	{"Remove", testRemove},
+	{"RemoveMissing", testRemoveMissing},
+	{"GetAll", testGetAll},
+	{"CopyIsolation", testCopyIsolation},
+	{"TransactCommit", testTransactCommit},
+	{"TransactRollback", testTransactRollback},
+	{"Changes", testChanges},
+	{"TransactChanges", testTransactChanges},
+	{"Webhooks", testWebhooks},
+	{"DeadLetters", testDeadLetters},
+	{"Namespaces", testNamespaces},
+}
+
+// Run runs every conformance test as a subtest, each against a new DB.
+func Run(t *testing.T, newDB NewDB) {
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tc.run(t, newDB(t))
+		})
+	}
+}
+
+// newKey returns a key with a primary and an active version.
+func newKey(id string) *keydb.DBKey {
+	return &keydb.DBKey{
+		ID:  id,
+		ACL: knox.ACL{{Type: knox.User, ID: "admin", AccessType: knox.Admin}},
+		VersionList: []keydb.EncKeyVersion{
+			{ID: 1, EncData: []byte(id + "-1"), Status: knox.Primary, CreationTime: 10, CryptoMetadata: []byte{0, 1}},
+			{ID: 2, EncData: []byte(id + "-2"), Status: knox.Active, CreationTime: 20, CryptoMetadata: []byte{0, 2}},
+		},
+		VersionHash: id + "-hash",
+	}
+}
+
+// fullKey returns a key with every field set.
+func fullKey(id string) *keydb.DBKey {
+	k := newKey(id)
+	k.ACL = append(k.ACL,
+		knox.Access{Type: knox.Machine, ID: "host1", AccessType: knox.Read, Expires: 1234},
+		knox.Access{Type: knox.UserGroup, ID: "group", AccessType: knox.Write})
+	// Version IDs use all 64 bits.
+	k.VersionList = append(k.VersionList, keydb.EncKeyVersion{
+		ID: 1<<64 - 1, EncData: []byte{0, 255, '\n'}, Status: knox.Inactive, CreationTime: 30, CryptoMetadata: []byte{2, 0},
+	})
+	k.Metadata = &knox.KeyMetadata{Description: "d", Team: "t", Tags: []string{"a", "b"}, CreatedBy: "admin", CreationTime: 5}
+	k.DeletedAt = 42
+	k.Policy = &knox.KeyPolicy{RequireApproval: true}
+	k.ApprovalRequests = []knox.ApprovalRequest{{
+		ID: "r1", KeyID: id, Operation: knox.UpdateAccessOperation,
+		ACL: knox.ACL{{Type: knox.User, ID: "other", AccessType: knox.Read}}, RequestedBy: "admin", CreationTime: 6, Expires: 7,
+	}}
+	k.DataKey = []byte{1, 2, 3}
+	k.MAC = []byte{4, 5, 6}
+	return k
+}
+
+// encode returns the stored fields of k. Backends may return empty lists
+// as nil, so the two are treated the same.
+func encode(t *testing.T, k *keydb.DBKey) string {
+	c := k.Copy()
+	if len(c.ACL) == 0 {
+		c.ACL = nil
+	}
+	if len(c.VersionList) == 0 {
+		c.VersionList = nil
+	}
+	for i := range c.VersionList {
+		if len(c.VersionList[i].EncData) == 0 {
+			c.VersionList[i].EncData = nil
+		}
+		if len(c.VersionList[i].CryptoMetadata) == 0 {
+			c.VersionList[i].CryptoMetadata = nil
+		}
+	}
+	if len(c.ApprovalRequests) == 0 {
+		c.ApprovalRequests = nil
+	}
+	if len(c.DataKey) == 0 {
+		c.DataKey = nil
+	}
+	if len(c.MAC) == 0 {
+		c.MAC = nil
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	return string(b)
+}
+
+func assertEqual(t *testing.T, got, want *keydb.DBKey) {
+	t.Helper()
+	if g, w := encode(t, got), encode(t, want); g != w {
+		t.Fatalf("%s does not equal %s", g, w)
+	}
+}
+
+func mustAdd(t *testing.T, db keydb.DB, keys ...*keydb.DBKey) {
+	t.Helper()
+	if err := db.Add(keys...); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+}
+
+func mustGet(t *testing.T, db keydb.DB, id string) *keydb.DBKey {
+	t.Helper()
+	k, err := db.Get(id)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	return k
+}
+
+func testAddGet(t *testing.T, db keydb.DB) {
+	if _, err := db.Get("k1"); err != knox.ErrKeyIDNotFound {
+		t.Fatalf("%v does not equal %s", err, knox.ErrKeyIDNotFound)
+	}
+	k1, k2 := newKey("k1"), newKey("k2")
+	mustAdd(t, db, k1, k2)
+	got := mustGet(t, db, "k1")
+	assertEqual(t, got, k1)
+	if got.DBVersion == 0 {
+		t.Fatal("DBVersion was not set by Add")
+	}
+	assertEqual(t, mustGet(t, db, "k2"), k2)
+}
+
+func testAddDuplicate(t *testing.T, db keydb.DB) {
+	k := newKey("k1")
+	mustAdd(t, db, k)
+	dup := newKey("k1")
+	dup.VersionHash = "other"
+	if err := db.Add(dup); err != knox.ErrKeyExists {
+		t.Fatalf("%v does not equal %s", err, knox.ErrKeyExists)
+	}
+	assertEqual(t, mustGet(t, db, "k1"), k)
+}
+
+func testAddAtomic(t *testing.T, db keydb.DB) {
+	mustAdd(t, db, newKey("k2"))
+	if err := db.Add(newKey("k1"), newKey("k2"), newKey("k3")); err != knox.ErrKeyExists {
+		t.Fatalf("%v does not equal %s", err, knox.ErrKeyExists)
+	}
+	if err := db.Add(newKey("k4"), newKey("k4")); err != knox.ErrKeyExists {
+		t.Fatalf("%v does not equal %s", err, knox.ErrKeyExists)
+	}
+	keys, err := db.GetAll()
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(keys) != 1 || keys[0].ID != "k2" {
+		t.Fatalf("a failed Add left keys behind: %+v", keys)
+	}
+}
+
+func testRoundTrip(t *testing.T, db keydb.DB) {
+	k := fullKey("k1")
+	mustAdd(t, db, k)
+	got := mustGet(t, db, "k1")
+	assertEqual(t, got, k)
+
+	// Every field can also be changed by Update.
+	got.ACL = got.ACL[1:]
+	got.VersionList[0].Status = knox.Active
+	got.VersionList[1].Status = knox.Primary
+	got.VersionList[2].EncData = []byte("reencrypted")
+	got.VersionList = append(got.VersionList, keydb.EncKeyVersion{ID: 3, EncData: []byte("3"), Status: knox.Active, CreationTime: 40, CryptoMetadata: []byte{0}})
+	got.VersionHash = "new-hash"
+	got.Metadata.Tags = []string{"c"}
+	got.DeletedAt = 0
+	got.Policy = nil
+	got.ApprovalRequests = nil
+	got.DataKey = []byte{7}
+	got.MAC = []byte{8}
+	if err := db.Update(got); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	assertEqual(t, mustGet(t, db, "k1"), got)
+}
+
+func testUpdate(t *testing.T, db keydb.DB) {
+	mustAdd(t, db, newKey("k1"))
+	k := mustGet(t, db, "k1")
+	stale := k.Copy()
+
+	k.VersionList = k.VersionList[1:]
+	k.VersionList[0].Status = knox.Primary
+	if err := db.Update(k); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	got := mustGet(t, db, "k1")
+	assertEqual(t, got, k)
+	if got.DBVersion == stale.DBVersion {
+		t.Fatal("DBVersion did not change on Update")
+	}
+
+	if err := db.Update(stale); err != keydb.ErrDBVersion {
+		t.Fatalf("%v does not equal %s", err, keydb.ErrDBVersion)
+	}
+	assertEqual(t, mustGet(t, db, "k1"), k)
+}
+
+func testUpdateMissing(t *testing.T, db keydb.DB) {
+	if err := db.Update(newKey("k1")); err != knox.ErrKeyIDNotFound {
+		t.Fatalf("%v does not equal %s", err, knox.ErrKeyIDNotFound)
+	}
+	mustAdd(t, db, newKey("k1"))
+	k := mustGet(t, db, "k1")
+	if err := db.Remove("k1"); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if err := db.Update(k); err != knox.ErrKeyIDNotFound {
+		t.Fatalf("%v does not equal %s", err, knox.ErrKeyIDNotFound)
+	}
+}
+
+func testConcurrentUpdates(t *testing.T, db keydb.DB) {
+	mustAdd(t, db, newKey("k1"))
+	k := mustGet(t, db, "k1")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, concurrentWriters)
+	for i := 0; i < concurrentWriters; i++ {
+		u := k.Copy()
+		u.VersionHash = fmt.Sprintf("writer-%d", i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- db.Update(u)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	succeeded := 0
+	for err := range errs {
+		switch err {
+		case nil:
+			succeeded++
+		case keydb.ErrDBVersion:
+		default:
+			t.Fatalf("unexpected error %s", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Fatalf("%d updates of the same DBVersion succeeded", succeeded)
+	}
+	if got := mustGet(t, db, "k1"); got.VersionHash == k.VersionHash {
+		t.Fatal("the successful update was not stored")
+	}
+}
+
+func testRemove(t *testing.T, db keydb.DB) {
+	mustAdd(t, db, newKey("k1"), newKey("k2"))
+	if err := db.Remove("k1"); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if _, err := db.Get("k1"); err != knox.ErrKeyIDNotFound {
+		t.Fatalf("%v does not equal %s", err, knox.ErrKeyIDNotFound)
+	}
+	mustGet(t, db, "k2")
+
+	// A removed key can be added again.
+	k := newKey("k1")
+	k.VersionList = k.VersionList[:1]
+	mustAdd(t, db, k)
+	assertEqual(t, mustGet(t, db, "k1"), k)
+}
+
+func testRemoveMissing(t *testing.T, db keydb.DB) {
+	if err := db.Remove("k1"); err != knox.ErrKeyIDNotFound {
+		t.Fatalf("%v does not equal %s", err, knox.ErrKeyIDNotFound)
+	}
+	mustAdd(t, db, newKey("k1"))
+	if err := db.Remove("k1"); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if err := db.Remove("k1"); err != knox.ErrKeyIDNotFound {
+		t.Fatalf("%v does not equal %s", err, knox.ErrKeyIDNotFound)
+	}
+}
+
+func testGetAll(t *testing.T, db keydb.DB) {
+	keys, err := db.GetAll()
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(keys) != 0 {
+		t.Fatalf("%d keys in an empty DB", len(keys))
+	}
+	mustAdd(t, db, newKey("k1"), fullKey("k2"), newKey("k3"))
+	k := mustGet(t, db, "k1")
+	k.VersionHash = "updated"
+	if err := db.Update(k); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if err := db.Remove("k3"); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+
+	keys, err = db.GetAll()
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("%d does not equal 2", len(keys))
+	}
+	seen := map[string]bool{}
+	for i := range keys {
+		k := &keys[i]
+		if seen[k.ID] {
+			t.Fatalf("key %s listed twice", k.ID)
+		}
+		seen[k.ID] = true
+		got := mustGet(t, db, k.ID)
+		assertEqual(t, k, got)
+		if k.DBVersion != got.DBVersion {
+			t.Fatalf("%d does not equal %d", k.DBVersion, got.DBVersion)
+		}
+	}
+	if !seen["k1"] || !seen["k2"] {
+		t.Fatalf("unexpected keys %v", seen)
+	}
+}
+
+func testCopyIsolation(t *testing.T, db keydb.DB) {
+	k := fullKey("k1")
+	want := k.Copy()
+	mustAdd(t, db, k)
+
+	// Changing a key after adding it does not change the stored key.
+	k.ACL[0].ID = "changed"
+	k.VersionList[0].Status = knox.Inactive
+	k.Metadata.Tags[0] = "changed"
+	k.DataKey[0] = 9
+	assertEqual(t, mustGet(t, db, "k1"), want)
+
+	// Changing a key that was read does not change the stored key.
+	got := mustGet(t, db, "k1")
+	got.ACL[0].ID = "changed"
+	got.VersionList[0].Status = knox.Inactive
+	got.Metadata.Tags[0] = "changed"
+	got.MAC[0] = 9
+	assertEqual(t, mustGet(t, db, "k1"), want)
+
+	keys, err := db.GetAll()
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	for i := range keys {
+		keys[i].ACL[0].ID = "changed"
+		keys[i].VersionList[0].Status = knox.Inactive
+		keys[i].VersionList = keys[i].VersionList[:1]
+	}
+	assertEqual(t, mustGet(t, db, "k1"), want)
+
+	// Changing a key after updating with it does not change the stored key.
+	got = mustGet(t, db, "k1")
+	want = got.Copy()
+	if err := db.Update(got); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	got.VersionList[1].Status = knox.Primary
+	got.ApprovalRequests[0].ACL[0].ID = "changed"
+	assertEqual(t, mustGet(t, db, "k1"), want)
+}
+
+func transactor(t *testing.T, db keydb.DB) keydb.Transactor {
+	tr, ok := db.(keydb.Transactor)
+	if !ok {
+		t.Skip("DB does not implement keydb.Transactor")
+	}
+	return tr
+}
+
+func testTransactCommit(t *testing.T, db keydb.DB) {
+	tr := transactor(t, db)
+	mustAdd(t, db, newKey("k1"), newKey("k2"))
+	err := tr.Transact(func(tx keydb.DB) error {
+		k := mustGet(t, tx, "k1")
+		k.VersionHash = "renamed"
+		if err := tx.Add(&keydb.DBKey{ID: "k3", ACL: k.ACL, VersionList: k.VersionList, VersionHash: k.VersionHash}); err != nil {
+			return err
+		}
+		if err := tx.Remove("k1"); err != nil {
+			return err
+		}
+		k2 := mustGet(t, tx, "k2")
+		k2.VersionHash = "updated"
+		if err := tx.Update(k2); err != nil {
+			return err
+		}
+		// Reads in the transaction see its writes.
+		if _, err := tx.Get("k1"); err != knox.ErrKeyIDNotFound {
+			t.Errorf("%v does not equal %s", err, knox.ErrKeyIDNotFound)
+		}
+		if got := mustGet(t, tx, "k2"); got.VersionHash != "updated" {
+			t.Errorf("%s does not equal updated", got.VersionHash)
+		}
+		keys, err := tx.GetAll()
+		if err != nil {
+			return err
+		}
+		if len(keys) != 2 {
+			t.Errorf("%d does not equal 2", len(keys))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if _, err := db.Get("k1"); err != knox.ErrKeyIDNotFound {
+		t.Fatalf("%v does not equal %s", err, knox.ErrKeyIDNotFound)
+	}
+	if got := mustGet(t, db, "k3"); got.VersionHash != "renamed" {
+		t.Fatalf("%s does not equal renamed", got.VersionHash)
+	}
+	if got := mustGet(t, db, "k2"); got.VersionHash != "updated" {
+		t.Fatalf("%s does not equal updated", got.VersionHash)
+	}
+}
+
+func testTransactRollback(t *testing.T, db keydb.DB) {
+	tr := transactor(t, db)
+	mustAdd(t, db, newKey("k1"), newKey("k2"))
+	want := mustGet(t, db, "k2")
+	stale := mustGet(t, db, "k1")
+	k := stale.Copy()
+	k.VersionHash = "updated"
+	if err := db.Update(k); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+
+	// A failed write inside the transaction undoes the writes before it.
+	err := tr.Transact(func(tx keydb.DB) error {
+		if err := tx.Add(newKey("k3")); err != nil {
+			return err
+		}
+		if err := tx.Remove("k2"); err != nil {
+			return err
+		}
+		return tx.Update(stale)
+	})
+	if err != keydb.ErrDBVersion {
+		t.Fatalf("%v does not equal %s", err, keydb.ErrDBVersion)
+	}
+	if _, err := db.Get("k3"); err != knox.ErrKeyIDNotFound {
+		t.Fatalf("%v does not equal %s", err, knox.ErrKeyIDNotFound)
+	}
+	assertEqual(t, mustGet(t, db, "k2"), want)
+
+	// So does an error returned by the function.
+	errAbort := fmt.Errorf("abort")
+	err = tr.Transact(func(tx keydb.DB) error {
+		if err := tx.Remove("k2"); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if err != errAbort {
+		t.Fatalf("%v does not equal %s", err, errAbort)
+	}
+	got := mustGet(t, db, "k2")
+	assertEqual(t, got, want)
+	if got.DBVersion != want.DBVersion {
+		t.Fatalf("%d does not equal %d", got.DBVersion, want.DBVersion)
+	}
+}
+
+func changeFeed(t *testing.T, db keydb.DB) (keydb.ChangeFeed, int64) {
+	feed, ok := db.(keydb.ChangeFeed)
+	if !ok {
+		t.Skip("DB does not implement keydb.ChangeFeed")
+	}
+	seq, err := feed.LastSeq()
+	if err == keydb.ErrNoChangeFeed {
+		t.Skip("DB does not have a change feed")
+	}
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	return feed, seq
+}
+
+// assertChanges checks the changes after seq are to the given keys, in
+// order, and returns the sequence number of the last one.
+func assertChanges(t *testing.T, feed keydb.ChangeFeed, seq int64, ids ...string) int64 {
+	t.Helper()
+	changes, err := feed.Changes(seq, 100)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	got := []string{}
+	for i, c := range changes {
+		if c.Seq <= seq {
+			t.Fatalf("change %d has sequence number %d after %d", i, c.Seq, seq)
+		}
+		seq = c.Seq
+		got = append(got, c.KeyID)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(ids) {
+		t.Fatalf("%v does not equal %v", got, ids)
+	}
+	return seq
+}
+
+func testChanges(t *testing.T, db keydb.DB) {
+	feed, start := changeFeed(t, db)
+	assertChanges(t, feed, start)
+	mustAdd(t, db, newKey("k1"), newKey("k2"))
+	k := mustGet(t, db, "k1")
+	stale := k.Copy()
+	k.VersionHash = "updated"
+	if err := db.Update(k); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if err := db.Remove("k2"); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	// Failed writes are not changes.
+	if err := db.Update(stale); err != keydb.ErrDBVersion {
+		t.Fatalf("%v does not equal %s", err, keydb.ErrDBVersion)
+	}
+	if err := db.Add(newKey("k1")); err != knox.ErrKeyExists {
+		t.Fatalf("%v does not equal %s", err, knox.ErrKeyExists)
+	}
+	last := assertChanges(t, feed, start, "k1", "k2", "k1", "k2")
+
+	seq, err := feed.LastSeq()
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if seq != last {
+		t.Fatalf("%d does not equal %d", seq, last)
+	}
+	// Changes can be read a few at a time.
+	changes, err := feed.Changes(start, 3)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(changes) != 3 {
+		t.Fatalf("%d does not equal 3", len(changes))
+	}
+	assertChanges(t, feed, changes[2].Seq, "k2")
+	assertChanges(t, feed, last)
+	// A sequence number the feed has not reached was not given out by it.
+	if _, err := feed.Changes(last+1, 100); err != keydb.ErrChangesTruncated {
+		t.Fatalf("%v does not equal %s", err, keydb.ErrChangesTruncated)
+	}
+}
+
+func testTransactChanges(t *testing.T, db keydb.DB) {
+	tr := transactor(t, db)
+	feed, start := changeFeed(t, db)
+	mustAdd(t, db, newKey("k1"))
+	seq := assertChanges(t, feed, start, "k1")
+	err := tr.Transact(func(tx keydb.DB) error {
+		if err := tx.Add(newKey("k2")); err != nil {
+			return err
+		}
+		return fmt.Errorf("abort")
+	})
+	if err == nil {
+		t.Fatal("error is nil")
+	}
+	assertChanges(t, feed, seq)
+	err = tr.Transact(func(tx keydb.DB) error {
+		if err := tx.Add(newKey("k2")); err != nil {
+			return err
+		}
+		return tx.Remove("k1")
+	})
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	assertChanges(t, feed, seq, "k2", "k1")
+}
+
+func webhookStore(t *testing.T, db keydb.DB) keydb.WebhookStore {
+	s, ok := db.(keydb.WebhookStore)
+	if !ok {
+		t.Skip("DB does not implement keydb.WebhookStore")
+	}
+	if _, err := s.GetWebhooks(); err == keydb.ErrNoWebhooks {
+		t.Skip("DB does not store webhooks")
+	}
+	return s
+}
+
+func newWebhook(id string, created int64) *knox.Webhook {
+	return &knox.Webhook{
+		ID:           id,
+		URL:          "https://example.com/" + id,
+		KeyID:        "k1",
+		Tags:         []string{"prod"},
+		Events:       []knox.AuditEventType{knox.PromoteVersionEvent},
+		CreatedBy:    "alice",
+		CreationTime: created,
+		Secret:       "secret-" + id,
+	}
+}
+
+func testWebhooks(t *testing.T, db keydb.DB) {
+	s := webhookStore(t, db)
+	hooks, err := s.GetWebhooks()
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(hooks) != 0 {
+		t.Fatalf("%d does not equal 0", len(hooks))
+	}
+	w2, w1 := newWebhook("w2", 2), newWebhook("w1", 1)
+	for _, w := range []*knox.Webhook{w2, w1} {
+		if err := s.AddWebhook(w); err != nil {
+			t.Fatalf("%s is not nil", err)
+		}
+	}
+	if err := s.AddWebhook(newWebhook("w1", 3)); err != keydb.ErrWebhookExists {
+		t.Fatalf("%v does not equal %s", err, keydb.ErrWebhookExists)
+	}
+	// Webhooks are listed oldest first with every field.
+	hooks, err = s.GetWebhooks()
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if fmt.Sprintf("%+v", hooks) != fmt.Sprintf("%+v", []knox.Webhook{*w1, *w2}) {
+		t.Fatalf("%+v does not equal %+v", hooks, []knox.Webhook{*w1, *w2})
+	}
+	// Webhooks are not key changes.
+	if feed, ok := db.(keydb.ChangeFeed); ok {
+		if seq, err := feed.LastSeq(); err == nil && seq != 0 {
+			t.Fatalf("%d does not equal 0", seq)
+		}
+	}
+
+	if err := s.RemoveWebhook("w1"); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if err := s.RemoveWebhook("w1"); err != knox.ErrWebhookNotFound {
+		t.Fatalf("%v does not equal %s", err, knox.ErrWebhookNotFound)
+	}
+	hooks, err = s.GetWebhooks()
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(hooks) != 1 || hooks[0].ID != "w2" {
+		t.Fatalf("%+v does not equal [w2]", hooks)
+	}
+}
+
+func newDeadLetter(webhookID, deliveryID string, failed int64) *knox.WebhookDeadLetter {
+	status := knox.Primary
+	return &knox.WebhookDeadLetter{
+		Event: knox.WebhookEvent{
+			ID:         deliveryID,
+			WebhookID:  webhookID,
+			Timestamp:  failed - 1,
+			Type:       knox.PromoteVersionEvent,
+			KeyID:      "k1",
+			Principal:  "alice",
+			VersionIDs: []uint64{1},
+			NewStatus:  &status,
+		},
+		Attempts:  3,
+		LastError: "503 Service Unavailable",
+		FailedAt:  failed,
+	}
+}
+
+func testDeadLetters(t *testing.T, db keydb.DB) {
+	s := webhookStore(t, db)
+	if err := s.AddDeadLetter(newDeadLetter("w1", "d1", 1)); err != knox.ErrWebhookNotFound {
+		t.Fatalf("%v does not equal %s", err, knox.ErrWebhookNotFound)
+	}
+	if _, err := s.GetDeadLetters("w1"); err != knox.ErrWebhookNotFound {
+		t.Fatalf("%v does not equal %s", err, knox.ErrWebhookNotFound)
+	}
+	if err := s.AddWebhook(newWebhook("w1", 1)); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	letters, err := s.GetDeadLetters("w1")
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(letters) != 0 {
+		t.Fatalf("%d does not equal 0", len(letters))
+	}
+	d1, d2 := newDeadLetter("w1", "d1", 10), newDeadLetter("w1", "d2", 20)
+	for _, d := range []*knox.WebhookDeadLetter{d1, d2} {
+		if err := s.AddDeadLetter(d); err != nil {
+			t.Fatalf("%s is not nil", err)
+		}
+	}
+	letters, err = s.GetDeadLetters("w1")
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(letters) != 2 || letters[0].Event.ID != "d1" || letters[1].Event.ID != "d2" {
+		t.Fatalf("%+v does not equal [d1 d2]", letters)
+	}
+	got, _ := json.Marshal(letters[0])
+	want, _ := json.Marshal(d1)
+	if string(got) != string(want) {
+		t.Fatalf("%s does not equal %s", got, want)
+	}
+
+	// Removing the webhook removes its dead letters.
+	if err := s.RemoveWebhook("w1"); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if err := s.AddWebhook(newWebhook("w1", 2)); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	letters, err = s.GetDeadLetters("w1")
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(letters) != 0 {
+		t.Fatalf("%d does not equal 0", len(letters))
+	}
+}
+
+func testNamespaces(t *testing.T, db keydb.DB) {
+	s, ok := db.(keydb.NamespaceStore)
+	if !ok {
+		t.Skip("DB does not implement keydb.NamespaceStore")
+	}
+	namespaces, err := s.GetNamespaces()
+	if err == keydb.ErrNoNamespaces {
+		t.Skip("DB does not store namespaces")
+	}
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(namespaces) != 0 {
+		t.Fatalf("%d does not equal 0", len(namespaces))
+	}
+	inner := &knox.Namespace{Prefix: "payments:stripe:", ACL: knox.ACL{
+		{Type: knox.Machine, ID: "payments001", AccessType: knox.Read},
+	}, MAC: []byte{2, 1, 2, 3}}
+	outer := &knox.Namespace{Prefix: "payments:", ACL: knox.ACL{
+		{Type: knox.UserGroup, ID: "payments", AccessType: knox.Admin},
+		{Type: knox.ServicePrefix, ID: "spiffe://example.com/payments/", AccessType: knox.Read, Expires: 1},
+	}}
+	for _, n := range []*knox.Namespace{inner, outer} {
+		if err := s.PutNamespace(n); err != nil {
+			t.Fatalf("%s is not nil", err)
+		}
+	}
+	// Namespaces are listed by prefix with their ACLs.
+	namespaces, err = s.GetNamespaces()
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if fmt.Sprintf("%+v", namespaces) != fmt.Sprintf("%+v", []knox.Namespace{*outer, *inner}) {
+		t.Fatalf("%+v does not equal %+v", namespaces, []knox.Namespace{*outer, *inner})
+	}
+	// Namespaces are not key changes.
+	if feed, ok := db.(keydb.ChangeFeed); ok {
+		if seq, err := feed.LastSeq(); err == nil && seq != 0 {
+			t.Fatalf("%d does not equal 0", seq)
+		}
+	}
+
+	// Putting a namespace again replaces its ACL, even with the same ACL.
+	for _, acl := range []knox.ACL{outer.ACL[:1], outer.ACL[:1]} {
+		if err := s.PutNamespace(&knox.Namespace{Prefix: "payments:", ACL: acl}); err != nil {
+			t.Fatalf("%s is not nil", err)
+		}
+	}
+	namespaces, err = s.GetNamespaces()
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(namespaces) != 2 || len(namespaces[0].ACL) != 1 || namespaces[0].ACL[0] != outer.ACL[0] {
+		t.Fatalf("%+v does not have the replaced ACL", namespaces)
+	}
+
+	if err := s.RemoveNamespace("payments:"); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if err := s.RemoveNamespace("payments:"); err != knox.ErrNamespaceNotFound {
+		t.Fatalf("%v does not equal %s", err, knox.ErrNamespaceNotFound)
+	}
+	namespaces, err = s.GetNamespaces()
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(namespaces) != 1 || namespaces[0].Prefix != "payments:stripe:" {
+		t.Fatalf("%+v does not equal [payments:stripe:]", namespaces)
+	}
+}
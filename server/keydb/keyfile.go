@@ -0,0 +1,98 @@
+package keydb
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+var ErrBadPassphrase = fmt.Errorf("Keyfile passphrase is incorrect or the keyfile is corrupt")
+
+// Scrypt parameters for new keyfiles, as recommended for interactive logins
+// in 2017. Keyfiles record their parameters, so these can be raised later.
+const (
+	keyfileScryptN = 1 << 15
+	keyfileScryptR = 8
+	keyfileScryptP = 1
+)
+
+const keyfileSaltSize = 16
+
+// keyfile is a master key encrypted with AES GCM under a key derived from a
+// passphrase with scrypt.
+type keyfile struct {
+	N      int    `json:"n"`
+	R      int    `json:"r"`
+	P      int    `json:"p"`
+	Salt   []byte `json:"salt"`
+	EncKey []byte `json:"key"`
+}
+
+func (f *keyfile) passphraseKey(passphrase []byte) ([]byte, error) {
+	return scrypt.Key(passphrase, f.Salt, f.N, f.R, f.P, dataKeySize)
+}
+
+// CreateKeyfile generates a random master key and writes it to filename,
+// protected by passphrase. It fails if the file already exists.
+func CreateKeyfile(filename string, passphrase []byte) error {
+	masterKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(masterKey); err != nil {
+		return err
+	}
+	f := keyfile{N: keyfileScryptN, R: keyfileScryptR, P: keyfileScryptP, Salt: make([]byte, keyfileSaltSize)}
+	if _, err := rand.Read(f.Salt); err != nil {
+		return err
+	}
+	pk, err := f.passphraseKey(passphrase)
+	if err != nil {
+		return err
+	}
+	f.EncKey, err = (&aesKeyWrapper{pk}).Wrap(masterKey, nil)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	return writeNewFile(filename, b)
+}
+
+// NewKeyfileWrapper creates a KeyWrapper that wraps keys locally with the
+// master key in a keyfile created by CreateKeyfile.
+func NewKeyfileWrapper(filename string, passphrase []byte) (KeyWrapper, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var f keyfile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, err
+	}
+	pk, err := f.passphraseKey(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	masterKey, err := (&aesKeyWrapper{pk}).Unwrap(f.EncKey, nil)
+	if err != nil {
+		return nil, ErrBadPassphrase
+	}
+	return &aesKeyWrapper{masterKey}, nil
+}
+
+// writeNewFile writes b to a new file that only its owner can read.
+func writeNewFile(filename string, b []byte) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
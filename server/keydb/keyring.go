@@ -0,0 +1,156 @@
+package keydb
+
+import (
+	"fmt"
+
+	"github.com/pinterest/knox"
+)
+
+var (
+	ErrNoCurrentKey   = fmt.Errorf("Keyring has no master key for the current version")
+	ErrKeyringCryptor = fmt.Errorf("Keyring cryptors must be AES GCM or XChaCha20-Poly1305 cryptors")
+)
+
+// StaleChecker is implemented by Cryptors that can tell whether a stored key
+// should be reencrypted, e.g. because it was encrypted by a retired master key.
+type StaleChecker interface {
+	Stale(k *DBKey) bool
+}
+
+// NewKeyringCryptor creates a Cryptor that performs AES GCM encryption with
+// the master key of the current version, and decrypts with the master key of
+// whichever version in keys is recorded in each version's metadata. This
+// lets a new master key be rolled out while data encrypted by the old one is
+// reencrypted in the background.
+func NewKeyringCryptor(current byte, keys map[byte][]byte) (Cryptor, error) {
+	keyData, ok := keys[current]
+	if !ok {
+		return nil, ErrNoCurrentKey
+	}
+	var previous []Cryptor
+	for version, keyData := range keys {
+		if version != current {
+			previous = append(previous, &aesGCMCryptor{keyData, version})
+		}
+	}
+	return NewKeyring(&aesGCMCryptor{keyData, current}, previous...)
+}
+
+// NewKeyring creates a Cryptor that encrypts with current and decrypts with
+// whichever of current and previous encrypted each version, as recorded in
+// its metadata. The cryptors must come from NewAESGCMCryptor or
+// NewXChaChaCryptor, and may mix the two. Envelope encryption cryptors rotate
+// their master keys with NewEnvelopeKeyring instead.
+func NewKeyring(current Cryptor, previous ...Cryptor) (Cryptor, error) {
+	c := &keyringCryptor{cryptors: map[cryptorID]masterCryptor{}}
+	for _, p := range append(previous, current) {
+		mc, ok := p.(masterCryptor)
+		if !ok {
+			return nil, ErrKeyringCryptor
+		}
+		c.cryptors[mc.id()] = mc
+	}
+	c.current = current.(masterCryptor)
+	return c, nil
+}
+
+// masterCryptor is a Cryptor that encrypts versions directly under one
+// master key, so it can be part of a keyring.
+type masterCryptor interface {
+	Cryptor
+	id() cryptorID
+	decryptVersion(k *DBKey, v *EncKeyVersion) (*knox.KeyVersion, error)
+}
+
+// cryptorID is the scheme and version of a master key, as recorded in the
+// metadata of the versions encrypted under it.
+type cryptorID struct {
+	scheme  byte
+	version byte
+}
+
+func (c *aesGCMCryptor) id() cryptorID {
+	return cryptorID{aesGCMScheme, c.version}
+}
+
+func (c *xchachaCryptor) id() cryptorID {
+	return cryptorID{xchachaScheme, c.version}
+}
+
+// versionCryptorID returns the scheme and version recorded in the metadata of
+// a version. Apart from aesGCMCryptor's, metadata starts with both.
+func versionCryptorID(v *EncKeyVersion) (cryptorID, error) {
+	scheme, err := versionScheme(v)
+	if err != nil {
+		return cryptorID{}, err
+	}
+	if scheme == aesGCMScheme {
+		return cryptorID{aesGCMScheme, aesCryptoMetadata(v.CryptoMetadata).Version()}, nil
+	}
+	if len(v.CryptoMetadata) < 2 {
+		return cryptorID{}, ErrCryptorVersion
+	}
+	return cryptorID{scheme, v.CryptoMetadata[1]}, nil
+}
+
+type keyringCryptor struct {
+	current  masterCryptor
+	cryptors map[cryptorID]masterCryptor
+}
+
+// cryptorFor returns the cryptor for the master key a version was encrypted by.
+func (c *keyringCryptor) cryptorFor(v *EncKeyVersion) (masterCryptor, error) {
+	id, err := versionCryptorID(v)
+	if err != nil {
+		return nil, err
+	}
+	cryptor, ok := c.cryptors[id]
+	if !ok {
+		return nil, ErrCryptorVersion
+	}
+	return cryptor, nil
+}
+
+func (c *keyringCryptor) EncryptVersion(k *knox.Key, v *knox.KeyVersion) (*EncKeyVersion, error) {
+	return c.current.EncryptVersion(k, v)
+}
+
+func (c *keyringCryptor) Encrypt(k *knox.Key) (*DBKey, error) {
+	return c.current.Encrypt(k)
+}
+
+func (c *keyringCryptor) Decrypt(k *DBKey) (*knox.Key, error) {
+	versions := make([]knox.KeyVersion, len(k.VersionList))
+	for i, v := range k.VersionList {
+		cryptor, err := c.cryptorFor(&v)
+		if err != nil {
+			return nil, err
+		}
+		dbv, err := cryptor.decryptVersion(k, &v)
+		if err != nil {
+			return nil, err
+		}
+		versions[i] = *dbv
+	}
+
+	newKey := knox.Key{
+		ID:          k.ID,
+		ACL:         k.ACL,
+		VersionList: versions,
+		VersionHash: k.VersionHash,
+		Metadata:    k.Metadata.Copy(),
+		Policy:      k.Policy.Copy(),
+	}
+	return &newKey, nil
+}
+
+// Stale reports whether any version of k was encrypted by a master key other
+// than the current one.
+func (c *keyringCryptor) Stale(k *DBKey) bool {
+	for _, v := range k.VersionList {
+		if id, err := versionCryptorID(&v); err != nil || id != c.current.id() {
+			return true
+		}
+	}
+	return false
+}
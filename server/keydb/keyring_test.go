@@ -0,0 +1,65 @@
+package keydb
+
+import (
+	"reflect"
+	"testing"
+)
+
+var testSecret2 = []byte("secondsecretkey!")
+
+func TestKeyringCryptor(t *testing.T) {
+	if _, err := NewKeyringCryptor(2, map[byte][]byte{1: testSecret}); err != ErrNoCurrentKey {
+		t.Fatalf("%v does not equal %s", err, ErrNoCurrentKey)
+	}
+
+	k := makeTestKey()
+	old := NewAESGCMCryptor(1, testSecret)
+	oldK, err := old.Encrypt(k)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+
+	crypt, err := NewKeyringCryptor(2, map[byte][]byte{1: testSecret, 2: testSecret2})
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	decK, err := crypt.Decrypt(oldK)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if !reflect.DeepEqual(decK, k) {
+		t.Fatal("decrypted key does not equal key")
+	}
+	checker := crypt.(StaleChecker)
+	if !checker.Stale(oldK) {
+		t.Fatal("key encrypted by the old master key should be stale")
+	}
+
+	newK, err := crypt.Encrypt(k)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if checker.Stale(newK) {
+		t.Fatal("key encrypted by the current master key should not be stale")
+	}
+	decK, err = NewAESGCMCryptor(2, testSecret2).Decrypt(newK)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if !reflect.DeepEqual(decK, k) {
+		t.Fatal("decrypted key does not equal key")
+	}
+
+	// Keys encrypted by versions that are not in the keyring do not decrypt.
+	retired, err := NewKeyringCryptor(2, map[byte][]byte{2: testSecret2})
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if _, err := retired.Decrypt(oldK); err != ErrCryptorVersion {
+		t.Fatalf("%v does not equal %s", err, ErrCryptorVersion)
+	}
+	_, err = retired.Decrypt(&DBKey{VersionList: []EncKeyVersion{{CryptoMetadata: []byte{2}}}})
+	if err != ErrCryptorVersion {
+		t.Fatalf("%v does not equal %s", err, ErrCryptorVersion)
+	}
+}
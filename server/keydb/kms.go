@@ -0,0 +1,58 @@
+package keydb
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+var ErrInvalidWrappedKey = fmt.Errorf("Wrapped key is malformed")
+
+// KeyWrapper wraps and unwraps data keys with a master key, which may be held
+// by an external key management service. The context is authenticated along
+// with the key and must be the same to unwrap it.
+type KeyWrapper interface {
+	Wrap(plaintext, context []byte) ([]byte, error)
+	Unwrap(wrapped, context []byte) ([]byte, error)
+}
+
+// NewKMSCryptor creates an envelope encryption Cryptor, like
+// NewEnvelopeCryptor, whose data keys are wrapped by w. The master key is
+// never seen by knox, so versions encrypted directly under a master key by an
+// AES GCM cryptor cannot be decrypted and must be reencrypted first.
+func NewKMSCryptor(version byte, w KeyWrapper) Cryptor {
+	return &envelopeCryptor{version: version, wrappers: map[byte]KeyWrapper{version: w}}
+}
+
+// NewAESKeyWrapper creates a KeyWrapper that wraps keys locally with AES GCM.
+func NewAESKeyWrapper(masterKey []byte) KeyWrapper {
+	return &aesKeyWrapper{masterKey}
+}
+
+// aesKeyWrapper wraps keys as the nonce followed by the AES GCM ciphertext.
+type aesKeyWrapper struct {
+	keyData []byte
+}
+
+func (w *aesKeyWrapper) Wrap(plaintext, context []byte) ([]byte, error) {
+	gcm, err := newGCM(w.keyData)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, context), nil
+}
+
+func (w *aesKeyWrapper) Unwrap(wrapped, context []byte) ([]byte, error) {
+	gcm, err := newGCM(w.keyData)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < gcm.NonceSize()+gcm.Overhead() {
+		return nil, ErrInvalidWrappedKey
+	}
+	n := gcm.NonceSize()
+	return gcm.Open(nil, wrapped[:n], wrapped[n:], context)
+}
@@ -0,0 +1,118 @@
+package keydb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// The remote key wrapping protocol is JSON over HTTP:
+//
+//	POST <url>/wrap   {"key_id": id, "plaintext": b64, "context": b64} -> {"ciphertext": b64}
+//	POST <url>/unwrap {"key_id": id, "ciphertext": b64, "context": b64} -> {"plaintext": b64}
+//
+// Failures have a non-200 status and a body of {"error": message}.
+type kmsMessage struct {
+	KeyID      string `json:"key_id,omitempty"`
+	Plaintext  []byte `json:"plaintext,omitempty"`
+	Ciphertext []byte `json:"ciphertext,omitempty"`
+	Context    []byte `json:"context,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// NewHTTPKeyWrapper creates a KeyWrapper that wraps keys with the master key
+// keyID of the key management service at url.
+func NewHTTPKeyWrapper(client *http.Client, url, keyID string) KeyWrapper {
+	return &httpKeyWrapper{client: client, url: strings.TrimSuffix(url, "/"), keyID: keyID}
+}
+
+type httpKeyWrapper struct {
+	client *http.Client
+	url    string
+	keyID  string
+}
+
+func (w *httpKeyWrapper) call(op string, req *kmsMessage) (*kmsMessage, error) {
+	req.KeyID = w.keyID
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	r, err := w.client.Post(w.url+"/"+op, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+	var resp kmsMessage
+	if err := json.NewDecoder(r.Body).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("Invalid response to %s from key management service: %s", op, err.Error())
+	}
+	if r.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Key management service failed to %s: %s", op, resp.Error)
+	}
+	return &resp, nil
+}
+
+func (w *httpKeyWrapper) Wrap(plaintext, context []byte) ([]byte, error) {
+	resp, err := w.call("wrap", &kmsMessage{Plaintext: plaintext, Context: context})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Ciphertext, nil
+}
+
+func (w *httpKeyWrapper) Unwrap(wrapped, context []byte) ([]byte, error) {
+	resp, err := w.call("unwrap", &kmsMessage{Ciphertext: wrapped, Context: context})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Plaintext, nil
+}
+
+// NewKMSHandler serves the remote key wrapping protocol with the given
+// wrappers, indexed by key ID. It can stand in for a key management service
+// in development and tests.
+func NewKMSHandler(wrappers map[string]KeyWrapper) http.Handler {
+	mux := http.NewServeMux()
+	handle := func(op string, f func(w KeyWrapper, req *kmsMessage) (*kmsMessage, error)) {
+		mux.HandleFunc("/"+op, func(rw http.ResponseWriter, r *http.Request) {
+			rw.Header().Set("Content-Type", "application/json")
+			enc := json.NewEncoder(rw)
+			if r.Method != http.MethodPost {
+				rw.WriteHeader(http.StatusMethodNotAllowed)
+				enc.Encode(kmsMessage{Error: "method not allowed"})
+				return
+			}
+			var req kmsMessage
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				rw.WriteHeader(http.StatusBadRequest)
+				enc.Encode(kmsMessage{Error: err.Error()})
+				return
+			}
+			w, ok := wrappers[req.KeyID]
+			if !ok {
+				rw.WriteHeader(http.StatusNotFound)
+				enc.Encode(kmsMessage{Error: "unknown key " + req.KeyID})
+				return
+			}
+			resp, err := f(w, &req)
+			if err != nil {
+				rw.WriteHeader(http.StatusBadRequest)
+				enc.Encode(kmsMessage{Error: err.Error()})
+				return
+			}
+			enc.Encode(resp)
+		})
+	}
+	handle("wrap", func(w KeyWrapper, req *kmsMessage) (*kmsMessage, error) {
+		c, err := w.Wrap(req.Plaintext, req.Context)
+		return &kmsMessage{Ciphertext: c}, err
+	})
+	handle("unwrap", func(w KeyWrapper, req *kmsMessage) (*kmsMessage, error) {
+		p, err := w.Unwrap(req.Ciphertext, req.Context)
+		return &kmsMessage{Plaintext: p}, err
+	})
+	return mux
+}
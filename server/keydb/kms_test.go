@@ -0,0 +1,123 @@
+package keydb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func testKeyWrapper(t *testing.T, w KeyWrapper) {
+	wrapped, err := w.Wrap([]byte("datakey"), []byte("ctx"))
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if bytes.Contains(wrapped, []byte("datakey")) {
+		t.Fatal("wrapped key contains the plaintext")
+	}
+	unwrapped, err := w.Unwrap(wrapped, []byte("ctx"))
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if string(unwrapped) != "datakey" {
+		t.Fatalf("%q does not equal datakey", unwrapped)
+	}
+	if _, err := w.Unwrap(wrapped, []byte("other")); err == nil {
+		t.Fatal("error is nil for a different context")
+	}
+	if _, err := w.Unwrap([]byte("short"), []byte("ctx")); err == nil {
+		t.Fatal("error is nil for a malformed wrapped key")
+	}
+}
+
+func TestAESKeyWrapper(t *testing.T) {
+	testKeyWrapper(t, NewAESKeyWrapper(testSecret))
+}
+
+func TestHTTPKeyWrapper(t *testing.T) {
+	s := httptest.NewServer(NewKMSHandler(map[string]KeyWrapper{"master": NewAESKeyWrapper(testSecret)}))
+	defer s.Close()
+	testKeyWrapper(t, NewHTTPKeyWrapper(http.DefaultClient, s.URL, "master"))
+
+	unknown := NewHTTPKeyWrapper(http.DefaultClient, s.URL, "unknown")
+	if _, err := unknown.Wrap([]byte("datakey"), nil); err == nil {
+		t.Fatal("error is nil for an unknown master key")
+	}
+
+	// A cryptor backed by the service works without the master key.
+	k := makeTestKey()
+	crypt := NewKMSCryptor(1, NewHTTPKeyWrapper(http.DefaultClient, s.URL+"/", "master"))
+	encK, err := crypt.Encrypt(k)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	decK, err := crypt.Decrypt(encK)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if !reflect.DeepEqual(decK, k) {
+		t.Fatal("decrypted key does not equal key")
+	}
+
+	// Versions encrypted directly under a master key cannot be decrypted.
+	oldK, err := NewAESGCMCryptor(1, testSecret).Encrypt(k)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if _, err := crypt.Decrypt(oldK); err != ErrCryptorVersion {
+		t.Fatalf("%v does not equal %s", err, ErrCryptorVersion)
+	}
+	if _, err := crypt.EncryptVersion(k, &k.VersionList[0]); err == nil {
+		t.Fatal("error is nil encrypting without a data key")
+	}
+}
+
+func TestKeyfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyfile")
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "master.key")
+
+	if err := CreateKeyfile(fn, []byte("passphrase")); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if err := CreateKeyfile(fn, []byte("passphrase")); err == nil {
+		t.Fatal("error is nil overwriting a keyfile")
+	}
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+
+	w, err := NewKeyfileWrapper(fn, []byte("passphrase"))
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	testKeyWrapper(t, w)
+	wrapped, err := w.Wrap([]byte("datakey"), nil)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+
+	// The same master key is loaded every time.
+	w2, err := NewKeyfileWrapper(fn, []byte("passphrase"))
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if _, err := w2.Unwrap(wrapped, nil); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if b2, _ := ioutil.ReadFile(fn); !bytes.Equal(b, b2) {
+		t.Fatal("keyfile changed when opened")
+	}
+
+	if _, err := NewKeyfileWrapper(fn, []byte("wrong")); err != ErrBadPassphrase {
+		t.Fatalf("%v does not equal %s", err, ErrBadPassphrase)
+	}
+}
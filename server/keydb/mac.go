@@ -0,0 +1,282 @@
+package keydb
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/pinterest/knox"
+)
+
+var (
+	ErrMACMismatch  = fmt.Errorf("Key record failed its integrity check")
+	ErrMACMissing   = fmt.Errorf("Key record has no MAC")
+	ErrMACOutdated  = fmt.Errorf("Key record has a MAC in an outdated format")
+	ErrNotDerivable = fmt.Errorf("Keys cannot be derived from a remote key wrapper")
+)
+
+// macVersion is the first byte of every MAC, so the format can change.
+// Version 1 MACs did not cover DeletedAt and Policy, and version 2 MACs did
+// not cover Metadata and ApprovalRequests.
+const (
+	macVersion   byte = 3
+	macVersionV1 byte = 1
+	macVersionV2 byte = 2
+)
+
+// Signer is implemented by Cryptors that protect the plaintext fields of a
+// DBKey with a MAC stored in DBKey.MAC.
+type Signer interface {
+	// Sign sets the MAC of k. DBKeys must be signed again after any field the
+	// MAC covers is changed.
+	Sign(k *DBKey) error
+	// Verify returns ErrMACMismatch if k has been changed since it was signed.
+	Verify(k *DBKey) error
+}
+
+// Sign sets the MAC of k if c is a Signer.
+func Sign(c Cryptor, k *DBKey) error {
+	if s, ok := c.(Signer); ok {
+		return s.Sign(k)
+	}
+	return nil
+}
+
+// Verify checks the MAC of k if c is a Signer.
+func Verify(c Cryptor, k *DBKey) error {
+	if s, ok := c.(Signer); ok {
+		return s.Verify(k)
+	}
+	return nil
+}
+
+// namespaceKey returns the DBKey that stands in for a namespace when it is
+// signed. Its ID can never be a key ID, so the MAC of a namespace cannot be
+// used for a key or the other way round.
+func namespaceKey(n *knox.Namespace) *DBKey {
+	return &DBKey{ID: "namespace " + n.Prefix, ACL: n.ACL, MAC: n.MAC}
+}
+
+// SignNamespace sets the MAC of n, covering its prefix and ACL, if c is a
+// Signer.
+func SignNamespace(c Cryptor, n *knox.Namespace) error {
+	k := namespaceKey(n)
+	if err := Sign(c, k); err != nil {
+		return err
+	}
+	n.MAC = k.MAC
+	return nil
+}
+
+// VerifyNamespace checks the MAC of n if c is a Signer.
+func VerifyNamespace(c Cryptor, n *knox.Namespace) error {
+	return Verify(c, namespaceKey(n))
+}
+
+// NewMACCryptor wraps c so that the key ID, ACL, version hash, deletion time,
+// policy, metadata, pending approval requests, and the status of every
+// version are covered by an HMAC-SHA256 under macKey. Anyone who can write to
+// the database but does not have macKey can then no longer grant access,
+// reactivate versions, plant approval requests, or have keys purged
+// unnoticed. Encrypt signs the keys it returns and Decrypt fails with
+// ErrMACMismatch for keys whose MAC does not match.
+//
+// Keys with version 2 MACs, which do not cover the metadata and approval
+// requests, are accepted and reported stale so that a Reencryptor signs them
+// again. If allowUnsigned is set, keys without a MAC, such as those written
+// before MACs were used, and keys with version 1 MACs, which do not cover the
+// deletion time and policy either, are accepted in the same way. It should be
+// turned off once every key has been signed.
+func NewMACCryptor(c Cryptor, macKey []byte, allowUnsigned bool) Cryptor {
+	return &macCryptor{cryptor: c, macKey: macKey, allowUnsigned: allowUnsigned}
+}
+
+// NewMACKeyring is like NewMACCryptor, but also accepts keys signed with any
+// of the previous MAC keys, e.g. ones derived from retired master keys. Such
+// keys are reported stale so that a Reencryptor signs them with macKey.
+func NewMACKeyring(c Cryptor, macKey []byte, previous [][]byte, allowUnsigned bool) Cryptor {
+	return &macCryptor{cryptor: c, macKey: macKey, previous: previous, allowUnsigned: allowUnsigned}
+}
+
+type macCryptor struct {
+	cryptor       Cryptor
+	macKey        []byte
+	previous      [][]byte
+	allowUnsigned bool
+}
+
+// macStatus is the status of a version as covered by the MAC.
+type macStatus struct {
+	ID     uint64             `json:"id"`
+	Status knox.VersionStatus `json:"status"`
+}
+
+// macFieldsV1 are the fields of a DBKey covered by version 1 MACs.
+type macFieldsV1 struct {
+	ID          string      `json:"id"`
+	ACL         knox.ACL    `json:"acl"`
+	VersionHash string      `json:"hash"`
+	Statuses    []macStatus `json:"statuses"`
+}
+
+// macFieldsV2 are the fields of a DBKey covered by version 2 MACs.
+type macFieldsV2 struct {
+	macFieldsV1
+	DeletedAt int64           `json:"deleted"`
+	Policy    *knox.KeyPolicy `json:"policy"`
+}
+
+// macFields are the fields of a DBKey covered by the MAC.
+type macFields struct {
+	macFieldsV2
+	Metadata         *knox.KeyMetadata      `json:"metadata"`
+	ApprovalRequests []knox.ApprovalRequest `json:"requests"`
+}
+
+// mac returns the MAC of k under macKey in the given format version.
+func (c *macCryptor) mac(macKey []byte, k *DBKey, version byte) ([]byte, error) {
+	f := macFieldsV1{ID: k.ID, ACL: k.ACL, VersionHash: k.VersionHash}
+	for _, v := range k.VersionList {
+		f.Statuses = append(f.Statuses, macStatus{v.ID, v.Status})
+	}
+	f2 := macFieldsV2{f, k.DeletedAt, k.Policy}
+	var b []byte
+	var err error
+	switch version {
+	case macVersionV1:
+		b, err = json.Marshal(f)
+	case macVersionV2:
+		b, err = json.Marshal(f2)
+	default:
+		f3 := macFields{macFieldsV2: f2, Metadata: k.Metadata}
+		// No requests are signed the same however they are stored.
+		if len(k.ApprovalRequests) > 0 {
+			f3.ApprovalRequests = k.ApprovalRequests
+		}
+		b, err = json.Marshal(f3)
+	}
+	if err != nil {
+		return nil, err
+	}
+	h := hmac.New(sha256.New, macKey)
+	h.Write(b)
+	return h.Sum([]byte{version}), nil
+}
+
+// signedWith returns whether k is signed with macKey in the format version of
+// its MAC.
+func (c *macCryptor) signedWith(macKey []byte, k *DBKey) (bool, error) {
+	mac, err := c.mac(macKey, k, k.MAC[0])
+	if err != nil {
+		return false, err
+	}
+	return hmac.Equal(mac, k.MAC), nil
+}
+
+func (c *macCryptor) Sign(k *DBKey) error {
+	mac, err := c.mac(c.macKey, k, macVersion)
+	if err != nil {
+		return err
+	}
+	k.MAC = mac
+	return nil
+}
+
+func (c *macCryptor) Verify(k *DBKey) error {
+	if len(k.MAC) == 0 {
+		if c.allowUnsigned {
+			return nil
+		}
+		return ErrMACMissing
+	}
+	if k.MAC[0] == macVersionV1 && !c.allowUnsigned {
+		return ErrMACOutdated
+	}
+	for _, macKey := range append([][]byte{c.macKey}, c.previous...) {
+		ok, err := c.signedWith(macKey, k)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+	}
+	return ErrMACMismatch
+}
+
+func (c *macCryptor) Encrypt(k *knox.Key) (*DBKey, error) {
+	dbk, err := c.cryptor.Encrypt(k)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Sign(dbk); err != nil {
+		return nil, err
+	}
+	return dbk, nil
+}
+
+func (c *macCryptor) Decrypt(k *DBKey) (*knox.Key, error) {
+	if err := c.Verify(k); err != nil {
+		return nil, err
+	}
+	return c.cryptor.Decrypt(k)
+}
+
+// EncryptVersion encrypts with the wrapped cryptor. The key must be signed
+// again once the version has been added to it.
+func (c *macCryptor) EncryptVersion(k *knox.Key, v *knox.KeyVersion) (*EncKeyVersion, error) {
+	return c.cryptor.EncryptVersion(k, v)
+}
+
+func (c *macCryptor) EncryptDBVersion(k *DBKey, v *knox.KeyVersion) (*EncKeyVersion, error) {
+	if e, ok := c.cryptor.(DBVersionEncryptor); ok {
+		return e.EncryptDBVersion(k, v)
+	}
+	key, err := c.Decrypt(k)
+	if err != nil {
+		return nil, err
+	}
+	return c.cryptor.EncryptVersion(key, v)
+}
+
+// Rewrap checks the MAC of k before rewrapping its data key with the wrapped
+// cryptor, so that the key is never signed again after being tampered with.
+func (c *macCryptor) Rewrap(k *DBKey) error {
+	if err := c.Verify(k); err != nil {
+		return err
+	}
+	return Rewrap(c.cryptor, k)
+}
+
+// Stale reports whether k is unsigned, signed with a previous MAC key or MAC
+// format, or stale for the wrapped cryptor.
+func (c *macCryptor) Stale(k *DBKey) bool {
+	if s, ok := c.cryptor.(StaleChecker); ok && s.Stale(k) {
+		return true
+	}
+	if len(k.MAC) == 0 || k.MAC[0] != macVersion {
+		return true
+	}
+	ok, err := c.signedWith(c.macKey, k)
+	return err != nil || !ok
+}
+
+// DeriveKey derives a key for purpose from the master key of a local
+// KeyWrapper, such as one from NewAESKeyWrapper or NewKeyfileWrapper, with
+// HKDF-SHA256. Remote key wrappers never reveal key material, so it fails with
+// ErrNotDerivable for them.
+func DeriveKey(w KeyWrapper, purpose string) ([]byte, error) {
+	aw, ok := w.(*aesKeyWrapper)
+	if !ok {
+		return nil, ErrNotDerivable
+	}
+	key := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, aw.keyData, nil, []byte(purpose)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
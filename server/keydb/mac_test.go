@@ -0,0 +1,238 @@
+package keydb
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/pinterest/knox"
+)
+
+func TestMACCryptor(t *testing.T) {
+	k := makeTestKey()
+	crypt := NewMACCryptor(NewAESGCMCryptor(10, testSecret), []byte("mackey"), false)
+	encK, err := crypt.Encrypt(k)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(encK.MAC) == 0 {
+		t.Fatal("MAC is not set")
+	}
+	decK, err := crypt.Decrypt(encK)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if !reflect.DeepEqual(decK, k) {
+		t.Fatal("decrypted key does not equal key")
+	}
+
+	tampered := []func(k *DBKey){
+		func(k *DBKey) { k.ID = "otherID" },
+		func(k *DBKey) { k.ACL = k.ACL.Add(knox.Access{Type: knox.User, ID: "attacker", AccessType: knox.Read}) },
+		func(k *DBKey) { k.VersionHash = "otherHash" },
+		func(k *DBKey) { k.VersionList[0].Status = knox.Inactive },
+		func(k *DBKey) { k.Metadata = nil },
+		func(k *DBKey) { k.MAC[len(k.MAC)-1] ^= 1 },
+	}
+	for i, tamper := range tampered {
+		changed := encK.Copy()
+		tamper(changed)
+		if _, err := crypt.Decrypt(changed); err != ErrMACMismatch {
+			t.Fatalf("%d: %v does not equal %s", i, err, ErrMACMismatch)
+		}
+	}
+
+	// Legitimate changes are signed again.
+	changed := encK.Copy()
+	changed.ACL = changed.ACL.Add(knox.Access{Type: knox.User, ID: "friend", AccessType: knox.Read})
+	if err := Sign(crypt, changed); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if err := Verify(crypt, changed); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+
+	// Fields that are not covered can change freely.
+	changed.DBVersion++
+	if err := Verify(crypt, changed); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+
+	other := NewMACCryptor(NewAESGCMCryptor(10, testSecret), []byte("othermackey"), false)
+	if _, err := other.Decrypt(encK); err != ErrMACMismatch {
+		t.Fatalf("%v does not equal %s", err, ErrMACMismatch)
+	}
+}
+
+func TestMACCryptorUnsigned(t *testing.T) {
+	k := makeTestKey()
+	unsigned, err := NewAESGCMCryptor(10, testSecret).Encrypt(k)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+
+	strict := NewMACCryptor(NewAESGCMCryptor(10, testSecret), []byte("mackey"), false)
+	if _, err := strict.Decrypt(unsigned); err != ErrMACMissing {
+		t.Fatalf("%v does not equal %s", err, ErrMACMissing)
+	}
+
+	lenient := NewMACCryptor(NewAESGCMCryptor(10, testSecret), []byte("mackey"), true)
+	if _, err := lenient.Decrypt(unsigned); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if !lenient.(StaleChecker).Stale(unsigned) {
+		t.Fatal("unsigned key should be stale")
+	}
+	signed, err := lenient.Encrypt(k)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if lenient.(StaleChecker).Stale(signed) {
+		t.Fatal("signed key should not be stale")
+	}
+
+	// Unsigned cryptors do nothing.
+	plain := NewAESGCMCryptor(10, testSecret)
+	if err := Sign(plain, unsigned); err != nil || unsigned.MAC != nil {
+		t.Fatalf("unsigned cryptor signed the key: %v", err)
+	}
+	if err := Verify(plain, unsigned); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+}
+
+func TestMACCoversDeletionAndPolicy(t *testing.T) {
+	crypt := NewMACCryptor(NewAESGCMCryptor(10, testSecret), []byte("mackey"), false)
+	encK, err := crypt.Encrypt(makeTestKey())
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	deleted := encK.Copy()
+	deleted.DeletedAt = 1
+	if err := Verify(crypt, deleted); err != ErrMACMismatch {
+		t.Fatalf("%v does not equal %s", err, ErrMACMismatch)
+	}
+	policy := encK.Copy()
+	policy.Policy = nil
+	if err := Verify(crypt, policy); err != ErrMACMismatch {
+		t.Fatalf("%v does not equal %s", err, ErrMACMismatch)
+	}
+
+	// Version 1 MACs did not cover them, so they are only accepted along with
+	// unsigned keys.
+	mc := crypt.(*macCryptor)
+	v1, err := mc.mac(mc.macKey, encK, macVersionV1)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	encK.MAC = v1
+	if err := Verify(crypt, encK); err != ErrMACOutdated {
+		t.Fatalf("%v does not equal %s", err, ErrMACOutdated)
+	}
+	lenient := NewMACCryptor(NewAESGCMCryptor(10, testSecret), []byte("mackey"), true)
+	if err := Verify(lenient, encK); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if !lenient.(StaleChecker).Stale(encK) {
+		t.Fatal("key with a version 1 MAC should be stale")
+	}
+}
+
+func TestMACCoversApprovalRequests(t *testing.T) {
+	crypt := NewMACCryptor(NewAESGCMCryptor(10, testSecret), []byte("mackey"), false)
+	encK, err := crypt.Encrypt(makeTestKey())
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	planted := encK.Copy()
+	planted.ApprovalRequests = []knox.ApprovalRequest{{ID: "r1", KeyID: encK.ID, RequestedBy: "attacker"}}
+	if err := Verify(crypt, planted); err != ErrMACMismatch {
+		t.Fatalf("%v does not equal %s", err, ErrMACMismatch)
+	}
+	metadata := encK.Copy()
+	metadata.Metadata = &knox.KeyMetadata{Team: "attacker"}
+	if err := Verify(crypt, metadata); err != ErrMACMismatch {
+		t.Fatalf("%v does not equal %s", err, ErrMACMismatch)
+	}
+
+	// Version 2 MACs did not cover them, but are still accepted until the key
+	// is signed again.
+	mc := crypt.(*macCryptor)
+	v2, err := mc.mac(mc.macKey, encK, macVersionV2)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	encK.MAC = v2
+	if err := Verify(crypt, encK); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if !crypt.(StaleChecker).Stale(encK) {
+		t.Fatal("key with a version 2 MAC should be stale")
+	}
+}
+
+func TestMACKeyring(t *testing.T) {
+	old := NewMACCryptor(NewAESGCMCryptor(10, testSecret), []byte("oldmackey"), false)
+	encK, err := old.Encrypt(makeTestKey())
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	crypt := NewMACKeyring(NewAESGCMCryptor(10, testSecret), []byte("mackey"), [][]byte{[]byte("oldmackey")}, false)
+	if _, err := crypt.Decrypt(encK); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if !crypt.(StaleChecker).Stale(encK) {
+		t.Fatal("key signed with a previous MAC key should be stale")
+	}
+	if err := Sign(crypt, encK); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if crypt.(StaleChecker).Stale(encK) {
+		t.Fatal("key signed with the current MAC key should not be stale")
+	}
+	if err := Verify(old, encK); err != ErrMACMismatch {
+		t.Fatalf("%v does not equal %s", err, ErrMACMismatch)
+	}
+}
+
+func TestMACCryptorRewrap(t *testing.T) {
+	crypt := NewMACCryptor(NewEnvelopeCryptor(10, testSecret), []byte("mackey"), false)
+	encK, err := crypt.Encrypt(makeTestKey())
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if err := Rewrap(crypt, encK); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+
+	// Tampered keys are not rewrapped, so they are never signed again.
+	encK.ACL = append(encK.ACL, knox.Access{Type: knox.User, ID: "attacker", AccessType: knox.Read})
+	if err := Rewrap(crypt, encK); err != ErrMACMismatch {
+		t.Fatalf("%v does not equal %s", err, ErrMACMismatch)
+	}
+}
+
+func TestDeriveKey(t *testing.T) {
+	w := NewAESKeyWrapper(testSecret)
+	k1, err := DeriveKey(w, "purpose")
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	k2, err := DeriveKey(NewAESKeyWrapper(testSecret), "purpose")
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if string(k1) != string(k2) || len(k1) != 32 {
+		t.Fatal("derived keys should be deterministic")
+	}
+	k3, err := DeriveKey(w, "other")
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if string(k1) == string(k3) || string(k1) == string(testSecret) {
+		t.Fatal("derived keys should differ by purpose and from the master key")
+	}
+	if _, err := DeriveKey(NewHTTPKeyWrapper(http.DefaultClient, "http://localhost", "k"), "purpose"); err != ErrNotDerivable {
+		t.Fatalf("%v does not equal %s", err, ErrNotDerivable)
+	}
+}
@@ -0,0 +1,401 @@
+package keydb
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sqlDialect captures the differences between the supported SQL databases.
+// Queries are written with ? parameters and rebound for the database.
+type sqlDialect struct {
+	// numberedParams is set for databases such as postgres that use $1 style
+	// parameters.
+	numberedParams bool
+}
+
+func (d sqlDialect) rebind(query string) string {
+	if !d.numberedParams {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// A migration upgrades the SQL schema by one version. Each migration runs in
+// its own transaction together with the insert that records it. On databases
+// with transactional DDL, such as postgres and sqlite, a migration is then
+// either applied and recorded or neither. MySQL commits each CREATE and DROP
+// TABLE implicitly, so a migration can be interrupted partway; migrations
+// must be safe to run again over their own partial results.
+type migration struct {
+	version     int64
+	description string
+	up          func(tx *sql.Tx, d sqlDialect) error
+}
+
+// sqlMigrations are applied in order. Applied migrations must never be edited;
+// schema changes are made by appending a new migration.
+var sqlMigrations = []migration{
+	{1, "single secrets table", createSecretsTable},
+	{2, "separate keys, versions and acl tables", normalizeSecretsTable},
+	{3, "change log", createChangeTables},
+	{4, "webhooks", createWebhookTables},
+	{5, "namespaces", createNamespacesTable},
+	{6, "namespace MACs", addNamespaceMAC},
+}
+
+var sqlCreateMigrations = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version BIGINT PRIMARY KEY,
+	description TEXT NOT NULL,
+	applied_at BIGINT NOT NULL
+);`
+
+// SchemaVersion returns the version of the newest migration applied to the
+// database, or zero if none have been.
+func SchemaVersion(sqlDB *sql.DB) (int64, error) {
+	var version sql.NullInt64
+	err := sqlDB.QueryRow("SELECT MAX(version) FROM schema_migrations").Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	return version.Int64, nil
+}
+
+// migrate applies the migrations newer than the database's schema version.
+// Servers sharing a database may start at the same time; a migration that
+// fails because another server applied it first is not an error.
+func migrate(sqlDB *sql.DB, d sqlDialect) error {
+	_, err := sqlDB.Exec(sqlCreateMigrations)
+	if err != nil {
+		return err
+	}
+	for _, m := range sqlMigrations {
+		current, err := SchemaVersion(sqlDB)
+		if err != nil {
+			return err
+		}
+		if current >= m.version {
+			continue
+		}
+		err = applyMigration(sqlDB, d, m)
+		if err != nil {
+			current, verr := SchemaVersion(sqlDB)
+			if verr == nil && current >= m.version {
+				continue
+			}
+			return fmt.Errorf("migration %d (%s) failed: %w", m.version, m.description, err)
+		}
+	}
+	return nil
+}
+
+func applyMigration(sqlDB *sql.DB, d sqlDialect, m migration) error {
+	tx, err := sqlDB.Begin()
+	if err != nil {
+		return err
+	}
+	err = m.up(tx, d)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec(d.rebind("INSERT INTO schema_migrations (version, description, applied_at) VALUES (?,?,?)"),
+		m.version, m.description, time.Now().UnixNano())
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+var sqlCreateSecrets = `CREATE TABLE IF NOT EXISTS secrets (
+	id VARCHAR(512) PRIMARY KEY,
+	acl TEXT NOT NULL,
+	version_hash TEXT NOT NULL,
+	versions TEXT NOT NULL,
+	last_updated BIGINT NOT NULL
+);`
+
+var sqlCreateLeases = `CREATE TABLE IF NOT EXISTS leases (
+	name VARCHAR(128) PRIMARY KEY,
+	holder VARCHAR(512) NOT NULL,
+	expires BIGINT NOT NULL
+);`
+
+// secretsColumns are the columns added to the secrets table after it was
+// first released, in the order they were added.
+var secretsColumns = []struct{ name, definition string }{
+	{"deleted_at", "BIGINT NOT NULL DEFAULT 0"},
+	{"metadata", "TEXT"},
+	{"policy", "TEXT"},
+	{"approval_requests", "TEXT"},
+	{"data_key", "TEXT"},
+	{"mac", "TEXT"},
+}
+
+// createSecretsTable brings databases created before migrations were tracked
+// to the last single table schema, whichever columns they started with.
+func createSecretsTable(tx *sql.Tx, d sqlDialect) error {
+	_, err := tx.Exec(sqlCreateSecrets)
+	if err != nil {
+		return err
+	}
+	existing, err := tableColumns(tx, "secrets")
+	if err != nil {
+		return err
+	}
+	for _, c := range secretsColumns {
+		if existing[c.name] {
+			continue
+		}
+		_, err = tx.Exec("ALTER TABLE secrets ADD COLUMN " + c.name + " " + c.definition)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(sqlCreateLeases)
+	return err
+}
+
+// tableColumns returns the lower case names of the columns of a table.
+// Listing the columns rather than selecting a missing one keeps postgres from
+// aborting the transaction.
+func tableColumns(tx *sql.Tx, table string) (map[string]bool, error) {
+	rows, err := tx.Query("SELECT * FROM " + table + " LIMIT 0")
+	if err != nil {
+		return nil, err
+	}
+	columns, err := rows.Columns()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	existing := map[string]bool{}
+	for _, c := range columns {
+		existing[strings.ToLower(c)] = true
+	}
+	return existing, nil
+}
+
+var sqlCreateSecretKeys = `CREATE TABLE IF NOT EXISTS secret_keys (
+	id VARCHAR(512) PRIMARY KEY,
+	version_hash TEXT NOT NULL,
+	last_updated BIGINT NOT NULL,
+	deleted_at BIGINT NOT NULL DEFAULT 0,
+	metadata TEXT,
+	policy TEXT,
+	approval_requests TEXT,
+	data_key TEXT,
+	mac TEXT
+);`
+
+var sqlCreateSecretVersions = `CREATE TABLE IF NOT EXISTS secret_versions (
+	key_id VARCHAR(512) NOT NULL,
+	version_id BIGINT NOT NULL,
+	ordinal INT NOT NULL,
+	status INT NOT NULL,
+	created BIGINT NOT NULL,
+	data TEXT NOT NULL,
+	crypto_metadata TEXT NOT NULL,
+	PRIMARY KEY (key_id, version_id)
+);`
+
+// sqlCreateEmptySecrets recreates the secrets table with its final columns
+// if an interrupted run of normalizeSecretsTable dropped it, so that
+// running it again copies nothing.
+var sqlCreateEmptySecrets = `CREATE TABLE IF NOT EXISTS secrets (
+	id VARCHAR(512) PRIMARY KEY,
+	acl TEXT NOT NULL,
+	version_hash TEXT NOT NULL,
+	versions TEXT NOT NULL,
+	last_updated BIGINT NOT NULL,
+	deleted_at BIGINT NOT NULL DEFAULT 0,
+	metadata TEXT,
+	policy TEXT,
+	approval_requests TEXT,
+	data_key TEXT,
+	mac TEXT
+);`
+
+var sqlCreateSecretACLs = `CREATE TABLE IF NOT EXISTS secret_acls (
+	key_id VARCHAR(512) NOT NULL,
+	ordinal INT NOT NULL,
+	principal_type INT NOT NULL,
+	principal VARCHAR(512) NOT NULL,
+	access INT NOT NULL,
+	expires BIGINT NOT NULL DEFAULT 0,
+	PRIMARY KEY (key_id, ordinal)
+);`
+
+// legacySecret is a row of the single table schema. The JSON columns other
+// than the versions and ACL are copied across unchanged.
+type legacySecret struct {
+	id, acl, versionHash, versions string
+	lastUpdated, deletedAt         int64
+	metadata, policy, requests     sql.NullString
+	dataKey, mac                   sql.NullString
+}
+
+// normalizeSecretsTable moves each secrets row into secret_keys, with its
+// versions and ACL entries split out into their own tables, and drops the
+// secrets table. DBVersions are preserved. Rows copied by an interrupted run
+// are replaced, and if the secrets table was already dropped nothing is
+// copied.
+func normalizeSecretsTable(tx *sql.Tx, d sqlDialect) error {
+	for _, create := range []string{sqlCreateEmptySecrets, sqlCreateSecretKeys, sqlCreateSecretVersions, sqlCreateSecretACLs} {
+		_, err := tx.Exec(create)
+		if err != nil {
+			return err
+		}
+	}
+	rows, err := tx.Query("SELECT id, acl, version_hash, versions, last_updated, deleted_at, metadata, policy, approval_requests, data_key, mac FROM secrets")
+	if err != nil {
+		return err
+	}
+	// Every row is read before writing since a transaction cannot run
+	// statements while a result set is open on some drivers.
+	var secrets []legacySecret
+	for rows.Next() {
+		var s legacySecret
+		err = rows.Scan(&s.id, &s.acl, &s.versionHash, &s.versions, &s.lastUpdated, &s.deletedAt, &s.metadata, &s.policy, &s.requests, &s.dataKey, &s.mac)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		secrets = append(secrets, s)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return err
+	}
+	for _, s := range secrets {
+		var key DBKey
+		err = json.Unmarshal([]byte(s.acl), &key.ACL)
+		if err != nil {
+			return fmt.Errorf("key %s: %w", s.id, err)
+		}
+		err = json.Unmarshal([]byte(s.versions), &key.VersionList)
+		if err != nil {
+			return fmt.Errorf("key %s: %w", s.id, err)
+		}
+		for _, del := range []string{sqlRemoveAllVersions, sqlRemoveACL, sqlRemoveKey} {
+			_, err = tx.Exec(d.rebind(del), s.id)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = tx.Exec(d.rebind(sqlInsertKey), s.id, s.versionHash, s.lastUpdated, s.deletedAt, s.metadata, s.policy, s.requests, s.dataKey, s.mac)
+		if err != nil {
+			return err
+		}
+		err = insertVersions(tx, d, s.id, key.VersionList)
+		if err != nil {
+			return err
+		}
+		err = insertACL(tx, d, s.id, key.ACL)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("DROP TABLE secrets")
+	return err
+}
+
+// secret_changes is the change feed, with a row for each write to a key.
+// secret_change_seq holds a single row with the latest sequence number and
+// the sequence number up to which changes have been pruned.
+var sqlCreateSecretChanges = `CREATE TABLE IF NOT EXISTS secret_changes (
+	seq BIGINT PRIMARY KEY,
+	key_id VARCHAR(512) NOT NULL,
+	changed_at BIGINT NOT NULL
+);`
+
+var sqlCreateSecretChangeSeq = `CREATE TABLE IF NOT EXISTS secret_change_seq (
+	id INT PRIMARY KEY,
+	seq BIGINT NOT NULL,
+	pruned BIGINT NOT NULL
+);`
+
+// createChangeTables creates the change feed tables and the row of
+// secret_change_seq, unless an interrupted run already inserted it.
+func createChangeTables(tx *sql.Tx, d sqlDialect) error {
+	for _, create := range []string{sqlCreateSecretChanges, sqlCreateSecretChangeSeq} {
+		_, err := tx.Exec(create)
+		if err != nil {
+			return err
+		}
+	}
+	var n int
+	err := tx.QueryRow("SELECT COUNT(*) FROM secret_change_seq").Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO secret_change_seq (id, seq, pruned) VALUES (1, 0, 0)")
+	return err
+}
+
+// webhooks and webhook_dead_letters hold the JSON encoded webhooks and the
+// events that could not be delivered to them.
+var sqlCreateWebhooks = `CREATE TABLE IF NOT EXISTS webhooks (
+	id VARCHAR(128) PRIMARY KEY,
+	created BIGINT NOT NULL,
+	webhook TEXT NOT NULL
+);`
+
+var sqlCreateWebhookDeadLetters = `CREATE TABLE IF NOT EXISTS webhook_dead_letters (
+	webhook_id VARCHAR(128) NOT NULL,
+	delivery_id VARCHAR(128) NOT NULL,
+	failed_at BIGINT NOT NULL,
+	dead_letter TEXT NOT NULL,
+	PRIMARY KEY (webhook_id, delivery_id)
+);`
+
+func createWebhookTables(tx *sql.Tx, d sqlDialect) error {
+	for _, create := range []string{sqlCreateWebhooks, sqlCreateWebhookDeadLetters} {
+		_, err := tx.Exec(create)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// namespaces holds the JSON encoded ACL of each namespace prefix.
+var sqlCreateNamespaces = `CREATE TABLE IF NOT EXISTS namespaces (
+	prefix VARCHAR(512) PRIMARY KEY,
+	acl TEXT NOT NULL
+);`
+
+func createNamespacesTable(tx *sql.Tx, d sqlDialect) error {
+	_, err := tx.Exec(sqlCreateNamespaces)
+	return err
+}
+
+// addNamespaceMAC adds the JSON encoded MAC of each namespace. The column is
+// only added if it is missing, since MySQL commits the ALTER TABLE even if
+// the migration is not recorded.
+func addNamespaceMAC(tx *sql.Tx, d sqlDialect) error {
+	columns, err := tableColumns(tx, "namespaces")
+	if err != nil {
+		return err
+	}
+	if columns["mac"] {
+		return nil
+	}
+	_, err = tx.Exec("ALTER TABLE namespaces ADD COLUMN mac TEXT")
+	return err
+}
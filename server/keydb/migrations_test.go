@@ -0,0 +1,180 @@
+package keydb
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+func TestMigrationsOrdered(t *testing.T) {
+	var last int64
+	for _, m := range sqlMigrations {
+		if m.version != last+1 {
+			t.Fatalf("migration %d follows %d", m.version, last)
+		}
+		if m.description == "" || m.up == nil {
+			t.Fatalf("migration %d is incomplete", m.version)
+		}
+		last = m.version
+	}
+}
+
+func TestRebind(t *testing.T) {
+	q := "UPDATE t SET a=?, b=? WHERE c=?"
+	if got := (sqlDialect{}).rebind(q); got != q {
+		t.Fatalf("%s does not equal %s", got, q)
+	}
+	exp := "UPDATE t SET a=$1, b=$2 WHERE c=$3"
+	if got := (sqlDialect{numberedParams: true}).rebind(q); got != exp {
+		t.Fatalf("%s does not equal %s", got, exp)
+	}
+}
+
+// HasSQLiteDriver reports whether the sqlite3 driver is registered, which it
+// is only when the tests are built with the sqlite tag.
+func HasSQLiteDriver() bool {
+	for _, d := range sql.Drivers() {
+		if d == "sqlite3" {
+			return true
+		}
+	}
+	return false
+}
+
+// newSQLite opens an empty in memory sqlite database, skipping the test
+// unless it was built with the sqlite tag.
+func newSQLite(t *testing.T) *sql.DB {
+	if !HasSQLiteDriver() {
+		t.Skip("sqlite3 driver is not registered; run with -tags sqlite")
+	}
+	d, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	// Every connection to :memory: opens a separate database.
+	d.SetMaxOpenConns(1)
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+// createLegacySecrets creates the secrets table with the create statement,
+// with one key in it.
+func createLegacySecrets(t *testing.T, d *sql.DB, create string) {
+	_, err := d.Exec(create)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	_, err = d.Exec(`INSERT INTO secrets (id, acl, version_hash, versions, last_updated) VALUES ('id1',
+		'[{"type":"User","id":"test","access":"Admin"}]', 'hash',
+		'[{"id":18446744073709551615,"data":"YQ==","status":"Primary","ts":5,"crypt":"Yg=="},{"id":2,"data":"Yw==","status":"Active","ts":6,"crypt":"ZA=="}]',
+		99)`)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+}
+
+// checkMigratedKey checks that the key from createLegacySecrets was moved to
+// the normalized tables unchanged.
+func checkMigratedKey(t *testing.T, d *sql.DB) {
+	db, err := NewSQLDB(d)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	version, err := SchemaVersion(d)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if version != sqlMigrations[len(sqlMigrations)-1].version {
+		t.Fatalf("schema version %d is not the latest", version)
+	}
+	if _, err := d.Exec("SELECT 1 FROM secrets"); err == nil {
+		t.Fatal("secrets table was not dropped")
+	}
+	k, err := db.Get("id1")
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if k.DBVersion != 99 || k.VersionHash != "hash" {
+		t.Fatalf("unexpected key %+v", k)
+	}
+	if len(k.ACL) != 1 || k.ACL[0].ID != "test" || k.ACL[0].AccessType != knox.Admin {
+		t.Fatalf("unexpected ACL %+v", k.ACL)
+	}
+	if len(k.VersionList) != 2 || k.VersionList[0].ID != 18446744073709551615 || k.VersionList[0].Status != knox.Primary ||
+		string(k.VersionList[0].EncData) != "a" || string(k.VersionList[1].CryptoMetadata) != "d" {
+		t.Fatalf("unexpected versions %+v", k.VersionList)
+	}
+}
+
+func TestMigrateLegacySecrets(t *testing.T) {
+	d := newSQLite(t)
+	createLegacySecrets(t, d, sqlCreateSecrets)
+	checkMigratedKey(t, d)
+	// Opening the database again applies nothing.
+	checkMigratedKey(t, d)
+}
+
+// TestMigrateInterrupted runs migrations again after they were interrupted
+// partway, as happens on MySQL where schema changes commit implicitly.
+func TestMigrateInterrupted(t *testing.T) {
+	// normalizeSecretsTable copied the rows but did not drop the table.
+	d := newSQLite(t)
+	createLegacySecrets(t, d, sqlCreateSecrets)
+	if err := migrate(d, sqlDialect{}); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if _, err := d.Exec("DELETE FROM schema_migrations WHERE version > 1"); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if _, err := d.Exec("DELETE FROM secret_change_seq"); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	createLegacySecrets(t, d, sqlCreateEmptySecrets)
+	checkMigratedKey(t, d)
+
+	// normalizeSecretsTable dropped the table but was not recorded, and
+	// createChangeTables inserted its row but was not recorded.
+	d = newSQLite(t)
+	createLegacySecrets(t, d, sqlCreateSecrets)
+	if err := migrate(d, sqlDialect{}); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if _, err := d.Exec("DELETE FROM schema_migrations WHERE version > 1"); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	checkMigratedKey(t, d)
+	var n int
+	if err := d.QueryRow("SELECT COUNT(*) FROM secret_change_seq").Scan(&n); err != nil || n != 1 {
+		t.Fatalf("%d change sequence rows (%v)", n, err)
+	}
+}
+
+func TestAcquireLeaseErrors(t *testing.T) {
+	d := newSQLite(t)
+	sqlDB, err := NewSQLDB(d)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	db := sqlDB.(Leaser)
+	ok, err := db.AcquireLease("rotator", "a", time.Minute)
+	if err != nil || !ok {
+		t.Fatalf("lease not acquired: %v", err)
+	}
+	// Another holder is refused without an error.
+	ok, err = db.AcquireLease("rotator", "b", time.Minute)
+	if err != nil || ok {
+		t.Fatalf("lease acquired by a second holder: %v", err)
+	}
+	// Other failures are not mistaken for the lease being held.
+	if _, err := d.Exec("DROP TABLE leases"); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if _, err := d.Exec("CREATE TABLE leases (name VARCHAR(128) PRIMARY KEY, holder VARCHAR(512) NOT NULL, expires BIGINT NOT NULL, extra TEXT NOT NULL)"); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if _, err := db.AcquireLease("rotator", "a", time.Minute); err == nil {
+		t.Fatal("insert error was not returned")
+	}
+}
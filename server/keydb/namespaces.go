@@ -0,0 +1,62 @@
+package keydb
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/pinterest/knox"
+)
+
+// ErrNoNamespaces is returned when namespaces are used with a DB that does
+// not store them.
+var ErrNoNamespaces = fmt.Errorf("DB does not store namespaces")
+
+// NamespaceStore is implemented by DBs that store namespace ACLs.
+type NamespaceStore interface {
+	// GetNamespaces returns every namespace ordered by prefix.
+	GetNamespaces() ([]knox.Namespace, error)
+	// PutNamespace adds the namespace or replaces the one with its prefix.
+	PutNamespace(n *knox.Namespace) error
+	// RemoveNamespace removes the namespace with the prefix. It fails with
+	// knox.ErrNamespaceNotFound if there is none.
+	RemoveNamespace(prefix string) error
+}
+
+// namespaceSet holds namespaces in memory, for the DBs that keep everything
+// in memory. The zero value is empty.
+type namespaceSet map[string]knox.Namespace
+
+func (s *namespaceSet) put(n *knox.Namespace) {
+	if *s == nil {
+		*s = namespaceSet{}
+	}
+	(*s)[n.Prefix] = copyNamespace(n)
+}
+
+// copyNamespace returns a copy of n that shares no memory with it.
+func copyNamespace(n *knox.Namespace) knox.Namespace {
+	c := knox.Namespace{Prefix: n.Prefix, ACL: append(knox.ACL{}, n.ACL...)}
+	if n.MAC != nil {
+		c.MAC = append([]byte{}, n.MAC...)
+	}
+	return c
+}
+
+func (s namespaceSet) has(prefix string) bool {
+	_, ok := s[prefix]
+	return ok
+}
+
+func (s namespaceSet) remove(prefix string) {
+	delete(s, prefix)
+}
+
+// list returns copies of the namespaces ordered by prefix.
+func (s namespaceSet) list() []knox.Namespace {
+	namespaces := make([]knox.Namespace, 0, len(s))
+	for _, n := range s {
+		namespaces = append(namespaces, copyNamespace(&n))
+	}
+	sort.Slice(namespaces, func(i, j int) bool { return namespaces[i].Prefix < namespaces[j].Prefix })
+	return namespaces
+}
@@ -0,0 +1,978 @@
+package keydb
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/pinterest/knox"
+)
+
+// SQLDB provides a generic way to use SQL providers as Knox DBs. Each key is a
+// row in secret_keys, with its versions and ACL entries in secret_versions
+// and secret_acls, so adding a version writes one row rather than rewriting
+// the key. The schema is created and upgraded by the migrations in
+// migrations.go.
+type SQLDB struct {
+	db      *sql.DB
+	dialect sqlDialect
+
+	getStmt            *sql.Stmt
+	getAllStmt         *sql.Stmt
+	getVersionsStmt    *sql.Stmt
+	getAllVersionsStmt *sql.Stmt
+	getACLStmt         *sql.Stmt
+	getAllACLsStmt     *sql.Stmt
+	lastUpdatedStmt    *sql.Stmt
+	allLastUpdatedStmt *sql.Stmt
+	changesStmt        *sql.Stmt
+	changeSeqStmt      *sql.Stmt
+
+	leaseUpdateStmt *sql.Stmt
+	leaseInsertStmt *sql.Stmt
+}
+
+// sqlReadAttempts is the number of times Get reads a key that is being
+// changed underneath it before giving up.
+const sqlReadAttempts = 3
+
+const (
+	sqlKeyColumns     = "id, version_hash, last_updated, deleted_at, metadata, policy, approval_requests, data_key, mac"
+	sqlVersionColumns = "key_id, version_id, status, created, data, crypto_metadata"
+	sqlACLColumns     = "key_id, principal_type, principal, access, expires"
+
+	sqlInsertKey         = "INSERT INTO secret_keys (" + sqlKeyColumns + ") VALUES (?,?,?,?,?,?,?,?,?)"
+	sqlUpdateKey         = "UPDATE secret_keys SET version_hash=?, last_updated=?, deleted_at=?, metadata=?, policy=?, approval_requests=?, data_key=?, mac=? WHERE id=? AND last_updated=?"
+	sqlRemoveKey         = "DELETE FROM secret_keys WHERE id=?"
+	sqlInsertVersion     = "INSERT INTO secret_versions (key_id, version_id, ordinal, status, created, data, crypto_metadata) VALUES (?,?,?,?,?,?,?)"
+	sqlUpdateVersion     = "UPDATE secret_versions SET ordinal=?, status=?, created=?, data=?, crypto_metadata=? WHERE key_id=? AND version_id=?"
+	sqlRemoveVersion     = "DELETE FROM secret_versions WHERE key_id=? AND version_id=?"
+	sqlRemoveAllVersions = "DELETE FROM secret_versions WHERE key_id=?"
+	sqlInsertACL         = "INSERT INTO secret_acls (key_id, ordinal, principal_type, principal, access, expires) VALUES (?,?,?,?,?,?)"
+	sqlRemoveACL         = "DELETE FROM secret_acls WHERE key_id=?"
+
+	sqlIncrementChangeSeq = "UPDATE secret_change_seq SET seq=seq+? WHERE id=1"
+	sqlGetChangeSeq       = "SELECT seq, pruned FROM secret_change_seq WHERE id=1"
+	sqlInsertChange       = "INSERT INTO secret_changes (seq, key_id, changed_at) VALUES (?,?,?)"
+)
+
+// NewPostgreSQLDB will create a SQLDB with the necessary statements for using postgres.
+func NewPostgreSQLDB(sqlDB *sql.DB) (DB, error) {
+	return newSQLDB(sqlDB, sqlDialect{numberedParams: true})
+}
+
+// NewSQLDB creates the tables and prepared statements suitable for mysql and sqlite databases.
+func NewSQLDB(sqlDB *sql.DB) (DB, error) {
+	return newSQLDB(sqlDB, sqlDialect{})
+}
+
+func newSQLDB(sqlDB *sql.DB, d sqlDialect) (*SQLDB, error) {
+	err := migrate(sqlDB, d)
+	if err != nil {
+		return nil, err
+	}
+	db := &SQLDB{db: sqlDB, dialect: d}
+	stmts := []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&db.getStmt, "SELECT " + sqlKeyColumns + " FROM secret_keys WHERE id=?"},
+		{&db.getAllStmt, "SELECT " + sqlKeyColumns + " FROM secret_keys"},
+		{&db.getVersionsStmt, "SELECT " + sqlVersionColumns + " FROM secret_versions WHERE key_id=? ORDER BY ordinal"},
+		{&db.getAllVersionsStmt, "SELECT " + sqlVersionColumns + " FROM secret_versions ORDER BY key_id, ordinal"},
+		{&db.getACLStmt, "SELECT " + sqlACLColumns + " FROM secret_acls WHERE key_id=? ORDER BY ordinal"},
+		{&db.getAllACLsStmt, "SELECT " + sqlACLColumns + " FROM secret_acls ORDER BY key_id, ordinal"},
+		{&db.lastUpdatedStmt, "SELECT last_updated FROM secret_keys WHERE id=?"},
+		{&db.allLastUpdatedStmt, "SELECT id, last_updated FROM secret_keys"},
+		{&db.changesStmt, "SELECT seq, key_id FROM secret_changes WHERE seq>? ORDER BY seq LIMIT ?"},
+		{&db.changeSeqStmt, sqlGetChangeSeq},
+		{&db.leaseUpdateStmt, "UPDATE leases SET holder=?, expires=? WHERE name=? AND (holder=? OR expires<?)"},
+		{&db.leaseInsertStmt, "INSERT INTO leases (name, holder, expires) VALUES (?,?,?)"},
+	}
+	for _, s := range stmts {
+		*s.stmt, err = sqlDB.Prepare(d.rebind(s.query))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// scanner is implemented by *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanKey(s scanner) (*DBKey, error) {
+	key := &DBKey{ACL: knox.ACL{}, VersionList: []EncKeyVersion{}}
+	var metadata, policy, requests, dataKey, mac []byte
+	err := s.Scan(&key.ID, &key.VersionHash, &key.DBVersion, &key.DeletedAt, &metadata, &policy, &requests, &dataKey, &mac)
+	if err != nil {
+		return nil, err
+	}
+	err = unmarshalNullable(metadata, &key.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	err = unmarshalNullable(policy, &key.Policy)
+	if err != nil {
+		return nil, err
+	}
+	err = unmarshalNullable(requests, &key.ApprovalRequests)
+	if err != nil {
+		return nil, err
+	}
+	err = unmarshalNullable(dataKey, &key.DataKey)
+	if err != nil {
+		return nil, err
+	}
+	err = unmarshalNullable(mac, &key.MAC)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func scanVersion(s scanner) (string, EncKeyVersion, error) {
+	var keyID, data, cryptoMetadata string
+	var id int64
+	var v EncKeyVersion
+	err := s.Scan(&keyID, &id, &v.Status, &v.CreationTime, &data, &cryptoMetadata)
+	if err != nil {
+		return "", v, err
+	}
+	// Version IDs use all 64 bits, which BIGINT stores as signed.
+	v.ID = uint64(id)
+	v.EncData, err = base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return "", v, err
+	}
+	v.CryptoMetadata, err = base64.StdEncoding.DecodeString(cryptoMetadata)
+	return keyID, v, err
+}
+
+func scanAccess(s scanner) (string, knox.Access, error) {
+	var keyID string
+	var a knox.Access
+	err := s.Scan(&keyID, &a.Type, &a.ID, &a.AccessType, &a.Expires)
+	return keyID, a, err
+}
+
+// unmarshalNullable decodes a JSON column that is NULL for keys written
+// before the column was added.
+func unmarshalNullable(b []byte, v interface{}) error {
+	if len(b) == 0 {
+		return nil
+	}
+	return json.Unmarshal(b, v)
+}
+
+// stmt returns the prepared statement s to run in tx, or outside of a
+// transaction if tx is nil.
+func stmt(tx *sql.Tx, s *sql.Stmt) *sql.Stmt {
+	if tx == nil {
+		return s
+	}
+	return tx.Stmt(s)
+}
+
+// Get will return the key given its key ID.
+func (db *SQLDB) Get(id string) (*DBKey, error) {
+	return db.getConsistent(nil, id)
+}
+
+// getConsistent reads the key, retrying if it changes while it is read.
+func (db *SQLDB) getConsistent(tx *sql.Tx, id string) (*DBKey, error) {
+	for i := 0; i < sqlReadAttempts; i++ {
+		key, err := db.get(tx, id)
+		if err != nil {
+			return nil, err
+		}
+		// The key's rows are read by separate queries, so they are only
+		// consistent if the key was not updated in between.
+		var lastUpdated int64
+		err = stmt(tx, db.lastUpdatedStmt).QueryRow(id).Scan(&lastUpdated)
+		if err == sql.ErrNoRows {
+			return nil, knox.ErrKeyIDNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		if lastUpdated == key.DBVersion {
+			return key, nil
+		}
+	}
+	return nil, ErrDBVersion
+}
+
+func (db *SQLDB) get(tx *sql.Tx, id string) (*DBKey, error) {
+	key, err := scanKey(stmt(tx, db.getStmt).QueryRow(id))
+	if err == sql.ErrNoRows {
+		return nil, knox.ErrKeyIDNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = readRows(stmt(tx, db.getVersionsStmt), stmt(tx, db.getACLStmt), key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// readRows appends the versions and ACL entries of key read by the given
+// statements.
+func readRows(versionsStmt, aclStmt *sql.Stmt, key *DBKey) error {
+	rows, err := versionsStmt.Query(key.ID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		_, v, err := scanVersion(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		key.VersionList = append(key.VersionList, v)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return err
+	}
+	rows, err = aclStmt.Query(key.ID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		_, a, err := scanAccess(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		key.ACL = append(key.ACL, a)
+	}
+	err = rows.Err()
+	rows.Close()
+	return err
+}
+
+// GetAll returns all of the keys in the database.
+func (db *SQLDB) GetAll() ([]DBKey, error) {
+	return db.getAll(nil)
+}
+
+func (db *SQLDB) getAll(tx *sql.Tx) ([]DBKey, error) {
+	var keys []*DBKey
+	byID := map[string]*DBKey{}
+	rows, err := stmt(tx, db.getAllStmt).Query()
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		key, err := scanKey(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		keys = append(keys, key)
+		byID[key.ID] = key
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err = stmt(tx, db.getAllVersionsStmt).Query()
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		keyID, v, err := scanVersion(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		// Versions of keys added since the keys were read are skipped.
+		if key, ok := byID[keyID]; ok {
+			key.VersionList = append(key.VersionList, v)
+		}
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err = stmt(tx, db.getAllACLsStmt).Query()
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		keyID, a, err := scanAccess(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if key, ok := byID[keyID]; ok {
+			key.ACL = append(key.ACL, a)
+		}
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// Keys updated while the tables were read are read again on their own.
+	lastUpdated := map[string]int64{}
+	rows, err = stmt(tx, db.allLastUpdatedStmt).Query()
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id string
+		var t int64
+		if err := rows.Scan(&id, &t); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		lastUpdated[id] = t
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	var result []DBKey
+	for _, key := range keys {
+		t, ok := lastUpdated[key.ID]
+		if !ok {
+			continue
+		}
+		if t != key.DBVersion {
+			key, err = db.getConsistent(tx, key.ID)
+			if err == knox.ErrKeyIDNotFound {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		result = append(result, *key)
+	}
+	return result, nil
+}
+
+// marshaledKey holds the JSON columns of a secret_keys row.
+type marshaledKey struct {
+	metadata, policy, requests, dataKey, mac string
+}
+
+func marshalKey(key *DBKey) (*marshaledKey, error) {
+	var m marshaledKey
+	for _, f := range []struct {
+		dst *string
+		v   interface{}
+	}{
+		{&m.metadata, key.Metadata},
+		{&m.policy, key.Policy},
+		{&m.requests, key.ApprovalRequests},
+		{&m.dataKey, key.DataKey},
+		{&m.mac, key.MAC},
+	} {
+		b, err := json.Marshal(f.v)
+		if err != nil {
+			return nil, err
+		}
+		*f.dst = string(b)
+	}
+	return &m, nil
+}
+
+func insertVersion(tx *sql.Tx, d sqlDialect, id string, ordinal int, v EncKeyVersion) error {
+	_, err := tx.Exec(d.rebind(sqlInsertVersion), id, int64(v.ID), ordinal, v.Status, v.CreationTime,
+		base64.StdEncoding.EncodeToString(v.EncData), base64.StdEncoding.EncodeToString(v.CryptoMetadata))
+	return err
+}
+
+func insertVersions(tx *sql.Tx, d sqlDialect, id string, versions []EncKeyVersion) error {
+	for i, v := range versions {
+		err := insertVersion(tx, d, id, i, v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func insertACL(tx *sql.Tx, d sqlDialect, id string, acl knox.ACL) error {
+	for i, a := range acl {
+		_, err := tx.Exec(d.rebind(sqlInsertACL), id, i, a.Type, a.ID, a.AccessType, a.Expires)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateVersions writes only the versions that were added, changed, moved or
+// removed.
+func updateVersions(tx *sql.Tx, d sqlDialect, id string, old, versions []EncKeyVersion) error {
+	oldByID := map[uint64]int{}
+	for i, v := range old {
+		oldByID[v.ID] = i
+	}
+	for i, v := range versions {
+		j, ok := oldByID[v.ID]
+		if !ok {
+			err := insertVersion(tx, d, id, i, v)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		delete(oldByID, v.ID)
+		o := old[j]
+		if i == j && o.Status == v.Status && o.CreationTime == v.CreationTime &&
+			string(o.EncData) == string(v.EncData) && string(o.CryptoMetadata) == string(v.CryptoMetadata) {
+			continue
+		}
+		_, err := tx.Exec(d.rebind(sqlUpdateVersion), i, v.Status, v.CreationTime,
+			base64.StdEncoding.EncodeToString(v.EncData), base64.StdEncoding.EncodeToString(v.CryptoMetadata), id, int64(v.ID))
+		if err != nil {
+			return err
+		}
+	}
+	for vid := range oldByID {
+		_, err := tx.Exec(d.rebind(sqlRemoveVersion), id, int64(vid))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func equalACLs(a, b knox.ACL) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// isUniqueViolation reports whether err is a primary key violation. The
+// drivers are not imported, so postgres errors are recognized by their
+// SQLSTATE and mysql and sqlite errors by their messages.
+func isUniqueViolation(err error) bool {
+	var pgErr interface{ SQLState() string }
+	if errors.As(err, &pgErr) {
+		return pgErr.SQLState() == "23505"
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "UNIQUE constraint failed") || // sqlite
+		strings.Contains(msg, "Error 1062") || // mysql
+		strings.Contains(msg, "duplicate key value violates unique constraint")
+}
+
+// Transact runs f in a database transaction, which is committed if f returns
+// nil and rolled back otherwise.
+func (db *SQLDB) Transact(f func(tx DB) error) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	t := &sqlTx{db: db, tx: tx}
+	err = f(t)
+	if err == nil {
+		err = t.logChanges()
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Update makes an update to DBKey indexed by its ID.
+// It will fail if the key has been changed since the specified version.
+func (db *SQLDB) Update(key *DBKey) error {
+	return db.Transact(func(tx DB) error { return tx.Update(key) })
+}
+
+// Add adds the keys in one transaction. It fails without adding any of them
+// if any key ID exists.
+func (db *SQLDB) Add(keys ...*DBKey) error {
+	return db.Transact(func(tx DB) error { return tx.Add(keys...) })
+}
+
+// Remove permanently removes the key specified by the ID.
+func (db *SQLDB) Remove(id string) error {
+	return db.Transact(func(tx DB) error { return tx.Remove(id) })
+}
+
+// sqlTx is the DB passed to the function run by SQLDB.Transact.
+type sqlTx struct {
+	db *SQLDB
+	tx *sql.Tx
+	// changed holds the IDs of the keys written, in order.
+	changed []string
+}
+
+// logChanges adds the keys written in the transaction to the change feed.
+// Incrementing the sequence number locks its row until the transaction ends,
+// so changes are committed in sequence order and a reader never sees a
+// change before one with a smaller sequence number.
+func (t *sqlTx) logChanges() error {
+	if len(t.changed) == 0 {
+		return nil
+	}
+	_, err := t.exec(sqlIncrementChangeSeq, len(t.changed))
+	if err != nil {
+		return err
+	}
+	var seq, pruned int64
+	err = t.tx.QueryRow(sqlGetChangeSeq).Scan(&seq, &pruned)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UnixNano()
+	seq -= int64(len(t.changed))
+	for _, id := range t.changed {
+		seq++
+		_, err = t.exec(sqlInsertChange, seq, id, now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *sqlTx) exec(query string, args ...interface{}) (sql.Result, error) {
+	return t.tx.Exec(t.db.dialect.rebind(query), args...)
+}
+
+// Get returns the key as the transaction sees it.
+func (t *sqlTx) Get(id string) (*DBKey, error) {
+	return t.db.getConsistent(t.tx, id)
+}
+
+// GetAll returns every key as the transaction sees it.
+func (t *sqlTx) GetAll() ([]DBKey, error) {
+	return t.db.getAll(t.tx)
+}
+
+// Update makes an update to DBKey indexed by its ID.
+// It will fail if the key has been changed since the specified version.
+func (t *sqlTx) Update(key *DBKey) error {
+	m, err := marshalKey(key)
+	if err != nil {
+		return err
+	}
+	updateTime := time.Now().UnixNano()
+	r, err := t.exec(sqlUpdateKey, key.VersionHash, updateTime, key.DeletedAt, m.metadata, m.policy, m.requests, m.dataKey, m.mac, key.ID, key.DBVersion)
+	if err != nil {
+		return err
+	}
+	affected, err := r.RowsAffected()
+	if err != nil {
+		// This likely shouldn't return an error if rows affected is not implemented.
+		return err
+	}
+	if affected == 0 {
+		var lastUpdated int64
+		err = t.tx.Stmt(t.db.lastUpdatedStmt).QueryRow(key.ID).Scan(&lastUpdated)
+		if err == sql.ErrNoRows {
+			return knox.ErrKeyIDNotFound
+		}
+		if err != nil {
+			return err
+		}
+		return ErrDBVersion
+	}
+	// The update above locks the key, so its versions and ACL cannot change
+	// until the transaction ends.
+	old := &DBKey{ID: key.ID}
+	err = readRows(t.tx.Stmt(t.db.getVersionsStmt), t.tx.Stmt(t.db.getACLStmt), old)
+	if err != nil {
+		return err
+	}
+	err = updateVersions(t.tx, t.db.dialect, key.ID, old.VersionList, key.VersionList)
+	if err != nil {
+		return err
+	}
+	if !equalACLs(old.ACL, key.ACL) {
+		_, err = t.exec(sqlRemoveACL, key.ID)
+		if err != nil {
+			return err
+		}
+		err = insertACL(t.tx, t.db.dialect, key.ID, key.ACL)
+		if err != nil {
+			return err
+		}
+	}
+	t.changed = append(t.changed, key.ID)
+	return nil
+}
+
+// Add adds the keys with their versions and ACLs, failing with
+// knox.ErrKeyExists if any key ID exists.
+func (t *sqlTx) Add(keys ...*DBKey) error {
+	updateTime := time.Now().UnixNano()
+	for _, key := range keys {
+		m, err := marshalKey(key)
+		if err != nil {
+			return err
+		}
+		_, err = t.exec(sqlInsertKey, key.ID, key.VersionHash, updateTime, key.DeletedAt, m.metadata, m.policy, m.requests, m.dataKey, m.mac)
+		if err != nil {
+			if isUniqueViolation(err) {
+				return knox.ErrKeyExists
+			}
+			return err
+		}
+		err = insertVersions(t.tx, t.db.dialect, key.ID, key.VersionList)
+		if err != nil {
+			return err
+		}
+		err = insertACL(t.tx, t.db.dialect, key.ID, key.ACL)
+		if err != nil {
+			return err
+		}
+		t.changed = append(t.changed, key.ID)
+	}
+	return nil
+}
+
+// Remove permanently removes the key specified by the ID.
+func (t *sqlTx) Remove(id string) error {
+	r, err := t.exec(sqlRemoveKey, id)
+	if err != nil {
+		return err
+	}
+	affected, err := r.RowsAffected()
+	if err != nil {
+		// This likely shouldn't return an error if rows affected is not implemented.
+		return err
+	}
+	if affected == 0 {
+		return knox.ErrKeyIDNotFound
+	}
+	_, err = t.exec(sqlRemoveAllVersions, id)
+	if err != nil {
+		return err
+	}
+	_, err = t.exec(sqlRemoveACL, id)
+	if err != nil {
+		return err
+	}
+	t.changed = append(t.changed, id)
+	return nil
+}
+
+// Changes returns up to limit changes after the given sequence number.
+func (db *SQLDB) Changes(after int64, limit int) ([]Change, error) {
+	rows, err := db.changesStmt.Query(after, limit)
+	if err != nil {
+		return nil, err
+	}
+	changes := []Change{}
+	for rows.Next() {
+		var c Change
+		if err := rows.Scan(&c.Seq, &c.KeyID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	// The pruned sequence number is read after the changes, so changes
+	// pruned while they were read are reported.
+	var seq, pruned int64
+	err = db.changeSeqStmt.QueryRow().Scan(&seq, &pruned)
+	if err != nil {
+		return nil, err
+	}
+	if after < pruned || after > seq {
+		return nil, ErrChangesTruncated
+	}
+	return changes, nil
+}
+
+// LastSeq returns the sequence number of the latest change.
+func (db *SQLDB) LastSeq() (int64, error) {
+	var seq, pruned int64
+	err := db.changeSeqStmt.QueryRow().Scan(&seq, &pruned)
+	return seq, err
+}
+
+// PruneChanges deletes the changes made before the given time, since
+// unlike the in memory feeds the change log is never trimmed otherwise.
+// Readers that have not read past them get ErrChangesTruncated.
+func (db *SQLDB) PruneChanges(before time.Time) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var last sql.NullInt64
+	err = tx.QueryRow(db.dialect.rebind("SELECT MAX(seq) FROM secret_changes WHERE changed_at<?"), before.UnixNano()).Scan(&last)
+	if err != nil {
+		return err
+	}
+	if !last.Valid {
+		return nil
+	}
+	_, err = tx.Exec(db.dialect.rebind("DELETE FROM secret_changes WHERE seq<=?"), last.Int64)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(db.dialect.rebind("UPDATE secret_change_seq SET pruned=? WHERE id=1 AND pruned<?"), last.Int64, last.Int64)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// AcquireLease grants or renews the named lease to holder for ttl. The
+// update and insert each succeed for at most one server, so only one holder
+// can have the lease at a time.
+func (db *SQLDB) AcquireLease(name, holder string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	r, err := db.leaseUpdateStmt.Exec(holder, now.Add(ttl).UnixNano(), name, holder, now.UnixNano())
+	if err != nil {
+		return false, err
+	}
+	affected, err := r.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if affected > 0 {
+		return true, nil
+	}
+	_, err = db.leaseInsertStmt.Exec(name, holder, now.Add(ttl).UnixNano())
+	if err != nil {
+		// The insert conflicts if another holder has the lease.
+		if isUniqueViolation(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// AddWebhook adds a webhook. It fails with ErrWebhookExists if the ID is
+// taken.
+func (db *SQLDB) AddWebhook(w *knox.Webhook) error {
+	b, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+	_, err = db.db.Exec(db.dialect.rebind("INSERT INTO webhooks (id, created, webhook) VALUES (?,?,?)"), w.ID, w.CreationTime, string(b))
+	if err != nil && isUniqueViolation(err) {
+		return ErrWebhookExists
+	}
+	return err
+}
+
+// GetWebhooks returns every webhook, oldest first.
+func (db *SQLDB) GetWebhooks() ([]knox.Webhook, error) {
+	rows, err := db.db.Query("SELECT webhook FROM webhooks ORDER BY created, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hooks := []knox.Webhook{}
+	for rows.Next() {
+		var b []byte
+		if err := rows.Scan(&b); err != nil {
+			return nil, err
+		}
+		var w knox.Webhook
+		if err := json.Unmarshal(b, &w); err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, w)
+	}
+	return hooks, rows.Err()
+}
+
+// RemoveWebhook removes the webhook and its dead letters.
+func (db *SQLDB) RemoveWebhook(id string) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	r, err := tx.Exec(db.dialect.rebind("DELETE FROM webhooks WHERE id=?"), id)
+	if err != nil {
+		return err
+	}
+	affected, err := r.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return knox.ErrWebhookNotFound
+	}
+	_, err = tx.Exec(db.dialect.rebind("DELETE FROM webhook_dead_letters WHERE webhook_id=?"), id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// AddDeadLetter records an event that could not be delivered to a webhook
+// and deletes the oldest dead letters of the webhook past deadLetterLimit.
+func (db *SQLDB) AddDeadLetter(d *knox.WebhookDeadLetter) error {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	id := d.Event.WebhookID
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var created int64
+	err = tx.QueryRow(db.dialect.rebind("SELECT created FROM webhooks WHERE id=?"), id).Scan(&created)
+	if err == sql.ErrNoRows {
+		return knox.ErrWebhookNotFound
+	}
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(db.dialect.rebind("INSERT INTO webhook_dead_letters (webhook_id, delivery_id, failed_at, dead_letter) VALUES (?,?,?,?)"), id, d.Event.ID, d.FailedAt, string(b))
+	if err != nil {
+		return err
+	}
+	// Find the newest dead letter past the limit and delete it and every
+	// older one.
+	var failedAt int64
+	var deliveryID string
+	err = tx.QueryRow(db.dialect.rebind("SELECT failed_at, delivery_id FROM webhook_dead_letters WHERE webhook_id=? ORDER BY failed_at DESC, delivery_id DESC LIMIT 1 OFFSET ?"), id, deadLetterLimit).Scan(&failedAt, &deliveryID)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == nil {
+		_, err = tx.Exec(db.dialect.rebind("DELETE FROM webhook_dead_letters WHERE webhook_id=? AND (failed_at<? OR (failed_at=? AND delivery_id<=?))"), id, failedAt, failedAt, deliveryID)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetDeadLetters returns the dead letters of a webhook, oldest first.
+func (db *SQLDB) GetDeadLetters(webhookID string) ([]knox.WebhookDeadLetter, error) {
+	var created int64
+	err := db.db.QueryRow(db.dialect.rebind("SELECT created FROM webhooks WHERE id=?"), webhookID).Scan(&created)
+	if err == sql.ErrNoRows {
+		return nil, knox.ErrWebhookNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.db.Query(db.dialect.rebind("SELECT dead_letter FROM webhook_dead_letters WHERE webhook_id=? ORDER BY failed_at, delivery_id"), webhookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	letters := []knox.WebhookDeadLetter{}
+	for rows.Next() {
+		var b []byte
+		if err := rows.Scan(&b); err != nil {
+			return nil, err
+		}
+		var d knox.WebhookDeadLetter
+		if err := json.Unmarshal(b, &d); err != nil {
+			return nil, err
+		}
+		letters = append(letters, d)
+	}
+	return letters, rows.Err()
+}
+
+// GetNamespaces returns every namespace ordered by prefix.
+func (db *SQLDB) GetNamespaces() ([]knox.Namespace, error) {
+	rows, err := db.db.Query("SELECT prefix, acl, mac FROM namespaces ORDER BY prefix")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	namespaces := []knox.Namespace{}
+	for rows.Next() {
+		var n knox.Namespace
+		var b, mac []byte
+		if err := rows.Scan(&n.Prefix, &b, &mac); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, &n.ACL); err != nil {
+			return nil, err
+		}
+		if err := unmarshalNullable(mac, &n.MAC); err != nil {
+			return nil, err
+		}
+		namespaces = append(namespaces, n)
+	}
+	return namespaces, rows.Err()
+}
+
+// PutNamespace adds the namespace or replaces the one with its prefix.
+func (db *SQLDB) PutNamespace(n *knox.Namespace) error {
+	b, err := json.Marshal(n.ACL)
+	if err != nil {
+		return err
+	}
+	mac, err := json.Marshal(n.MAC)
+	if err != nil {
+		return err
+	}
+	r, err := db.db.Exec(db.dialect.rebind("UPDATE namespaces SET acl=?, mac=? WHERE prefix=?"), string(b), string(mac), n.Prefix)
+	if err != nil {
+		return err
+	}
+	affected, err := r.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected > 0 {
+		return nil
+	}
+	_, err = db.db.Exec(db.dialect.rebind("INSERT INTO namespaces (prefix, acl, mac) VALUES (?,?,?)"), n.Prefix, string(b), string(mac))
+	// MySQL does not count rows that an update left unchanged, so the
+	// namespace may already exist with this ACL.
+	if err != nil && isUniqueViolation(err) {
+		return nil
+	}
+	return err
+}
+
+// RemoveNamespace removes the namespace with the prefix.
+func (db *SQLDB) RemoveNamespace(prefix string) error {
+	r, err := db.db.Exec(db.dialect.rebind("DELETE FROM namespaces WHERE prefix=?"), prefix)
+	if err != nil {
+		return err
+	}
+	affected, err := r.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return knox.ErrNamespaceNotFound
+	}
+	return nil
+}
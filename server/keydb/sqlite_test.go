@@ -0,0 +1,12 @@
+//go:build sqlite
+// +build sqlite
+
+package keydb
+
+// The SQL tests run against sqlite, which needs cgo, so its driver is only
+// linked into the tests when they are built with the sqlite tag. It is not a
+// dependency of this module; fetch it first:
+//
+//	go get github.com/mattn/go-sqlite3
+//	go test -tags sqlite ./server/keydb/
+import _ "github.com/mattn/go-sqlite3"
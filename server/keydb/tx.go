@@ -0,0 +1,124 @@
+package keydb
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/pinterest/knox"
+)
+
+// ErrNoTransactions is returned when a transaction is started on a DB that
+// cannot run one.
+var ErrNoTransactions = fmt.Errorf("DB does not support transactions")
+
+// Transactor is implemented by DBs that can write several keys atomically.
+// The key manager purges and restores keys in transactions, so that a key is
+// checked and written without another change in between.
+type Transactor interface {
+	// Transact calls f with a DB that stages its writes. They are applied
+	// together if f returns nil and discarded if it returns an error. Reads
+	// through the staging DB see its own writes.
+	Transact(f func(tx DB) error) error
+}
+
+// stagedDB holds the writes of a transaction on a DB kept in memory. Keys
+// are read from base until the transaction changes them.
+type stagedDB struct {
+	base    map[string]*DBKey
+	changes map[string]*DBKey
+	// order holds the IDs of changed keys in the order they were first
+	// changed. A nil entry in changes is a removed key.
+	order   []string
+	version func() int64
+}
+
+func newStagedDB(base map[string]*DBKey, version func() int64) *stagedDB {
+	return &stagedDB{base: base, changes: map[string]*DBKey{}, version: version}
+}
+
+func (s *stagedDB) lookup(id string) (*DBKey, bool) {
+	if k, ok := s.changes[id]; ok {
+		return k, k != nil
+	}
+	k, ok := s.base[id]
+	return k, ok
+}
+
+func (s *stagedDB) set(id string, k *DBKey) {
+	if _, ok := s.changes[id]; !ok {
+		s.order = append(s.order, id)
+	}
+	s.changes[id] = k
+}
+
+// Get returns the key as the transaction sees it.
+func (s *stagedDB) Get(id string) (*DBKey, error) {
+	k, ok := s.lookup(id)
+	if !ok {
+		return nil, knox.ErrKeyIDNotFound
+	}
+	return k.Copy(), nil
+}
+
+// GetAll returns every key as the transaction sees it, ordered by ID.
+func (s *stagedDB) GetAll() ([]DBKey, error) {
+	ids := []string{}
+	for id := range s.base {
+		if _, ok := s.changes[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	for id, k := range s.changes {
+		if k != nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	keys := make([]DBKey, len(ids))
+	for i, id := range ids {
+		k, _ := s.lookup(id)
+		keys[i] = *k.Copy()
+	}
+	return keys, nil
+}
+
+// Update stages an update to the key.
+func (s *stagedDB) Update(key *DBKey) error {
+	old, ok := s.lookup(key.ID)
+	if !ok {
+		return knox.ErrKeyIDNotFound
+	}
+	if old.DBVersion != key.DBVersion {
+		return ErrDBVersion
+	}
+	k := key.Copy()
+	k.DBVersion = s.version()
+	s.set(k.ID, k)
+	return nil
+}
+
+// Add stages the keys, failing if any of them exists.
+func (s *stagedDB) Add(keys ...*DBKey) error {
+	seen := map[string]bool{}
+	for _, key := range keys {
+		if _, ok := s.lookup(key.ID); ok || seen[key.ID] {
+			return knox.ErrKeyExists
+		}
+		seen[key.ID] = true
+	}
+	for _, key := range keys {
+		k := key.Copy()
+		k.DBVersion = s.version()
+		s.set(k.ID, k)
+	}
+	return nil
+}
+
+// Remove stages removing the key.
+func (s *stagedDB) Remove(id string) error {
+	if _, ok := s.lookup(id); !ok {
+		return knox.ErrKeyIDNotFound
+	}
+	s.set(id, nil)
+	return nil
+}
@@ -0,0 +1,116 @@
+package keydb
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/pinterest/knox"
+)
+
+// ErrWebhookExists is returned when a webhook is added with the ID of an
+// existing one.
+var ErrWebhookExists = fmt.Errorf("Webhook exists")
+
+// ErrNoWebhooks is returned when webhooks are used with a DB that does not
+// store them.
+var ErrNoWebhooks = fmt.Errorf("DB does not store webhooks")
+
+// WebhookStore is implemented by DBs that store webhooks and the events that
+// could not be delivered to them.
+type WebhookStore interface {
+	// AddWebhook adds a webhook. It fails with ErrWebhookExists if the ID is
+	// taken.
+	AddWebhook(w *knox.Webhook) error
+	// GetWebhooks returns every webhook, oldest first.
+	GetWebhooks() ([]knox.Webhook, error)
+	// RemoveWebhook removes the webhook and its dead letters.
+	RemoveWebhook(id string) error
+	// AddDeadLetter records an event that could not be delivered to the
+	// webhook with the event's WebhookID. Only the latest deadLetterLimit
+	// dead letters of each webhook are kept.
+	AddDeadLetter(d *knox.WebhookDeadLetter) error
+	// GetDeadLetters returns the dead letters of a webhook, oldest first.
+	GetDeadLetters(webhookID string) ([]knox.WebhookDeadLetter, error)
+}
+
+// deadLetterLimit is the number of dead letters kept for each webhook.
+const deadLetterLimit = 1000
+
+// webhookSet holds webhooks and their dead letters in memory, for the DBs
+// that keep everything in memory. The zero value is empty.
+type webhookSet struct {
+	hooks       map[string]*knox.Webhook
+	deadLetters map[string][]knox.WebhookDeadLetter
+}
+
+func (s *webhookSet) put(w *knox.Webhook) {
+	if s.hooks == nil {
+		s.hooks = map[string]*knox.Webhook{}
+		s.deadLetters = map[string][]knox.WebhookDeadLetter{}
+	}
+	s.hooks[w.ID] = copyWebhook(w)
+}
+
+func (s *webhookSet) has(id string) bool {
+	_, ok := s.hooks[id]
+	return ok
+}
+
+func (s *webhookSet) remove(id string) {
+	delete(s.hooks, id)
+	delete(s.deadLetters, id)
+}
+
+// addDeadLetter keeps the dead letter if its webhook exists.
+func (s *webhookSet) addDeadLetter(d *knox.WebhookDeadLetter) {
+	id := d.Event.WebhookID
+	if !s.has(id) {
+		return
+	}
+	letters := append(s.deadLetters[id], *d)
+	if len(letters) > deadLetterLimit {
+		letters = append([]knox.WebhookDeadLetter(nil), letters[len(letters)-deadLetterLimit:]...)
+	}
+	s.deadLetters[id] = letters
+}
+
+// list returns copies of the webhooks ordered by creation time and ID.
+func (s *webhookSet) list() []knox.Webhook {
+	hooks := make([]knox.Webhook, 0, len(s.hooks))
+	for _, w := range s.hooks {
+		hooks = append(hooks, *copyWebhook(w))
+	}
+	sortWebhooks(hooks)
+	return hooks
+}
+
+func (s *webhookSet) deadLettersOf(id string) []knox.WebhookDeadLetter {
+	letters := make([]knox.WebhookDeadLetter, len(s.deadLetters[id]))
+	copy(letters, s.deadLetters[id])
+	return letters
+}
+
+// size is the number of webhooks and dead letters held.
+func (s *webhookSet) size() int {
+	n := len(s.hooks)
+	for _, letters := range s.deadLetters {
+		n += len(letters)
+	}
+	return n
+}
+
+func sortWebhooks(hooks []knox.Webhook) {
+	sort.Slice(hooks, func(i, j int) bool {
+		if hooks[i].CreationTime != hooks[j].CreationTime {
+			return hooks[i].CreationTime < hooks[j].CreationTime
+		}
+		return hooks[i].ID < hooks[j].ID
+	})
+}
+
+func copyWebhook(w *knox.Webhook) *knox.Webhook {
+	c := *w
+	c.Tags = append([]string(nil), w.Tags...)
+	c.Events = append([]knox.AuditEventType(nil), w.Events...)
+	return &c
+}
@@ -0,0 +1,112 @@
+package keydb
+
+import (
+	"crypto/rand"
+
+	"golang.org/x/crypto/chacha20poly1305"
+
+	"github.com/pinterest/knox"
+)
+
+// xchachaScheme marks versions encrypted by xchachaCryptor.
+const xchachaScheme byte = 2
+
+// NewXChaChaCryptor creates a Cryptor that performs XChaCha20-Poly1305 AEAD
+// encryption on key data. Its 192 bit random nonces allow far more versions
+// to be encrypted under one master key than AES GCM. keyData must be 32 bytes.
+func NewXChaChaCryptor(version byte, keyData []byte) Cryptor {
+	return &xchachaCryptor{keyData, version}
+}
+
+// xchachaCryptor binds the same associated data as aesGCMCryptor. Its
+// metadata is the scheme, the version, and the nonce.
+type xchachaCryptor struct {
+	keyData []byte
+	version byte
+}
+
+func (c *xchachaCryptor) EncryptVersion(k *knox.Key, v *knox.KeyVersion) (*EncKeyVersion, error) {
+	aead, err := chacha20poly1305.NewX(c.keyData)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	ciphertext := aead.Seal(nil, nonce, v.Data, generateAD(k.ID, v.ID, v.CreationTime))
+
+	return &EncKeyVersion{
+		ID:             v.ID,
+		EncData:        ciphertext,
+		Status:         v.Status,
+		CreationTime:   v.CreationTime,
+		CryptoMetadata: append([]byte{xchachaScheme, c.version}, nonce...),
+	}, nil
+}
+
+func (c *xchachaCryptor) decryptVersion(k *DBKey, v *EncKeyVersion) (*knox.KeyVersion, error) {
+	aead, err := chacha20poly1305.NewX(c.keyData)
+	if err != nil {
+		return nil, err
+	}
+	md := v.CryptoMetadata
+	if len(md) != 2+aead.NonceSize() || md[0] != xchachaScheme || md[1] != c.version {
+		return nil, ErrCryptorVersion
+	}
+
+	plaintext, err := aead.Open(nil, md[2:], v.EncData, generateAD(k.ID, v.ID, v.CreationTime))
+	if err != nil {
+		return nil, err
+	}
+
+	return &knox.KeyVersion{
+		ID:           v.ID,
+		Data:         plaintext,
+		Status:       v.Status,
+		CreationTime: v.CreationTime,
+	}, nil
+}
+
+func (c *xchachaCryptor) Encrypt(k *knox.Key) (*DBKey, error) {
+	dbVersions := make([]EncKeyVersion, len(k.VersionList))
+	for i, v := range k.VersionList {
+		dbv, err := c.EncryptVersion(k, &v)
+		if err != nil {
+			return nil, err
+		}
+		dbVersions[i] = *dbv
+	}
+
+	newKey := DBKey{
+		ID:          k.ID,
+		ACL:         k.ACL,
+		VersionList: dbVersions,
+		VersionHash: k.VersionHash,
+		Metadata:    k.Metadata.Copy(),
+		Policy:      k.Policy.Copy(),
+	}
+	return &newKey, nil
+}
+
+func (c *xchachaCryptor) Decrypt(k *DBKey) (*knox.Key, error) {
+	versions := make([]knox.KeyVersion, len(k.VersionList))
+	for i, v := range k.VersionList {
+		dbv, err := c.decryptVersion(k, &v)
+		if err != nil {
+			return nil, err
+		}
+		versions[i] = *dbv
+	}
+
+	newKey := knox.Key{
+		ID:          k.ID,
+		ACL:         k.ACL,
+		VersionList: versions,
+		VersionHash: k.VersionHash,
+		Metadata:    k.Metadata.Copy(),
+		Policy:      k.Policy.Copy(),
+	}
+	return &newKey, nil
+}
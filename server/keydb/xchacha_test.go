@@ -0,0 +1,120 @@
+package keydb
+
+import (
+	"reflect"
+	"testing"
+)
+
+var testXChaChaSecret = []byte("testtesttesttesttesttesttesttest")
+
+func TestXChaChaEncryptDecryptKey(t *testing.T) {
+	k := makeTestKey()
+	crypt := NewXChaChaCryptor(10, testXChaChaSecret)
+	encK, err := crypt.Encrypt(k)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	id, err := versionCryptorID(&encK.VersionList[0])
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if id != (cryptorID{xchachaScheme, 10}) {
+		t.Fatalf("%+v is not the XChaCha scheme", id)
+	}
+	decK, err := crypt.Decrypt(encK)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if !reflect.DeepEqual(decK, k) {
+		t.Fatal("decrypted key does not equal key")
+	}
+
+	// The key ID, version ID and creation time are authenticated.
+	moved := encK.Copy()
+	moved.ID = "otherID"
+	if _, err := crypt.Decrypt(moved); err == nil {
+		t.Fatal("error is nil for a version of another key")
+	}
+	changed := encK.Copy()
+	changed.VersionList[0].CreationTime++
+	if _, err := crypt.Decrypt(changed); err == nil {
+		t.Fatal("error is nil for a changed creation time")
+	}
+}
+
+func TestXChaChaBadData(t *testing.T) {
+	k := makeTestKey()
+	if _, err := NewXChaChaCryptor(0, testSecret).Encrypt(k); err == nil {
+		t.Fatal("error is nil for a bad key")
+	}
+
+	crypt := NewXChaChaCryptor(10, testXChaChaSecret)
+	encK, err := crypt.Encrypt(k)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if _, err := NewXChaChaCryptor(1, testXChaChaSecret).Decrypt(encK); err != ErrCryptorVersion {
+		t.Fatalf("%v does not equal %s", err, ErrCryptorVersion)
+	}
+	aesK, err := NewAESGCMCryptor(10, testSecret).Encrypt(k)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if _, err := crypt.Decrypt(aesK); err != ErrCryptorVersion {
+		t.Fatalf("%v does not equal %s", err, ErrCryptorVersion)
+	}
+	encK.VersionList[0].EncData = []byte("invalidciphertext")
+	if _, err := crypt.Decrypt(encK); err == nil {
+		t.Fatal("error is nil for bad ciphertext")
+	}
+}
+
+func TestKeyringMixesSchemes(t *testing.T) {
+	k := makeTestKey()
+	aes := NewAESGCMCryptor(1, testSecret)
+	aesK, err := aes.Encrypt(k)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+
+	xchacha := NewXChaChaCryptor(1, testXChaChaSecret)
+	crypt, err := NewKeyring(xchacha, aes)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if !crypt.(StaleChecker).Stale(aesK) {
+		t.Fatal("key encrypted by a previous master key should be stale")
+	}
+
+	// A key with versions under both master keys decrypts.
+	v := k.VersionList[0]
+	v.ID++
+	encV, err := crypt.EncryptVersion(k, &v)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	aesK.VersionList = append(aesK.VersionList, *encV)
+	k.VersionList = append(k.VersionList, v)
+	decK, err := crypt.Decrypt(aesK)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if !reflect.DeepEqual(decK, k) {
+		t.Fatal("decrypted key does not equal key")
+	}
+
+	newK, err := crypt.Encrypt(k)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if crypt.(StaleChecker).Stale(newK) {
+		t.Fatal("key encrypted by the current master key should not be stale")
+	}
+	if _, err := xchacha.Decrypt(newK); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+
+	if _, err := NewKeyring(NewEnvelopeCryptor(1, testSecret)); err != ErrKeyringCryptor {
+		t.Fatalf("%v does not equal %s", err, ErrKeyringCryptor)
+	}
+}
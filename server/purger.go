@@ -0,0 +1,58 @@
+package server
+
+import (
+	"time"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/log"
+)
+
+// purgerComponent is recorded as the principal of audit events for purges.
+const purgerComponent = "purger"
+
+// Purger permanently removes keys once they have been deleted for longer
+// than the retention period.
+type Purger struct {
+	m         KeyManager
+	retention time.Duration
+	now       func() time.Time
+}
+
+// NewPurger creates a Purger for the keys managed by m. Deleted keys can be
+// restored until they have been deleted for longer than retention.
+func NewPurger(m KeyManager, retention time.Duration) *Purger {
+	return &Purger{m: m, retention: retention, now: time.Now}
+}
+
+// Purge removes every key deleted more than the retention period ago and
+// returns their IDs.
+func (p *Purger) Purge() ([]string, error) {
+	purged, err := p.m.PurgeDeletedKeys(p.now().Add(-p.retention))
+	for _, id := range purged {
+		recordSystemEvent(purgerComponent, knox.AuditEvent{
+			Type:  knox.PurgeKeyEvent,
+			KeyID: id,
+		})
+	}
+	return purged, err
+}
+
+// Run purges keys every interval until stop is closed.
+func (p *Purger) Run(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			purged, err := p.Purge()
+			if len(purged) > 0 {
+				log.Printf("Purged %d deleted keys", len(purged))
+			}
+			if err != nil {
+				log.Printf("Failed to purge deleted keys: %s", err.Error())
+			}
+		case <-stop:
+			return
+		}
+	}
+}
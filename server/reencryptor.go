@@ -0,0 +1,199 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/log"
+	"github.com/pinterest/knox/server/keydb"
+)
+
+// maxReencryptAttempts is the number of times a key is reencrypted before
+// giving up when it keeps being changed concurrently.
+const maxReencryptAttempts = 3
+
+// reencryptorLease is the name of the lease held by the server that
+// reencrypts keys.
+const reencryptorLease = "reencryptor"
+
+// ReencryptProgress reports how far a reencryption pass has got.
+type ReencryptProgress struct {
+	// Total is the number of keys in the database when the pass started.
+	Total int `json:"total"`
+	// Checked is the number of keys looked at so far.
+	Checked int `json:"checked"`
+	// Reencrypted is the number of stale keys rewritten so far.
+	Reencrypted int `json:"reencrypted"`
+	// Failed is the number of stale keys that could not be rewritten.
+	Failed int `json:"failed"`
+	// Done is set once every key has been checked.
+	Done bool `json:"done"`
+}
+
+// Reencryptor rewrites keys encrypted by retired master keys so that they
+// are encrypted by the current one. Keys are only rewritten if the cryptor
+// reports them stale; cryptors that do not implement keydb.StaleChecker have
+// no keys rewritten. If the cryptor is a keydb.Rewrapper, only the data keys
+// of keys that have them are rewrapped, without reencrypting versions.
+type Reencryptor struct {
+	db      keydb.DB
+	cryptor keydb.Cryptor
+	leaser  keydb.Leaser
+	holder  string
+
+	mu       sync.Mutex
+	progress ReencryptProgress
+}
+
+// NewReencryptor creates a Reencryptor for the keys in db. If leaser is not
+// nil, Run only reencrypts keys while this server holds the reencryptor
+// lease, so servers sharing a DB do not rewrite the same keys at once.
+func NewReencryptor(db keydb.DB, cryptor keydb.Cryptor, leaser keydb.Leaser) *Reencryptor {
+	hostname, _ := os.Hostname()
+	holder := fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), time.Now().UnixNano())
+	return &Reencryptor{db: db, cryptor: cryptor, leaser: leaser, holder: holder}
+}
+
+// Progress returns the progress of the current or most recent pass.
+func (r *Reencryptor) Progress() ReencryptProgress {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.progress
+}
+
+// Reencrypt rewrites every stale key. Each key is updated with an optimistic
+// DBVersion check, so concurrent changes to a key are never overwritten; the
+// key is read again and retried instead. It continues past keys that fail and
+// returns the first error.
+func (r *Reencryptor) Reencrypt() (ReencryptProgress, error) {
+	keys, err := r.db.GetAll()
+	if err != nil {
+		return r.Progress(), err
+	}
+	r.mu.Lock()
+	r.progress = ReencryptProgress{Total: len(keys)}
+	r.mu.Unlock()
+
+	var firstErr error
+	for i := range keys {
+		changed, err := r.reencryptKey(&keys[i])
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		r.mu.Lock()
+		r.progress.Checked++
+		if err != nil {
+			r.progress.Failed++
+		} else if changed {
+			r.progress.Reencrypted++
+		}
+		r.mu.Unlock()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.progress.Done = true
+	return r.progress, firstErr
+}
+
+func (r *Reencryptor) stale(k *keydb.DBKey) bool {
+	if c, ok := r.cryptor.(keydb.StaleChecker); ok {
+		return c.Stale(k)
+	}
+	return false
+}
+
+// reencryptKey rewrites k if it is stale and reports whether it did.
+func (r *Reencryptor) reencryptKey(k *keydb.DBKey) (bool, error) {
+	for attempt := 1; ; attempt++ {
+		if !r.stale(k) {
+			return false, nil
+		}
+		newK := k.Copy()
+		err := keydb.Rewrap(r.cryptor, newK)
+		if err == keydb.ErrNotRewrappable {
+			err = r.reencryptVersions(newK)
+		}
+		if err != nil {
+			return false, err
+		}
+		if err := keydb.Sign(r.cryptor, newK); err != nil {
+			return false, err
+		}
+
+		err = r.db.Update(newK)
+		switch {
+		case err == nil:
+			return true, nil
+		case err == knox.ErrKeyIDNotFound:
+			// The key was purged since it was read.
+			return false, nil
+		case err != keydb.ErrDBVersion || attempt == maxReencryptAttempts:
+			return false, err
+		}
+		k, err = r.db.Get(k.ID)
+		if err == knox.ErrKeyIDNotFound {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// reencryptVersions decrypts every version of k and encrypts it again under
+// the current master key.
+func (r *Reencryptor) reencryptVersions(k *keydb.DBKey) error {
+	key, err := r.cryptor.Decrypt(k)
+	if err != nil {
+		return err
+	}
+	encK, err := r.cryptor.Encrypt(key)
+	if err != nil {
+		return err
+	}
+	k.VersionList = encK.VersionList
+	k.DataKey = encK.DataKey
+	return nil
+}
+
+// Run reencrypts stale keys immediately and then every interval until stop
+// is closed.
+func (r *Reencryptor) Run(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		if r.leader(interval) {
+			p, err := r.Reencrypt()
+			if p.Reencrypted > 0 || p.Failed > 0 {
+				log.Printf("Reencrypted %d of %d keys, %d failed", p.Reencrypted, p.Total, p.Failed)
+			}
+			if err != nil {
+				log.Printf("Failed to reencrypt keys: %s", err.Error())
+			}
+		}
+		select {
+		case <-t.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// leader reports whether this server should run a pass, acquiring or
+// renewing the reencryptor lease if there is a leaser.
+func (r *Reencryptor) leader(interval time.Duration) bool {
+	if r.leaser == nil {
+		return true
+	}
+	// The lease outlives the interval so the leader keeps it between runs.
+	leader, err := r.leaser.AcquireLease(reencryptorLease, r.holder, 3*interval)
+	if err != nil {
+		log.Printf("Failed to acquire reencryptor lease: %s", err.Error())
+		return false
+	}
+	return leader
+}
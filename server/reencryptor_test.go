@@ -0,0 +1,194 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/auth"
+	"github.com/pinterest/knox/server/keydb"
+)
+
+// conflictDB fails the first conflicts updates as if the key had changed.
+type conflictDB struct {
+	keydb.DB
+	conflicts int
+}
+
+func (db *conflictDB) Update(k *keydb.DBKey) error {
+	if db.conflicts > 0 {
+		db.conflicts--
+		return keydb.ErrDBVersion
+	}
+	return db.DB.Update(k)
+}
+
+func TestReencryptor(t *testing.T) {
+	oldSecret := []byte("testtesttesttest")
+	newSecret := []byte("newnewnewnewnew!")
+	db := keydb.NewTempDB()
+	old := NewKeyManager(keydb.NewAESGCMCryptor(1, oldSecret), db)
+	u := auth.NewUser("testuser", []string{})
+	acl := knox.ACL([]knox.Access{})
+	for _, id := range []string{"id1", "id2"} {
+		key := newKey(id, acl, []byte("data"), u)
+		if err := old.AddNewKey(&key); err != nil {
+			t.Fatalf("%s is not nil", err)
+		}
+	}
+
+	cryptor, err := keydb.NewKeyringCryptor(2, map[byte][]byte{1: oldSecret, 2: newSecret})
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	cdb := &conflictDB{DB: db, conflicts: 1}
+	r := NewReencryptor(cdb, cryptor, nil)
+	p, err := r.Reencrypt()
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	expected := ReencryptProgress{Total: 2, Checked: 2, Reencrypted: 2, Done: true}
+	if p != expected || r.Progress() != expected {
+		t.Fatalf("%+v does not equal %+v", p, expected)
+	}
+
+	// The keys only need the new master key now.
+	m := NewKeyManager(keydb.NewAESGCMCryptor(2, newSecret), db)
+	for _, id := range []string{"id1", "id2"} {
+		k, err := m.GetKey(id, knox.Primary)
+		if err != nil {
+			t.Fatalf("%s is not nil", err)
+		}
+		if string(k.VersionList[0].Data) != "data" {
+			t.Fatalf("%q does not equal data", k.VersionList[0].Data)
+		}
+	}
+
+	p, err = r.Reencrypt()
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if p.Reencrypted != 0 || p.Checked != 2 {
+		t.Fatalf("current keys were reencrypted: %+v", p)
+	}
+
+	// Keys that keep changing are counted as failed.
+	key := newKey("id3", acl, []byte("data"), u)
+	if err := old.AddNewKey(&key); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	cdb.conflicts = maxReencryptAttempts
+	p, err = r.Reencrypt()
+	if err != keydb.ErrDBVersion {
+		t.Fatalf("%v does not equal %s", err, keydb.ErrDBVersion)
+	}
+	if p.Failed != 1 || p.Reencrypted != 0 {
+		t.Fatalf("unexpected progress %+v", p)
+	}
+}
+
+func TestReencryptorRewrap(t *testing.T) {
+	oldSecret := []byte("testtesttesttest")
+	newSecret := []byte("newnewnewnewnew!")
+	db := keydb.NewTempDB()
+	old := NewKeyManager(keydb.NewEnvelopeCryptor(1, oldSecret), db)
+	u := auth.NewUser("testuser", []string{})
+	key := newKey("id1", knox.ACL{}, []byte("data"), u)
+	if err := old.AddNewKey(&key); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	before, err := db.Get("id1")
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+
+	cryptor, err := keydb.NewEnvelopeKeyring(2, map[byte]keydb.KeyWrapper{
+		1: keydb.NewAESKeyWrapper(oldSecret),
+		2: keydb.NewAESKeyWrapper(newSecret),
+	})
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	r := NewReencryptor(db, cryptor, nil)
+	p, err := r.Reencrypt()
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if p.Reencrypted != 1 || p.Failed != 0 {
+		t.Fatalf("unexpected progress %+v", p)
+	}
+
+	// Only the data key was rewritten, and the new master key opens it.
+	after, err := db.Get("id1")
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if string(after.VersionList[0].EncData) != string(before.VersionList[0].EncData) {
+		t.Fatal("versions should not be reencrypted when rewrapping")
+	}
+	m := NewKeyManager(keydb.NewEnvelopeCryptor(2, newSecret), db)
+	k, err := m.GetKey("id1", knox.Primary)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if string(k.VersionList[0].Data) != "data" {
+		t.Fatalf("%q does not equal data", k.VersionList[0].Data)
+	}
+}
+
+func TestReencryptorWithoutStaleChecker(t *testing.T) {
+	db := keydb.NewTempDB()
+	m := NewKeyManager(keydb.NewAESGCMCryptor(1, []byte("testtesttesttest")), db)
+	key := newKey("id1", knox.ACL{}, []byte("data"), auth.NewUser("testuser", []string{}))
+	if err := m.AddNewKey(&key); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	before, err := db.Get("id1")
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+
+	r := NewReencryptor(db, keydb.NewAESGCMCryptor(1, []byte("testtesttesttest")), nil)
+	p, err := r.Reencrypt()
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if p.Checked != 1 || p.Reencrypted != 0 {
+		t.Fatalf("keys were reencrypted without a stale checker: %+v", p)
+	}
+	after, err := db.Get("id1")
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if after.DBVersion != before.DBVersion {
+		t.Fatalf("%d does not equal %d", after.DBVersion, before.DBVersion)
+	}
+}
+
+func TestReencryptorLease(t *testing.T) {
+	db := keydb.NewTempDB().(*keydb.TempDB)
+	cryptor := keydb.NewAESGCMCryptor(1, []byte("testtesttesttest"))
+	if !NewReencryptor(db, cryptor, nil).leader(time.Hour) {
+		t.Fatal("reencryptor without a leaser should always run")
+	}
+
+	r1 := NewReencryptor(db, cryptor, db)
+	r2 := NewReencryptor(db, cryptor, db)
+	if r1.holder == r2.holder {
+		t.Fatal("reencryptors share a lease holder")
+	}
+	if !r1.leader(time.Hour) {
+		t.Fatal("lease not acquired")
+	}
+	if r2.leader(time.Hour) {
+		t.Fatal("lease acquired by a second holder")
+	}
+	if !r1.leader(time.Hour) {
+		t.Fatal("lease not renewed")
+	}
+	// The reencryptor lease is separate from the rotator's.
+	ok, err := db.AcquireLease(rotatorLease, r2.holder, time.Hour)
+	if err != nil || !ok {
+		t.Fatalf("rotator lease not acquired: %v", err)
+	}
+}
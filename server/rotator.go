@@ -0,0 +1,174 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/log"
+	"github.com/pinterest/knox/server/keydb"
+)
+
+// rotatorComponent is recorded as the principal of audit events for rotations.
+const rotatorComponent = "rotator"
+
+// rotatorLease is the name of the lease held by the server that rotates keys.
+const rotatorLease = "rotator"
+
+// Rotator carries out the rotation policies of keys. Each step of a rotation
+// is decided from the key's versions, so a rotation picks up where it left
+// off after a restart or a change of leader.
+type Rotator struct {
+	m      KeyManager
+	leaser keydb.Leaser
+	holder string
+	now    func() time.Time
+}
+
+// NewRotator creates a Rotator for the keys managed by m. If leaser is not
+// nil, Run only rotates keys while this server holds the rotator lease, so
+// servers sharing a DB do not rotate the same key at once.
+func NewRotator(m KeyManager, leaser keydb.Leaser) *Rotator {
+	hostname, _ := os.Hostname()
+	holder := fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), time.Now().UnixNano())
+	return &Rotator{m: m, leaser: leaser, holder: holder, now: time.Now}
+}
+
+// Rotate advances the rotation of every key with a rotation policy and
+// returns the IDs of the keys it changed. A failure on one key does not stop
+// the others; the first error is returned.
+func (r *Rotator) Rotate() ([]string, error) {
+	ids, err := r.m.SearchKeyIDs(KeyQuery{Rotating: true})
+	if err != nil {
+		return nil, err
+	}
+	rotated := []string{}
+	var firstErr error
+	for _, id := range ids {
+		changed, err := r.rotateKey(id)
+		if changed {
+			rotated = append(rotated, id)
+		}
+		if err != nil && err != knox.ErrKeyIDNotFound && firstErr == nil {
+			firstErr = fmt.Errorf("Error rotating %s: %s", id, err.Error())
+		}
+	}
+	return rotated, firstErr
+}
+
+// rotateKey promotes the newest version once its promote delay has passed,
+// deactivates older versions once the grace period has passed after that,
+// and adds a new version once the rotation period has passed.
+func (r *Rotator) rotateKey(id string) (bool, error) {
+	key, err := r.m.GetKey(id, knox.Inactive)
+	if err != nil {
+		return false, err
+	}
+	if key.Policy == nil || key.Policy.Rotation == nil {
+		return false, nil
+	}
+	p := key.Policy.Rotation
+	now := r.now().UnixNano()
+
+	newest := key.VersionList[0]
+	for _, v := range key.VersionList {
+		if v.CreationTime > newest.CreationTime {
+			newest = v
+		}
+	}
+	promoteAt := newest.CreationTime + int64(p.PromoteDelay)
+
+	changed := false
+	switch {
+	case newest.Status == knox.Active && now >= promoteAt:
+		if err := r.updateVersion(key, newest.ID, knox.Primary); err != nil {
+			return changed, err
+		}
+		changed = true
+	case newest.Status == knox.Primary && now >= promoteAt+int64(p.GracePeriod):
+		for _, v := range key.VersionList {
+			if v.Status != knox.Active {
+				continue
+			}
+			if err := r.updateVersion(key, v.ID, knox.Inactive); err != nil {
+				return changed, err
+			}
+			changed = true
+		}
+	}
+
+	if newest.Status != knox.Active && now >= newest.CreationTime+int64(p.Period) {
+		data, err := generateSecret(p.Generator)
+		if err != nil {
+			return changed, err
+		}
+		version := newKeyVersion(data, knox.Active)
+		if err := r.m.AddVersion(id, &version); err != nil {
+			return changed, err
+		}
+		recordSystemEvent(rotatorComponent, knox.AuditEvent{
+			Type:       knox.AddVersionEvent,
+			KeyID:      id,
+			VersionIDs: []uint64{version.ID},
+			NewStatus:  &version.Status,
+		})
+		changed = true
+	}
+	return changed, nil
+}
+
+func (r *Rotator) updateVersion(key *knox.Key, versionID uint64, status knox.VersionStatus) error {
+	if err := r.m.UpdateVersion(key.ID, versionID, status); err != nil {
+		return err
+	}
+	e := knox.AuditEvent{
+		Type:       knox.PromoteVersionEvent,
+		KeyID:      key.ID,
+		VersionIDs: []uint64{versionID},
+		NewStatus:  &status,
+	}
+	if status == knox.Inactive {
+		e.Type = knox.DeactivateVersionEvent
+	}
+	for _, v := range key.VersionList {
+		if v.ID == versionID {
+			oldStatus := v.Status
+			e.OldStatus = &oldStatus
+		}
+	}
+	recordSystemEvent(rotatorComponent, e)
+	return nil
+}
+
+// Run rotates keys every interval until stop is closed.
+func (r *Rotator) Run(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if r.leaser != nil {
+				// The lease outlives the interval so the leader keeps it
+				// between runs.
+				leader, err := r.leaser.AcquireLease(rotatorLease, r.holder, 3*interval)
+				if err != nil {
+					log.Printf("Failed to acquire rotator lease: %s", err.Error())
+					continue
+				}
+				if !leader {
+					continue
+				}
+			}
+			rotated, err := r.Rotate()
+			if len(rotated) > 0 {
+				log.Printf("Rotated %d keys", len(rotated))
+			}
+			if err != nil {
+				log.Printf("Failed to rotate keys: %s", err.Error())
+			}
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/audit"
+	"github.com/pinterest/knox/server/keydb"
+)
+
+func versionStatuses(t *testing.T, m KeyManager, id string) map[uint64]knox.VersionStatus {
+	key, err := m.GetKey(id, knox.Inactive)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	statuses := map[uint64]knox.VersionStatus{}
+	for _, v := range key.VersionList {
+		statuses[v.ID] = v.Status
+	}
+	return statuses
+}
+
+func TestRotator(t *testing.T) {
+	m, u, acl := GetMocks()
+	sink := audit.NewMemorySink()
+	l, err := audit.NewLogger(sink)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	SetAuditLogger(l)
+	defer SetAuditLogger(nil)
+
+	key := newKey("id1", acl, []byte("data"), u)
+	if err := m.AddNewKey(&key); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	static := newKey("id2", acl, []byte("data"), u)
+	if err := m.AddNewKey(&static); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	policy := knox.KeyPolicy{Rotation: &knox.RotationPolicy{
+		Generator:    knox.GeneratorSpec{Encoding: knox.HexEncoding, Length: 16},
+		Period:       24 * time.Hour,
+		PromoteDelay: time.Hour,
+		GracePeriod:  time.Hour,
+	}}
+	if err := m.SetPolicy("id1", policy); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	first := key.VersionList[0].ID
+	start := time.Unix(0, key.VersionList[0].CreationTime)
+
+	r := NewRotator(m, nil)
+	at := func(d time.Duration) {
+		r.now = func() time.Time { return start.Add(d) }
+	}
+
+	// Nothing happens before the period has passed.
+	at(23 * time.Hour)
+	rotated, err := r.Rotate()
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(rotated) != 0 {
+		t.Fatalf("unexpected rotated keys %v", rotated)
+	}
+
+	// A new Active version is added.
+	at(25 * time.Hour)
+	rotated, err = r.Rotate()
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(rotated) != 1 || rotated[0] != "id1" {
+		t.Fatalf("unexpected rotated keys %v", rotated)
+	}
+	statuses := versionStatuses(t, m, "id1")
+	if len(statuses) != 2 || statuses[first] != knox.Primary {
+		t.Fatalf("unexpected versions %v", statuses)
+	}
+	var second uint64
+	for id, s := range statuses {
+		if id != first {
+			second = id
+			if s != knox.Active {
+				t.Fatalf("unexpected versions %v", statuses)
+			}
+		}
+	}
+	if len(versionStatuses(t, m, "id2")) != 1 {
+		t.Fatal("key without a rotation policy was rotated")
+	}
+
+	// The new version is promoted after the delay, measured from when it was
+	// really created.
+	at(100 * time.Hour)
+	if _, err := r.Rotate(); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	statuses = versionStatuses(t, m, "id1")
+	if statuses[second] != knox.Primary || statuses[first] != knox.Active || len(statuses) != 2 {
+		t.Fatalf("unexpected versions %v", statuses)
+	}
+
+	// The old version is deactivated after the grace period and, since the
+	// period has also passed, the next rotation starts.
+	if _, err := r.Rotate(); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	statuses = versionStatuses(t, m, "id1")
+	if statuses[second] != knox.Primary || statuses[first] != knox.Inactive || len(statuses) != 3 {
+		t.Fatalf("unexpected versions %v", statuses)
+	}
+
+	types := []knox.AuditEventType{}
+	for _, e := range sink.Events() {
+		if e.Principal != rotatorComponent || e.AuthType != systemAuthType {
+			t.Fatalf("unexpected event %+v", e)
+		}
+		types = append(types, e.Type)
+	}
+	expected := []knox.AuditEventType{knox.AddVersionEvent, knox.PromoteVersionEvent, knox.DeactivateVersionEvent, knox.AddVersionEvent}
+	if len(types) != len(expected) {
+		t.Fatalf("%v does not equal %v", types, expected)
+	}
+	for i := range types {
+		if types[i] != expected[i] {
+			t.Fatalf("%v does not equal %v", types, expected)
+		}
+	}
+}
+
+func TestRotatorLease(t *testing.T) {
+	db := keydb.NewTempDB().(*keydb.TempDB)
+	m := NewKeyManager(keydb.NewAESGCMCryptor(10, []byte("testtesttesttest")), db)
+	r1 := NewRotator(m, db)
+	r2 := NewRotator(m, db)
+	if r1.holder == r2.holder {
+		t.Fatal("rotators share a lease holder")
+	}
+
+	ok, err := db.AcquireLease(rotatorLease, r1.holder, time.Hour)
+	if err != nil || !ok {
+		t.Fatalf("lease not acquired: %v", err)
+	}
+	ok, err = db.AcquireLease(rotatorLease, r2.holder, time.Hour)
+	if err != nil || ok {
+		t.Fatalf("lease acquired by a second holder: %v", err)
+	}
+	ok, err = db.AcquireLease(rotatorLease, r1.holder, time.Millisecond)
+	if err != nil || !ok {
+		t.Fatalf("lease not renewed: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	ok, err = db.AcquireLease(rotatorLease, r2.holder, time.Hour)
+	if err != nil || !ok {
+		t.Fatalf("expired lease not taken over: %v", err)
+	}
+}
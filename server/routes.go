@@ -6,9 +6,14 @@ import (
 	"fmt"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/log"
+	"github.com/pinterest/knox/server/audit"
 	"github.com/pinterest/knox/server/auth"
+	"github.com/pinterest/knox/server/keydb"
 )
 
 var routes = [...]route{
@@ -21,6 +26,33 @@ var routes = [...]route{
 			rawQueryParameter("queryString"),
 		},
 	},
+	{
+		method:  "GET",
+		id:      "watchkeys",
+		path:    "/v0/watch/",
+		handler: watchKeysHandler,
+		parameters: []parameter{
+			queryParameter("keys"),
+			queryParameter("timeout"),
+		},
+	},
+	{
+		method:  "GET",
+		id:      "searchkeys",
+		path:    "/v0/search/keys/",
+		handler: searchKeysHandler,
+		parameters: []parameter{
+			queryParameter("prefix"),
+			queryParameter("cursor"),
+			queryParameter("access"),
+			queryParameter("team"),
+			queryParameter("tags"),
+			queryParameter("limit"),
+			queryParameter("principal_type"),
+			queryParameter("principal"),
+			queryParameter("groups"),
+		},
+	},
 	{
 		method:  "POST",
 		id:      "postkeys",
@@ -30,6 +62,8 @@ var routes = [...]route{
 			postParameter("id"),
 			postParameter("data"),
 			postParameter("acl"),
+			postParameter("metadata"),
+			postParameter("generate"),
 		},
 	},
 
@@ -52,6 +86,15 @@ var routes = [...]route{
 			urlParameter("keyID"),
 		},
 	},
+	{
+		method:  "POST",
+		id:      "restorekey",
+		path:    "/v0/keys/{keyID}/restore/",
+		handler: restoreKeyHandler,
+		parameters: []parameter{
+			urlParameter("keyID"),
+		},
+	},
 	{
 		method:  "GET",
 		id:      "getaccess",
@@ -72,6 +115,86 @@ var routes = [...]route{
 			postParameter("acl"),
 		},
 	},
+	{
+		method:  "GET",
+		id:      "explainaccess",
+		path:    "/v0/keys/{keyID}/explain/",
+		handler: explainAccessHandler,
+		parameters: []parameter{
+			urlParameter("keyID"),
+			queryParameter("access"),
+			queryParameter("principal_type"),
+			queryParameter("principal"),
+			queryParameter("groups"),
+		},
+	},
+	{
+		method:  "GET",
+		id:      "getmetadata",
+		path:    "/v0/keys/{keyID}/metadata/",
+		handler: getMetadataHandler,
+		parameters: []parameter{
+			urlParameter("keyID"),
+		},
+	},
+	{
+		method:  "PUT",
+		id:      "putmetadata",
+		path:    "/v0/keys/{keyID}/metadata/",
+		handler: putMetadataHandler,
+		parameters: []parameter{
+			urlParameter("keyID"),
+			postParameter("metadata"),
+		},
+	},
+	{
+		method:  "GET",
+		id:      "getpolicy",
+		path:    "/v0/keys/{keyID}/policy/",
+		handler: getPolicyHandler,
+		parameters: []parameter{
+			urlParameter("keyID"),
+		},
+	},
+	{
+		method:  "PUT",
+		id:      "putpolicy",
+		path:    "/v0/keys/{keyID}/policy/",
+		handler: putPolicyHandler,
+		parameters: []parameter{
+			urlParameter("keyID"),
+			postParameter("policy"),
+		},
+	},
+	{
+		method:  "GET",
+		id:      "getrequests",
+		path:    "/v0/keys/{keyID}/requests/",
+		handler: getRequestsHandler,
+		parameters: []parameter{
+			urlParameter("keyID"),
+		},
+	},
+	{
+		method:  "POST",
+		id:      "approverequest",
+		path:    "/v0/keys/{keyID}/requests/{requestID}/approve/",
+		handler: approveRequestHandler,
+		parameters: []parameter{
+			urlParameter("keyID"),
+			urlParameter("requestID"),
+		},
+	},
+	{
+		method:  "POST",
+		id:      "rejectrequest",
+		path:    "/v0/keys/{keyID}/requests/{requestID}/reject/",
+		handler: rejectRequestHandler,
+		parameters: []parameter{
+			urlParameter("keyID"),
+			urlParameter("requestID"),
+		},
+	},
 	{
 		method:  "POST",
 		id:      "postversion",
@@ -80,6 +203,7 @@ var routes = [...]route{
 		parameters: []parameter{
 			urlParameter("keyID"),
 			postParameter("data"),
+			postParameter("generate"),
 		},
 	},
 	{
@@ -93,6 +217,115 @@ var routes = [...]route{
 			postParameter("status"),
 		},
 	},
+	{
+		method:  "GET",
+		id:      "gethistory",
+		path:    "/v0/keys/{keyID}/history/",
+		handler: getHistoryHandler,
+		parameters: []parameter{
+			urlParameter("keyID"),
+			queryParameter("cursor"),
+			queryParameter("since"),
+			queryParameter("until"),
+			queryParameter("type"),
+			queryParameter("limit"),
+		},
+	},
+	{
+		method:  "GET",
+		id:      "getwebhooks",
+		path:    "/v0/webhooks/",
+		handler: getWebhooksHandler,
+		parameters: []parameter{
+			queryParameter("key"),
+		},
+	},
+	{
+		method:  "POST",
+		id:      "postwebhook",
+		path:    "/v0/webhooks/",
+		handler: postWebhookHandler,
+		parameters: []parameter{
+			postParameter("webhook"),
+		},
+	},
+	{
+		method:  "DELETE",
+		id:      "deletewebhook",
+		path:    "/v0/webhooks/{webhookID}/",
+		handler: deleteWebhookHandler,
+		parameters: []parameter{
+			urlParameter("webhookID"),
+		},
+	},
+	{
+		method:  "GET",
+		id:      "getdeadletters",
+		path:    "/v0/webhooks/{webhookID}/deadletters/",
+		handler: getDeadLettersHandler,
+		parameters: []parameter{
+			urlParameter("webhookID"),
+		},
+	},
+	{
+		method:  "GET",
+		id:      "getnamespaces",
+		path:    "/v0/namespaces/",
+		handler: getNamespacesHandler,
+	},
+	{
+		method:  "GET",
+		id:      "getnamespace",
+		path:    "/v0/namespaces/{prefix}/",
+		handler: getNamespaceHandler,
+		parameters: []parameter{
+			urlParameter("prefix"),
+		},
+	},
+	{
+		method:  "PUT",
+		id:      "putnamespace",
+		path:    "/v0/namespaces/{prefix}/",
+		handler: putNamespaceAccessHandler,
+		parameters: []parameter{
+			urlParameter("prefix"),
+			postParameter("access"),
+			postParameter("acl"),
+		},
+	},
+	{
+		method:  "DELETE",
+		id:      "deletenamespace",
+		path:    "/v0/namespaces/{prefix}/",
+		handler: deleteNamespaceHandler,
+		parameters: []parameter{
+			urlParameter("prefix"),
+		},
+	},
+	{
+		method:      "GET",
+		id:          "health",
+		path:        "/v0/health/",
+		handler:     healthHandler,
+		allowSealed: true,
+	},
+	{
+		method:      "POST",
+		id:          "unseal",
+		path:        "/v0/unseal/",
+		handler:     unsealHandler,
+		allowSealed: true,
+		parameters: []parameter{
+			postParameter("share"),
+		},
+	},
+	{
+		method:      "POST",
+		id:          "seal",
+		path:        "/v0/seal/",
+		handler:     sealHandler,
+		allowSealed: true,
+	},
 }
 
 // getKeysHandler is a handler that gets key IDs specified in the request.
@@ -132,26 +365,236 @@ func getKeysHandler(m KeyManager, principal knox.Principal, parameters map[strin
 	return keys, nil
 }
 
+// Default and maximum times watchKeysHandler waits for a change.
+const (
+	defaultWatchTimeout = time.Minute
+	maxWatchTimeout     = 10 * time.Minute
+)
+
+// watchKeysHandler waits for any of the requested keys to change and returns
+// the IDs of the changed keys, so clients learn of rotations without polling.
+// keys is a JSON object of key IDs and the version hashes the client has. As
+// with getKeysHandler, IDs of keys that do not exist are ignored. The request
+// returns as soon as any hash differs, or with an empty list after timeout
+// seconds.
+// The route for this handler is GET /v0/watch/
+// There are no authorization constraints on this route.
+func watchKeysHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *httpError) {
+	keysJSON, ok := parameters["keys"]
+	if !ok {
+		return nil, errF(knox.NoKeyIDCode, "")
+	}
+	versions := map[string]string{}
+	if err := json.Unmarshal([]byte(keysJSON), &versions); err != nil {
+		return nil, errF(knox.BadRequestDataCode, err.Error())
+	}
+	if len(versions) == 0 {
+		return nil, errF(knox.NoKeyIDCode, "")
+	}
+	timeout := defaultWatchTimeout
+	if timeoutStr, ok := parameters["timeout"]; ok {
+		seconds, err := strconv.Atoi(timeoutStr)
+		if err != nil || seconds <= 0 || seconds > int(maxWatchTimeout/time.Second) {
+			return nil, errF(knox.BadRequestDataCode, fmt.Sprintf("timeout must be between 1 and %d seconds", int(maxWatchTimeout/time.Second)))
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+	keys, err := m.WatchKeyIDs(versions, timeout)
+	if err != nil {
+		return nil, errF(knox.InternalServerErrorCode, err.Error())
+	}
+	return keys, nil
+}
+
+// Default and maximum page sizes for searchKeysHandler.
+const (
+	defaultSearchLimit = 100
+	maxSearchLimit     = 1000
+)
+
+// searchKeysHandler returns a page of key IDs in sorted order.
+// prefix only returns key IDs starting with it. access (Read, Write, or Admin)
+// only returns keys the principal has at least that access to. If
+// principal_type and principal are set, access is evaluated for that principal
+// instead and defaults to Read (see specPrincipal). team and tags (a comma
+// separated list) filter on key metadata. cursor continues from a previous page.
+// The route for this handler is GET /v0/search/keys/
+// There are no authorization constraints on this route.
+func searchKeysHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *httpError) {
+	q := KeyQuery{
+		Prefix:    parameters["prefix"],
+		After:     parameters["cursor"],
+		Principal: principal,
+		Team:      parameters["team"],
+	}
+	spec, specErr := specPrincipal(parameters)
+	if specErr != nil {
+		return nil, specErr
+	}
+	if spec != nil {
+		q.Principal = spec
+		q.Access = knox.Read
+	}
+	if accessStr, ok := parameters["access"]; ok && accessStr != "" {
+		var accessErr *httpError
+		q.Access, accessErr = parseAccessType(accessStr)
+		if accessErr != nil {
+			return nil, accessErr
+		}
+	}
+	if tagStr, ok := parameters["tags"]; ok && tagStr != "" {
+		q.Tags = strings.Split(tagStr, ",")
+	}
+	limit := defaultSearchLimit
+	if limitStr, ok := parameters["limit"]; ok {
+		var intErr error
+		limit, intErr = strconv.Atoi(limitStr)
+		if intErr != nil || limit <= 0 || limit > maxSearchLimit {
+			return nil, errF(knox.BadRequestDataCode, fmt.Sprintf("limit must be between 1 and %d", maxSearchLimit))
+		}
+	}
+
+	// Ask for one more key than needed to find out if there is another page.
+	q.Limit = limit + 1
+	keys, err := m.SearchKeyIDs(q)
+	if err != nil {
+		return nil, errF(knox.InternalServerErrorCode, err.Error())
+	}
+	page := knox.KeyIDPage{KeyIDs: keys}
+	if len(keys) > limit {
+		page.KeyIDs = keys[:limit]
+		page.Cursor = keys[limit-1]
+	}
+	return page, nil
+}
+
+// parseAccessType parses Read, Write, or Admin.
+func parseAccessType(s string) (knox.AccessType, *httpError) {
+	var t knox.AccessType
+	jsonErr := json.Unmarshal([]byte(`"`+s+`"`), &t)
+	if jsonErr != nil || t == knox.None {
+		return knox.None, errF(knox.BadRequestDataCode, fmt.Sprintf("Invalid access %s", s))
+	}
+	return t, nil
+}
+
+// specPrincipal builds the principal described by the principal_type,
+// principal, and groups parameters, or returns nil if they are not set.
+// principal_type is User, Machine, or Service. principal is the username,
+// hostname, or SPIFFE ID, and groups is a comma separated list of the groups
+// of a User.
+func specPrincipal(parameters map[string]string) (knox.Principal, *httpError) {
+	typeStr := parameters["principal_type"]
+	id := parameters["principal"]
+	if typeStr == "" && id == "" {
+		return nil, nil
+	}
+	if id == "" {
+		return nil, errF(knox.BadPrincipalIdentifier, "Missing parameter 'principal'")
+	}
+	var t knox.PrincipalType
+	json.Unmarshal([]byte(`"`+typeStr+`"`), &t)
+	switch t {
+	case knox.User:
+		var groups []string
+		if groupStr := parameters["groups"]; groupStr != "" {
+			groups = strings.Split(groupStr, ",")
+		}
+		return auth.NewUser(id, groups), nil
+	case knox.Machine:
+		return auth.NewMachine(id), nil
+	case knox.Service:
+		p, err := auth.NewServiceFromID(id)
+		if err != nil {
+			return nil, errF(knox.BadPrincipalIdentifier, err.Error())
+		}
+		return p, nil
+	default:
+		return nil, errF(knox.BadPrincipalIdentifier, fmt.Sprintf("principal_type must be User, Machine, or Service, not %s", typeStr))
+	}
+}
+
+// explainAccessHandler says whether a principal has an access type to a key
+// and which ACL entries grant it. The principal is described by parameters
+// (see specPrincipal). Without one, it lists the entries that grant the
+// access to anyone. access is Read, Write, or Admin and defaults to Read.
+// The route for this handler is GET /v0/keys/<key_id>/explain/
+// There are no authorization constraints on this route, since ACLs are not secret.
+func explainAccessHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *httpError) {
+	keyID := parameters["keyID"]
+
+	accessType := knox.Read
+	if accessStr, ok := parameters["access"]; ok && accessStr != "" {
+		var accessErr *httpError
+		accessType, accessErr = parseAccessType(accessStr)
+		if accessErr != nil {
+			return nil, accessErr
+		}
+	}
+	spec, specErr := specPrincipal(parameters)
+	if specErr != nil {
+		return nil, specErr
+	}
+
+	// Get the key
+	key, getErr := m.GetKey(keyID, knox.Primary)
+	if getErr != nil {
+		if getErr == knox.ErrKeyIDNotFound {
+			return nil, errF(knox.KeyIdentifierDoesNotExistCode, fmt.Sprintf("No such key %s", keyID))
+		}
+		return nil, errF(knox.InternalServerErrorCode, getErr.Error())
+	}
+
+	explanation := knox.AccessExplanation{KeyID: keyID, AccessType: accessType}
+	if spec != nil {
+		explanation.Principal = spec.GetID()
+		explanation.GrantedBy = auth.GrantingEntries(spec, key.EffectiveACL(), accessType)
+	} else {
+		now := time.Now()
+		explanation.GrantedBy = knox.ACL{}
+		for _, a := range key.EffectiveACL() {
+			if !a.Expired(now) && a.AccessType.CanAccess(accessType) {
+				explanation.GrantedBy = append(explanation.GrantedBy, a)
+			}
+		}
+	}
+	explanation.Granted = len(explanation.GrantedBy) > 0
+	return explanation, nil
+}
+
 // postKeysHandler creates a new key and stores it. It reads from the post data
-// key ID, base64 encoded data, and JSON encoded ACL.
-// It returns the key version ID of the original Primary key version.
+// key ID, base64 encoded data, and JSON encoded ACL. Instead of data, generate
+// may hold a JSON encoded GeneratorSpec for the server to generate the data.
+// It returns the key version ID of the original Primary key version. Generated
+// data is not returned, so it is only ever read by principals on the ACL.
 // The route for this handler is POST /v0/keys/
-// The postKeysHandler must be a User.
+// The principal must be a User, or have Admin access to the namespaces the
+// key is in. Keys created in a namespace inherit its ACL either way.
 func postKeysHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *httpError) {
+	keyID, keyIDOK := parameters["id"]
 
 	// Authorize
 	if !auth.IsUser(principal) {
-		return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Must be a user to create keys, principal is %s", principal.GetID()))
+		inherited, nsErr := namespaceACL(m, keyID)
+		if nsErr != nil {
+			return nil, nsErr
+		}
+		if !principal.CanAccess(inherited, knox.Admin) {
+			return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Must be a user or an admin of the namespaces of %s to create it, principal is %s", keyID, principal.GetID()))
+		}
 	}
 
-	keyID, keyIDOK := parameters["id"]
 	if !keyIDOK {
 		return nil, errF(knox.NoKeyIDCode, "Missing parameter 'id'")
 	}
 	data, dataOK := parameters["data"]
-	if !dataOK {
+	genStr, genOK := parameters["generate"]
+	if !dataOK && !genOK {
 		return nil, errF(knox.NoKeyDataCode, "Missing parameter 'data'")
 	}
+	if dataOK && genOK {
+		return nil, errF(knox.BadRequestDataCode, "Only one of 'data' and 'generate' may be set")
+	}
 	aclStr, aclOK := parameters["acl"]
 
 	acl := make(knox.ACL, 0)
@@ -162,13 +605,24 @@ func postKeysHandler(m KeyManager, principal knox.Principal, parameters map[stri
 		}
 	}
 
-	decodedData, decodeErr := base64.StdEncoding.DecodeString(data)
-	if decodeErr != nil {
-		return nil, errF(knox.BadRequestDataCode, decodeErr.Error())
+	var metadata knox.KeyMetadata
+	if metadataStr, ok := parameters["metadata"]; ok {
+		jsonErr := json.Unmarshal([]byte(metadataStr), &metadata)
+		if jsonErr != nil {
+			return nil, errF(knox.BadRequestDataCode, jsonErr.Error())
+		}
+	}
+
+	decodedData, dataErr := keyData(data, genStr, genOK)
+	if dataErr != nil {
+		return nil, dataErr
 	}
 
 	// Create and add new key
 	key := newKey(keyID, acl, decodedData, principal)
+	key.Metadata.Description = metadata.Description
+	key.Metadata.Team = metadata.Team
+	key.Metadata.Tags = metadata.Tags
 	err := m.AddNewKey(&key)
 	if err != nil {
 		if err == knox.ErrKeyExists {
@@ -177,12 +631,49 @@ func postKeysHandler(m KeyManager, principal knox.Principal, parameters map[stri
 		if err == knox.ErrInvalidKeyID {
 			return nil, errF(knox.BadKeyFormatCode, fmt.Sprintf("KeyID includes unsupported characters %s", keyID))
 		}
+		if err == knox.ErrMetadataTooLarge || err == knox.ErrInvalidTag {
+			return nil, errF(knox.BadRequestDataCode, err.Error())
+		}
 
 		return nil, errF(knox.InternalServerErrorCode, err.Error())
 	}
+	status := knox.Primary
+	recordEvent(principal, knox.AuditEvent{
+		Type:       knox.CreateKeyEvent,
+		KeyID:      keyID,
+		VersionIDs: []uint64{key.VersionList[0].ID},
+		NewACL:     key.ACL,
+		NewStatus:  &status,
+	})
 	return key.VersionList[0].ID, nil
 }
 
+// keyData decodes base64 encoded key data, or generates it from the JSON
+// encoded GeneratorSpec if generate is set.
+func keyData(data string, genStr string, generate bool) ([]byte, *httpError) {
+	if !generate {
+		decodedData, decodeErr := base64.StdEncoding.DecodeString(data)
+		if decodeErr != nil {
+			return nil, errF(knox.BadRequestDataCode, decodeErr.Error())
+		}
+		return decodedData, nil
+	}
+	var g knox.GeneratorSpec
+	jsonErr := json.Unmarshal([]byte(genStr), &g)
+	if jsonErr != nil {
+		return nil, errF(knox.BadRequestDataCode, jsonErr.Error())
+	}
+	generated, err := generateSecret(g)
+	switch err {
+	case nil:
+		return generated, nil
+	case knox.ErrInvalidGenerator, knox.ErrInvalidCharset:
+		return nil, errF(knox.BadRequestDataCode, err.Error())
+	default:
+		return nil, errF(knox.InternalServerErrorCode, err.Error())
+	}
+}
+
 // getKeyHandler gets the key matching the keyID in the request.
 // The route for this handler is GET /v0/keys/<key_id>/
 // The principal must have Read access to the key
@@ -208,15 +699,27 @@ func getKeyHandler(m KeyManager, principal knox.Principal, parameters map[string
 	}
 
 	// Authorize access to data
-	if !principal.CanAccess(key.ACL, knox.Read) {
+	if !principal.CanAccess(key.EffectiveACL(), knox.Read) {
 		return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Principal %s not authorized to read %s", principal.GetID(), keyID))
 	}
+	versionIDs := make([]uint64, len(key.VersionList))
+	for i, v := range key.VersionList {
+		versionIDs[i] = v.ID
+	}
+	recordEvent(principal, knox.AuditEvent{
+		Type:       knox.ReadKeyEvent,
+		KeyID:      keyID,
+		VersionIDs: versionIDs,
+	})
 	// Zero ACL for key response, in order to avoid caching unnecessarily
 	key.ACL = knox.ACL{}
+	key.InheritedACL = nil
 	return key, nil
 }
 
 // deleteKeyHandler deletes the key matching the keyID in the request.
+// Deleted keys can be restored until they are purged. If the key's policy
+// requires approval, an approval request is created instead.
 // The route for this handler is DELETE /v0/keys/<key_id>/
 // The principal needs Admin access to the key.
 func deleteKeyHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *httpError) {
@@ -231,19 +734,77 @@ func deleteKeyHandler(m KeyManager, principal knox.Principal, parameters map[str
 	}
 
 	// Authorize
-	if !principal.CanAccess(key.ACL, knox.Admin) {
+	if !principal.CanAccess(key.EffectiveACL(), knox.Admin) {
 		return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Principal %s not authorized to delete %s", principal.GetID(), keyID))
 	}
 
+	if requiresApproval(key) {
+		r, err := newApprovalRequest(keyID, knox.DeleteKeyOperation, principal)
+		if err != nil {
+			return nil, errF(knox.InternalServerErrorCode, err.Error())
+		}
+		return nil, requestApproval(m, principal, &r)
+	}
+
 	// Delete the key
 	err := m.DeleteKey(keyID)
 	if err != nil {
+		if err == knox.ErrKeyIDNotFound {
+			return nil, errF(knox.KeyIdentifierDoesNotExistCode, fmt.Sprintf("No such key %s", keyID))
+		}
+		return nil, errF(knox.InternalServerErrorCode, err.Error())
+	}
+	recordEvent(principal, knox.AuditEvent{
+		Type:   knox.DeleteKeyEvent,
+		KeyID:  keyID,
+		OldACL: key.ACL,
+	})
+	return nil, nil
+}
+
+// restoreKeyHandler restores a deleted key that has not yet been purged.
+// The route for this handler is POST /v0/keys/<key_id>/restore/
+// The principal needs Admin access to the key as it was when deleted.
+func restoreKeyHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *httpError) {
+	keyID := parameters["keyID"]
+
+	key, getErr := m.GetDeletedKey(keyID)
+	if getErr != nil {
+		switch getErr {
+		case knox.ErrKeyIDNotFound:
+			return nil, errF(knox.KeyIdentifierDoesNotExistCode, fmt.Sprintf("No deleted key %s", keyID))
+		case knox.ErrKeyNotDeleted:
+			return nil, errF(knox.BadRequestDataCode, fmt.Sprintf("Key %s is not deleted", keyID))
+		default:
+			return nil, errF(knox.InternalServerErrorCode, getErr.Error())
+		}
+	}
+
+	// Authorize
+	if !principal.CanAccess(key.EffectiveACL(), knox.Admin) {
+		return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Principal %s not authorized to restore %s", principal.GetID(), keyID))
+	}
+
+	err := m.RestoreKey(keyID)
+	switch err {
+	case nil:
+	case knox.ErrKeyIDNotFound:
+		return nil, errF(knox.KeyIdentifierDoesNotExistCode, fmt.Sprintf("No deleted key %s", keyID))
+	case knox.ErrKeyNotDeleted:
+		return nil, errF(knox.BadRequestDataCode, fmt.Sprintf("Key %s is not deleted", keyID))
+	default:
 		return nil, errF(knox.InternalServerErrorCode, err.Error())
 	}
+	recordEvent(principal, knox.AuditEvent{
+		Type:   knox.RestoreKeyEvent,
+		KeyID:  keyID,
+		NewACL: key.ACL,
+	})
 	return nil, nil
 }
 
-// getAccessHandler gets the ACL for a specific Key.
+// getAccessHandler gets the ACL for a specific Key. Entries inherited from
+// namespaces are not included.
 // The route for this handler is GET /v0/keys/<key_id>/access/
 func getAccessHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *httpError) {
 
@@ -268,31 +829,81 @@ func getAccessHandler(m KeyManager, principal knox.Principal, parameters map[str
 // This object is input as base64 encoded json encoded form data
 // access is used for a single access rule and acl is used for multiple rules
 // existing access rules will not be modified unless the same Type and Name is used
+// If the key's policy requires approval, an approval request is created instead.
 // The route for this handler is PUT /v0/keys/<key_id>/access/
 // The principal needs Admin access.
 func putAccessHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *httpError) {
 	keyID := parameters["keyID"]
 
-	accessStr, accessOK := parameters["access"]
-	aclStr, aclOK := parameters["acl"]
+	acl, aclErr := accessChanges(parameters)
+	if aclErr != nil {
+		return nil, aclErr
+	}
 
-	acl := []knox.Access{}
-	if accessOK {
-		access := knox.Access{}
-		// If JSON decode fails, try a base64 encoded JSON string (both options are around for backwards compatibility)
-		jsonErr := json.Unmarshal([]byte(accessStr), &access)
-		if jsonErr != nil {
-			decodedData, decodeErr := base64.RawURLEncoding.DecodeString(accessStr)
-			if decodeErr != nil {
-				return nil, errF(knox.BadRequestDataCode, decodeErr.Error())
-			}
-			jsonErr := json.Unmarshal(decodedData, &access)
-			if jsonErr != nil {
-				return nil, errF(knox.BadRequestDataCode, jsonErr.Error())
-			}
+	// Get the Key
+	key, getErr := m.GetKey(keyID, knox.Primary)
+	if getErr != nil {
+		if getErr == knox.ErrKeyIDNotFound {
+			return nil, errF(knox.KeyIdentifierDoesNotExistCode, fmt.Sprintf("No such key %s", keyID))
 		}
-		acl = append(acl, access)
-	} else if aclOK {
+		return nil, errF(knox.InternalServerErrorCode, getErr.Error())
+	}
+
+	// Authorize
+	if !principal.CanAccess(key.EffectiveACL(), knox.Admin) {
+		return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Principal %s not authorized to update access for %s", principal.GetID(), keyID))
+	}
+
+	if validErr := validateAccessChanges(acl); validErr != nil {
+		return nil, validErr
+	}
+
+	if requiresApproval(key) {
+		r, err := newApprovalRequest(keyID, knox.UpdateAccessOperation, principal)
+		if err != nil {
+			return nil, errF(knox.InternalServerErrorCode, err.Error())
+		}
+		r.ACL = acl
+		return nil, requestApproval(m, principal, &r)
+	}
+
+	// Update Access
+	updateErr := m.UpdateAccess(keyID, acl...)
+	if updateErr != nil {
+		return nil, errF(knox.InternalServerErrorCode, updateErr.Error())
+	}
+	recordEvent(principal, knox.AuditEvent{
+		Type:   knox.UpdateAccessEvent,
+		KeyID:  keyID,
+		OldACL: key.ACL,
+		NewACL: updatedACL(key.ACL, acl),
+	})
+	return nil, nil
+}
+
+// accessChanges reads the ACL changes for an access route. access holds a
+// single change as JSON or base64 encoded JSON, and acl a JSON list of them.
+func accessChanges(parameters map[string]string) (knox.ACL, *httpError) {
+	accessStr, accessOK := parameters["access"]
+	aclStr, aclOK := parameters["acl"]
+
+	acl := []knox.Access{}
+	if accessOK {
+		access := knox.Access{}
+		// If JSON decode fails, try a base64 encoded JSON string (both options are around for backwards compatibility)
+		jsonErr := json.Unmarshal([]byte(accessStr), &access)
+		if jsonErr != nil {
+			decodedData, decodeErr := base64.RawURLEncoding.DecodeString(accessStr)
+			if decodeErr != nil {
+				return nil, errF(knox.BadRequestDataCode, decodeErr.Error())
+			}
+			jsonErr := json.Unmarshal(decodedData, &access)
+			if jsonErr != nil {
+				return nil, errF(knox.BadRequestDataCode, jsonErr.Error())
+			}
+		}
+		acl = append(acl, access)
+	} else if aclOK {
 		jsonErr := json.Unmarshal([]byte(aclStr), &acl)
 		if jsonErr != nil {
 			return nil, errF(knox.BadRequestDataCode, jsonErr.Error())
@@ -300,6 +911,76 @@ func putAccessHandler(m KeyManager, principal knox.Principal, parameters map[str
 	} else {
 		return nil, errF(knox.BadRequestDataCode, "Missing acl and access parameters")
 	}
+	return acl, nil
+}
+
+// validateAccessChanges checks the principals and expiries of ACL changes.
+func validateAccessChanges(acl knox.ACL) *httpError {
+	for _, access := range acl {
+		// If access type change is not "None" (i.e. we're adding, not deleting, an ACL entry) then
+		// we apply validation on the ID string to make sure it conforms to the expectations of the
+		// particular principal type. We do this to block empty machines prefixes and other invalid
+		// or bad entries.
+		if access.AccessType != knox.None {
+			principalErr := access.Type.IsValidPrincipal(access.ID, extraPrincipalValidators)
+			if principalErr != nil {
+				return errF(knox.BadPrincipalIdentifier, principalErr.Error())
+			}
+		}
+		if access.Expires < 0 {
+			return errF(knox.BadRequestDataCode, knox.ErrACLInvalidExpiry.Error())
+		}
+	}
+	return nil
+}
+
+// updatedACL returns the ACL that results from applying the changes to acl.
+func updatedACL(acl knox.ACL, changes knox.ACL) knox.ACL {
+	newACL := append(knox.ACL{}, acl...)
+	for _, access := range changes {
+		newACL = newACL.Add(access)
+	}
+	return newACL.Prune(time.Now())
+}
+
+// getMetadataHandler gets the metadata for a specific Key.
+// The route for this handler is GET /v0/keys/<key_id>/metadata/
+func getMetadataHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *httpError) {
+	keyID := parameters["keyID"]
+
+	// Get the key
+	key, getErr := m.GetKey(keyID, knox.Primary)
+	if getErr != nil {
+		if getErr == knox.ErrKeyIDNotFound {
+			return nil, errF(knox.KeyIdentifierDoesNotExistCode, fmt.Sprintf("No such key %s", keyID))
+		}
+		return nil, errF(knox.InternalServerErrorCode, getErr.Error())
+	}
+
+	// NO authorization on purpose
+	// metadata is not secret, like the ACL
+
+	if key.Metadata == nil {
+		return knox.KeyMetadata{}, nil
+	}
+	return key.Metadata, nil
+}
+
+// putMetadataHandler replaces the description, team, and tags of a key.
+// The route for this handler is PUT /v0/keys/<key_id>/metadata/
+// The principal needs Admin access.
+func putMetadataHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *httpError) {
+	keyID := parameters["keyID"]
+
+	metadataStr, metadataOK := parameters["metadata"]
+	if !metadataOK {
+		return nil, errF(knox.BadRequestDataCode, "Missing parameter 'metadata'")
+	}
+	var metadata knox.KeyMetadata
+	jsonErr := json.Unmarshal([]byte(metadataStr), &metadata)
+	if jsonErr != nil {
+		return nil, errF(knox.BadRequestDataCode, jsonErr.Error())
+	}
 
 	// Get the Key
 	key, getErr := m.GetKey(keyID, knox.Primary)
@@ -311,45 +992,297 @@ func putAccessHandler(m KeyManager, principal knox.Principal, parameters map[str
 	}
 
 	// Authorize
-	if !principal.CanAccess(key.ACL, knox.Admin) {
-		return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Principal %s not authorized to update access for %s", principal.GetID(), keyID))
+	if !principal.CanAccess(key.EffectiveACL(), knox.Admin) {
+		return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Principal %s not authorized to update metadata for %s", principal.GetID(), keyID))
 	}
 
-	for _, access := range acl {
-		// If access type change is not "None" (i.e. we're adding, not deleting, an ACL entry) then
-		// we apply validation on the ID string to make sure it conforms to the expectations of the
-		// particular principal type. We do this to block empty machines prefixes and other invalid
-		// or bad entries.
-		if access.AccessType != knox.None {
-			principalErr := access.Type.IsValidPrincipal(access.ID, extraPrincipalValidators)
-			if principalErr != nil {
-				return nil, errF(knox.BadPrincipalIdentifier, principalErr.Error())
-			}
+	updateErr := m.UpdateMetadata(keyID, metadata)
+	switch updateErr {
+	case nil:
+	case knox.ErrMetadataTooLarge, knox.ErrInvalidTag:
+		return nil, errF(knox.BadRequestDataCode, updateErr.Error())
+	default:
+		return nil, errF(knox.InternalServerErrorCode, updateErr.Error())
+	}
+	recordEvent(principal, knox.AuditEvent{
+		Type:  knox.UpdateMetadataEvent,
+		KeyID: keyID,
+	})
+	return nil, nil
+}
+
+// getPolicyHandler gets the policy for a specific Key.
+// The route for this handler is GET /v0/keys/<key_id>/policy/
+func getPolicyHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *httpError) {
+	keyID := parameters["keyID"]
+
+	// Get the key
+	key, getErr := m.GetKey(keyID, knox.Primary)
+	if getErr != nil {
+		if getErr == knox.ErrKeyIDNotFound {
+			return nil, errF(knox.KeyIdentifierDoesNotExistCode, fmt.Sprintf("No such key %s", keyID))
 		}
+		return nil, errF(knox.InternalServerErrorCode, getErr.Error())
 	}
 
-	// Update Access
-	updateErr := m.UpdateAccess(keyID, acl...)
+	// NO authorization on purpose
+	// the policy is not secret, like the ACL
+
+	if key.Policy == nil {
+		return knox.KeyPolicy{}, nil
+	}
+	return key.Policy, nil
+}
+
+// putPolicyHandler replaces the policy of a key, including its rotation
+// policy. Turning on approval takes effect immediately, but any change to a
+// policy that already requires approval creates an approval request instead.
+// The route for this handler is PUT /v0/keys/<key_id>/policy/
+// The principal needs Admin access.
+func putPolicyHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *httpError) {
+	keyID := parameters["keyID"]
+
+	policyStr, policyOK := parameters["policy"]
+	if !policyOK {
+		return nil, errF(knox.BadRequestDataCode, "Missing parameter 'policy'")
+	}
+	var policy knox.KeyPolicy
+	jsonErr := json.Unmarshal([]byte(policyStr), &policy)
+	if jsonErr != nil {
+		return nil, errF(knox.BadRequestDataCode, jsonErr.Error())
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, errF(knox.BadRequestDataCode, err.Error())
+	}
+
+	// Get the Key
+	key, getErr := m.GetKey(keyID, knox.Primary)
+	if getErr != nil {
+		if getErr == knox.ErrKeyIDNotFound {
+			return nil, errF(knox.KeyIdentifierDoesNotExistCode, fmt.Sprintf("No such key %s", keyID))
+		}
+		return nil, errF(knox.InternalServerErrorCode, getErr.Error())
+	}
+
+	// Authorize
+	if !principal.CanAccess(key.EffectiveACL(), knox.Admin) {
+		return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Principal %s not authorized to update policy for %s", principal.GetID(), keyID))
+	}
+
+	if requiresApproval(key) {
+		r, err := newApprovalRequest(keyID, knox.UpdatePolicyOperation, principal)
+		if err != nil {
+			return nil, errF(knox.InternalServerErrorCode, err.Error())
+		}
+		r.Policy = &policy
+		return nil, requestApproval(m, principal, &r)
+	}
+
+	updateErr := m.SetPolicy(keyID, policy)
 	if updateErr != nil {
 		return nil, errF(knox.InternalServerErrorCode, updateErr.Error())
 	}
+	recordEvent(principal, knox.AuditEvent{
+		Type:  knox.UpdatePolicyEvent,
+		KeyID: keyID,
+	})
+	return nil, nil
+}
+
+// requiresApproval reports whether changes to the key need a second Admin.
+func requiresApproval(key *knox.Key) bool {
+	return key.Policy != nil && key.Policy.RequireApproval
+}
+
+// requestApproval stores an approval request and returns the error telling
+// the client that the change is pending.
+func requestApproval(m KeyManager, principal knox.Principal, r *knox.ApprovalRequest) *httpError {
+	err := m.AddApprovalRequest(r)
+	if err != nil {
+		if err == knox.ErrKeyIDNotFound {
+			return errF(knox.KeyIdentifierDoesNotExistCode, fmt.Sprintf("No such key %s", r.KeyID))
+		}
+		return errF(knox.InternalServerErrorCode, err.Error())
+	}
+	recordEvent(principal, knox.AuditEvent{
+		Type:      knox.RequestApprovalEvent,
+		KeyID:     r.KeyID,
+		NewACL:    r.ACL,
+		RequestID: r.ID,
+	})
+	return errF(knox.ApprovalPendingCode, fmt.Sprintf("Key %s requires approval from another admin. Request %s is pending", r.KeyID, r.ID))
+}
+
+// getRequestsHandler lists the pending approval requests for a key.
+// The route for this handler is GET /v0/keys/<key_id>/requests/
+// The principal needs Admin access.
+func getRequestsHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *httpError) {
+	keyID := parameters["keyID"]
+
+	key, requests, err := getApprovalRequests(m, keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Authorize
+	if !principal.CanAccess(key.EffectiveACL(), knox.Admin) {
+		return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Principal %s not authorized to list requests for %s", principal.GetID(), keyID))
+	}
+	return requests, nil
+}
+
+// approveRequestHandler carries out a pending approval request.
+// The route for this handler is POST /v0/keys/<key_id>/requests/<request_id>/approve/
+// The principal needs Admin access and must not be the requester.
+func approveRequestHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *httpError) {
+	keyID := parameters["keyID"]
+	requestID := parameters["requestID"]
+
+	key, requests, err := getApprovalRequests(m, keyID)
+	if err != nil {
+		return nil, err
+	}
+	r, err := findApprovalRequest(requests, keyID, requestID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Authorize
+	if !principal.CanAccess(key.EffectiveACL(), knox.Admin) {
+		return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Principal %s not authorized to approve requests for %s", principal.GetID(), keyID))
+	}
+	if isPrincipal(principal, r.RequestedBy) {
+		return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Request %s must be approved by an admin other than %s", requestID, r.RequestedBy))
+	}
+
+	approved, approveErr := m.ApproveRequest(keyID, requestID)
+	switch approveErr {
+	case nil:
+	case knox.ErrKeyIDNotFound:
+		return nil, errF(knox.KeyIdentifierDoesNotExistCode, fmt.Sprintf("No such key %s", keyID))
+	case knox.ErrApprovalRequestNotFound:
+		return nil, errF(knox.ApprovalRequestDoesNotExistCode, fmt.Sprintf("No such request %s for key %s", requestID, keyID))
+	default:
+		return nil, errF(knox.InternalServerErrorCode, approveErr.Error())
+	}
+
+	e := knox.AuditEvent{
+		KeyID:     keyID,
+		OldACL:    key.ACL,
+		RequestID: requestID,
+	}
+	switch approved.Operation {
+	case knox.DeleteKeyOperation:
+		e.Type = knox.DeleteKeyEvent
+	case knox.UpdateAccessOperation:
+		e.Type = knox.UpdateAccessEvent
+		e.NewACL = updatedACL(key.ACL, approved.ACL)
+	case knox.UpdatePolicyOperation:
+		e.Type = knox.UpdatePolicyEvent
+		e.OldACL = nil
+	}
+	recordEvent(principal, e)
 	return nil, nil
 }
 
+// rejectRequestHandler discards a pending approval request.
+// The route for this handler is POST /v0/keys/<key_id>/requests/<request_id>/reject/
+// The principal needs Admin access or must be the requester.
+func rejectRequestHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *httpError) {
+	keyID := parameters["keyID"]
+	requestID := parameters["requestID"]
+
+	key, requests, err := getApprovalRequests(m, keyID)
+	if err != nil {
+		return nil, err
+	}
+	r, err := findApprovalRequest(requests, keyID, requestID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Authorize
+	if !principal.CanAccess(key.EffectiveACL(), knox.Admin) && !isPrincipal(principal, r.RequestedBy) {
+		return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Principal %s not authorized to reject requests for %s", principal.GetID(), keyID))
+	}
+
+	_, rejectErr := m.RejectRequest(keyID, requestID)
+	switch rejectErr {
+	case nil:
+	case knox.ErrKeyIDNotFound:
+		return nil, errF(knox.KeyIdentifierDoesNotExistCode, fmt.Sprintf("No such key %s", keyID))
+	case knox.ErrApprovalRequestNotFound:
+		return nil, errF(knox.ApprovalRequestDoesNotExistCode, fmt.Sprintf("No such request %s for key %s", requestID, keyID))
+	default:
+		return nil, errF(knox.InternalServerErrorCode, rejectErr.Error())
+	}
+	recordEvent(principal, knox.AuditEvent{
+		Type:      knox.RejectRequestEvent,
+		KeyID:     keyID,
+		RequestID: requestID,
+	})
+	return nil, nil
+}
+
+// getApprovalRequests returns a key along with its pending approval requests.
+func getApprovalRequests(m KeyManager, keyID string) (*knox.Key, []knox.ApprovalRequest, *httpError) {
+	key, getErr := m.GetKey(keyID, knox.Primary)
+	if getErr == nil {
+		requests, err := m.GetApprovalRequests(keyID)
+		if err == nil {
+			return key, requests, nil
+		}
+		getErr = err
+	}
+	if getErr == knox.ErrKeyIDNotFound {
+		return nil, nil, errF(knox.KeyIdentifierDoesNotExistCode, fmt.Sprintf("No such key %s", keyID))
+	}
+	return nil, nil, errF(knox.InternalServerErrorCode, getErr.Error())
+}
+
+func findApprovalRequest(requests []knox.ApprovalRequest, keyID, requestID string) (*knox.ApprovalRequest, *httpError) {
+	for i := range requests {
+		if requests[i].ID == requestID {
+			return &requests[i], nil
+		}
+	}
+	return nil, errF(knox.ApprovalRequestDoesNotExistCode, fmt.Sprintf("No such request %s for key %s", requestID, keyID))
+}
+
+// isPrincipal reports whether id is any of the principal's identities.
+func isPrincipal(principal knox.Principal, id string) bool {
+	if principal.GetID() == id {
+		return true
+	}
+	if mux, ok := principal.(knox.PrincipalMux); ok {
+		for _, pid := range mux.GetIDs() {
+			if pid == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // postVersionHandler creates a new key version. This version is immediately
-// added as an Active key.
+// added as an Active key. Like postKeysHandler, it takes either base64 encoded
+// data or a JSON encoded GeneratorSpec in generate.
 // The route for this handler is PUT /v0/keys/<key_id>/versions/
 // The principal needs Write access.
 func postVersionHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *httpError) {
 
 	keyID := parameters["keyID"]
 	dataStr, dataOK := parameters["data"]
-	if !dataOK {
+	genStr, genOK := parameters["generate"]
+	if !dataOK && !genOK {
 		return nil, errF(knox.BadRequestDataCode, "Missing parameter 'data'")
 	}
-	decodedData, decodeErr := base64.StdEncoding.DecodeString(dataStr)
-	if decodeErr != nil {
-		return nil, errF(knox.BadRequestDataCode, decodeErr.Error())
+	if dataOK && genOK {
+		return nil, errF(knox.BadRequestDataCode, "Only one of 'data' and 'generate' may be set")
+	}
+	decodedData, dataErr := keyData(dataStr, genStr, genOK)
+	if dataErr != nil {
+		return nil, dataErr
 	}
 
 	// Get the key
@@ -362,7 +1295,7 @@ func postVersionHandler(m KeyManager, principal knox.Principal, parameters map[s
 	}
 
 	// Authorize
-	if !principal.CanAccess(key.ACL, knox.Write) {
+	if !principal.CanAccess(key.EffectiveACL(), knox.Write) {
 		return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Principal %s not authorized to write %s", principal.GetID(), keyID))
 	}
 
@@ -374,6 +1307,12 @@ func postVersionHandler(m KeyManager, principal knox.Principal, parameters map[s
 	if err != nil {
 		return nil, errF(knox.InternalServerErrorCode, err.Error())
 	}
+	recordEvent(principal, knox.AuditEvent{
+		Type:       knox.AddVersionEvent,
+		KeyID:      keyID,
+		VersionIDs: []uint64{version.ID},
+		NewStatus:  &version.Status,
+	})
 	return version.ID, nil
 }
 
@@ -415,14 +1354,37 @@ func putVersionsHandler(m KeyManager, principal knox.Principal, parameters map[s
 	}
 
 	// Authorize
-	if !principal.CanAccess(key.ACL, knox.Write) {
+	if !principal.CanAccess(key.EffectiveACL(), knox.Write) {
 		return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Principal %s not authorized to write %s", principal.GetID(), keyID))
 	}
 
+	var oldStatus *knox.VersionStatus
+	for _, v := range key.VersionList {
+		if v.ID == id {
+			s := v.Status
+			oldStatus = &s
+		}
+	}
+
 	err := m.UpdateVersion(keyID, id, status)
 
 	switch err {
 	case nil:
+		e := knox.AuditEvent{
+			KeyID:      keyID,
+			VersionIDs: []uint64{id},
+			OldStatus:  oldStatus,
+			NewStatus:  &status,
+		}
+		switch status {
+		case knox.Primary:
+			e.Type = knox.PromoteVersionEvent
+		case knox.Inactive:
+			e.Type = knox.DeactivateVersionEvent
+		default:
+			e.Type = knox.ReactivateVersionEvent
+		}
+		recordEvent(principal, e)
 		return nil, nil
 	case knox.ErrKeyVersionNotFound:
 		return nil, errF(knox.KeyVersionDoesNotExistCode, err.Error())
@@ -432,3 +1394,540 @@ func putVersionsHandler(m KeyManager, principal knox.Principal, parameters map[s
 		return nil, errF(knox.InternalServerErrorCode, err.Error())
 	}
 }
+
+// Default and maximum page sizes for getHistoryHandler.
+const (
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 1000
+)
+
+// historyTypes are the event types returned by getHistoryHandler by default.
+var historyTypes = []knox.AuditEventType{
+	knox.CreateKeyEvent,
+	knox.AddVersionEvent,
+	knox.PromoteVersionEvent,
+	knox.DeactivateVersionEvent,
+	knox.ReactivateVersionEvent,
+	knox.UpdateAccessEvent,
+	knox.UpdateMetadataEvent,
+	knox.DeleteKeyEvent,
+	knox.RestoreKeyEvent,
+	knox.PurgeKeyEvent,
+	knox.UpdatePolicyEvent,
+	knox.RequestApprovalEvent,
+	knox.RejectRequestEvent,
+	knox.IntegrityFailureEvent,
+}
+
+// getHistoryHandler returns a page of the audit history of a key in time order.
+// The type parameter is a comma separated list of event types to return. By
+// default every event except reads is returned. since and until are
+// timestamps in nanoseconds and cursor continues from a previous page.
+// The route for this handler is GET /v0/keys/<key_id>/history/
+// The principal needs Admin access. For keys that no longer exist, the last
+// ACL recorded in the history is used instead.
+func getHistoryHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *httpError) {
+	if auditLogger == nil {
+		return nil, errF(knox.NotYetImplementedCode, "Audit logging is not enabled")
+	}
+	keyID := parameters["keyID"]
+
+	q := audit.Query{KeyID: keyID, Types: historyTypes}
+	var intErr error
+	if cursor, ok := parameters["cursor"]; ok && cursor != "" {
+		q.After, intErr = strconv.ParseUint(cursor, 10, 64)
+	}
+	if since, ok := parameters["since"]; ok && intErr == nil {
+		q.Since, intErr = strconv.ParseInt(since, 10, 64)
+	}
+	if until, ok := parameters["until"]; ok && intErr == nil {
+		q.Until, intErr = strconv.ParseInt(until, 10, 64)
+	}
+	limit := defaultHistoryLimit
+	if limitStr, ok := parameters["limit"]; ok && intErr == nil {
+		limit, intErr = strconv.Atoi(limitStr)
+		if intErr == nil && (limit <= 0 || limit > maxHistoryLimit) {
+			return nil, errF(knox.BadRequestDataCode, fmt.Sprintf("limit must be between 1 and %d", maxHistoryLimit))
+		}
+	}
+	if intErr != nil {
+		return nil, errF(knox.BadRequestDataCode, intErr.Error())
+	}
+	if typeStr, ok := parameters["type"]; ok && typeStr != "" {
+		q.Types = nil
+		for _, t := range strings.Split(typeStr, ",") {
+			eventType := knox.AuditEventType(t)
+			if eventType != knox.ReadKeyEvent && !containsEventType(historyTypes, eventType) {
+				return nil, errF(knox.BadRequestDataCode, fmt.Sprintf("Unknown event type %s", t))
+			}
+			q.Types = append(q.Types, eventType)
+		}
+	}
+
+	acl, aclErr := historyACL(m, keyID)
+	if aclErr != nil {
+		return nil, aclErr
+	}
+
+	// Authorize
+	if !principal.CanAccess(acl, knox.Admin) {
+		return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Principal %s not authorized to read history of %s", principal.GetID(), keyID))
+	}
+
+	// Ask for one more event than needed to find out if there is another page.
+	q.Limit = limit + 1
+	events, err := auditLogger.Query(q)
+	if err != nil {
+		return nil, errF(knox.InternalServerErrorCode, err.Error())
+	}
+	page := knox.AuditEventPage{Events: events}
+	if len(events) > limit {
+		page.Events = events[:limit]
+		page.Cursor = strconv.FormatUint(events[limit-1].Sequence, 10)
+	}
+	return page, nil
+}
+
+// historyACL returns the ACL that governs access to a key's history. This is
+// the current ACL, the ACL at deletion for keys that have not been purged, or
+// the last recorded one otherwise, along with the ACL the key inherits from
+// its namespaces.
+func historyACL(m KeyManager, keyID string) (knox.ACL, *httpError) {
+	key, getErr := m.GetKey(keyID, knox.Primary)
+	if getErr == nil {
+		return key.EffectiveACL(), nil
+	}
+	if getErr != knox.ErrKeyIDNotFound {
+		return nil, errF(knox.InternalServerErrorCode, getErr.Error())
+	}
+	if deleted, err := m.GetDeletedKey(keyID); err == nil {
+		return deleted.EffectiveACL(), nil
+	}
+	inherited, nsErr := namespaceACL(m, keyID)
+	if nsErr != nil {
+		return nil, nsErr
+	}
+	events, err := auditLogger.Query(audit.Query{
+		KeyID: keyID,
+		Types: []knox.AuditEventType{knox.CreateKeyEvent, knox.UpdateAccessEvent, knox.DeleteKeyEvent, knox.RestoreKeyEvent},
+	})
+	if err != nil {
+		return nil, errF(knox.InternalServerErrorCode, err.Error())
+	}
+	if len(events) > 0 {
+		last := events[len(events)-1]
+		if last.Type == knox.DeleteKeyEvent {
+			return append(inherited, last.OldACL...), nil
+		}
+		return append(inherited, last.NewACL...), nil
+	}
+	return nil, errF(knox.KeyIdentifierDoesNotExistCode, fmt.Sprintf("No such key %s", keyID))
+}
+
+func containsEventType(types []knox.AuditEventType, t knox.AuditEventType) bool {
+	for _, u := range types {
+		if u == t {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookKeyACL returns the ACL of the key a webhook is for, or nil for
+// webhooks on every key.
+func webhookKeyACL(m KeyManager, keyID string) (knox.ACL, *httpError) {
+	if keyID == "" {
+		return nil, nil
+	}
+	key, getErr := m.GetKey(keyID, knox.Primary)
+	if getErr != nil {
+		if getErr == knox.ErrKeyIDNotFound {
+			return nil, errF(knox.KeyIdentifierDoesNotExistCode, fmt.Sprintf("No such key %s", keyID))
+		}
+		return nil, errF(knox.InternalServerErrorCode, getErr.Error())
+	}
+	return key.EffectiveACL(), nil
+}
+
+// canManageWebhooks reports whether the principal can manage the webhooks of
+// a key with the given ACL. Webhooks on every key, given by a nil ACL, can
+// only be managed by admins through the default access list.
+func canManageWebhooks(principal knox.Principal, acl knox.ACL) bool {
+	if principal.CanAccess(knox.ACL(defaultAccess), knox.Admin) {
+		return true
+	}
+	return acl != nil && principal.CanAccess(acl, knox.Admin)
+}
+
+// authorizeWebhook checks that the webhook exists and the principal can
+// manage it. Webhooks on keys that no longer exist can only be managed by
+// admins through the default access list.
+func authorizeWebhook(m KeyManager, principal knox.Principal, id string) *httpError {
+	hook, err := webhooks.Get(id)
+	if err == knox.ErrWebhookNotFound {
+		return errF(knox.WebhookDoesNotExistCode, fmt.Sprintf("No such webhook %s", id))
+	}
+	if err != nil {
+		return errF(knox.InternalServerErrorCode, err.Error())
+	}
+	acl, aclErr := webhookKeyACL(m, hook.KeyID)
+	if aclErr != nil && aclErr.Subcode != knox.KeyIdentifierDoesNotExistCode {
+		return aclErr
+	}
+	if !canManageWebhooks(principal, acl) {
+		return errF(knox.UnauthorizedCode, fmt.Sprintf("Principal %s not authorized to manage webhook %s", principal.GetID(), id))
+	}
+	return nil
+}
+
+// getWebhooksHandler lists webhooks without their secrets. If key is set,
+// only the webhooks for that key are listed.
+// The route for this handler is GET /v0/webhooks/
+// The principal needs Admin access to the key, or admin access through the
+// default access list to list every webhook.
+func getWebhooksHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *httpError) {
+	if webhooks == nil {
+		return nil, errF(knox.NotYetImplementedCode, "Webhooks are not enabled")
+	}
+	keyID := parameters["key"]
+	acl, aclErr := webhookKeyACL(m, keyID)
+	if aclErr != nil {
+		return nil, aclErr
+	}
+
+	// Authorize
+	if !canManageWebhooks(principal, acl) {
+		return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Principal %s not authorized to list webhooks", principal.GetID()))
+	}
+
+	hooks, err := webhooks.List()
+	if err != nil {
+		return nil, errF(knox.InternalServerErrorCode, err.Error())
+	}
+	listed := []knox.Webhook{}
+	for _, hook := range hooks {
+		if keyID == "" || hook.KeyID == keyID {
+			hook.Secret = ""
+			listed = append(listed, hook)
+		}
+	}
+	return listed, nil
+}
+
+// postWebhookHandler creates a webhook from the JSON encoded webhook. Only
+// its URL, KeyID, Tags and Events are used. The created webhook is returned
+// with the secret its deliveries are signed with, which is not returned
+// again.
+// The route for this handler is POST /v0/webhooks/
+// The principal needs Admin access to the key, or admin access through the
+// default access list for webhooks on every key.
+func postWebhookHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *httpError) {
+	if webhooks == nil {
+		return nil, errF(knox.NotYetImplementedCode, "Webhooks are not enabled")
+	}
+	hookStr, hookOK := parameters["webhook"]
+	if !hookOK {
+		return nil, errF(knox.BadRequestDataCode, "Missing parameter 'webhook'")
+	}
+	var req knox.Webhook
+	if err := json.Unmarshal([]byte(hookStr), &req); err != nil {
+		return nil, errF(knox.BadRequestDataCode, err.Error())
+	}
+	hook := knox.Webhook{
+		URL:       req.URL,
+		KeyID:     req.KeyID,
+		Tags:      req.Tags,
+		Events:    req.Events,
+		CreatedBy: principal.GetID(),
+	}
+	if err := hook.Validate(); err != nil {
+		return nil, errF(knox.BadRequestDataCode, err.Error())
+	}
+	acl, aclErr := webhookKeyACL(m, hook.KeyID)
+	if aclErr != nil {
+		return nil, aclErr
+	}
+
+	// Authorize
+	if !canManageWebhooks(principal, acl) {
+		return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Principal %s not authorized to create webhook", principal.GetID()))
+	}
+
+	if err := webhooks.Create(&hook); err != nil {
+		return nil, errF(knox.InternalServerErrorCode, err.Error())
+	}
+	log.Printf("Webhook %s for %s created by %s", hook.ID, hook.URL, principal.GetID())
+	return hook, nil
+}
+
+// deleteWebhookHandler removes a webhook and its dead letters.
+// The route for this handler is DELETE /v0/webhooks/<webhook_id>/
+// The principal needs the same access as to create the webhook.
+func deleteWebhookHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *httpError) {
+	if webhooks == nil {
+		return nil, errF(knox.NotYetImplementedCode, "Webhooks are not enabled")
+	}
+	id := parameters["webhookID"]
+	if authErr := authorizeWebhook(m, principal, id); authErr != nil {
+		return nil, authErr
+	}
+	err := webhooks.Remove(id)
+	if err == knox.ErrWebhookNotFound {
+		return nil, errF(knox.WebhookDoesNotExistCode, fmt.Sprintf("No such webhook %s", id))
+	}
+	if err != nil {
+		return nil, errF(knox.InternalServerErrorCode, err.Error())
+	}
+	log.Printf("Webhook %s deleted by %s", id, principal.GetID())
+	return nil, nil
+}
+
+// getDeadLettersHandler returns the events that could not be delivered to a
+// webhook, oldest first.
+// The route for this handler is GET /v0/webhooks/<webhook_id>/deadletters/
+// The principal needs the same access as to create the webhook.
+func getDeadLettersHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *httpError) {
+	if webhooks == nil {
+		return nil, errF(knox.NotYetImplementedCode, "Webhooks are not enabled")
+	}
+	id := parameters["webhookID"]
+	if authErr := authorizeWebhook(m, principal, id); authErr != nil {
+		return nil, authErr
+	}
+	letters, err := webhooks.DeadLetters(id)
+	if err == knox.ErrWebhookNotFound {
+		return nil, errF(knox.WebhookDoesNotExistCode, fmt.Sprintf("No such webhook %s", id))
+	}
+	if err != nil {
+		return nil, errF(knox.InternalServerErrorCode, err.Error())
+	}
+	return letters, nil
+}
+
+// namespaceACL returns the ACL that a key ID or namespace prefix inherits
+// from the namespaces that contain it, or nil if none do.
+func namespaceACL(m KeyManager, id string) (knox.ACL, *httpError) {
+	parents, err := m.ParentNamespaces(id)
+	if err != nil {
+		return nil, errF(knox.InternalServerErrorCode, err.Error())
+	}
+	if len(parents) == 0 {
+		return nil, nil
+	}
+	acl := knox.ACL{}
+	for _, n := range parents {
+		acl = append(acl, n.ACL...)
+	}
+	return acl, nil
+}
+
+// grantsAccess reports whether any of the access changes gives access rather
+// than removing it.
+func grantsAccess(acl knox.ACL) bool {
+	for _, a := range acl {
+		if a.AccessType != knox.None {
+			return true
+		}
+	}
+	return false
+}
+
+// canManageNamespace reports whether the principal can change or delete a
+// namespace with the given ACL. Admins of a namespace manage it and the
+// namespaces nested in it. Top level namespaces can only be created by admins
+// through the default access list.
+func canManageNamespace(principal knox.Principal, acl, inherited knox.ACL) bool {
+	if principal.CanAccess(knox.ACL(defaultAccess), knox.Admin) {
+		return true
+	}
+	return principal.CanAccess(acl, knox.Admin) || principal.CanAccess(inherited, knox.Admin)
+}
+
+// namespaceError converts an error from a namespace operation.
+func namespaceError(err error, prefix string) *httpError {
+	switch err {
+	case keydb.ErrNoNamespaces:
+		return errF(knox.NotYetImplementedCode, "Namespaces are not supported by this server's DB")
+	case knox.ErrNamespaceNotFound:
+		return errF(knox.NamespaceDoesNotExistCode, fmt.Sprintf("No such namespace %s", prefix))
+	default:
+		return errF(knox.InternalServerErrorCode, err.Error())
+	}
+}
+
+// getNamespacesHandler lists every namespace with its ACL, ordered by prefix.
+// The route for this handler is GET /v0/namespaces/
+// There are no authorization constraints on this route, since ACLs are not secret.
+func getNamespacesHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *httpError) {
+	namespaces, err := m.GetNamespaces()
+	if err != nil {
+		return nil, namespaceError(err, "")
+	}
+	return namespaces, nil
+}
+
+// getNamespaceHandler gets the namespace with the prefix.
+// The route for this handler is GET /v0/namespaces/<prefix>/
+// There are no authorization constraints on this route, since ACLs are not secret.
+func getNamespaceHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *httpError) {
+	prefix := parameters["prefix"]
+	n, err := m.GetNamespace(prefix)
+	if err != nil {
+		return nil, namespaceError(err, prefix)
+	}
+	return n, nil
+}
+
+// putNamespaceAccessHandler adds or updates entries in the ACL of the
+// namespace with the prefix, like putAccessHandler does for keys, creating
+// the namespace if it does not exist. Every key whose ID starts with the
+// prefix inherits the ACL, so access cannot be granted while any of them has
+// a policy that requires approval; it can only be removed.
+// The route for this handler is PUT /v0/namespaces/<prefix>/
+// The principal needs Admin access to the namespace or a namespace it is
+// nested in, or admin access through the default access list.
+func putNamespaceAccessHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *httpError) {
+	prefix := parameters["prefix"]
+	if err := (knox.Namespace{Prefix: prefix}).Validate(); err != nil {
+		return nil, errF(knox.BadKeyFormatCode, err.Error())
+	}
+	acl, aclErr := accessChanges(parameters)
+	if aclErr != nil {
+		return nil, aclErr
+	}
+
+	var oldACL knox.ACL
+	n, err := m.GetNamespace(prefix)
+	if err == nil {
+		oldACL = n.ACL
+	} else if err != knox.ErrNamespaceNotFound {
+		return nil, namespaceError(err, prefix)
+	}
+	inherited, nsErr := namespaceACL(m, prefix)
+	if nsErr != nil {
+		return nil, nsErr
+	}
+
+	// Authorize
+	if !canManageNamespace(principal, oldACL, inherited) {
+		return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Principal %s not authorized to update access for namespace %s", principal.GetID(), prefix))
+	}
+
+	if validErr := validateAccessChanges(acl); validErr != nil {
+		return nil, validErr
+	}
+	if grantsAccess(acl) {
+		// Keys that require approval would otherwise get new access from the
+		// namespace without a second admin.
+		ids, err := m.SearchKeyIDs(KeyQuery{Prefix: prefix, RequireApproval: true, Limit: 1})
+		if err != nil {
+			return nil, errF(knox.InternalServerErrorCode, err.Error())
+		}
+		if len(ids) > 0 {
+			return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Key %s in namespace %s requires approval for access changes; grant access on its keys instead", ids[0], prefix))
+		}
+	}
+	if err := m.UpdateNamespaceAccess(prefix, acl...); err != nil {
+		return nil, namespaceError(err, prefix)
+	}
+	recordEvent(principal, knox.AuditEvent{
+		Type:   knox.UpdateNamespaceEvent,
+		KeyID:  prefix,
+		OldACL: oldACL,
+		NewACL: updatedACL(oldACL, acl),
+	})
+	return nil, nil
+}
+
+// deleteNamespaceHandler removes the namespace with the prefix. Keys in it
+// keep their own ACLs but no longer inherit the namespace's.
+// The route for this handler is DELETE /v0/namespaces/<prefix>/
+// The principal needs the same access as to update the namespace.
+func deleteNamespaceHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *httpError) {
+	prefix := parameters["prefix"]
+	n, err := m.GetNamespace(prefix)
+	if err != nil {
+		return nil, namespaceError(err, prefix)
+	}
+	inherited, nsErr := namespaceACL(m, prefix)
+	if nsErr != nil {
+		return nil, nsErr
+	}
+
+	// Authorize
+	if !canManageNamespace(principal, n.ACL, inherited) {
+		return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Principal %s not authorized to delete namespace %s", principal.GetID(), prefix))
+	}
+
+	if err := m.DeleteNamespace(prefix); err != nil {
+		return nil, namespaceError(err, prefix)
+	}
+	recordEvent(principal, knox.AuditEvent{
+		Type:   knox.DeleteNamespaceEvent,
+		KeyID:  prefix,
+		OldACL: n.ACL,
+	})
+	return nil, nil
+}
+
+// healthHandler reports whether the server is sealed.
+// The route for this handler is GET /v0/health/
+func healthHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *httpError) {
+	if sealer == nil {
+		return knox.SealStatus{}, nil
+	}
+	return sealer.Status(), nil
+}
+
+// unsealHandler submits a share of the master secret to a sealed server.
+// The route for this handler is POST /v0/unseal/
+// The share is base64 encoded.
+// It requires admin access through the default access list or being an
+// unseal operator.
+func unsealHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *httpError) {
+	if sealer == nil {
+		return nil, errF(knox.NotYetImplementedCode, "Server does not support sealing")
+	}
+	if !principal.CanAccess(knox.ACL(defaultAccess), knox.Admin) && !principal.CanAccess(knox.ACL(unsealOperators), knox.Read) {
+		return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Principal %s not authorized to unseal the server", principal.GetID()))
+	}
+	shareStr, ok := parameters["share"]
+	if !ok {
+		return nil, errF(knox.BadRequestDataCode, "Missing parameter 'share'")
+	}
+	share, err := base64.StdEncoding.DecodeString(shareStr)
+	if err != nil {
+		return nil, errF(knox.BadRequestDataCode, fmt.Sprintf("Share is not base64 encoded: %s", err.Error()))
+	}
+	status, err := sealer.Unseal(share)
+	switch err {
+	case nil:
+	case ErrInvalidShare, ErrDuplicateShare:
+		log.Printf("Unseal share from %s rejected: %s", principal.GetID(), err.Error())
+		return nil, errF(knox.BadRequestDataCode, err.Error())
+	default:
+		log.Printf("Unsealing failed after a share from %s, every share was discarded: %s", principal.GetID(), err.Error())
+		return nil, errF(knox.BadRequestDataCode, fmt.Sprintf("Unsealing failed and every submitted share was discarded: %s", err.Error()))
+	}
+	if !status.Sealed {
+		log.Printf("Server unsealed, last share submitted by %s", principal.GetID())
+	} else {
+		log.Printf("Unseal share submitted by %s, %d of %d", principal.GetID(), status.Progress, status.Threshold)
+	}
+	return status, nil
+}
+
+// sealHandler seals the server, discarding its master key.
+// The route for this handler is POST /v0/seal/
+// It requires admin access through the default access list.
+func sealHandler(m KeyManager, principal knox.Principal, parameters map[string]string) (interface{}, *httpError) {
+	if sealer == nil {
+		return nil, errF(knox.NotYetImplementedCode, "Server does not support sealing")
+	}
+	if !principal.CanAccess(knox.ACL(defaultAccess), knox.Admin) {
+		return nil, errF(knox.UnauthorizedCode, fmt.Sprintf("Principal %s not authorized to seal the server", principal.GetID()))
+	}
+	sealer.Seal()
+	log.Printf("Server sealed by %s", principal.GetID())
+	return sealer.Status(), nil
+}
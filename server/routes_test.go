@@ -3,9 +3,13 @@ package server
 import (
 	"encoding/json"
 	"fmt"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/audit"
 	"github.com/pinterest/knox/server/auth"
 	"github.com/pinterest/knox/server/keydb"
 )
@@ -84,6 +88,43 @@ func TestGetKeys(t *testing.T) {
 	}
 }
 
+func TestWatchKeys(t *testing.T) {
+	m, db := makeDB()
+	u := auth.NewUser("testuser", []string{})
+	_, err := postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ=="})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	for _, p := range []map[string]string{
+		{},
+		{"keys": "{}"},
+		{"keys": "a1=NOHASH"},
+		{"keys": `{"a1":"NOHASH"}`, "timeout": "0"},
+		{"keys": `{"a1":"NOHASH"}`, "timeout": "601"},
+		{"keys": `{"a1":"NOHASH"}`, "timeout": "soon"},
+	} {
+		_, err := watchKeysHandler(m, u, p)
+		if err == nil {
+			t.Fatalf("Expected err for %v", p)
+		}
+	}
+
+	i, err := watchKeysHandler(m, u, map[string]string{"keys": `{"a1":"NOHASH","a2":"NOHASH"}`, "timeout": "1"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if d := i.([]string); len(d) != 1 || d[0] != "a1" {
+		t.Fatalf("Expected [a1] not %v", d)
+	}
+
+	db.SetError(fmt.Errorf("Test Error!"))
+	_, err = watchKeysHandler(m, u, map[string]string{"keys": `{"a1":"NOHASH"}`})
+	if err == nil {
+		t.Fatal("Expected err")
+	}
+}
+
 func TestPostKeys(t *testing.T) {
 	m, db := makeDB()
 	machine := auth.NewMachine("MrRoboto")
@@ -598,3 +639,1048 @@ func TestPutVersions(t *testing.T) {
 	}
 
 }
+
+func TestAuditEvents(t *testing.T) {
+	m, _ := makeDB()
+	sink := audit.NewMemorySink()
+	l, lErr := audit.NewLogger(sink)
+	if lErr != nil {
+		t.Fatalf("%s is not nil", lErr)
+	}
+	SetAuditLogger(l)
+	defer SetAuditLogger(nil)
+
+	u := auth.NewUser("testuser", []string{})
+	machine := auth.NewMachine("MrRoboto")
+	i, err := postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ=="})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	_, err = putAccessHandler(m, u, map[string]string{"keyID": "a1", "access": `{"type":"Machine","id":"MrRoboto","access":"Read"}`})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	_, err = getKeyHandler(m, machine, map[string]string{"keyID": "a1"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	j, err := postVersionHandler(m, u, map[string]string{"keyID": "a1", "data": "Mg=="})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	_, err = putVersionsHandler(m, u, map[string]string{"keyID": "a1", "versionID": fmt.Sprintf("%d", j), "status": `"Primary"`})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	// Failed requests are not recorded.
+	_, err = deleteKeyHandler(m, machine, map[string]string{"keyID": "a1"})
+	if err == nil {
+		t.Fatal("Expected err")
+	}
+	_, err = deleteKeyHandler(m, u, map[string]string{"keyID": "a1"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	events := sink.Events()
+	expected := []knox.AuditEventType{
+		knox.CreateKeyEvent,
+		knox.UpdateAccessEvent,
+		knox.ReadKeyEvent,
+		knox.AddVersionEvent,
+		knox.PromoteVersionEvent,
+		knox.DeleteKeyEvent,
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("%d events does not equal %d", len(events), len(expected))
+	}
+	for n, e := range events {
+		if e.Type != expected[n] {
+			t.Fatalf("%s does not equal %s", e.Type, expected[n])
+		}
+		if e.KeyID != "a1" {
+			t.Fatalf("%s does not equal a1", e.KeyID)
+		}
+	}
+	if events[0].VersionIDs[0] != i.(uint64) || events[0].Principal != "testuser" {
+		t.Fatalf("unexpected create event %+v", events[0])
+	}
+	if len(events[1].OldACL) != 1 || len(events[1].NewACL) != 2 {
+		t.Fatalf("unexpected access event %+v", events[1])
+	}
+	if events[2].Principal != "MrRoboto" || events[2].AuthType != "machine" {
+		t.Fatalf("unexpected read event %+v", events[2])
+	}
+	if *events[4].OldStatus != knox.Active || *events[4].NewStatus != knox.Primary {
+		t.Fatalf("unexpected promote event %+v", events[4])
+	}
+	if err := audit.Verify(events); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+}
+
+func TestGetHistory(t *testing.T) {
+	m, _ := makeDB()
+	u := auth.NewUser("testuser", []string{})
+	machine := auth.NewMachine("MrRoboto")
+
+	_, err := getHistoryHandler(m, u, map[string]string{"keyID": "a1"})
+	if err == nil || err.Subcode != knox.NotYetImplementedCode {
+		t.Fatalf("Expected NotYetImplementedCode, got %+v", err)
+	}
+
+	l, lErr := audit.NewLogger(audit.NewMemorySink())
+	if lErr != nil {
+		t.Fatalf("%s is not nil", lErr)
+	}
+	SetAuditLogger(l)
+	defer SetAuditLogger(nil)
+
+	_, err = postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ=="})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	_, err = putAccessHandler(m, u, map[string]string{"keyID": "a1", "access": `{"type":"Machine","id":"MrRoboto","access":"Read"}`})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	_, err = getKeyHandler(m, machine, map[string]string{"keyID": "a1"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	_, err = postVersionHandler(m, u, map[string]string{"keyID": "a1", "data": "Mg=="})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	_, err = getHistoryHandler(m, machine, map[string]string{"keyID": "a1"})
+	if err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("Expected UnauthorizedCode, got %+v", err)
+	}
+	_, err = getHistoryHandler(m, u, map[string]string{"keyID": "a1", "limit": "0"})
+	if err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("Expected BadRequestDataCode, got %+v", err)
+	}
+	_, err = getHistoryHandler(m, u, map[string]string{"keyID": "a1", "type": "bogus"})
+	if err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("Expected BadRequestDataCode, got %+v", err)
+	}
+
+	// Reads are left out by default.
+	i, err := getHistoryHandler(m, u, map[string]string{"keyID": "a1"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	page := i.(knox.AuditEventPage)
+	if len(page.Events) != 3 || page.Cursor != "" {
+		t.Fatalf("unexpected page %+v", page)
+	}
+
+	// Page through the history one event at a time.
+	var types []knox.AuditEventType
+	params := map[string]string{"keyID": "a1", "limit": "1", "type": "create,read,add_version"}
+	for {
+		i, err = getHistoryHandler(m, u, params)
+		if err != nil {
+			t.Fatalf("%+v is not nil", err)
+		}
+		page = i.(knox.AuditEventPage)
+		for _, e := range page.Events {
+			types = append(types, e.Type)
+		}
+		if page.Cursor == "" {
+			break
+		}
+		params["cursor"] = page.Cursor
+	}
+	expected := []knox.AuditEventType{knox.CreateKeyEvent, knox.ReadKeyEvent, knox.AddVersionEvent}
+	if len(types) != len(expected) {
+		t.Fatalf("%v does not equal %v", types, expected)
+	}
+	for n := range types {
+		if types[n] != expected[n] {
+			t.Fatalf("%v does not equal %v", types, expected)
+		}
+	}
+
+	// After deletion the last ACL still governs the history.
+	_, err = deleteKeyHandler(m, u, map[string]string{"keyID": "a1"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	i, err = getHistoryHandler(m, u, map[string]string{"keyID": "a1"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	page = i.(knox.AuditEventPage)
+	if len(page.Events) != 4 || page.Events[3].Type != knox.DeleteKeyEvent {
+		t.Fatalf("unexpected page %+v", page)
+	}
+	_, err = getHistoryHandler(m, machine, map[string]string{"keyID": "a1"})
+	if err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("Expected UnauthorizedCode, got %+v", err)
+	}
+	_, err = getHistoryHandler(m, u, map[string]string{"keyID": "nope"})
+	if err == nil || err.Subcode != knox.KeyIdentifierDoesNotExistCode {
+		t.Fatalf("Expected KeyIdentifierDoesNotExistCode, got %+v", err)
+	}
+}
+
+func TestRestoreKey(t *testing.T) {
+	m, db := makeDB()
+	u := auth.NewUser("testuser", []string{})
+	machine := auth.NewMachine("MrRoboto")
+	_, err := postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ=="})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	_, err = restoreKeyHandler(m, u, map[string]string{"keyID": "a1"})
+	if err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("Expected BadRequestDataCode, got %+v", err)
+	}
+	_, err = restoreKeyHandler(m, u, map[string]string{"keyID": "NOTAKEY"})
+	if err == nil || err.Subcode != knox.KeyIdentifierDoesNotExistCode {
+		t.Fatalf("Expected KeyIdentifierDoesNotExistCode, got %+v", err)
+	}
+
+	_, err = deleteKeyHandler(m, u, map[string]string{"keyID": "a1"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	_, err = restoreKeyHandler(m, machine, map[string]string{"keyID": "a1"})
+	if err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("Expected UnauthorizedCode, got %+v", err)
+	}
+
+	db.SetError(fmt.Errorf("Test Error"))
+	_, err = restoreKeyHandler(m, u, map[string]string{"keyID": "a1"})
+	if err == nil || err.Subcode != knox.InternalServerErrorCode {
+		t.Fatalf("Expected InternalServerErrorCode, got %+v", err)
+	}
+	db.SetError(nil)
+
+	_, err = restoreKeyHandler(m, u, map[string]string{"keyID": "a1"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	i, err := getKeyHandler(m, u, map[string]string{"keyID": "a1"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if string(i.(*knox.Key).VersionList[0].Data) != "1" {
+		t.Fatalf("unexpected key %+v", i)
+	}
+}
+
+func TestPurger(t *testing.T) {
+	m, _ := makeDB()
+	sink := audit.NewMemorySink()
+	l, lErr := audit.NewLogger(sink)
+	if lErr != nil {
+		t.Fatalf("%s is not nil", lErr)
+	}
+	SetAuditLogger(l)
+	defer SetAuditLogger(nil)
+
+	u := auth.NewUser("testuser", []string{})
+	_, err := postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ=="})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	_, err = deleteKeyHandler(m, u, map[string]string{"keyID": "a1"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	p := NewPurger(m, time.Hour)
+	purged, purgeErr := p.Purge()
+	if purgeErr != nil {
+		t.Fatalf("%s is not nil", purgeErr)
+	}
+	if len(purged) != 0 {
+		t.Fatalf("unexpected purged keys %v", purged)
+	}
+
+	p.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	purged, purgeErr = p.Purge()
+	if purgeErr != nil {
+		t.Fatalf("%s is not nil", purgeErr)
+	}
+	if len(purged) != 1 || purged[0] != "a1" {
+		t.Fatalf("unexpected purged keys %v", purged)
+	}
+	_, err = restoreKeyHandler(m, u, map[string]string{"keyID": "a1"})
+	if err == nil || err.Subcode != knox.KeyIdentifierDoesNotExistCode {
+		t.Fatalf("Expected KeyIdentifierDoesNotExistCode, got %+v", err)
+	}
+
+	events := sink.Events()
+	last := events[len(events)-1]
+	if last.Type != knox.PurgeKeyEvent || last.Principal != purgerComponent || last.AuthType != systemAuthType {
+		t.Fatalf("unexpected purge event %+v", last)
+	}
+	// The history of a purged key is still governed by its ACL when deleted.
+	_, err = getHistoryHandler(m, u, map[string]string{"keyID": "a1"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	m, db := makeDB()
+	u := auth.NewUser("testuser", []string{})
+	machine := auth.NewMachine("MrRoboto")
+	_, err := postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ==", "metadata": "NotJSON"})
+	if err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("Expected BadRequestDataCode, got %+v", err)
+	}
+	_, err = postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ==", "metadata": `{"tags":["a","a"]}`})
+	if err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("Expected BadRequestDataCode, got %+v", err)
+	}
+	_, err = postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ==", "metadata": `{"description":"test key","team":"security","tags":["prod"],"created_by":"someoneelse"}`})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	// Anyone can read metadata.
+	i, err := getMetadataHandler(m, machine, map[string]string{"keyID": "a1"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	md := i.(*knox.KeyMetadata)
+	if md.Description != "test key" || md.Team != "security" || !md.HasTag("prod") {
+		t.Fatalf("unexpected metadata %+v", md)
+	}
+	if md.CreatedBy != "testuser" || md.CreationTime == 0 {
+		t.Fatalf("unexpected creation info %+v", md)
+	}
+	created := md.CreationTime
+
+	_, err = getMetadataHandler(m, u, map[string]string{"keyID": "NOTAKEY"})
+	if err == nil || err.Subcode != knox.KeyIdentifierDoesNotExistCode {
+		t.Fatalf("Expected KeyIdentifierDoesNotExistCode, got %+v", err)
+	}
+
+	newMD := `{"description":"updated","tags":["prod","db"],"created_by":"someoneelse","ts":1}`
+	_, err = putMetadataHandler(m, machine, map[string]string{"keyID": "a1", "metadata": newMD})
+	if err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("Expected UnauthorizedCode, got %+v", err)
+	}
+	_, err = putMetadataHandler(m, u, map[string]string{"keyID": "a1"})
+	if err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("Expected BadRequestDataCode, got %+v", err)
+	}
+	_, err = putMetadataHandler(m, u, map[string]string{"keyID": "a1", "metadata": `{"tags":[""]}`})
+	if err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("Expected BadRequestDataCode, got %+v", err)
+	}
+	db.SetError(fmt.Errorf("Test Error"))
+	_, err = putMetadataHandler(m, u, map[string]string{"keyID": "a1", "metadata": newMD})
+	if err == nil || err.Subcode != knox.InternalServerErrorCode {
+		t.Fatalf("Expected InternalServerErrorCode, got %+v", err)
+	}
+	db.SetError(nil)
+	_, err = putMetadataHandler(m, u, map[string]string{"keyID": "a1", "metadata": newMD})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	i, err = getMetadataHandler(m, u, map[string]string{"keyID": "a1"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	md = i.(*knox.KeyMetadata)
+	if md.Description != "updated" || md.Team != "" || len(md.Tags) != 2 {
+		t.Fatalf("unexpected metadata %+v", md)
+	}
+	// Creation info can't be changed.
+	if md.CreatedBy != "testuser" || md.CreationTime != created {
+		t.Fatalf("unexpected creation info %+v", md)
+	}
+}
+
+func TestSearchKeys(t *testing.T) {
+	m, db := makeDB()
+	u := auth.NewUser("testuser", []string{})
+	other := auth.NewUser("otheruser", []string{})
+	machine := auth.NewMachine("MrRoboto")
+	for _, p := range []map[string]string{
+		{"id": "app:a", "data": "MQ==", "metadata": `{"team":"app","tags":["prod","db"]}`},
+		{"id": "app:b", "data": "MQ==", "metadata": `{"team":"app","tags":["dev"]}`},
+		{"id": "app:c", "data": "MQ==", "acl": `[{"type":"Machine","id":"MrRoboto","access":"Read"}]`},
+		{"id": "web:a", "data": "MQ==", "metadata": `{"team":"web","tags":["prod"]}`},
+	} {
+		creator := u
+		if p["id"] == "app:b" {
+			creator = other
+		}
+		_, err := postKeysHandler(m, creator, p)
+		if err != nil {
+			t.Fatalf("%+v is not nil", err)
+		}
+	}
+	_, err := deleteKeyHandler(m, u, map[string]string{"keyID": "web:a"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	search := func(p knox.Principal, params map[string]string) []string {
+		var keys []string
+		for {
+			i, err := searchKeysHandler(m, p, params)
+			if err != nil {
+				t.Fatalf("%+v is not nil", err)
+			}
+			page := i.(knox.KeyIDPage)
+			keys = append(keys, page.KeyIDs...)
+			if page.Cursor == "" {
+				return keys
+			}
+			params["cursor"] = page.Cursor
+		}
+	}
+	expect := func(keys []string, expected ...string) {
+		if len(keys) != len(expected) {
+			t.Fatalf("%v does not equal %v", keys, expected)
+		}
+		for i := range keys {
+			if keys[i] != expected[i] {
+				t.Fatalf("%v does not equal %v", keys, expected)
+			}
+		}
+	}
+
+	expect(search(u, map[string]string{}), "app:a", "app:b", "app:c")
+	expect(search(u, map[string]string{"limit": "1"}), "app:a", "app:b", "app:c")
+	expect(search(u, map[string]string{"prefix": "web:"}))
+	expect(search(u, map[string]string{"access": "Admin"}), "app:a", "app:c")
+	expect(search(other, map[string]string{"access": "Write"}), "app:b")
+	expect(search(machine, map[string]string{"access": "Read"}), "app:c")
+	expect(search(u, map[string]string{"team": "app"}), "app:a", "app:b")
+	expect(search(u, map[string]string{"tags": "prod,db"}), "app:a")
+	expect(search(u, map[string]string{"tags": "prod,dev"}))
+
+	_, err = searchKeysHandler(m, u, map[string]string{"access": "Everything"})
+	if err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("Expected BadRequestDataCode, got %+v", err)
+	}
+	_, err = searchKeysHandler(m, u, map[string]string{"limit": "5000"})
+	if err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("Expected BadRequestDataCode, got %+v", err)
+	}
+	db.SetError(fmt.Errorf("Test Error"))
+	_, err = searchKeysHandler(m, u, map[string]string{})
+	if err == nil || err.Subcode != knox.InternalServerErrorCode {
+		t.Fatalf("Expected InternalServerErrorCode, got %+v", err)
+	}
+}
+
+func TestExplainAccess(t *testing.T) {
+	m, _ := makeDB()
+	u := auth.NewUser("testuser", []string{})
+	acl := `[{"type":"MachinePrefix","id":"web","access":"Read"},{"type":"UserGroup","id":"security","access":"Write"},{"type":"ServicePrefix","id":"spiffe://example.com/app/","access":"Read"}]`
+	_, err := postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ==", "acl": acl})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	_, err = postKeysHandler(m, u, map[string]string{"id": "a2", "data": "MQ=="})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	explain := func(params map[string]string) knox.AccessExplanation {
+		params["keyID"] = "a1"
+		i, err := explainAccessHandler(m, u, params)
+		if err != nil {
+			t.Fatalf("%+v is not nil", err)
+		}
+		return i.(knox.AccessExplanation)
+	}
+
+	e := explain(map[string]string{"principal_type": "Machine", "principal": "web0123"})
+	if !e.Granted || e.Principal != "web0123" || len(e.GrantedBy) != 1 || e.GrantedBy[0].ID != "web" {
+		t.Fatalf("unexpected explanation %+v", e)
+	}
+	e = explain(map[string]string{"principal_type": "Machine", "principal": "web0123", "access": "Write"})
+	if e.Granted || len(e.GrantedBy) != 0 {
+		t.Fatalf("unexpected explanation %+v", e)
+	}
+	e = explain(map[string]string{"principal_type": "User", "principal": "alice", "groups": "eng,security", "access": "Write"})
+	if !e.Granted || e.GrantedBy[0].ID != "security" {
+		t.Fatalf("unexpected explanation %+v", e)
+	}
+	e = explain(map[string]string{"principal_type": "Service", "principal": "spiffe://example.com/app/api"})
+	if !e.Granted || e.GrantedBy[0].Type != knox.ServicePrefix {
+		t.Fatalf("unexpected explanation %+v", e)
+	}
+	// Without a principal, every entry granting the access is listed.
+	e = explain(map[string]string{"access": "Admin"})
+	if e.Principal != "" || len(e.GrantedBy) != 1 || e.GrantedBy[0].ID != "testuser" {
+		t.Fatalf("unexpected explanation %+v", e)
+	}
+
+	for _, params := range []map[string]string{
+		{"keyID": "a1", "principal_type": "MachinePrefix", "principal": "web"},
+		{"keyID": "a1", "principal_type": "Machine"},
+		{"keyID": "a1", "principal_type": "Service", "principal": "notspiffe"},
+	} {
+		_, err = explainAccessHandler(m, u, params)
+		if err == nil || err.Subcode != knox.BadPrincipalIdentifier {
+			t.Fatalf("Expected BadPrincipalIdentifier for %v, got %+v", params, err)
+		}
+	}
+	_, err = explainAccessHandler(m, u, map[string]string{"keyID": "a1", "access": "None"})
+	if err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("Expected BadRequestDataCode, got %+v", err)
+	}
+	_, err = explainAccessHandler(m, u, map[string]string{"keyID": "NOTAKEY"})
+	if err == nil || err.Subcode != knox.KeyIdentifierDoesNotExistCode {
+		t.Fatalf("Expected KeyIdentifierDoesNotExistCode, got %+v", err)
+	}
+
+	// The reverse query lists the keys the principal can reach.
+	i, err := searchKeysHandler(m, u, map[string]string{"principal_type": "Machine", "principal": "web0123"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	page := i.(knox.KeyIDPage)
+	if len(page.KeyIDs) != 1 || page.KeyIDs[0] != "a1" {
+		t.Fatalf("unexpected page %+v", page)
+	}
+	i, err = searchKeysHandler(m, u, map[string]string{"principal_type": "User", "principal": "testuser", "access": "Admin"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	page = i.(knox.KeyIDPage)
+	if len(page.KeyIDs) != 2 {
+		t.Fatalf("unexpected page %+v", page)
+	}
+}
+
+func TestApprovals(t *testing.T) {
+	m, _ := makeDB()
+	sink := audit.NewMemorySink()
+	l, lErr := audit.NewLogger(sink)
+	if lErr != nil {
+		t.Fatalf("%s is not nil", lErr)
+	}
+	SetAuditLogger(l)
+	defer SetAuditLogger(nil)
+
+	u := auth.NewUser("testuser", []string{})
+	u2 := auth.NewUser("otheruser", []string{})
+	machine := auth.NewMachine("MrRoboto")
+	acl := `[{"type":"User","id":"otheruser","access":"Admin"}]`
+	_, err := postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ==", "acl": acl})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	_, err = putPolicyHandler(m, machine, map[string]string{"keyID": "a1", "policy": `{"require_approval":true}`})
+	if err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("Expected UnauthorizedCode, got %+v", err)
+	}
+	_, err = putPolicyHandler(m, u, map[string]string{"keyID": "a1", "policy": "NotJSON"})
+	if err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("Expected BadRequestDataCode, got %+v", err)
+	}
+	_, err = putPolicyHandler(m, u, map[string]string{"keyID": "a1", "policy": `{"rotation":{"period":0}}`})
+	if err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("Expected BadRequestDataCode, got %+v", err)
+	}
+	// Turning approval on takes effect immediately.
+	_, err = putPolicyHandler(m, u, map[string]string{"keyID": "a1", "policy": `{"require_approval":true}`})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	i, err := getPolicyHandler(m, machine, map[string]string{"keyID": "a1"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if !i.(*knox.KeyPolicy).RequireApproval {
+		t.Fatalf("unexpected policy %+v", i)
+	}
+
+	// Deleting the key and changing its ACL are now requests.
+	_, err = deleteKeyHandler(m, u, map[string]string{"keyID": "a1"})
+	if err == nil || err.Subcode != knox.ApprovalPendingCode {
+		t.Fatalf("Expected ApprovalPendingCode, got %+v", err)
+	}
+	access := `{"type":"Machine","id":"MrRoboto","access":"Read"}`
+	_, err = putAccessHandler(m, u, map[string]string{"keyID": "a1", "access": access})
+	if err == nil || err.Subcode != knox.ApprovalPendingCode {
+		t.Fatalf("Expected ApprovalPendingCode, got %+v", err)
+	}
+	if _, err = getKeyHandler(m, machine, map[string]string{"keyID": "a1"}); err == nil {
+		t.Fatal("access was granted before approval")
+	}
+
+	_, err = getRequestsHandler(m, machine, map[string]string{"keyID": "a1"})
+	if err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("Expected UnauthorizedCode, got %+v", err)
+	}
+	i, err = getRequestsHandler(m, u2, map[string]string{"keyID": "a1"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	requests := i.([]knox.ApprovalRequest)
+	if len(requests) != 2 || requests[0].Operation != knox.DeleteKeyOperation || requests[1].Operation != knox.UpdateAccessOperation {
+		t.Fatalf("unexpected requests %+v", requests)
+	}
+	if requests[0].RequestedBy != "testuser" || requests[0].Expires <= requests[0].CreationTime {
+		t.Fatalf("unexpected request %+v", requests[0])
+	}
+	deleteID, accessID := requests[0].ID, requests[1].ID
+
+	// The requester and non-admins cannot approve.
+	_, err = approveRequestHandler(m, u, map[string]string{"keyID": "a1", "requestID": accessID})
+	if err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("Expected UnauthorizedCode, got %+v", err)
+	}
+	_, err = approveRequestHandler(m, machine, map[string]string{"keyID": "a1", "requestID": accessID})
+	if err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("Expected UnauthorizedCode, got %+v", err)
+	}
+	_, err = approveRequestHandler(m, u2, map[string]string{"keyID": "a1", "requestID": "NOTAREQUEST"})
+	if err == nil || err.Subcode != knox.ApprovalRequestDoesNotExistCode {
+		t.Fatalf("Expected ApprovalRequestDoesNotExistCode, got %+v", err)
+	}
+
+	_, err = approveRequestHandler(m, u2, map[string]string{"keyID": "a1", "requestID": accessID})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if _, err = getKeyHandler(m, machine, map[string]string{"keyID": "a1"}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	// A request can only be approved once.
+	_, err = approveRequestHandler(m, u2, map[string]string{"keyID": "a1", "requestID": accessID})
+	if err == nil || err.Subcode != knox.ApprovalRequestDoesNotExistCode {
+		t.Fatalf("Expected ApprovalRequestDoesNotExistCode, got %+v", err)
+	}
+
+	_, err = rejectRequestHandler(m, machine, map[string]string{"keyID": "a1", "requestID": deleteID})
+	if err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("Expected UnauthorizedCode, got %+v", err)
+	}
+	_, err = rejectRequestHandler(m, u2, map[string]string{"keyID": "a1", "requestID": deleteID})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if _, err = getKeyHandler(m, u, map[string]string{"keyID": "a1"}); err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	// Turning approval off needs approval too.
+	_, err = putPolicyHandler(m, u, map[string]string{"keyID": "a1", "policy": `{}`})
+	if err == nil || err.Subcode != knox.ApprovalPendingCode {
+		t.Fatalf("Expected ApprovalPendingCode, got %+v", err)
+	}
+	i, _ = getRequestsHandler(m, u, map[string]string{"keyID": "a1"})
+	requests = i.([]knox.ApprovalRequest)
+	if len(requests) != 1 || requests[0].Operation != knox.UpdatePolicyOperation {
+		t.Fatalf("unexpected requests %+v", requests)
+	}
+	_, err = approveRequestHandler(m, u2, map[string]string{"keyID": "a1", "requestID": requests[0].ID})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	_, err = deleteKeyHandler(m, u, map[string]string{"keyID": "a1"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	var types []knox.AuditEventType
+	for _, e := range sink.Events() {
+		if e.RequestID != "" {
+			types = append(types, e.Type)
+		}
+	}
+	expected := []knox.AuditEventType{
+		knox.RequestApprovalEvent, knox.RequestApprovalEvent, knox.UpdateAccessEvent,
+		knox.RejectRequestEvent, knox.RequestApprovalEvent, knox.UpdatePolicyEvent,
+	}
+	if !reflect.DeepEqual(types, expected) {
+		t.Fatalf("%v does not equal %v", types, expected)
+	}
+}
+
+func TestApprovalExpiry(t *testing.T) {
+	m, _ := makeDB()
+	SetApprovalTTL(time.Millisecond)
+	defer SetApprovalTTL(24 * time.Hour)
+
+	u := auth.NewUser("testuser", []string{})
+	u2 := auth.NewUser("otheruser", []string{})
+	acl := `[{"type":"User","id":"otheruser","access":"Admin"}]`
+	_, err := postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ==", "acl": acl})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	_, err = putPolicyHandler(m, u, map[string]string{"keyID": "a1", "policy": `{"require_approval":true}`})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	_, err = deleteKeyHandler(m, u, map[string]string{"keyID": "a1"})
+	if err == nil || err.Subcode != knox.ApprovalPendingCode {
+		t.Fatalf("Expected ApprovalPendingCode, got %+v", err)
+	}
+	requests, getErr := m.GetApprovalRequests("a1")
+	if getErr != nil || len(requests) != 1 {
+		t.Fatalf("unexpected requests %+v, %v", requests, getErr)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	_, err = approveRequestHandler(m, u2, map[string]string{"keyID": "a1", "requestID": requests[0].ID})
+	if err == nil || err.Subcode != knox.ApprovalRequestDoesNotExistCode {
+		t.Fatalf("Expected ApprovalRequestDoesNotExistCode, got %+v", err)
+	}
+	i, err := getRequestsHandler(m, u, map[string]string{"keyID": "a1"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if len(i.([]knox.ApprovalRequest)) != 0 {
+		t.Fatalf("unexpected requests %+v", i)
+	}
+}
+
+func TestGenerateKeyData(t *testing.T) {
+	m, _ := makeDB()
+	u := auth.NewUser("testuser", []string{})
+	gen := `{"encoding":"charset","length":24,"charset":"abc"}`
+
+	_, err := postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ==", "generate": gen})
+	if err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("Expected BadRequestDataCode, got %+v", err)
+	}
+	for _, bad := range []string{"NotJSON", `{"encoding":"base32","length":16}`, `{"encoding":"hex","length":16,"charset":"abc"}`} {
+		_, err = postKeysHandler(m, u, map[string]string{"id": "a1", "generate": bad})
+		if err == nil || err.Subcode != knox.BadRequestDataCode {
+			t.Fatalf("Expected BadRequestDataCode for %s, got %+v", bad, err)
+		}
+	}
+
+	i, err := postKeysHandler(m, u, map[string]string{"id": "a1", "generate": gen})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if _, ok := i.(uint64); !ok {
+		t.Fatalf("Expected only a version ID, got %+v", i)
+	}
+	i, err = getKeyHandler(m, u, map[string]string{"keyID": "a1"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	data := i.(*knox.Key).VersionList[0].Data
+	if len(data) != 24 || strings.Trim(string(data), "abc") != "" {
+		t.Fatalf("unexpected generated data %q", data)
+	}
+
+	_, err = postVersionHandler(m, u, map[string]string{"keyID": "a1", "data": "MQ==", "generate": gen})
+	if err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("Expected BadRequestDataCode, got %+v", err)
+	}
+	_, err = postVersionHandler(m, u, map[string]string{"keyID": "a1", "generate": `{"encoding":"hex","length":16}`})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	key, getErr := m.GetKey("a1", knox.Active)
+	if getErr != nil {
+		t.Fatalf("%s is not nil", getErr)
+	}
+	if len(key.VersionList) != 2 {
+		t.Fatalf("unexpected versions %+v", key.VersionList)
+	}
+	for _, v := range key.VersionList {
+		if v.Status == knox.Active && len(v.Data) != 32 {
+			t.Fatalf("unexpected generated data %q", v.Data)
+		}
+	}
+}
+
+func TestWebhookRoutes(t *testing.T) {
+	m, db := makeDB()
+	u := auth.NewUser("testuser", []string{})
+	other := auth.NewUser("other", []string{})
+	defaultAccess = []knox.Access{{Type: knox.User, ID: "admin", AccessType: knox.Admin}}
+	defer func() { defaultAccess = nil }()
+	admin := auth.NewUser("admin", []string{})
+	hookJSON := `{"url":"https://example.com/hook","key_id":"a1","secret":"chosen","id":"chosen"}`
+
+	_, err := postWebhookHandler(m, u, map[string]string{"webhook": hookJSON})
+	if err == nil || err.Subcode != knox.NotYetImplementedCode {
+		t.Fatalf("Expected NotYetImplementedCode, got %+v", err)
+	}
+
+	w, wErr := NewWebhooks(db, testWebhookCryptor, nil)
+	if wErr != nil {
+		t.Fatalf("%s is not nil", wErr)
+	}
+	SetWebhooks(w)
+	defer SetWebhooks(nil)
+
+	_, err = postWebhookHandler(m, u, map[string]string{"webhook": hookJSON})
+	if err == nil || err.Subcode != knox.KeyIdentifierDoesNotExistCode {
+		t.Fatalf("Expected KeyIdentifierDoesNotExistCode, got %+v", err)
+	}
+	_, err = postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ=="})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	_, err = postWebhookHandler(m, u, map[string]string{"webhook": `{"url":"example.com/hook","key_id":"a1"}`})
+	if err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("Expected BadRequestDataCode, got %+v", err)
+	}
+	_, err = postWebhookHandler(m, u, map[string]string{"webhook": `{"url":"https://example.com/hook","events":["read"]}`})
+	if err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("Expected BadRequestDataCode, got %+v", err)
+	}
+	_, err = postWebhookHandler(m, other, map[string]string{"webhook": hookJSON})
+	if err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("Expected UnauthorizedCode, got %+v", err)
+	}
+	// Webhooks on every key need a global admin.
+	_, err = postWebhookHandler(m, u, map[string]string{"webhook": `{"url":"https://example.com/all"}`})
+	if err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("Expected UnauthorizedCode, got %+v", err)
+	}
+	_, err = postWebhookHandler(m, admin, map[string]string{"webhook": `{"url":"https://example.com/all"}`})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	// The ID and secret are chosen by the server.
+	i, err := postWebhookHandler(m, u, map[string]string{"webhook": hookJSON})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	hook := i.(knox.Webhook)
+	if hook.ID == "chosen" || hook.Secret == "chosen" || len(hook.Secret) != 64 || hook.CreatedBy != "testuser" || hook.KeyID != "a1" {
+		t.Fatalf("unexpected webhook %+v", hook)
+	}
+
+	// Key admins see the webhooks of their key without secrets.
+	i, err = getWebhooksHandler(m, u, map[string]string{"key": "a1"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	hooks := i.([]knox.Webhook)
+	if len(hooks) != 1 || hooks[0].ID != hook.ID || hooks[0].Secret != "" {
+		t.Fatalf("unexpected webhooks %+v", hooks)
+	}
+	_, err = getWebhooksHandler(m, u, map[string]string{})
+	if err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("Expected UnauthorizedCode, got %+v", err)
+	}
+	i, err = getWebhooksHandler(m, admin, map[string]string{})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if len(i.([]knox.Webhook)) != 2 {
+		t.Fatalf("%d does not equal 2", len(i.([]knox.Webhook)))
+	}
+
+	_, err = getDeadLettersHandler(m, other, map[string]string{"webhookID": hook.ID})
+	if err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("Expected UnauthorizedCode, got %+v", err)
+	}
+	i, err = getDeadLettersHandler(m, u, map[string]string{"webhookID": hook.ID})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if len(i.([]knox.WebhookDeadLetter)) != 0 {
+		t.Fatalf("%d does not equal 0", len(i.([]knox.WebhookDeadLetter)))
+	}
+
+	_, err = deleteWebhookHandler(m, other, map[string]string{"webhookID": hook.ID})
+	if err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("Expected UnauthorizedCode, got %+v", err)
+	}
+	_, err = deleteWebhookHandler(m, u, map[string]string{"webhookID": hook.ID})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	_, err = deleteWebhookHandler(m, u, map[string]string{"webhookID": hook.ID})
+	if err == nil || err.Subcode != knox.WebhookDoesNotExistCode {
+		t.Fatalf("Expected WebhookDoesNotExistCode, got %+v", err)
+	}
+}
+
+func TestNamespaceRoutes(t *testing.T) {
+	m, _ := makeDB()
+	defaultAccess = []knox.Access{{Type: knox.User, ID: "admin", AccessType: knox.Admin}}
+	defer func() { defaultAccess = nil }()
+	admin := auth.NewUser("admin", []string{})
+	alice := auth.NewUser("alice", []string{"payments-team"})
+	other := auth.NewUser("other", []string{})
+	machine := auth.NewMachine("payments001")
+	acl := `[{"type":"UserGroup","id":"payments-team","access":"Admin"},{"type":"Machine","id":"payments001","access":"Admin"}]`
+
+	i, err := getNamespacesHandler(m, other, map[string]string{})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if len(i.([]knox.Namespace)) != 0 {
+		t.Fatalf("%v is not empty", i)
+	}
+	_, err = putNamespaceAccessHandler(m, admin, map[string]string{"prefix": "payments", "acl": acl})
+	if err == nil || err.Subcode != knox.BadKeyFormatCode {
+		t.Fatalf("Expected BadKeyFormatCode, got %+v", err)
+	}
+	_, err = putNamespaceAccessHandler(m, admin, map[string]string{"prefix": "payments:", "access": `{"type":"Machine","id":"","access":"Read"}`})
+	if err == nil || err.Subcode != knox.BadPrincipalIdentifier {
+		t.Fatalf("Expected BadPrincipalIdentifier, got %+v", err)
+	}
+	// Top level namespaces need a global admin.
+	_, err = putNamespaceAccessHandler(m, alice, map[string]string{"prefix": "payments:", "acl": acl})
+	if err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("Expected UnauthorizedCode, got %+v", err)
+	}
+	_, err = putNamespaceAccessHandler(m, admin, map[string]string{"prefix": "payments:", "acl": acl})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	// Namespace admins manage nested namespaces.
+	_, err = putNamespaceAccessHandler(m, alice, map[string]string{"prefix": "payments:stripe:", "access": `{"type":"User","id":"bob","access":"Read"}`})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	_, err = putNamespaceAccessHandler(m, other, map[string]string{"prefix": "payments:stripe:", "access": `{"type":"User","id":"other","access":"Admin"}`})
+	if err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("Expected UnauthorizedCode, got %+v", err)
+	}
+	i, err = getNamespaceHandler(m, other, map[string]string{"prefix": "payments:stripe:"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if n := i.(*knox.Namespace); len(n.ACL) != 1 || n.ACL[0].ID != "bob" {
+		t.Fatalf("unexpected namespace %+v", n)
+	}
+
+	// Namespace admins create keys in it even if they are not users, and
+	// other principals that are not users cannot.
+	_, err = postKeysHandler(m, machine, map[string]string{"id": "payments:k1", "data": "MQ=="})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	_, err = postKeysHandler(m, machine, map[string]string{"id": "k2", "data": "MQ=="})
+	if err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("Expected UnauthorizedCode, got %+v", err)
+	}
+	_, err = postKeysHandler(m, auth.NewMachine("stranger001"), map[string]string{"id": "payments:k3", "data": "MQ=="})
+	if err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("Expected UnauthorizedCode, got %+v", err)
+	}
+	// Users still create keys anywhere, becoming their admins, and the keys
+	// inherit the namespace ACL on top.
+	_, err = postKeysHandler(m, other, map[string]string{"id": "payments:k3", "data": "MQ=="})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	k3, kErr := m.GetKey("payments:k3", knox.Primary)
+	if kErr != nil {
+		t.Fatalf("%s is not nil", kErr)
+	}
+	if !other.CanAccess(k3.ACL, knox.Admin) || len(k3.InheritedACL) != 2 {
+		t.Fatalf("unexpected key %+v", k3)
+	}
+	i, err = getAccessHandler(m, other, map[string]string{"keyID": "payments:k1"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if !reflect.DeepEqual(i.(knox.ACL), knox.ACL(defaultAccess)) {
+		t.Fatalf("%v does not equal %v", i, defaultAccess)
+	}
+
+	// The namespace ACL is combined with the key's own.
+	i, err = getKeyHandler(m, alice, map[string]string{"keyID": "payments:k1"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if key := i.(*knox.Key); key.InheritedACL != nil {
+		t.Fatalf("%v is not nil", key.InheritedACL)
+	}
+	_, err = putAccessHandler(m, alice, map[string]string{"keyID": "payments:k1", "access": `{"type":"User","id":"carol","access":"Read"}`})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	i, err = explainAccessHandler(m, other, map[string]string{"keyID": "payments:k1", "access": "Admin"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if e := i.(knox.AccessExplanation); len(e.GrantedBy) != 3 {
+		t.Fatalf("%v is not the default access and the namespace admins", e.GrantedBy)
+	}
+	_, err = getKeyHandler(m, other, map[string]string{"keyID": "payments:k1"})
+	if err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("Expected UnauthorizedCode, got %+v", err)
+	}
+
+	_, err = deleteNamespaceHandler(m, other, map[string]string{"prefix": "payments:"})
+	if err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("Expected UnauthorizedCode, got %+v", err)
+	}
+	_, err = deleteNamespaceHandler(m, alice, map[string]string{"prefix": "payments:"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	_, err = deleteNamespaceHandler(m, alice, map[string]string{"prefix": "payments:"})
+	if err == nil || err.Subcode != knox.NamespaceDoesNotExistCode {
+		t.Fatalf("Expected NamespaceDoesNotExistCode, got %+v", err)
+	}
+	_, err = getKeyHandler(m, alice, map[string]string{"keyID": "payments:k1"})
+	if err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("Expected UnauthorizedCode, got %+v", err)
+	}
+}
+
+func TestNamespaceAccessRequiresApproval(t *testing.T) {
+	m, _ := makeDB()
+	defaultAccess = []knox.Access{{Type: knox.User, ID: "admin", AccessType: knox.Admin}}
+	defer func() { defaultAccess = nil }()
+	admin := auth.NewUser("admin", []string{})
+	u := auth.NewUser("testuser", []string{})
+	grant := map[string]string{"prefix": "payments:", "access": `{"type":"User","id":"attacker","access":"Read"}`}
+
+	_, err := putNamespaceAccessHandler(m, admin, grant)
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	_, err = postKeysHandler(m, u, map[string]string{"id": "payments:stripe:k1", "data": "MQ=="})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	if pErr := m.SetPolicy("payments:stripe:k1", knox.KeyPolicy{RequireApproval: true}); pErr != nil {
+		t.Fatalf("%s is not nil", pErr)
+	}
+
+	// Access to keys that require approval cannot be granted through their
+	// namespaces, even by global admins.
+	grant["access"] = `{"type":"User","id":"other","access":"Admin"}`
+	_, err = putNamespaceAccessHandler(m, admin, grant)
+	if err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("Expected UnauthorizedCode, got %+v", err)
+	}
+	_, err = putNamespaceAccessHandler(m, admin, map[string]string{"prefix": "payments:stripe:", "access": grant["access"]})
+	if err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("Expected UnauthorizedCode, got %+v", err)
+	}
+	// Access can still be removed, and granted in unrelated namespaces.
+	_, err = putNamespaceAccessHandler(m, admin, map[string]string{"prefix": "payments:", "access": `{"type":"User","id":"attacker","access":"None"}`})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	_, err = putNamespaceAccessHandler(m, admin, map[string]string{"prefix": "payroll:", "access": grant["access"]})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	n, nErr := m.GetNamespace("payments:")
+	if nErr != nil {
+		t.Fatalf("%s is not nil", nErr)
+	}
+	if len(n.ACL) != 0 {
+		t.Fatalf("%+v is not empty", n.ACL)
+	}
+}
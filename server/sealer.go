@@ -0,0 +1,193 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/keydb"
+	"github.com/pinterest/knox/shamir"
+)
+
+// ErrSealed is returned by a sealed Sealer instead of encrypting or decrypting.
+var ErrSealed = fmt.Errorf("Server is sealed")
+
+// ErrInvalidShare is returned by Unseal for a share that cannot belong to the
+// same split as the shares already submitted.
+var ErrInvalidShare = fmt.Errorf("Share is malformed or does not match the submitted shares")
+
+// ErrDuplicateShare is returned by Unseal for a share with the same index as
+// one already submitted.
+var ErrDuplicateShare = fmt.Errorf("A share with this index was already submitted")
+
+// Sealer is a keydb.Cryptor that starts sealed, without the master key, and
+// refuses to encrypt or decrypt. Operators unseal it by each submitting a
+// share of the master secret made with shamir.Split; once the threshold is
+// reached the secret is recreated and the real cryptor is built from it.
+type Sealer struct {
+	threshold  int
+	newCryptor func(secret []byte) (keydb.Cryptor, error)
+
+	mu      sync.RWMutex
+	shares  [][]byte
+	cryptor keydb.Cryptor
+}
+
+// NewSealer creates a sealed Sealer that needs threshold shares to unseal.
+// newCryptor builds the cryptor from the recreated secret. It should fail if
+// the secret is wrong, e.g. by using it to open a keyfile, since a wrong
+// share cannot otherwise be detected.
+func NewSealer(threshold int, newCryptor func(secret []byte) (keydb.Cryptor, error)) *Sealer {
+	return &Sealer{threshold: threshold, newCryptor: newCryptor}
+}
+
+// Status returns whether the Sealer is sealed and how many shares it has.
+func (s *Sealer) Status() knox.SealStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.status()
+}
+
+func (s *Sealer) status() knox.SealStatus {
+	return knox.SealStatus{Sealed: s.cryptor == nil, Threshold: s.threshold, Progress: len(s.shares)}
+}
+
+// Unseal adds a share. Malformed shares and shares whose index was already
+// submitted are rejected without affecting the others. When the threshold is
+// reached it builds the cryptor; if that fails every share is discarded and
+// unsealing starts over, since the wrong share cannot be identified.
+// Submitting a share to an unsealed Sealer does nothing.
+func (s *Sealer) Unseal(share []byte) (knox.SealStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cryptor != nil {
+		return s.status(), nil
+	}
+	// shamir.Split stores the share index in the last byte.
+	if len(share) < 2 || share[len(share)-1] == 0 {
+		return s.status(), ErrInvalidShare
+	}
+	for _, other := range s.shares {
+		if len(other) != len(share) {
+			return s.status(), ErrInvalidShare
+		}
+		if other[len(other)-1] == share[len(share)-1] {
+			return s.status(), ErrDuplicateShare
+		}
+	}
+	s.shares = append(s.shares, append([]byte{}, share...))
+	if len(s.shares) < s.threshold {
+		return s.status(), nil
+	}
+
+	secret, err := shamir.Combine(s.shares)
+	s.shares = nil
+	if err != nil {
+		return s.status(), err
+	}
+	c, err := s.newCryptor(secret)
+	if err != nil {
+		return s.status(), err
+	}
+	s.cryptor = c
+	return s.status(), nil
+}
+
+// Seal discards the cryptor and any submitted shares.
+func (s *Sealer) Seal() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cryptor = nil
+	s.shares = nil
+}
+
+func (s *Sealer) current() (keydb.Cryptor, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.cryptor == nil {
+		return nil, ErrSealed
+	}
+	return s.cryptor, nil
+}
+
+func (s *Sealer) Decrypt(k *keydb.DBKey) (*knox.Key, error) {
+	c, err := s.current()
+	if err != nil {
+		return nil, err
+	}
+	return c.Decrypt(k)
+}
+
+func (s *Sealer) Encrypt(k *knox.Key) (*keydb.DBKey, error) {
+	c, err := s.current()
+	if err != nil {
+		return nil, err
+	}
+	return c.Encrypt(k)
+}
+
+func (s *Sealer) EncryptVersion(k *knox.Key, v *knox.KeyVersion) (*keydb.EncKeyVersion, error) {
+	c, err := s.current()
+	if err != nil {
+		return nil, err
+	}
+	return c.EncryptVersion(k, v)
+}
+
+// EncryptDBVersion lets the cryptor use the stored key if it implements
+// keydb.DBVersionEncryptor.
+func (s *Sealer) EncryptDBVersion(k *keydb.DBKey, v *knox.KeyVersion) (*keydb.EncKeyVersion, error) {
+	c, err := s.current()
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := c.(keydb.DBVersionEncryptor); ok {
+		return e.EncryptDBVersion(k, v)
+	}
+	key, err := c.Decrypt(k)
+	if err != nil {
+		return nil, err
+	}
+	return c.EncryptVersion(key, v)
+}
+
+// Sign signs k if the cryptor is a keydb.Signer.
+func (s *Sealer) Sign(k *keydb.DBKey) error {
+	c, err := s.current()
+	if err != nil {
+		return err
+	}
+	return keydb.Sign(c, k)
+}
+
+// Verify checks k if the cryptor is a keydb.Signer.
+func (s *Sealer) Verify(k *keydb.DBKey) error {
+	c, err := s.current()
+	if err != nil {
+		return err
+	}
+	return keydb.Verify(c, k)
+}
+
+// Rewrap rewraps the data key of k if the cryptor is a keydb.Rewrapper.
+func (s *Sealer) Rewrap(k *keydb.DBKey) error {
+	c, err := s.current()
+	if err != nil {
+		return err
+	}
+	return keydb.Rewrap(c, k)
+}
+
+// Stale reports whether the cryptor considers k stale. Nothing is stale while
+// sealed, so reencryption waits until the Sealer is unsealed, and nothing is
+// stale for cryptors that cannot tell.
+func (s *Sealer) Stale(k *keydb.DBKey) bool {
+	c, err := s.current()
+	if err != nil {
+		return false
+	}
+	if sc, ok := c.(keydb.StaleChecker); ok {
+		return sc.Stale(k)
+	}
+	return false
+}
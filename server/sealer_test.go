@@ -0,0 +1,153 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/auth"
+	"github.com/pinterest/knox/server/keydb"
+	"github.com/pinterest/knox/shamir"
+)
+
+var testSealSecret = []byte("testtesttesttest")
+
+func newTestSealer(t *testing.T) (*Sealer, [][]byte) {
+	shares, err := shamir.Split(testSealSecret, 3, 2)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	s := NewSealer(2, func(secret []byte) (keydb.Cryptor, error) {
+		if string(secret) != string(testSealSecret) {
+			return nil, fmt.Errorf("wrong secret")
+		}
+		return keydb.NewAESGCMCryptor(10, secret), nil
+	})
+	return s, shares
+}
+
+func TestSealer(t *testing.T) {
+	s, shares := newTestSealer(t)
+	db := keydb.NewTempDB()
+	m := NewKeyManager(s, db)
+	u := auth.NewUser("test", []string{})
+	key := newKey("id1", knox.ACL{}, []byte("data"), u)
+
+	if err := m.AddNewKey(&key); err != ErrSealed {
+		t.Fatalf("%v does not equal %s", err, ErrSealed)
+	}
+	expected := knox.SealStatus{Sealed: true, Threshold: 2, Progress: 1}
+	if status, err := s.Unseal(shares[0]); err != nil || status != expected {
+		t.Fatalf("%+v does not equal %+v (%v)", status, expected, err)
+	}
+	// Repeated and malformed shares are rejected without discarding the
+	// submitted ones.
+	if _, err := s.Unseal(shares[0]); err != ErrDuplicateShare {
+		t.Fatalf("%v does not equal %s", err, ErrDuplicateShare)
+	}
+	if _, err := s.Unseal(shares[1][1:]); err != ErrInvalidShare {
+		t.Fatalf("%v does not equal %s", err, ErrInvalidShare)
+	}
+	if status := s.Status(); status != expected {
+		t.Fatalf("%+v does not equal %+v", status, expected)
+	}
+	expected = knox.SealStatus{Threshold: 2}
+	if status, err := s.Unseal(shares[2]); err != nil || status != expected {
+		t.Fatalf("%+v does not equal %+v (%v)", status, expected, err)
+	}
+	if err := m.AddNewKey(&key); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+
+	s.Seal()
+	if _, err := m.GetKey("id1", knox.Primary); err == nil {
+		t.Fatal("error is nil reading a key while sealed")
+	}
+	keys, err := db.GetAll()
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if s.Stale(&keys[0]) {
+		t.Fatal("keys should not be stale while sealed")
+	}
+
+	// A corrupted share discards every share submitted.
+	bad := append([]byte{}, shares[1]...)
+	bad[0] ^= 1
+	s.Unseal(shares[0])
+	if _, err := s.Unseal(bad); err == nil {
+		t.Fatal("error is nil for a bad share")
+	}
+	if status := s.Status(); !status.Sealed || status.Progress != 0 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+
+	s.Unseal(shares[1])
+	s.Unseal(shares[2])
+	k, err := m.GetKey("id1", knox.Primary)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if string(k.VersionList[0].Data) != "data" {
+		t.Fatalf("%q does not equal data", k.VersionList[0].Data)
+	}
+}
+
+func TestSealRoutes(t *testing.T) {
+	s, shares := newTestSealer(t)
+	m := NewKeyManager(s, keydb.NewTempDB())
+	SetSealer(s)
+	defer SetSealer(nil)
+	defaultAccess = []knox.Access{{Type: knox.User, ID: "admin", AccessType: knox.Admin}}
+	defer func() { defaultAccess = nil }()
+	unsealOperators = []knox.Access{{Type: knox.User, ID: "operator", AccessType: knox.Read}}
+	defer func() { unsealOperators = nil }()
+	admin := auth.NewUser("admin", []string{})
+	operator := auth.NewUser("operator", []string{})
+	u := auth.NewUser("test", []string{})
+
+	w := httptest.NewRecorder()
+	mockRoute().ServeHTTP(w, httptest.NewRequest("GET", "/v0/keys/", nil))
+	if w.Code != HTTPErrMap[knox.SealedCode].Code {
+		t.Fatalf("%d does not equal %d", w.Code, HTTPErrMap[knox.SealedCode].Code)
+	}
+
+	status, err := healthHandler(m, u, map[string]string{})
+	if err != nil || !status.(knox.SealStatus).Sealed {
+		t.Fatalf("unexpected status %+v (%v)", status, err)
+	}
+	_, err = unsealHandler(m, u, map[string]string{"share": base64.StdEncoding.EncodeToString(shares[0])})
+	if err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("unexpected error %v", err)
+	}
+	_, err = unsealHandler(m, admin, map[string]string{"share": "not base64!"})
+	if err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("unexpected error %v", err)
+	}
+	status, err = unsealHandler(m, admin, map[string]string{"share": base64.StdEncoding.EncodeToString(shares[0])})
+	if err != nil {
+		t.Fatalf("%v is not nil", err)
+	}
+	_, err = unsealHandler(m, operator, map[string]string{"share": base64.StdEncoding.EncodeToString(shares[0])})
+	if err == nil || err.Subcode != knox.BadRequestDataCode {
+		t.Fatalf("unexpected error %v", err)
+	}
+	status, err = unsealHandler(m, operator, map[string]string{"share": base64.StdEncoding.EncodeToString(shares[1])})
+	if err != nil {
+		t.Fatalf("%v is not nil", err)
+	}
+	if status.(knox.SealStatus).Sealed {
+		t.Fatal("server should be unsealed")
+	}
+
+	_, err = sealHandler(m, u, map[string]string{})
+	if err == nil || err.Subcode != knox.UnauthorizedCode {
+		t.Fatalf("unexpected error %v", err)
+	}
+	status, err = sealHandler(m, admin, map[string]string{})
+	if err != nil || !status.(knox.SealStatus).Sealed {
+		t.Fatalf("unexpected status %+v (%v)", status, err)
+	}
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pinterest/knox/log"
+	"github.com/pinterest/knox/server/keydb"
+)
+
+// watchPollInterval is how often the change feed is read while requests are
+// waiting for keys to change.
+var watchPollInterval = time.Second
+
+// watchChangeBatch is the number of changes read from the feed at a time.
+const watchChangeBatch = 1000
+
+// changeWatcher lets requests wait for keys to change. While any request is
+// waiting, one goroutine reads the change feed and wakes the requests
+// watching the changed keys, so the DB sees one query per interval however
+// many clients are watching.
+type changeWatcher struct {
+	feed keydb.ChangeFeed
+
+	sync.Mutex
+	seq     int64
+	running bool
+	subs    map[*watchSub]bool
+}
+
+// watchSub is a request waiting for any of ids to change.
+type watchSub struct {
+	ids map[string]string
+	c   chan struct{}
+}
+
+func newChangeWatcher(feed keydb.ChangeFeed) *changeWatcher {
+	return &changeWatcher{feed: feed, subs: map[*watchSub]bool{}}
+}
+
+// subscribe returns a subscription whose channel receives a value when any of
+// the keys in ids may have changed after subscribe returned. Spurious wakeups
+// are possible, so the keys have to be checked afterwards.
+func (w *changeWatcher) subscribe(ids map[string]string) (*watchSub, error) {
+	w.Lock()
+	defer w.Unlock()
+	if !w.running {
+		seq, err := w.feed.LastSeq()
+		if err != nil {
+			return nil, err
+		}
+		w.seq = seq
+		w.running = true
+		go w.run()
+	}
+	sub := &watchSub{ids: ids, c: make(chan struct{}, 1)}
+	w.subs[sub] = true
+	return sub, nil
+}
+
+func (w *changeWatcher) unsubscribe(sub *watchSub) {
+	w.Lock()
+	defer w.Unlock()
+	delete(w.subs, sub)
+}
+
+// run reads the change feed every watchPollInterval until no requests are
+// waiting.
+func (w *changeWatcher) run() {
+	t := time.NewTicker(watchPollInterval)
+	defer t.Stop()
+	for range t.C {
+		w.Lock()
+		if len(w.subs) == 0 {
+			w.running = false
+			w.Unlock()
+			return
+		}
+		seq := w.seq
+		w.Unlock()
+
+		changes, err := w.feed.Changes(seq, watchChangeBatch)
+		// If changes were missed, every request checks its keys again.
+		all := err == keydb.ErrChangesTruncated
+		if all {
+			seq, err = w.feed.LastSeq()
+		}
+		if err != nil {
+			log.Printf("Failed to read key changes: %s", err.Error())
+			continue
+		}
+		changed := map[string]bool{}
+		for _, c := range changes {
+			changed[c.KeyID] = true
+			seq = c.Seq
+		}
+
+		w.Lock()
+		w.seq = seq
+		for sub := range w.subs {
+			if all || sub.matches(changed) {
+				select {
+				case sub.c <- struct{}{}:
+				default:
+				}
+			}
+		}
+		w.Unlock()
+	}
+}
+
+func (s *watchSub) matches(changed map[string]bool) bool {
+	for id := range changed {
+		if _, ok := s.ids[id]; ok {
+			return true
+		}
+	}
+	return false
+}
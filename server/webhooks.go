@@ -0,0 +1,416 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/log"
+	"github.com/pinterest/knox/server/keydb"
+)
+
+// webhookQueueSize is the number of events that can wait to be sent to
+// webhooks. Events are dropped while the queue is full.
+const webhookQueueSize = 1000
+
+// webhookAttempts is the number of times an event is sent to a webhook
+// before it is recorded as a dead letter.
+const webhookAttempts = 5
+
+// webhookBackoff is the delay before the first retry of a delivery. It
+// doubles after every retry.
+const webhookBackoff = time.Second
+
+// ErrWebhookAddress is returned when a delivery would connect to an address
+// that webhooks are not allowed to reach.
+var ErrWebhookAddress = fmt.Errorf("Webhook address is not allowed")
+
+// blockedNetworks are the addresses that webhooks cannot be delivered to
+// unless they are allowed: unspecified, loopback, private, shared, link-local
+// (which includes cloud metadata services) and multicast addresses.
+var blockedNetworks = parseCIDRs(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.168.0.0/16", "224.0.0.0/4",
+	"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+// checkWebhookAddress fails with ErrWebhookAddress if address, an IP and
+// port, is in a blocked network and not in an allowed one.
+func checkWebhookAddress(address string, allowed []*net.IPNet) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ErrWebhookAddress
+	}
+	for _, n := range allowed {
+		if n.Contains(ip) {
+			return nil
+		}
+	}
+	for _, n := range blockedNetworks {
+		if n.Contains(ip) {
+			return ErrWebhookAddress
+		}
+	}
+	return nil
+}
+
+// NewWebhookClient creates an HTTP client for NewWebhooks that refuses to
+// connect to loopback, private, link-local and other internal addresses,
+// apart from those in allowed. Addresses are checked as each connection is
+// made, after DNS resolution and for every redirect, so a webhook cannot
+// reach them through a host name that resolves to one. Proxies from the
+// environment are not used.
+func NewWebhookClient(timeout time.Duration, allowed []*net.IPNet) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			return checkWebhookAddress(address, allowed)
+		},
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+}
+
+// Webhooks sends key lifecycle events to the webhooks stored in a DB.
+// Events are queued as they are recorded and sent in the background, so a
+// slow or failing receiver does not hold up requests. Failed deliveries are
+// retried with exponential backoff and recorded as dead letters once every
+// attempt has failed. Deliveries for different events run concurrently, so
+// receivers that care about order should use the event timestamps.
+//
+// Webhook secrets are stored encrypted by the cryptor. They are not
+// reencrypted when the master key is rotated, so webhooks must be created
+// again before the master key their secret was encrypted by is retired.
+type Webhooks struct {
+	db      keydb.DB
+	store   keydb.WebhookStore
+	cryptor keydb.Cryptor
+	client  *http.Client
+	events  chan knox.AuditEvent
+
+	attempts int
+	backoff  time.Duration
+	now      func() time.Time
+}
+
+// NewWebhooks creates Webhooks for the webhooks stored in db, which must be
+// a keydb.WebhookStore, with their secrets encrypted by cryptor. Deliveries
+// are sent with client, which should come from NewWebhookClient unless
+// every principal that can create keys is trusted to reach internal
+// addresses.
+func NewWebhooks(db keydb.DB, cryptor keydb.Cryptor, client *http.Client) (*Webhooks, error) {
+	store, ok := db.(keydb.WebhookStore)
+	if !ok {
+		return nil, keydb.ErrNoWebhooks
+	}
+	return &Webhooks{
+		db:       db,
+		store:    store,
+		cryptor:  cryptor,
+		client:   client,
+		events:   make(chan knox.AuditEvent, webhookQueueSize),
+		attempts: webhookAttempts,
+		backoff:  webhookBackoff,
+		now:      time.Now,
+	}, nil
+}
+
+// Create stores a new webhook with a generated ID and secret.
+func (w *Webhooks) Create(hook *knox.Webhook) error {
+	id, err := randomHex(8)
+	if err != nil {
+		return err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return err
+	}
+	hook.ID = id
+	hook.CreationTime = w.now().UnixNano()
+	stored := *hook
+	stored.Secret, err = w.encryptSecret(id, secret)
+	if err != nil {
+		return err
+	}
+	if err := w.store.AddWebhook(&stored); err != nil {
+		return err
+	}
+	hook.Secret = secret
+	return nil
+}
+
+// encryptedSecretPrefix starts the stored secrets that are encrypted. Secrets
+// stored before they were encrypted do not have it.
+const encryptedSecretPrefix = "enc:"
+
+// webhookSecretKeyID is the key ID a webhook's secret is encrypted as, which
+// binds the encrypted secret to the webhook.
+func webhookSecretKeyID(id string) string {
+	return "webhook:" + id
+}
+
+// encryptSecret encrypts a webhook secret for storage, as the only version of
+// a key encoded as JSON.
+func (w *Webhooks) encryptSecret(id, secret string) (string, error) {
+	k := knox.Key{
+		ID:          webhookSecretKeyID(id),
+		ACL:         knox.ACL{},
+		VersionList: knox.KeyVersionList{{ID: 1, Data: []byte(secret), Status: knox.Primary}},
+	}
+	encK, err := w.cryptor.Encrypt(&k)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(encK)
+	if err != nil {
+		return "", err
+	}
+	return encryptedSecretPrefix + base64.StdEncoding.EncodeToString(b), nil
+}
+
+// decryptSecret returns the secret of a stored webhook.
+func (w *Webhooks) decryptSecret(hook *knox.Webhook) (string, error) {
+	if !strings.HasPrefix(hook.Secret, encryptedSecretPrefix) {
+		return hook.Secret, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(hook.Secret, encryptedSecretPrefix))
+	if err != nil {
+		return "", err
+	}
+	var encK keydb.DBKey
+	if err := json.Unmarshal(b, &encK); err != nil {
+		return "", err
+	}
+	if encK.ID != webhookSecretKeyID(hook.ID) {
+		return "", fmt.Errorf("secret of webhook %s belongs to %s", hook.ID, encK.ID)
+	}
+	k, err := w.cryptor.Decrypt(&encK)
+	if err != nil {
+		return "", err
+	}
+	if len(k.VersionList) != 1 {
+		return "", fmt.Errorf("secret of webhook %s is malformed", hook.ID)
+	}
+	return string(k.VersionList[0].Data), nil
+}
+
+// List returns every webhook, oldest first.
+func (w *Webhooks) List() ([]knox.Webhook, error) {
+	return w.store.GetWebhooks()
+}
+
+// Get returns the webhook with the given ID.
+func (w *Webhooks) Get(id string) (*knox.Webhook, error) {
+	hooks, err := w.store.GetWebhooks()
+	if err != nil {
+		return nil, err
+	}
+	for _, hook := range hooks {
+		if hook.ID == id {
+			return &hook, nil
+		}
+	}
+	return nil, knox.ErrWebhookNotFound
+}
+
+// Remove removes the webhook and its dead letters.
+func (w *Webhooks) Remove(id string) error {
+	return w.store.RemoveWebhook(id)
+}
+
+// DeadLetters returns the events that could not be delivered to the webhook.
+func (w *Webhooks) DeadLetters(id string) ([]knox.WebhookDeadLetter, error) {
+	return w.store.GetDeadLetters(id)
+}
+
+// Notify queues an audit event to be sent to the webhooks that match it.
+// Events of types that are not in knox.WebhookEvents are ignored.
+func (w *Webhooks) Notify(e knox.AuditEvent) {
+	if !containsEventType(knox.WebhookEvents, e.Type) {
+		return
+	}
+	if e.Timestamp == 0 {
+		e.Timestamp = w.now().UnixNano()
+	}
+	select {
+	case w.events <- e:
+	default:
+		log.Printf("Dropped %s webhook event for %s since the queue is full", e.Type, e.KeyID)
+	}
+}
+
+// Run sends queued events to webhooks until stop is closed. Deliveries
+// waiting to be retried are abandoned when it stops.
+func (w *Webhooks) Run(stop <-chan struct{}) {
+	for {
+		select {
+		case e := <-w.events:
+			w.dispatch(e, stop)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// dispatch starts a delivery of the event to each webhook that matches it.
+func (w *Webhooks) dispatch(e knox.AuditEvent, stop <-chan struct{}) {
+	hooks, err := w.store.GetWebhooks()
+	if err != nil {
+		log.Printf("Failed to read webhooks for %s event for %s: %s", e.Type, e.KeyID, err.Error())
+		return
+	}
+	// Tags are only read if a webhook filters on them.
+	var tags []string
+	tagsRead := false
+	for _, hook := range hooks {
+		if len(hook.Tags) > 0 && !tagsRead {
+			tags = w.keyTags(e.KeyID)
+			tagsRead = true
+		}
+		if !hook.Matches(e.Type, e.KeyID, tags) {
+			continue
+		}
+		id, err := randomHex(8)
+		if err != nil {
+			log.Printf("Failed to create webhook delivery ID: %s", err.Error())
+			return
+		}
+		go w.deliver(hook, newWebhookEvent(id, hook.ID, e), stop)
+	}
+}
+
+// keyTags returns the tags of a key, or none if it cannot be read.
+func (w *Webhooks) keyTags(keyID string) []string {
+	key, err := w.db.Get(keyID)
+	if err != nil || key.Metadata == nil {
+		return nil
+	}
+	return key.Metadata.Tags
+}
+
+// newWebhookEvent copies the fields of an audit event that are sent to
+// webhooks. Audit events never hold key data, and neither do these.
+func newWebhookEvent(id, webhookID string, e knox.AuditEvent) knox.WebhookEvent {
+	return knox.WebhookEvent{
+		ID:         id,
+		WebhookID:  webhookID,
+		Timestamp:  e.Timestamp,
+		Type:       e.Type,
+		KeyID:      e.KeyID,
+		Principal:  e.Principal,
+		VersionIDs: e.VersionIDs,
+		OldACL:     e.OldACL,
+		NewACL:     e.NewACL,
+		OldStatus:  e.OldStatus,
+		NewStatus:  e.NewStatus,
+		RequestID:  e.RequestID,
+	}
+}
+
+// deliver sends the event to the webhook, retrying with exponential backoff,
+// and records a dead letter if every attempt fails.
+func (w *Webhooks) deliver(hook knox.Webhook, event knox.WebhookEvent, stop <-chan struct{}) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to encode webhook event %s: %s", event.ID, err.Error())
+		return
+	}
+	secret, err := w.decryptSecret(&hook)
+	if err != nil {
+		log.Printf("Failed to decrypt the secret of webhook %s: %s", hook.ID, err.Error())
+		return
+	}
+	backoff := w.backoff
+	for attempt := 1; ; attempt++ {
+		err = w.post(&hook, secret, &event, body)
+		if err == nil {
+			return
+		}
+		if attempt == w.attempts {
+			break
+		}
+		select {
+		case <-time.After(backoff):
+		case <-stop:
+			return
+		}
+		backoff *= 2
+	}
+	log.Printf("Failed to deliver %s webhook event for %s to webhook %s: %s", event.Type, event.KeyID, hook.ID, err.Error())
+	d := &knox.WebhookDeadLetter{
+		Event:     event,
+		Attempts:  w.attempts,
+		LastError: err.Error(),
+		FailedAt:  w.now().UnixNano(),
+	}
+	// The webhook may have been removed since the event was dispatched.
+	if err := w.store.AddDeadLetter(d); err != nil && err != knox.ErrWebhookNotFound {
+		log.Printf("Failed to record dead letter for webhook %s: %s", hook.ID, err.Error())
+	}
+}
+
+// post sends one attempt of a delivery signed with secret. Any response
+// other than a 2xx status is a failure.
+func (w *Webhooks) post(hook *knox.Webhook, secret string, event *knox.WebhookEvent, body []byte) error {
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(knox.WebhookEventHeader, string(event.Type))
+	req.Header.Set(knox.WebhookDeliveryHeader, event.ID)
+	req.Header.Set(knox.WebhookSignatureHeader, knox.WebhookSignature(secret, body))
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	// Reading some of the body lets the connection be reused.
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return nil
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,293 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pinterest/knox"
+	"github.com/pinterest/knox/server/auth"
+	"github.com/pinterest/knox/server/keydb"
+)
+
+// delivery is a request received by a test webhook.
+type delivery struct {
+	header http.Header
+	body   []byte
+}
+
+// newWebhookServer starts a webhook that sends the deliveries it receives to
+// the returned channel and responds with the status returned by status.
+func newWebhookServer(status func(n int) int) (*httptest.Server, chan delivery) {
+	c := make(chan delivery, 100)
+	var n int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		c <- delivery{r.Header, body}
+		w.WriteHeader(status(int(atomic.AddInt32(&n, 1))))
+	}))
+	return srv, c
+}
+
+func ok(n int) int { return http.StatusOK }
+
+var testWebhookCryptor = keydb.NewAESGCMCryptor(0, []byte("testtesttesttest"))
+
+// startWebhooks enables webhooks stored in db until the returned function is
+// called.
+func startWebhooks(t *testing.T, db keydb.DB) (*Webhooks, func()) {
+	w, err := NewWebhooks(db, testWebhookCryptor, &http.Client{Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	w.attempts = 3
+	w.backoff = time.Millisecond
+	stop := make(chan struct{})
+	go w.Run(stop)
+	SetWebhooks(w)
+	return w, func() {
+		SetWebhooks(nil)
+		close(stop)
+	}
+}
+
+func receive(t *testing.T, c chan delivery) delivery {
+	t.Helper()
+	select {
+	case d := <-c:
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not called")
+	}
+	return delivery{}
+}
+
+func decodeDelivery(t *testing.T, d delivery, secret string) knox.WebhookEvent {
+	t.Helper()
+	sig := d.header.Get(knox.WebhookSignatureHeader)
+	if !hmac.Equal([]byte(sig), []byte(knox.WebhookSignature(secret, d.body))) {
+		t.Fatalf("signature %s does not match", sig)
+	}
+	var e knox.WebhookEvent
+	if err := json.Unmarshal(d.body, &e); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if d.header.Get(knox.WebhookEventHeader) != string(e.Type) || d.header.Get(knox.WebhookDeliveryHeader) != e.ID {
+		t.Fatalf("headers %v do not match %+v", d.header, e)
+	}
+	return e
+}
+
+func TestNewWebhooks(t *testing.T) {
+	if _, err := NewWebhooks(&noFeedDB{keydb.NewTempDB()}, testWebhookCryptor, http.DefaultClient); err != keydb.ErrNoWebhooks {
+		t.Fatalf("%v does not equal %s", err, keydb.ErrNoWebhooks)
+	}
+}
+
+func TestWebhookClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	_, err := NewWebhookClient(time.Second, nil).Get(srv.URL)
+	if !errors.Is(err, ErrWebhookAddress) {
+		t.Fatalf("%v does not equal %s", err, ErrWebhookAddress)
+	}
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	resp, err := NewWebhookClient(time.Second, []*net.IPNet{loopback}).Get(srv.URL)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	resp.Body.Close()
+
+	for _, addr := range []string{"10.1.2.3:80", "169.254.169.254:80", "[::1]:443", "[fe80::1]:80", "0.0.0.0:80"} {
+		if err := checkWebhookAddress(addr, nil); err != ErrWebhookAddress {
+			t.Fatalf("%s: %v does not equal %s", addr, err, ErrWebhookAddress)
+		}
+	}
+	if err := checkWebhookAddress("93.184.216.34:443", nil); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	m, db := makeDB()
+	u := auth.NewUser("testuser", []string{})
+	srv, c := newWebhookServer(ok)
+	defer srv.Close()
+
+	_, err := postKeysHandler(m, u, map[string]string{"id": "a1", "data": "MQ=="})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	_, stop := startWebhooks(t, db)
+	defer stop()
+	i, err := postWebhookHandler(m, u, map[string]string{"webhook": `{"url":"` + srv.URL + `","key_id":"a1"}`})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	hook := i.(knox.Webhook)
+	// Only the encrypted secret is stored.
+	stored, sErr := db.GetWebhooks()
+	if sErr != nil {
+		t.Fatalf("%s is not nil", sErr)
+	}
+	if len(stored) != 1 || stored[0].Secret == hook.Secret || strings.Contains(stored[0].Secret, hook.Secret) {
+		t.Fatalf("webhook secret is stored in plaintext: %+v", stored)
+	}
+
+	i, err = postVersionHandler(m, u, map[string]string{"keyID": "a1", "data": "c2VjcmV0IGRhdGE="})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	versionID := i.(uint64)
+	d := receive(t, c)
+	e := decodeDelivery(t, d, hook.Secret)
+	if e.Type != knox.AddVersionEvent || e.KeyID != "a1" || e.WebhookID != hook.ID || e.Principal != "testuser" || e.Timestamp == 0 {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	if len(e.VersionIDs) != 1 || e.VersionIDs[0] != versionID {
+		t.Fatalf("%v does not equal [%d]", e.VersionIDs, versionID)
+	}
+	// Key data is never sent, in any encoding.
+	for _, data := range []string{"c2VjcmV0IGRhdGE=", "secret data", "MQ=="} {
+		if bytes.Contains(d.body, []byte(data)) {
+			t.Fatalf("delivery %s contains key data", d.body)
+		}
+	}
+	fields := map[string]interface{}{}
+	json.Unmarshal(d.body, &fields)
+	if _, ok := fields["data"]; ok {
+		t.Fatalf("delivery %s has a data field", d.body)
+	}
+
+	// Reads are not delivered, promotions are.
+	_, err = getKeyHandler(m, u, map[string]string{"keyID": "a1"})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	_, err = putVersionsHandler(m, u, map[string]string{"keyID": "a1", "versionID": strconv.FormatUint(versionID, 10), "status": `"Primary"`})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	e = decodeDelivery(t, receive(t, c), hook.Secret)
+	if e.Type != knox.PromoteVersionEvent || e.NewStatus == nil || *e.NewStatus != knox.Primary {
+		t.Fatalf("unexpected event %+v", e)
+	}
+}
+
+func TestWebhookFilters(t *testing.T) {
+	m, db := makeDB()
+	u := auth.NewUser("testuser", []string{})
+	srv, c := newWebhookServer(ok)
+	defer srv.Close()
+	w, stop := startWebhooks(t, db)
+	defer stop()
+
+	hook := &knox.Webhook{URL: srv.URL, Tags: []string{"pci"}, Events: []knox.AuditEventType{knox.UpdateAccessEvent}}
+	if err := w.Create(hook); err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	_, err := postKeysHandler(m, u, map[string]string{"id": "untagged", "data": "MQ=="})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	_, err = postKeysHandler(m, u, map[string]string{"id": "tagged", "data": "MQ==", "metadata": `{"tags":["pci"]}`})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	access := `{"type":"Machine","id":"MrRoboto","access":"Read"}`
+	_, err = putAccessHandler(m, u, map[string]string{"keyID": "untagged", "access": access})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+	_, err = putAccessHandler(m, u, map[string]string{"keyID": "tagged", "access": access})
+	if err != nil {
+		t.Fatalf("%+v is not nil", err)
+	}
+
+	// Only the ACL change to the tagged key matches.
+	e := decodeDelivery(t, receive(t, c), hook.Secret)
+	if e.Type != knox.UpdateAccessEvent || e.KeyID != "tagged" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	if len(e.NewACL) != len(e.OldACL)+1 {
+		t.Fatalf("%v is not one entry longer than %v", e.NewACL, e.OldACL)
+	}
+	select {
+	case d := <-c:
+		t.Fatalf("unexpected delivery %s", d.body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	_, db := makeDB()
+	// The first webhook fails twice before accepting the event.
+	flaky, flakyC := newWebhookServer(func(n int) int {
+		if n < 3 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	})
+	defer flaky.Close()
+	down, downC := newWebhookServer(func(n int) int { return http.StatusInternalServerError })
+	defer down.Close()
+	w, stop := startWebhooks(t, db)
+	defer stop()
+
+	flakyHook := &knox.Webhook{URL: flaky.URL}
+	downHook := &knox.Webhook{URL: down.URL}
+	for _, hook := range []*knox.Webhook{flakyHook, downHook} {
+		if err := w.Create(hook); err != nil {
+			t.Fatalf("%s is not nil", err)
+		}
+	}
+	recordSystemEvent(rotatorComponent, knox.AuditEvent{Type: knox.DeleteKeyEvent, KeyID: "a1"})
+
+	var ids []string
+	for n := 0; n < 3; n++ {
+		ids = append(ids, decodeDelivery(t, receive(t, flakyC), flakyHook.Secret).ID)
+		receive(t, downC)
+	}
+	// Retries are the same delivery.
+	if ids[0] != ids[1] || ids[1] != ids[2] {
+		t.Fatalf("%v are not the same delivery", ids)
+	}
+
+	// The webhook that never accepted the event has a dead letter once the
+	// attempts run out.
+	var letters []knox.WebhookDeadLetter
+	deadline := time.Now().Add(5 * time.Second)
+	for len(letters) == 0 && time.Now().Before(deadline) {
+		var err error
+		letters, err = w.DeadLetters(downHook.ID)
+		if err != nil {
+			t.Fatalf("%s is not nil", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if len(letters) != 1 {
+		t.Fatalf("%d does not equal 1", len(letters))
+	}
+	d := letters[0]
+	if d.Attempts != 3 || d.Event.KeyID != "a1" || d.Event.Type != knox.DeleteKeyEvent || d.Event.Principal != rotatorComponent || d.LastError == "" {
+		t.Fatalf("unexpected dead letter %+v", d)
+	}
+	letters, err := w.DeadLetters(flakyHook.ID)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(letters) != 0 {
+		t.Fatalf("%d does not equal 0", len(letters))
+	}
+}
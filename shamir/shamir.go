@@ -0,0 +1,124 @@
+// Package shamir implements Shamir's secret sharing over GF(2^8).
+//
+// A secret is split into shares so that any threshold of them can recreate
+// it, while fewer reveal nothing about it. Each byte of the secret is the
+// constant term of its own random polynomial of degree threshold-1. A share
+// is the value of every polynomial at one point, followed by that point.
+package shamir
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+var (
+	ErrInvalidParameters = fmt.Errorf("Secret must not be empty and 2 <= threshold <= parts <= 255")
+	ErrTooFewShares      = fmt.Errorf("At least two shares are required")
+	ErrInvalidShare      = fmt.Errorf("Shares must be the same length and have distinct non-zero points")
+)
+
+// Split divides secret into parts shares, any threshold of which can be
+// combined to recreate it.
+func Split(secret []byte, parts, threshold int) ([][]byte, error) {
+	if len(secret) == 0 || threshold < 2 || parts < threshold || parts > 255 {
+		return nil, ErrInvalidParameters
+	}
+	shares := make([][]byte, parts)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][len(secret)] = byte(i + 1)
+	}
+	coefficients := make([]byte, threshold)
+	for b, s := range secret {
+		if _, err := rand.Read(coefficients[1:]); err != nil {
+			return nil, err
+		}
+		coefficients[0] = s
+		for _, share := range shares {
+			share[b] = evaluate(coefficients, share[len(secret)])
+		}
+	}
+	return shares, nil
+}
+
+// Combine recreates a secret from its shares. It cannot tell whether enough
+// shares were given; too few produce a wrong secret.
+func Combine(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, ErrTooFewShares
+	}
+	n := len(shares[0]) - 1
+	if n < 1 {
+		return nil, ErrInvalidShare
+	}
+	xs := make([]byte, len(shares))
+	seen := map[byte]bool{}
+	for i, share := range shares {
+		if len(share) != n+1 || share[n] == 0 || seen[share[n]] {
+			return nil, ErrInvalidShare
+		}
+		xs[i] = share[n]
+		seen[xs[i]] = true
+	}
+
+	// Interpolate each polynomial at zero with Lagrange basis polynomials.
+	secret := make([]byte, n)
+	for i, share := range shares {
+		basis := byte(1)
+		for j, x := range xs {
+			if j != i {
+				basis = mul(basis, div(x, x^xs[i]))
+			}
+		}
+		for b := 0; b < n; b++ {
+			secret[b] ^= mul(share[b], basis)
+		}
+	}
+	return secret, nil
+}
+
+// evaluate returns the value of the polynomial with the given coefficients,
+// lowest degree first, at x.
+func evaluate(coefficients []byte, x byte) byte {
+	var y byte
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		y = mul(y, x) ^ coefficients[i]
+	}
+	return y
+}
+
+// Logarithm tables for GF(2^8) with the AES polynomial and generator 3.
+var (
+	expTable [510]byte
+	logTable [256]byte
+)
+
+func init() {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		expTable[i] = x
+		expTable[i+255] = x
+		logTable[x] = byte(i)
+		// Multiply by the generator: x*3 = x*2 + x.
+		x2 := x << 1
+		if x&0x80 != 0 {
+			x2 ^= 0x1b
+		}
+		x ^= x2
+	}
+}
+
+func mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])+int(logTable[b])]
+}
+
+// div divides a by b, which must not be zero.
+func div(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])+255-int(logTable[b])]
+}
@@ -0,0 +1,87 @@
+package shamir
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMulDiv(t *testing.T) {
+	// 0x57 * 0x83 = 0xc1 is the worked example in FIPS 197.
+	if p := mul(0x57, 0x83); p != 0xc1 {
+		t.Fatalf("%#x does not equal 0xc1", p)
+	}
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			if q := div(mul(byte(a), byte(b)), byte(b)); q != byte(a) {
+				t.Fatalf("%d*%d/%d = %d", a, b, b, q)
+			}
+		}
+	}
+}
+
+func TestSplitCombine(t *testing.T) {
+	secret := []byte("correct horse battery staple")
+	shares, err := Split(secret, 5, 3)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if len(shares) != 5 {
+		t.Fatalf("%d does not equal 5", len(shares))
+	}
+
+	for _, subset := range [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4}, {0, 1, 2, 3, 4}} {
+		var parts [][]byte
+		for _, i := range subset {
+			parts = append(parts, shares[i])
+		}
+		got, err := Combine(parts)
+		if err != nil {
+			t.Fatalf("%s is not nil", err)
+		}
+		if !bytes.Equal(got, secret) {
+			t.Fatalf("shares %v recreated %q", subset, got)
+		}
+	}
+
+	got, err := Combine(shares[:2])
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if bytes.Equal(got, secret) {
+		t.Fatal("two shares should not recreate the secret")
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	for _, c := range []struct {
+		secret           []byte
+		parts, threshold int
+	}{
+		{nil, 3, 2},
+		{[]byte("s"), 3, 1},
+		{[]byte("s"), 2, 3},
+		{[]byte("s"), 256, 2},
+	} {
+		if _, err := Split(c.secret, c.parts, c.threshold); err != ErrInvalidParameters {
+			t.Fatalf("%v does not equal %s for %+v", err, ErrInvalidParameters, c)
+		}
+	}
+
+	shares, err := Split([]byte("secret"), 3, 2)
+	if err != nil {
+		t.Fatalf("%s is not nil", err)
+	}
+	if _, err := Combine(shares[:1]); err != ErrTooFewShares {
+		t.Fatalf("%v does not equal %s", err, ErrTooFewShares)
+	}
+	for _, parts := range [][][]byte{
+		{shares[0], shares[0]},
+		{shares[0], shares[1][1:]},
+		{shares[0], append([]byte("secret"), 0)},
+		{{1}, {2}},
+	} {
+		if _, err := Combine(parts); err != ErrInvalidShare {
+			t.Fatalf("%v does not equal %s", err, ErrInvalidShare)
+		}
+	}
+}